@@ -7,10 +7,10 @@ package cluster
 import (
 	"bytes"
 	"context"
-	"math/rand"
 	"net"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -27,6 +27,7 @@ import (
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"github.com/wind-c/comqtt/v2/config"
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
@@ -56,6 +57,9 @@ type Agent struct {
 	raftNotifyCh      chan *message.Message
 	inboundMsgCh      chan []byte
 	grpcMsgCh         chan *message.Message
+	relayStats        relayStats
+	shared            *mqtt.SharedSelector // selects the nodes of shared subscription groups
+	relayShared       *mqtt.SharedSelector // selects the nodes of groups which are not delivered locally
 }
 
 func NewAgent(conf *config.Cluster) *Agent {
@@ -68,6 +72,8 @@ func NewAgent(conf *config.Cluster) *Agent {
 		raftNotifyCh: make(chan *message.Message, 1024),
 		inboundMsgCh: make(chan []byte, 10240),
 		grpcMsgCh:    make(chan *message.Message, 10240),
+		shared:       mqtt.NewSharedSelector(),
+		relayShared:  mqtt.NewSharedSelector(),
 	}
 }
 
@@ -181,6 +187,7 @@ func (a *Agent) Stop() {
 
 func (a *Agent) BindMqttServer(server *mqtt.Server) {
 	server.AddHook(new(MqttEventHook), a)
+	server.AddSysTopics(mqtt.SysTreeCluster, a.sysTopics)
 	a.mqttServer = server
 }
 
@@ -306,6 +313,11 @@ func (a *Agent) processNodeEvent() {
 					err = a.raftPeer.Join(nodeName, addr)
 					prompt = "raft join"
 				}
+				if nodeName != a.GetLocalName() {
+					a.OutPool.Submit(func() {
+						a.syncBlacklist(nodeName)
+					})
+				}
 			} else if event.Type == discovery.EventLeave {
 				err = a.raftPeer.Leave(nodeName)
 				if a.Config.GrpcEnable {
@@ -343,6 +355,18 @@ func (a *Agent) processRelayMsg(msg *message.Message) {
 			a.mqttServer.PublishToSubscribers(pk, false)
 			OnPublishPacketLog(DirectionInbound, msg.NodeID, msg.ClientID, pk.TopicName, pk.PacketID)
 		}
+	case message.BlacklistAdd, message.BlacklistDelete:
+		var e storage.BlacklistEntry
+		if err := e.UnmarshalBinary(msg.Payload); err != nil || a.mqttServer == nil {
+			return
+		}
+		if msg.Type == message.BlacklistAdd {
+			if err := a.mqttServer.AddBlacklist(e); err != nil {
+				log.Warn("apply blacklist entry", "from", msg.NodeID, "kind", e.Kind, "value", e.Value, "error", err)
+			}
+		} else {
+			a.mqttServer.DeleteBlacklistAt(e.Kind, e.Value, e.Created)
+		}
 	case packets.Connect:
 		//If a client is connected to another node, the client's data cached on the node needs to be cleared
 		if existing, ok := a.mqttServer.Clients.Get(msg.ClientID); ok {
@@ -433,7 +457,7 @@ func (a *Agent) processOutboundPublish(pk *packets.Packet, sharedFilters map[str
 		}
 	}
 	for _, filter := range filters {
-		ns := a.pickNodes(filter, sharedFilters)
+		ns := a.pickNodes(filter, *pk, sharedFilters)
 		for _, node := range ns {
 			if node != a.GetLocalName() && !utils.Contains(oldNodes, node) {
 				if a.Config.GrpcEnable {
@@ -449,6 +473,63 @@ func (a *Agent) processOutboundPublish(pk *packets.Packet, sharedFilters map[str
 	}
 }
 
+// SubmitOutBlacklistTask replicates a change to the blacklist to the other nodes.
+func (a *Agent) SubmitOutBlacklistTask(tp byte, e storage.BlacklistEntry) {
+	a.OutPool.Submit(func() {
+		a.processOutboundBlacklist(tp, e, "")
+	})
+}
+
+// processOutboundBlacklist sends a blacklist change to a node, or to all other nodes if node is empty.
+// Blacklist changes are always gossiped, as the entries are idempotent and converge on the most recent.
+// A deletion is sent as the tombstone of the entry, created at the time of the deletion.
+func (a *Agent) processOutboundBlacklist(tp byte, e storage.BlacklistEntry, node string) {
+	payload, err := e.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	msg := message.Message{
+		Type:    tp,
+		NodeID:  a.Config.NodeName,
+		Payload: payload,
+	}
+	if node == "" {
+		a.membership.SendToOthers(msg.MsgpackBytes())
+	} else {
+		a.membership.SendToNode(node, msg.MsgpackBytes())
+	}
+}
+
+// syncBlacklist sends every blacklist entry and tombstone to a node which has joined the cluster,
+// so the node neither misses a deletion nor revives a deleted entry it still holds.
+func (a *Agent) syncBlacklist(node string) {
+	if a.mqttServer == nil {
+		return
+	}
+	for _, e := range a.mqttServer.Blacklist.GetAll() {
+		a.processOutboundBlacklist(message.BlacklistAdd, e, node)
+	}
+	for _, t := range a.mqttServer.Blacklist.Tombstones() {
+		a.processOutboundBlacklist(message.BlacklistDelete, t, node)
+	}
+}
+
+// AddBlacklist adds an entry to the blacklist of the local node, which replicates it to the other nodes.
+func (a *Agent) AddBlacklist(e storage.BlacklistEntry) error {
+	return a.mqttServer.AddBlacklist(e)
+}
+
+// DeleteBlacklist deletes an entry from the blacklist of the local node, which replicates it to the other nodes.
+func (a *Agent) DeleteBlacklist(kind, value string) bool {
+	return a.mqttServer.DeleteBlacklist(kind, value)
+}
+
+// GetBlacklist returns the blacklist entries of the local node.
+func (a *Agent) GetBlacklist() []storage.BlacklistEntry {
+	return a.mqttServer.Blacklist.GetAll()
+}
+
 // processOutboundConnect process outbound connect msg
 func (a *Agent) processOutboundConnect(pk *packets.Packet) {
 	msg := message.Message{
@@ -469,8 +550,8 @@ func (a *Agent) processOutboundConnect(pk *packets.Packet) {
 	OnConnectPacketLog(DirectionOutbound, a.GetLocalName(), msg.ClientID)
 }
 
-// pickNodes pick nodes, if the filter is shared, select a node at random
-func (a *Agent) pickNodes(filter string, sharedFilters map[string]bool) (ns []string) {
+// pickNodes pick nodes, if the filter is shared, select a node using the strategy of the group
+func (a *Agent) pickNodes(filter string, pk packets.Packet, sharedFilters map[string]bool) (ns []string) {
 	tmpNs := a.raftPeer.Lookup(filter)
 	if tmpNs == nil || len(tmpNs) == 0 {
 		return ns
@@ -481,15 +562,15 @@ func (a *Agent) pickNodes(filter string, sharedFilters map[string]bool) (ns []st
 			return ns
 		}
 
-		for _, n := range tmpNs {
-			// The shared subscription is local priority, indicating that it has been sent
-			if n == a.GetLocalName() {
-				return ns
-			}
+		// Will messages are sent locally if the node has a member of the group
+		if sharedFilters == nil && utils.Contains(tmpNs, a.GetLocalName()) {
+			return ns
+		}
+
+		// The group was delivered by another node when it was selected, or failed locally
+		if n := a.pickSharedNode(filter, pk, tmpNs, false); n != "" {
+			ns = []string{n}
 		}
-		// Share subscription Select a node at random
-		n := tmpNs[rand.Intn(len(tmpNs))]
-		ns = []string{n}
 		return ns
 	}
 
@@ -498,6 +579,40 @@ func (a *Agent) pickNodes(filter string, sharedFilters map[string]bool) (ns []st
 	return
 }
 
+// pickSharedNode selects the node which delivers a message to a shared subscription group,
+// using the strategy of the group. The local node is only selected if local is true.
+func (a *Agent) pickSharedNode(filter string, pk packets.Packet, nodes []string, local bool) string {
+	strategy := mqtt.SharedLocalFirst
+	if a.mqttServer != nil {
+		strategy = a.mqttServer.Options.SharedSubscriptions.GroupStrategy(filter)
+	}
+
+	// the inflight messages of members on other nodes are not known, so they are selected at random
+	localFirst := strategy == mqtt.SharedLocalFirst || strategy == mqtt.SharedLeastInflight
+	if localFirst {
+		strategy = mqtt.SharedRandom
+	}
+
+	candidates := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n == a.GetLocalName() {
+			if !local {
+				continue
+			}
+			if localFirst {
+				return n
+			}
+		}
+		candidates = append(candidates, n)
+	}
+	sort.Strings(candidates)
+
+	if local {
+		return a.shared.Select(strategy, filter, pk, candidates, nil)
+	}
+	return a.relayShared.Select(strategy, filter, pk, candidates, nil)
+}
+
 func OnJoinLog(nodeId, addr, prompt string, err error) {
 	if err != nil {
 		log.Error(prompt, "error", err, "node", nodeId, "addr", addr)
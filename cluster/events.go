@@ -10,6 +10,7 @@ import (
 
 	msg "github.com/wind-c/comqtt/v2/cluster/message"
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
@@ -31,7 +32,10 @@ func (h *MqttEventHook) Provides(b byte) bool {
 		mqtt.OnSubscribed,
 		mqtt.OnUnsubscribed,
 		mqtt.OnPublishedWithSharedFilters,
+		mqtt.OnSelectSharedNodes,
 		mqtt.OnWillSent,
+		mqtt.OnBlacklistAdded,
+		mqtt.OnBlacklistDeleted,
 	}, []byte{b})
 }
 
@@ -76,6 +80,18 @@ func (h *MqttEventHook) OnPublishedWithSharedFilters(pk packets.Packet, sharedFi
 	h.agent.SubmitOutPublishTask(&pk, sharedFilters)
 }
 
+// OnSelectSharedNodes selects the node of each shared subscription group, removing the groups
+// which are delivered by another node.
+func (h *MqttEventHook) OnSelectSharedNodes(subs *mqtt.Subscribers, pk packets.Packet) *mqtt.Subscribers {
+	for filter := range subs.Shared {
+		nodes := h.agent.raftPeer.Lookup(filter)
+		if n := h.agent.pickSharedNode(filter, pk, nodes, true); n != "" && n != h.agent.GetLocalName() {
+			delete(subs.Shared, filter)
+		}
+	}
+	return subs
+}
+
 // OnWillSent is called when an LWT message has been issued from a disconnecting client.
 func (h *MqttEventHook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
 	if pk.Connect.ClientIdentifier == "" {
@@ -120,3 +136,16 @@ func (h *MqttEventHook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reaso
 		}
 	}
 }
+
+// OnBlacklistAdded replicates a new or updated blacklist entry to the other nodes.
+func (h *MqttEventHook) OnBlacklistAdded(e storage.BlacklistEntry) {
+	h.agent.SubmitOutBlacklistTask(msg.BlacklistAdd, e)
+}
+
+// OnBlacklistDeleted replicates the tombstone of a deleted blacklist entry to the other nodes.
+// Expired entries leave no tombstone and are not replicated, as every node clears them itself.
+func (h *MqttEventHook) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	if t, ok := h.agent.mqttServer.Blacklist.Tombstone(e.Kind, e.Value); ok {
+		h.agent.SubmitOutBlacklistTask(msg.BlacklistDelete, t)
+	}
+}
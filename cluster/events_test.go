@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+)
+
+// sendMembership records the messages sent to other nodes.
+type sendMembership struct {
+	fakeMembership
+	sync.Mutex
+	sent []sentMessage
+}
+
+type sentMessage struct {
+	node string // empty if sent to all other nodes
+	msg  message.Message
+}
+
+func (m *sendMembership) SendToNode(node string, bs []byte) error {
+	m.record(node, bs)
+	return nil
+}
+
+func (m *sendMembership) SendToOthers(bs []byte) {
+	m.record("", bs)
+}
+
+func (m *sendMembership) record(node string, bs []byte) {
+	var msg message.Message
+	_ = msg.MsgpackLoad(bs)
+	m.Lock()
+	defer m.Unlock()
+	m.sent = append(m.sent, sentMessage{node: node, msg: msg})
+}
+
+func (m *sendMembership) get() []sentMessage {
+	m.Lock()
+	defer m.Unlock()
+	return append([]sentMessage{}, m.sent...)
+}
+
+func newBlacklistAgent(t *testing.T) (*Agent, *sendMembership) {
+	agent := NewAgent(&config.Cluster{NodeName: "node1"})
+	membership := new(sendMembership)
+	agent.membership = membership
+	require.NoError(t, agent.initPool())
+	t.Cleanup(agent.cancel)
+
+	server := mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	agent.BindMqttServer(server)
+	return agent, membership
+}
+
+func TestAgentReplicateBlacklist(t *testing.T) {
+	agent, membership := newBlacklistAgent(t)
+
+	require.NoError(t, agent.AddBlacklist(storage.BlacklistEntry{Kind: mqtt.BlacklistClientID, Value: "c1", Reason: "abuse"}))
+	require.Eventually(t, func() bool { return len(membership.get()) == 1 }, time.Second, time.Millisecond)
+	sent := membership.get()[0]
+	require.Equal(t, "", sent.node)
+	require.Equal(t, message.BlacklistAdd, sent.msg.Type)
+	require.Equal(t, "node1", sent.msg.NodeID)
+
+	var e storage.BlacklistEntry
+	require.NoError(t, e.UnmarshalBinary(sent.msg.Payload))
+	require.Equal(t, "c1", e.Value)
+	require.Equal(t, "abuse", e.Reason)
+
+	require.True(t, agent.DeleteBlacklist(mqtt.BlacklistClientID, "c1"))
+	require.Eventually(t, func() bool { return len(membership.get()) == 2 }, time.Second, time.Millisecond)
+	sent = membership.get()[1]
+	require.Equal(t, message.BlacklistDelete, sent.msg.Type)
+
+	var ts storage.BlacklistEntry
+	require.NoError(t, ts.UnmarshalBinary(sent.msg.Payload))
+	require.Equal(t, "c1", ts.Value)
+	require.GreaterOrEqual(t, ts.Created, e.Created)
+}
+
+func TestAgentApplyRemoteBlacklistDeleteFirst(t *testing.T) {
+	agent, _ := newBlacklistAgent(t)
+
+	e := storage.BlacklistEntry{Kind: mqtt.BlacklistClientID, Value: "c1", Created: 10}
+	add, err := e.MarshalBinary()
+	require.NoError(t, err)
+	del, err := storage.BlacklistEntry{Kind: mqtt.BlacklistClientID, Value: "c1", Created: 11}.MarshalBinary()
+	require.NoError(t, err)
+
+	// the deletion overtakes the entry it deleted
+	agent.processRelayMsg(&message.Message{Type: message.BlacklistDelete, NodeID: "node2", Payload: del})
+	agent.processRelayMsg(&message.Message{Type: message.BlacklistAdd, NodeID: "node3", Payload: add})
+	require.Empty(t, agent.GetBlacklist())
+}
+
+func TestAgentApplyRemoteBlacklist(t *testing.T) {
+	agent, membership := newBlacklistAgent(t)
+
+	e := storage.BlacklistEntry{Kind: mqtt.BlacklistIP, Value: "10.0.0.0/8", Created: time.Now().Unix()}
+	payload, err := e.MarshalBinary()
+	require.NoError(t, err)
+
+	agent.processRelayMsg(&message.Message{Type: message.BlacklistAdd, NodeID: "node2", Payload: payload})
+	require.Len(t, agent.GetBlacklist(), 1)
+
+	// applying the same entry again does not replicate it again
+	agent.processRelayMsg(&message.Message{Type: message.BlacklistAdd, NodeID: "node3", Payload: payload})
+	require.Eventually(t, func() bool { return len(membership.get()) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	require.Len(t, membership.get(), 1)
+
+	agent.processRelayMsg(&message.Message{Type: message.BlacklistDelete, NodeID: "node2", Payload: payload})
+	require.Empty(t, agent.GetBlacklist())
+}
+
+func TestAgentSyncBlacklist(t *testing.T) {
+	agent, membership := newBlacklistAgent(t)
+	for _, v := range []string{"c1", "c2"} {
+		_, _, err := agent.mqttServer.Blacklist.Add(storage.BlacklistEntry{Kind: mqtt.BlacklistClientID, Value: v})
+		require.NoError(t, err)
+	}
+
+	agent.mqttServer.Blacklist.Delete(mqtt.BlacklistClientID, "c3", time.Now().Unix())
+
+	agent.syncBlacklist("node2")
+	sent := membership.get()
+	require.Len(t, sent, 3)
+	for _, m := range sent {
+		require.Equal(t, "node2", m.node)
+	}
+	require.Equal(t, message.BlacklistAdd, sent[0].msg.Type)
+	require.Equal(t, message.BlacklistAdd, sent[1].msg.Type)
+	require.Equal(t, message.BlacklistDelete, sent[2].msg.Type)
+}
@@ -15,6 +15,8 @@ const (
 	Reserved byte = iota + 21
 	RaftJoin
 	RaftApply
+	BlacklistAdd
+	BlacklistDelete
 )
 
 //go:generate msgp -io=false
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+const (
+	relayPublish byte = iota
+	relayConnect
+	relayRaftApply
+	relayRaftJoin
+	relayKinds
+)
+
+var relayKindNames = [relayKinds]string{"publish", "connect", "raft_apply", "raft_join"}
+
+// relayStats contains counters for messages relayed between nodes over grpc.
+type relayStats struct {
+	sent     [relayKinds]int64
+	failed   [relayKinds]int64
+	received [relayKinds]int64
+}
+
+// onSent counts a relayed message, or a failed relay if err is not nil.
+func (r *relayStats) onSent(kind byte, err error) {
+	if err != nil {
+		atomic.AddInt64(&r.failed[kind], 1)
+		return
+	}
+	atomic.AddInt64(&r.sent[kind], 1)
+}
+
+// onReceived counts a message received from another node.
+func (r *relayStats) onReceived(kind byte) {
+	atomic.AddInt64(&r.received[kind], 1)
+}
+
+// CollectMetrics writes the cluster membership, raft and grpc relay statistics of the
+// agent. It can be passed to listeners.NewHTTPMetrics as a listeners.MetricsCollector.
+func (a *Agent) CollectMetrics(w *listeners.MetricsWriter) {
+	if a.membership != nil {
+		stat := a.Stat()
+		nodes := make([]string, 0, len(stat))
+		for node := range stat {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			w.Gauge("cluster_node_clients", "Number of clients connected to each node in the cluster.", float64(stat[node]), "node", node)
+		}
+		w.Gauge("cluster_members", "Number of members in the cluster.", float64(len(a.membership.Members())))
+	}
+
+	if a.raftPeer != nil {
+		var isLeader float64
+		if a.raftPeer.IsApplyRight() {
+			isLeader = 1
+		}
+		_, leader := a.raftPeer.GetLeader()
+		w.Gauge("cluster_raft_is_leader", "Whether this node is the raft leader.", isLeader)
+		w.Gauge("cluster_raft_leader", "The current raft leader as seen by this node.", 1, "leader", leader)
+	}
+
+	for i, kind := range relayKindNames {
+		w.Counter("cluster_grpc_relay_sent_total", "Total number of messages relayed to other nodes over grpc.", float64(atomic.LoadInt64(&a.relayStats.sent[i])), "type", kind)
+	}
+	for i, kind := range relayKindNames {
+		w.Counter("cluster_grpc_relay_failed_total", "Total number of messages which failed to relay to other nodes over grpc.", float64(atomic.LoadInt64(&a.relayStats.failed[i])), "type", kind)
+	}
+	for i, kind := range relayKindNames {
+		w.Counter("cluster_grpc_relay_received_total", "Total number of messages received from other nodes over grpc.", float64(atomic.LoadInt64(&a.relayStats.received[i])), "type", kind)
+	}
+}
@@ -0,0 +1,29 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+func TestAgentCollectMetrics(t *testing.T) {
+	agent := NewAgent(&config.Cluster{NodeName: "node1"})
+	agent.relayStats.onSent(relayPublish, nil)
+	agent.relayStats.onSent(relayPublish, nil)
+	agent.relayStats.onSent(relayConnect, errors.New("test"))
+	agent.relayStats.onReceived(relayRaftApply)
+
+	var buf bytes.Buffer
+	agent.CollectMetrics(listeners.NewMetricsWriter(&buf))
+
+	out := buf.String()
+	require.Contains(t, out, `comqtt_cluster_grpc_relay_sent_total{type="publish"} 2`)
+	require.Contains(t, out, `comqtt_cluster_grpc_relay_failed_total{type="connect"} 1`)
+	require.Contains(t, out, `comqtt_cluster_grpc_relay_received_total{type="raft_apply"} 1`)
+	require.NotContains(t, out, "comqtt_cluster_raft_is_leader")
+	require.NotContains(t, out, "comqtt_cluster_members")
+}
@@ -10,3 +10,12 @@ type node struct {
 	Name string `json:"name"`
 	Addr string `json:"addr"`
 }
+
+type tenant struct {
+	Name          string   `json:"name"`
+	Clients       int      `json:"clients"`
+	Online        int      `json:"online"`
+	Subscriptions int      `json:"subscriptions"`
+	Retained      int      `json:"retained"`
+	Nodes         []result `json:"nodes,omitempty"`
+}
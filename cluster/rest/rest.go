@@ -5,6 +5,8 @@ import (
 	"fmt"
 	cs "github.com/wind-c/comqtt/v2/cluster"
 	"github.com/wind-c/comqtt/v2/cluster/discovery"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	rt "github.com/wind-c/comqtt/v2/mqtt/rest"
 	"net/http"
 	"net/netip"
@@ -23,16 +25,18 @@ func New(agent *cs.Agent) *rest {
 
 func (s *rest) GenHandlers() map[string]rt.Handler {
 	return map[string]rt.Handler{
-		"GET /api/v1/node/config":               s.viewConfig,
-		"DELETE /api/v1/node/{name}":            s.leave,
-		"GET /api/v1/cluster/nodes":             s.getNodes,
-		"POST /api/v1/cluster/nodes":            s.join,
-		"POST /api/v1/cluster/peers":            s.addRaftPeer,
-		"DELETE /api/v1/cluster/peers/{name}":   s.removeRaftPeer,
-		"GET /api/v1/cluster/stat/online":       s.getOnlineCount,
-		"GET /api/v1/cluster/clients/{id}":      s.getClient,
-		"POST /api/v1/cluster/blacklist/{id}":   s.kickClient,
-		"DELETE /api/v1/cluster/blacklist/{id}": s.blanchClient,
+		"GET /api/v1/node/config":                      s.viewConfig,
+		"DELETE /api/v1/node/{name}":                   s.leave,
+		"GET /api/v1/cluster/nodes":                    s.getNodes,
+		"POST /api/v1/cluster/nodes":                   s.join,
+		"POST /api/v1/cluster/peers":                   s.addRaftPeer,
+		"DELETE /api/v1/cluster/peers/{name}":          s.removeRaftPeer,
+		"GET /api/v1/cluster/stat/online":              s.getOnlineCount,
+		"GET /api/v1/cluster/clients/{id}":             s.getClient,
+		"POST /api/v1/cluster/blacklist/{id}":          s.kickClient,
+		"DELETE /api/v1/cluster/blacklist/{id}":        s.blanchClient,
+		"GET /api/v1/cluster/tenants/{tenant}":         s.getTenant,
+		"GET /api/v1/cluster/tenants/{tenant}/clients": s.getTenantClients,
 	}
 }
 
@@ -147,24 +151,69 @@ func (s *rest) getClient(w http.ResponseWriter, r *http.Request) {
 	rt.Ok(w, rs)
 }
 
-// kickClient add it to the blacklist on all nodes in the cluster
+// getTenant return the usage of a tenant summed over all nodes in the cluster, with the usage of each node
+// GET api/v1/cluster/tenants/{tenant}
+func (s *rest) getTenant(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !mqtt.IsValidTenant(name) {
+		rt.Error(w, http.StatusBadRequest, "invalid tenant")
+		return
+	}
+
+	path := strings.Replace(rt.MqttGetTenantPath, "{tenant}", name, 1)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpGet, urls, nil)
+	t := tenant{Name: name, Nodes: rs}
+	for _, res := range rs {
+		var nt tenant
+		if res.Err != "" || json.Unmarshal([]byte(res.Data), &nt) != nil {
+			continue
+		}
+
+		t.Clients += nt.Clients
+		t.Online += nt.Online
+		t.Subscriptions += nt.Subscriptions
+		t.Retained = max(t.Retained, nt.Retained) // each node holds the retained messages it has received
+	}
+
+	rt.Ok(w, t)
+}
+
+// getTenantClients return the clients of a tenant from all nodes in the cluster
+// GET api/v1/cluster/tenants/{tenant}/clients
+func (s *rest) getTenantClients(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !mqtt.IsValidTenant(name) {
+		rt.Error(w, http.StatusBadRequest, "invalid tenant")
+		return
+	}
+
+	path := strings.Replace(rt.MqttTenantClientsPath, "{tenant}", name, 1)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpGet, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// kickClient add it to the blacklist, which is replicated to all nodes in the cluster
 // POST api/v1/cluster/blacklist/{id}
 func (s *rest) kickClient(w http.ResponseWriter, r *http.Request) {
 	cid := r.PathValue("id")
-	path := strings.Replace(rt.MqttAddBlacklistPath, "{id}", cid, 1)
-	urls := genUrls(s.agent.GetMemberList(), path)
-	rs := fetchM(HttpPost, urls, nil)
-	rt.Ok(w, rs)
+	if err := s.agent.AddBlacklist(storage.BlacklistEntry{Kind: mqtt.BlacklistClientID, Value: cid}); err != nil {
+		rt.Error(w, http.StatusBadRequest, err.Error())
+	} else {
+		rt.Ok(w, cid)
+	}
 }
 
-// blanchClient remove from the blacklist on all nodes in the cluster
+// blanchClient remove from the blacklist, which is replicated to all nodes in the cluster
 // DELETE api/v1/cluster/blacklist/{id}
 func (s *rest) blanchClient(w http.ResponseWriter, r *http.Request) {
 	cid := r.PathValue("id")
-	path := strings.Replace(rt.MqttDelBlacklistPath, "{id}", cid, 1)
-	urls := genUrls(s.agent.GetMemberList(), path)
-	rs := fetchM(HttpDelete, urls, nil)
-	rt.Ok(w, rs)
+	if s.agent.DeleteBlacklist(mqtt.BlacklistClientID, cid) {
+		rt.Ok(w, cid)
+	} else {
+		rt.Error(w, http.StatusNotFound, "blacklist entry not found")
+	}
 }
 
 // genUrls generate urls
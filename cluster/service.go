@@ -95,6 +95,7 @@ func (s *RpcService) PublishPacket(ctx context.Context, req *crpc.PublishRequest
 		ProtocolVersion: uint8(req.ProtocolVersion),
 		Payload:         req.Payload,
 	}
+	s.agent.relayStats.onReceived(relayPublish)
 	s.agent.grpcMsgCh <- &msg
 
 	return &crpc.Response{Ok: true}, nil
@@ -106,6 +107,7 @@ func (s *RpcService) ConnectNotify(ctx context.Context, req *crpc.ConnectRequest
 		NodeID:   req.NodeId,
 		ClientID: req.ClientId,
 	}
+	s.agent.relayStats.onReceived(relayConnect)
 	s.agent.grpcMsgCh <- &msg
 
 	return &crpc.Response{Ok: true}, nil
@@ -117,6 +119,7 @@ func (s *RpcService) RaftApply(ctx context.Context, req *crpc.ApplyRequest) (*cr
 		NodeID:  req.NodeId,
 		Payload: req.Filter,
 	}
+	s.agent.relayStats.onReceived(relayRaftApply)
 	s.agent.grpcMsgCh <- &msg
 
 	return &crpc.Response{Ok: true}, nil
@@ -129,6 +132,7 @@ func (s *RpcService) RaftJoin(ctx context.Context, req *crpc.JoinRequest) (*crpc
 		NodeID:  req.NodeId,
 		Payload: []byte(addr),
 	}
+	s.agent.relayStats.onReceived(relayRaftJoin)
 	s.agent.grpcMsgCh <- &msg
 
 	return &crpc.Response{Ok: true}, nil
@@ -208,6 +212,7 @@ func (c *ClientManager) getClient(nodeId string) (*client, error) {
 func (c *ClientManager) RelayPublishPacket(nodeId string, msg *message.Message) {
 	client, err := c.getClient(nodeId)
 	if err != nil {
+		c.agent.relayStats.onSent(relayPublish, err)
 		log.Error("get grpc client", "error", err)
 		return
 	}
@@ -220,7 +225,9 @@ func (c *ClientManager) RelayPublishPacket(nodeId string, msg *message.Message)
 		ProtocolVersion: uint32(msg.ProtocolVersion),
 		Payload:         msg.Payload,
 	}
-	if _, err := client.PublishPacket(ctx, &req); err != nil {
+	_, err = client.PublishPacket(ctx, &req)
+	c.agent.relayStats.onSent(relayPublish, err)
+	if err != nil {
 		log.Error("relay publish packet", "error", err, "to", nodeId, "cid", msg.ClientID)
 	}
 }
@@ -228,6 +235,7 @@ func (c *ClientManager) RelayPublishPacket(nodeId string, msg *message.Message)
 func (c *ClientManager) ConnectNotifyToNode(nodeId, clientId string) {
 	client, err := c.getClient(nodeId)
 	if err != nil {
+		c.agent.relayStats.onSent(relayConnect, err)
 		return
 	}
 
@@ -238,7 +246,9 @@ func (c *ClientManager) ConnectNotifyToNode(nodeId, clientId string) {
 		ClientId: clientId,
 	}
 	OnConnectPacketLog(DirectionOutbound, nodeId, clientId)
-	if _, err := client.ConnectNotify(ctx, &req); err != nil {
+	_, err = client.ConnectNotify(ctx, &req)
+	c.agent.relayStats.onSent(relayConnect, err)
+	if err != nil {
 		log.Error("connection notification", "error", err, "to", nodeId, "cid", clientId)
 	}
 }
@@ -256,6 +266,7 @@ func (c *ClientManager) ConnectNotifyToOthers(msg *message.Message) {
 func (c *ClientManager) RelayRaftApply(nodeId string, msg *message.Message) {
 	client, err := c.getClient(nodeId)
 	if err != nil {
+		c.agent.relayStats.onSent(relayRaftApply, err)
 		log.Error("get grpc client", "error", err)
 		return
 	}
@@ -267,7 +278,9 @@ func (c *ClientManager) RelayRaftApply(nodeId string, msg *message.Message) {
 		NodeId: msg.NodeID,
 		Filter: msg.Payload,
 	}
-	if _, err := client.RaftApply(ctx, &req); err != nil {
+	_, err = client.RaftApply(ctx, &req)
+	c.agent.relayStats.onSent(relayRaftApply, err)
+	if err != nil {
 		OnApplyLog(nodeId, msg.NodeID, msg.Type, msg.Payload, "to leader do apply", err)
 	}
 }
@@ -285,6 +298,7 @@ func (c *ClientManager) RaftApplyToOthers(msg *message.Message) {
 func (c *ClientManager) RelayRaftJoin(nodeId string) {
 	client, err := c.getClient(nodeId)
 	if err != nil {
+		c.agent.relayStats.onSent(relayRaftJoin, err)
 		log.Error("get grpc client", "error", err)
 		return
 	}
@@ -296,7 +310,9 @@ func (c *ClientManager) RelayRaftJoin(nodeId string) {
 		Addr:   c.agent.Config.BindAddr,
 		Port:   uint32(c.agent.Config.RaftPort),
 	}
-	if _, err := client.RaftJoin(ctx, &req); err != nil {
+	_, err = client.RaftJoin(ctx, &req)
+	c.agent.relayStats.onSent(relayRaftJoin, err)
+	if err != nil {
 		addr := c.agent.Config.BindAddr + ":" + strconv.Itoa(c.agent.Config.RaftPort)
 		OnJoinLog(nodeId, addr, "raft join", err)
 	}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	redis "github.com/redis/go-redis/v9"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
@@ -18,6 +19,9 @@ import (
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 )
 
+// globEscaper escapes the special characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
 // defaultAddr is the default address to the redis service.
 const defaultAddr = "localhost:6379"
 
@@ -46,6 +50,11 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return pk.FormatID()
 }
 
+// blacklistKey returns a primary key for a blacklist entry.
+func blacklistKey(e storage.BlacklistEntry) string {
+	return e.Kind + ":" + e.Value
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return localIP
@@ -85,11 +94,15 @@ func (s *Storage) Provides(b byte) bool {
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
+		mqtt.OnBlacklistAdded,
+		mqtt.OnBlacklistDeleted,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
+		mqtt.StoredBlacklist,
+		mqtt.StoredRetainedMessagesByFilter,
 	}, []byte{b})
 }
 
@@ -388,6 +401,59 @@ func (s *Storage) OnClientExpired(cl *mqtt.Client) {
 	}
 }
 
+// OnBlacklistAdded adds or updates a blacklist entry in the store shared by the cluster.
+func (s *Storage) OnBlacklistAdded(e storage.BlacklistEntry) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	e.ID = blacklistKey(e)
+	e.T = storage.BlacklistKey
+	err := s.db.HSet(s.ctx, s.hKey(storage.BlacklistKey), e.ID, e).Err()
+	if err != nil {
+		s.Log.Error("failed to hset blacklist data", "error", err, "data", e)
+	}
+}
+
+// OnBlacklistDeleted deletes a deleted or expired blacklist entry from the store.
+func (s *Storage) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := s.db.HDel(s.ctx, s.hKey(storage.BlacklistKey), blacklistKey(e)).Err()
+	if err != nil {
+		s.Log.Error("failed to delete blacklist data", "error", err, "id", blacklistKey(e))
+	}
+}
+
+// StoredBlacklist returns all stored blacklist entries from the store.
+func (s *Storage) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := s.db.HGetAll(s.ctx, s.hKey(storage.BlacklistKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		s.Log.Error("failed to HGetAll blacklist data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.BlacklistEntry
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			s.Log.Error("failed to unmarshal blacklist data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
 // StoredSysInfo returns the system info from the store.
 func (s *Storage) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if s.db == nil {
@@ -479,6 +545,45 @@ func (s *Storage) StoredRetainedMessageByTopic(topic string) (v storage.Message,
 	return v, nil
 }
 
+// StoredRetainedMessagesByFilter returns the stored retained messages on topics matching a filter,
+// scanning only the topics which begin with the part of the filter before any wildcard.
+func (s *Storage) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	pattern := globEscaper.Replace(retainedKey(mqtt.FilterPrefix(filter))) + "*"
+	iter := s.db.HScan(s.ctx, s.hKey(storage.RetainedKey), 0, pattern, 0).Iterator()
+	for iter.Next(s.ctx) {
+		topic := iter.Val()
+		if !iter.Next(s.ctx) { // fields are followed by their values
+			break
+		}
+
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(iter.Val())); err != nil {
+			s.Log.Error("failed to unmarshal retained message data", "error", err, "data", iter.Val())
+			continue
+		}
+
+		if d.TopicName == "" {
+			d.TopicName = topic
+		}
+
+		if mqtt.MatchFilter(filter, d.TopicName) {
+			v = append(v, d)
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		s.Log.Error("failed to HScan retained message data", "error", err)
+		return
+	}
+
+	return v, nil
+}
+
 // StoredInflightMessagesByCid returns all stored inflight messages of client from the store.
 func (s *Storage) StoredInflightMessagesByCid(cid string) (v []storage.Message, err error) {
 	if s.db == nil {
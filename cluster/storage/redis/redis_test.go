@@ -108,6 +108,9 @@ func TestProvides(t *testing.T) {
 	require.True(t, s.Provides(mqtt.StoredRetainedMessages))
 	require.True(t, s.Provides(mqtt.StoredSubscriptions))
 	require.True(t, s.Provides(mqtt.StoredSysInfo))
+	require.True(t, s.Provides(mqtt.StoredBlacklist))
+	require.True(t, s.Provides(mqtt.OnBlacklistAdded))
+	require.True(t, s.Provides(mqtt.OnBlacklistDeleted))
 	require.False(t, s.Provides(mqtt.OnACLCheck))
 	require.False(t, s.Provides(mqtt.OnConnectAuthenticate))
 }
@@ -657,6 +660,54 @@ func TestStoredRetainedMessageByTopicClosedDB(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestStoredRetainedMessagesByFilter(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	for _, topic := range []string{"a/b/c", "a/b/d", "a", "ab/c", "[a]*/b"} {
+		err := s.db.HSet(s.ctx, s.hKey(storage.RetainedKey), topic, &storage.Message{TopicName: topic, Payload: []byte(topic)}).Err()
+		require.NoError(t, err)
+	}
+
+	topics := func(filter string) []string {
+		r, err := s.StoredRetainedMessagesByFilter(filter)
+		require.NoError(t, err)
+		names := []string{}
+		for _, msg := range r {
+			names = append(names, msg.TopicName)
+		}
+		return names
+	}
+
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d", "a"}, topics("a/#"))
+	require.ElementsMatch(t, []string{"a/b/c"}, topics("+/b/c"))
+	require.ElementsMatch(t, []string{"[a]*/b"}, topics("[a]*/+"))
+	require.Empty(t, topics("x"))
+}
+
+func TestStoredRetainedMessagesByFilterNoDB(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	s.db = nil
+	v, err := s.StoredRetainedMessagesByFilter("a/#")
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredRetainedMessagesByFilterClosedDB(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	teardown(t, s)
+
+	v, err := s.StoredRetainedMessagesByFilter("a/#")
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
 func TestStoredInflightMessages(t *testing.T) {
 	m := miniredis.RunT(t)
 	defer m.Close()
@@ -745,3 +796,35 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestOnBlacklistAddedThenDeleted(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	e := storage.BlacklistEntry{Kind: "ip", Value: "10.0.0.0/8", Reason: "abuse", Created: 1}
+	s.OnBlacklistAdded(e)
+	s.OnBlacklistAdded(storage.BlacklistEntry{Kind: "client-id", Value: "c1", Created: 2})
+
+	r, err := s.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	s.OnBlacklistDeleted(e)
+	r, err = s.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "c1", r[0].Value)
+	require.Equal(t, storage.BlacklistKey, r[0].T)
+}
+
+func TestStoredBlacklistNoDB(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	s.db = nil
+	v, err := s.StoredBlacklist()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
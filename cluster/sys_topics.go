@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeStatusAlive = "alive"
+	nodeStatusDown  = "down"
+)
+
+// sysTopics returns the $SYS/cluster subtree, containing the health and client count of
+// each node and the current raft leader.
+func (a *Agent) sysTopics() map[string]string {
+	topics := make(map[string]string)
+	if a.membership != nil {
+		members := a.membership.Members()
+		stat := a.Stat()
+
+		nodes := make(map[string]string, len(members))
+		for node := range stat {
+			nodes[node] = nodeStatusDown // known to have had clients, but no longer a member
+		}
+		for _, m := range members {
+			nodes[m.Name] = nodeStatusAlive
+		}
+
+		for node, status := range nodes {
+			if node == "" || strings.ContainsAny(node, "+#/") {
+				continue
+			}
+			topics["cluster/nodes/"+node+"/status"] = status
+			topics["cluster/nodes/"+node+"/clients"] = strconv.FormatInt(stat[node], 10)
+		}
+		topics["cluster/members"] = strconv.Itoa(len(members))
+	}
+
+	if a.raftPeer != nil {
+		_, leader := a.raftPeer.GetLeader()
+		topics["cluster/leader"] = leader
+	}
+
+	return topics
+}
@@ -0,0 +1,37 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/discovery"
+	"github.com/wind-c/comqtt/v2/config"
+)
+
+type fakeMembership struct {
+	discovery.Node
+	members []discovery.Member
+	stat    map[string]int64
+}
+
+func (m *fakeMembership) Members() []discovery.Member { return m.members }
+func (m *fakeMembership) Stat() map[string]int64      { return m.stat }
+
+func TestAgentSysTopics(t *testing.T) {
+	agent := NewAgent(&config.Cluster{NodeName: "node1"})
+	require.Empty(t, agent.sysTopics())
+
+	agent.membership = &fakeMembership{
+		members: []discovery.Member{{Name: "node1"}, {Name: "node2"}},
+		stat:    map[string]int64{"node1": 3, "node3": 1},
+	}
+
+	topics := agent.sysTopics()
+	require.Equal(t, "2", topics["cluster/members"])
+	require.Equal(t, "alive", topics["cluster/nodes/node1/status"])
+	require.Equal(t, "3", topics["cluster/nodes/node1/clients"])
+	require.Equal(t, "alive", topics["cluster/nodes/node2/status"])
+	require.Equal(t, "0", topics["cluster/nodes/node2/clients"])
+	require.Equal(t, "down", topics["cluster/nodes/node3/status"])
+	require.NotContains(t, topics, "cluster/leader")
+}
@@ -8,9 +8,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -23,14 +25,32 @@ import (
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/badger"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/bolt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/redis"
+	sqlstore "github.com/wind-c/comqtt/v2/mqtt/hooks/storage/sql"
 	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/rest"
 	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+	cauth "github.com/wind-c/comqtt/v2/plugin/auth/cert"
 	hauth "github.com/wind-c/comqtt/v2/plugin/auth/http"
+	jauth "github.com/wind-c/comqtt/v2/plugin/auth/jwt"
 	mauth "github.com/wind-c/comqtt/v2/plugin/auth/mysql"
 	pauth "github.com/wind-c/comqtt/v2/plugin/auth/postgresql"
 	rauth "github.com/wind-c/comqtt/v2/plugin/auth/redis"
+	"github.com/wind-c/comqtt/v2/plugin/auth/scram"
+	coamqp "github.com/wind-c/comqtt/v2/plugin/bridge/amqp"
 	cokafka "github.com/wind-c/comqtt/v2/plugin/bridge/kafka"
+	comqttbr "github.com/wind-c/comqtt/v2/plugin/bridge/mqtt"
+	conats "github.com/wind-c/comqtt/v2/plugin/bridge/nats"
+	coredisbr "github.com/wind-c/comqtt/v2/plugin/bridge/redis"
+	"github.com/wind-c/comqtt/v2/plugin/bridge/webhook"
+	"github.com/wind-c/comqtt/v2/plugin/ratelimit"
+	"github.com/wind-c/comqtt/v2/plugin/rewrite"
+	rewriteRt "github.com/wind-c/comqtt/v2/plugin/rewrite/rest"
+	"github.com/wind-c/comqtt/v2/plugin/rule"
+	ruleRt "github.com/wind-c/comqtt/v2/plugin/rule/rest"
+	"github.com/wind-c/comqtt/v2/plugin/schema"
+	"github.com/wind-c/comqtt/v2/plugin/tenant"
 	"go.etcd.io/bbolt"
 )
 
@@ -53,13 +73,15 @@ func realMain(ctx context.Context) error {
 	cfg := config.New()
 
 	flag.StringVar(&confFile, "conf", "", "read the program parameters from the config file")
-	flag.UintVar(&cfg.StorageWay, "storage-way", 1, "storage way optional items:0 memory, 1 bolt, 2 badger, 3 redis")
+	flag.UintVar(&cfg.StorageWay, "storage-way", 1, "storage way optional items:0 memory, 1 bolt, 2 badger, 3 redis, 4 sql")
 	flag.UintVar(&cfg.Auth.Way, "auth-way", 0, "authentication way optional items:0 anonymous, 1 username and password, 2 clientid")
-	flag.UintVar(&cfg.Auth.Datasource, "auth-ds", 0, "authentication datasource optional items:0 free, 1 redis, 2 mysql, 3 postgresql, 4 http")
+	flag.UintVar(&cfg.Auth.Datasource, "auth-ds", 0, "authentication datasource optional items:0 free, 1 redis, 2 mysql, 3 postgresql, 4 http, 5 jwt, 6 cert")
 	flag.StringVar(&cfg.Auth.ConfPath, "auth-path", "", "config file path should correspond to the auth-datasource")
+	flag.BoolVar(&cfg.Auth.Scram, "auth-scram", false, "enable scram-sha-256 enhanced authentication for mqtt v5 clients, passwords must be stored with password-hash 9")
 	flag.StringVar(&cfg.Mqtt.TCP, "tcp", ":1883", "network address for Mqtt TCP listener")
 	flag.StringVar(&cfg.Mqtt.WS, "ws", ":1882", "network address for Mqtt Websocket listener")
 	flag.StringVar(&cfg.Mqtt.HTTP, "http", ":8080", "network address for web info dashboard listener")
+	flag.StringVar(&cfg.Mqtt.Metrics, "metrics", "", "network address for prometheus metrics listener, empty to disable")
 	flag.BoolVar(&cfg.Log.Enable, "log-enable", true, "log enabled or not")
 	flag.StringVar(&cfg.Log.Filename, "log-file", "./logs/comqtt.log", "log filename")
 	//parse arguments
@@ -82,37 +104,78 @@ func realMain(ctx context.Context) error {
 		fmt.Println("log output to the files, please check")
 	}
 
-	// create server instance and init hooks
+	// create server instance
 	cfg.Mqtt.Options.Logger = log.Default()
 	server := mqtt.New(&cfg.Mqtt.Options)
 	log.Info("comqtt server initializing...")
-	initStorage(server, cfg)
-	initAuth(server, cfg)
-	initBridge(server, cfg)
-	initDeviceEvents(server, cfg)
 
-	// gen tls config
-	var listenerConfig *listeners.Config
+	// gen listener config
+	listenerConfig := &listeners.Config{
+		ProxyProtocol:  cfg.Mqtt.ProxyProtocol,
+		TrustedProxies: cfg.Mqtt.TrustedProxies,
+	}
 	if tlsConfig, err := config.GenTlsConfig(cfg); err != nil {
 		onError(err, "")
 	} else {
-		if tlsConfig != nil {
-			listenerConfig = &listeners.Config{TLSConfig: tlsConfig}
-		}
+		listenerConfig.TLSConfig = tlsConfig
 	}
 
 	// add tcp listener
-	tcp := listeners.NewTCP("tcp", cfg.Mqtt.TCP, listenerConfig)
-	onError(server.AddListener(tcp), "add tcp listener")
+	if cfg.Mqtt.TCP != "" {
+		tcp := listeners.NewTCP("tcp", cfg.Mqtt.TCP, listenerConfig)
+		onError(server.AddListener(tcp), "add tcp listener")
+	}
 
 	// add websocket listener
-	ws := listeners.NewWebsocket("ws", cfg.Mqtt.WS, listenerConfig)
-	onError(server.AddListener(ws), "add websocket listener")
+	if cfg.Mqtt.WS != "" {
+		ws := listeners.NewWebsocket("ws", cfg.Mqtt.WS, listenerConfig)
+		onError(server.AddListener(ws), "add websocket listener")
+	}
+
+	// add quic listener
+	if cfg.Mqtt.QUIC != "" {
+		quic := listeners.NewQUIC("quic", cfg.Mqtt.QUIC, listenerConfig)
+		onError(server.AddListener(quic), "add quic listener")
+	}
+
+	// add the listeners with their own tls, capabilities and connection limits
+	for i := range cfg.Mqtt.Listeners {
+		l := &cfg.Mqtt.Listeners[i]
+		ln, err := config.GenListener(l)
+		onError(err, "add listener")
+		opts, err := config.GenListenerOptions(l, server.Options.Capabilities)
+		onError(err, "add listener")
+		onError(server.AddListenerWithOptions(ln, opts), "add listener")
+	}
+
+	// init hooks
+	initStorage(server, cfg)
+	initAuth(ctx, server, cfg)
+	rewriter := initRewrite(server, cfg)
+	initTenant(server, cfg)
+	initRateLimit(server, cfg)
+	initSchema(server, cfg)
+	bridge := initBridge(server, cfg)
+	engine := initRule(server, cfg, bridge)
+	initDeviceEvents(server, cfg)
 
 	// add http listener
-	http := listeners.NewHTTP("stats", cfg.Mqtt.HTTP, nil, rest.New(server).GenHandlers())
+	hls := rest.New(server).GenHandlers()
+	if engine != nil {
+		maps.Copy(hls, ruleRt.New(engine).GenHandlers())
+	}
+	if rewriter != nil {
+		maps.Copy(hls, rewriteRt.New(rewriter).GenHandlers())
+	}
+	http := listeners.NewHTTP("stats", cfg.Mqtt.HTTP, nil, hls)
 	onError(server.AddListener(http), "add http listener")
 
+	// add prometheus metrics listener
+	if cfg.Mqtt.Metrics != "" {
+		metrics := listeners.NewHTTPMetrics("metrics", cfg.Mqtt.Metrics, nil, server.Info, server.CollectMetrics)
+		onError(server.AddListener(metrics), "add metrics listener")
+	}
+
 	errCh := make(chan error, 1)
 	// start server
 	go func() {
@@ -135,34 +198,193 @@ func realMain(ctx context.Context) error {
 	return nil
 }
 
-func initAuth(server *mqtt.Server, conf *config.Config) {
+// initAuth adds the hooks of the global auth chain, and of each listener with its own auth.
+// If any listener has its own auth, the global auth chain only checks the clients of the
+// listeners added to the server without their own, so it is called after they are added.
+func initAuth(ctx context.Context, server *mqtt.Server, conf *config.Config) {
+	own := map[string]bool{}
+	for _, l := range conf.Mqtt.Listeners {
+		if l.Auth != nil {
+			own[l.ID] = true
+		}
+	}
+
+	var ids []string // the global auth chain checks every client if nil
+	if len(own) > 0 {
+		ids = []string{}
+		for id := range server.Listeners.GetAll() {
+			if !own[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	initAuthChain(ctx, server, &conf.Auth, conf.Mqtt.Tls.CACert, ids)
+	for _, l := range conf.Mqtt.Listeners {
+		if l.Auth != nil {
+			initAuthChain(ctx, server, l.Auth, l.Tls.CACert, []string{l.ID})
+		}
+	}
+}
+
+// initAuthChain adds the hooks of an auth chain, limited to the clients of some listeners,
+// or checking every client if ids is nil.
+func initAuthChain(ctx context.Context, server *mqtt.Server, a *config.Auth, caCert string, ids []string) {
 	logMsg := "init auth"
-	if conf.Auth.Way == config.AuthModeAnonymous {
-		server.AddHook(new(auth.AllowHook), nil)
-	} else if conf.Auth.Way == config.AuthModeUsername || conf.Auth.Way == config.AuthModeClientid {
-		switch conf.Auth.Datasource {
-		case config.AuthDSRedis:
-			opts := rauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(rauth.Auth), &opts), logMsg)
-		case config.AuthDSMysql:
-			opts := mauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(mauth.Auth), &opts), logMsg)
-		case config.AuthDSPostgresql:
-			opts := pauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(pauth.Auth), &opts), logMsg)
-		case config.AuthDSHttp:
-			opts := hauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(hauth.Auth), &opts), logMsg)
+	if a.Way == config.AuthModeAnonymous {
+		onError(server.AddHook(scopeAuth(new(auth.AllowHook), ids), nil), logMsg)
+	} else if a.Way == config.AuthModeUsername || a.Way == config.AuthModeClientid {
+		blacklist := new(auth.Ledger)
+		if a.BlacklistPath != "" {
+			onError(plugin.LoadYaml(a.BlacklistPath, blacklist), logMsg)
+		}
+
+		hook, opts, err := newAuthHook(a, caCert, blacklist)
+		onError(err, logMsg)
+		if hook != nil {
+			onError(server.AddHook(scopeAuth(hook, ids), opts), logMsg)
 		}
+
+		if a.Scram {
+			store, ok := hook.(pa.CredentialStore)
+			if !ok {
+				onError(config.ErrAuthScram, logMsg)
+			}
+			onError(server.AddHook(scopeAuth(new(scram.Auth), ids), &scram.Options{Store: store}), logMsg)
+		}
+
+		onError(watchAuth(ctx, server, a, caCert, blacklist, ids), logMsg)
 	} else {
 		onError(config.ErrAuthWay, logMsg)
 	}
 }
 
+// scopeAuth limits an auth hook to the clients of some listeners, or returns the hook as
+// is if ids is nil.
+func scopeAuth(hook mqtt.Hook, ids []string) mqtt.Hook {
+	if ids == nil {
+		return hook
+	}
+	return auth.NewListenerHook(hook, ids...)
+}
+
+// newAuthHook returns the hook of the auth datasource and its options loaded from the
+// auth conf-path, or a nil hook if there is no datasource.
+func newAuthHook(a *config.Auth, caCert string, blacklist *auth.Ledger) (mqtt.Hook, any, error) {
+	var hook mqtt.Hook
+	var opts interface{ SetBlacklist(bl *auth.Ledger) }
+	switch a.Datasource {
+	case config.AuthDSRedis:
+		hook, opts = new(rauth.Auth), new(rauth.Options)
+	case config.AuthDSMysql:
+		hook, opts = new(mauth.Auth), new(mauth.Options)
+	case config.AuthDSPostgresql:
+		hook, opts = new(pauth.Auth), new(pauth.Options)
+	case config.AuthDSHttp:
+		hook, opts = new(hauth.Auth), new(hauth.Options)
+	case config.AuthDSJwt:
+		hook, opts = new(jauth.Auth), new(jauth.Options)
+	case config.AuthDSCert:
+		if caCert == "" {
+			return nil, nil, config.ErrAuthCert
+		}
+		hook, opts = new(cauth.Auth), new(cauth.Options)
+	default:
+		return nil, nil, nil
+	}
+
+	if err := plugin.LoadYaml(a.ConfPath, opts); err != nil {
+		return nil, nil, err
+	}
+	opts.SetBlacklist(blacklist)
+
+	return hook, opts, nil
+}
+
+// watchAuth reloads the blacklist and the auth datasource config when their files change,
+// or when the process receives SIGHUP. Malformed files are rejected and the previous rules
+// are kept. If auth revoke is enabled, clients of the auth chain which lost access are
+// disconnected.
+func watchAuth(ctx context.Context, server *mqtt.Server, a *config.Auth, caCert string, blacklist *auth.Ledger, ids []string) error {
+	reauthorize := func() {
+		if !a.Revoke {
+			return
+		}
+
+		bl := new(pa.Blacklist)
+		bl.SetBlacklist(blacklist)
+		n := server.ReauthorizeClients(func(cl *mqtt.Client) bool {
+			if ids != nil && !slices.Contains(ids, cl.Net.Listener) {
+				return true // checked by another auth chain
+			}
+			n, ok := bl.CheckBLAuth(cl, packets.Packet{})
+			return n < 0 || ok
+		})
+		log.Info("reauthorized clients", "disconnected", n)
+	}
+
+	w := plugin.NewWatcher(time.Duration(a.ReloadInterval)*time.Second, log.Default())
+	if a.BlacklistPath != "" {
+		err := w.Add(a.BlacklistPath, func(data []byte) error {
+			ln := new(auth.Ledger)
+			if err := ln.Unmarshal(data); err != nil {
+				return err
+			}
+			blacklist.Update(ln)
+			reauthorize()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.ConfPath != "" && a.Datasource != config.AuthDSFree {
+		err := w.Add(a.ConfPath, func(data []byte) error {
+			hook, opts, err := newAuthHook(a, caCert, blacklist)
+			if err != nil {
+				return err
+			}
+			if err := server.ReplaceHook(scopeAuth(hook, ids), opts); err != nil {
+				return err
+			}
+			if a.Scram { // the scram hook must use the new credential store
+				store, _ := hook.(pa.CredentialStore)
+				if err := server.ReplaceHook(scopeAuth(new(scram.Auth), ids), &scram.Options{Store: store}); err != nil {
+					return err
+				}
+			}
+			reauthorize()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Start()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer w.Stop()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Info("caught SIGHUP, reloading auth...")
+				if err := w.Reload(); err != nil {
+					log.Warn("failed to reload auth, keeping previous rules", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
 func initStorage(server *mqtt.Server, conf *config.Config) {
 	logMsg := "init storage"
 	switch conf.StorageWay {
@@ -186,18 +408,141 @@ func initStorage(server *mqtt.Server, conf *config.Config) {
 				Password: conf.Redis.Options.Password,
 			},
 		}), logMsg)
+	case config.StorageWaySql:
+		onError(server.AddHook(new(sqlstore.Hook), &sqlstore.Options{
+			Driver:       conf.Sql.Driver,
+			DSN:          conf.Sql.DSN,
+			TablePrefix:  conf.Sql.TablePrefix,
+			MaxOpenConns: conf.Sql.MaxOpenConns,
+			MaxIdleConns: conf.Sql.MaxIdleConns,
+		}), logMsg)
 	}
 }
 
-func initBridge(server *mqtt.Server, conf *config.Config) {
+func initRewrite(server *mqtt.Server, conf *config.Config) *rewrite.Rewrite {
+	if conf.RewritePath == "" {
+		return nil
+	}
+
+	logMsg := "init topic rewrite"
+	opts := rewrite.Options{}
+	onError(plugin.LoadYaml(conf.RewritePath, &opts), logMsg)
+	hook := new(rewrite.Rewrite)
+	onError(server.AddHook(hook, &opts), logMsg)
+	return hook
+}
+
+func initTenant(server *mqtt.Server, conf *config.Config) {
+	if conf.TenantPath == "" {
+		return
+	}
+
+	logMsg := "init tenant"
+	opts := tenant.Options{}
+	onError(plugin.LoadYaml(conf.TenantPath, &opts), logMsg)
+	hook := new(tenant.Tenant)
+	hook.SetServer(server)
+	onError(server.AddHook(hook, &opts), logMsg)
+}
+
+func initRateLimit(server *mqtt.Server, conf *config.Config) {
+	if conf.RateLimitPath == "" {
+		return
+	}
+
+	logMsg := "init rate limit"
+	opts := ratelimit.Options{}
+	onError(plugin.LoadYaml(conf.RateLimitPath, &opts), logMsg)
+	hook := new(ratelimit.RateLimit)
+	hook.SetServer(server)
+	onError(server.AddHook(hook, &opts), logMsg)
+}
+
+func initSchema(server *mqtt.Server, conf *config.Config) {
+	if conf.SchemaPath == "" {
+		return
+	}
+
+	logMsg := "init schema"
+	opts := schema.Options{}
+	onError(plugin.LoadYaml(conf.SchemaPath, &opts), logMsg)
+	hook := new(schema.Schema)
+	hook.SetServer(server)
+	onError(server.AddHook(hook, &opts), logMsg)
+}
+
+func initBridge(server *mqtt.Server, conf *config.Config) rule.Sink {
 	logMsg := "init bridge"
 	if conf.BridgeWay == config.BridgeWayNone {
-		return
+		return nil
 	} else if conf.BridgeWay == config.BridgeWayKafka {
 		opts := cokafka.Options{}
 		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
-		onError(server.AddHook(new(cokafka.Bridge), &opts), logMsg)
+		bridge := new(cokafka.Bridge)
+		bridge.SetServer(server)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	} else if conf.BridgeWay == config.BridgeWayMqtt {
+		opts := comqttbr.Options{}
+		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
+		bridge := new(comqttbr.Bridge)
+		bridge.SetServer(server)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	} else if conf.BridgeWay == config.BridgeWayWebhook {
+		opts := webhook.Options{}
+		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
+		bridge := new(webhook.Bridge)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	} else if conf.BridgeWay == config.BridgeWayRedis {
+		opts := coredisbr.Options{}
+		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
+		bridge := new(coredisbr.Bridge)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	} else if conf.BridgeWay == config.BridgeWayNats {
+		opts := conats.Options{}
+		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
+		bridge := new(conats.Bridge)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	} else if conf.BridgeWay == config.BridgeWayAmqp {
+		opts := coamqp.Options{}
+		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
+		bridge := new(coamqp.Bridge)
+		onError(server.AddHook(bridge, &opts), logMsg)
+		return bridge
+	}
+	return nil
+}
+
+// bridgeSinks are the names of the bridges in rule bridge actions.
+var bridgeSinks = map[uint]string{
+	config.BridgeWayKafka:   "kafka",
+	config.BridgeWayMqtt:    "mqtt",
+	config.BridgeWayWebhook: "webhook",
+	config.BridgeWayRedis:   "redis",
+	config.BridgeWayNats:    "nats",
+	config.BridgeWayAmqp:    "amqp",
+}
+
+// initRule adds the rule engine, with the configured bridge available to bridge actions by its name in bridgeSinks.
+func initRule(server *mqtt.Server, conf *config.Config, bridge rule.Sink) *rule.Engine {
+	if conf.RulePath == "" {
+		return nil
+	}
+
+	logMsg := "init rule engine"
+	opts := rule.Options{}
+	onError(plugin.LoadYaml(conf.RulePath, &opts), logMsg)
+	engine := new(rule.Engine)
+	engine.SetServer(server)
+	if name, ok := bridgeSinks[conf.BridgeWay]; ok {
+		engine.AddSink(name, bridge)
 	}
+	onError(server.AddHook(engine, &opts), logMsg)
+	return engine
 }
 
 func initDeviceEvents(server *mqtt.Server, conf *config.Config) {
@@ -8,10 +8,12 @@ import (
 	tls2 "crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/wind-c/comqtt/v2/cluster/log"
 	comqtt "github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,6 +32,7 @@ const (
 	StorageWayBolt
 	StorageWayBadger
 	StorageWayRedis
+	StorageWaySql
 )
 
 const (
@@ -44,18 +47,40 @@ const (
 	AuthDSMysql
 	AuthDSPostgresql
 	AuthDSHttp
+	AuthDSJwt
+	AuthDSCert
+)
+
+const (
+	ListenerTypeTCP  = "tcp"
+	ListenerTypeTLS  = "tls"
+	ListenerTypeWS   = "ws"
+	ListenerTypeWSS  = "wss"
+	ListenerTypeUnix = "unix"
+	ListenerTypeQUIC = "quic"
 )
 
 const (
 	BridgeWayNone uint = iota
 	BridgeWayKafka
+	BridgeWayMqtt
+	BridgeWayWebhook
+	BridgeWayRedis
+	BridgeWayNats
+	BridgeWayAmqp
 )
 
 var (
 	ErrAuthWay     = errors.New("auth-way is incorrectly configured")
+	ErrAuthScram   = errors.New("auth-scram requires a redis, mysql or postgresql auth-datasource")
+	ErrAuthCert    = errors.New("certificate auth requires mqtt tls with a ca-cert")
 	ErrStorageWay  = errors.New("only redis can be used in cluster mode")
 	ErrClusterOpts = errors.New("cluster options must be configured")
 
+	ErrListenerID   = errors.New("listener id must be configured")
+	ErrListenerType = errors.New("listener type is incorrectly configured")
+	ErrListenerTls  = errors.New("tls, wss and quic listeners require a server certificate and private key")
+
 	ErrAppendCerts      = errors.New("append ca cert failure")
 	ErrMissingCertOrKey = errors.New("missing server certificate or private key files")
 )
@@ -82,31 +107,60 @@ func parse(buf []byte) (*Config, error) {
 }
 
 type Config struct {
-	StorageWay  uint        `yaml:"storage-way"`
-	StoragePath string      `yaml:"storage-path"`
-	BridgeWay   uint        `yaml:"bridge-way"`
-	BridgePath  string      `yaml:"bridge-path"`
-	Auth        auth        `yaml:"auth"`
-	Mqtt        mqtt        `yaml:"mqtt"`
-	Cluster     Cluster     `yaml:"cluster"`
-	Redis       redis       `yaml:"redis"`
-	Log         log.Options `yaml:"log"`
-	PprofEnable bool        `yaml:"pprof-enable"`
+	StorageWay    uint        `yaml:"storage-way"`
+	StoragePath   string      `yaml:"storage-path"`
+	BridgeWay     uint        `yaml:"bridge-way"`
+	BridgePath    string      `yaml:"bridge-path"`
+	RateLimitPath string      `yaml:"rate-limit-path"`
+	SchemaPath    string      `yaml:"schema-path"`
+	RulePath      string      `yaml:"rule-path"`
+	RewritePath   string      `yaml:"rewrite-path"`
+	TenantPath    string      `yaml:"tenant-path"`
+	Auth          Auth        `yaml:"auth"`
+	Mqtt          mqtt        `yaml:"mqtt"`
+	Cluster       Cluster     `yaml:"cluster"`
+	Redis         redis       `yaml:"redis"`
+	Sql           sql         `yaml:"sql"`
+	Log           log.Options `yaml:"log"`
+	PprofEnable   bool        `yaml:"pprof-enable"`
 }
 
-type auth struct {
-	Way           uint   `yaml:"way"`
-	Datasource    uint   `yaml:"datasource"`
-	ConfPath      string `yaml:"conf-path"`
-	BlacklistPath string `yaml:"blacklist-path"`
+type Auth struct {
+	Way            uint   `yaml:"way"`
+	Datasource     uint   `yaml:"datasource"`
+	ConfPath       string `yaml:"conf-path"`
+	BlacklistPath  string `yaml:"blacklist-path"`
+	Scram          bool   `yaml:"scram"`
+	ReloadInterval int64  `yaml:"reload-interval"`
+	Revoke         bool   `yaml:"revoke"`
 }
 
 type mqtt struct {
 	TCP     string         `yaml:"tcp"`
 	WS      string         `yaml:"ws"`
+	QUIC    string         `yaml:"quic"`
 	HTTP    string         `yaml:"http"`
+	Metrics string         `yaml:"metrics"`
 	Tls     tls            `yaml:"tls"`
 	Options comqtt.Options `yaml:"options"`
+
+	ProxyProtocol  bool     `yaml:"proxy-protocol"`
+	TrustedProxies []string `yaml:"trusted-proxies"`
+
+	Listeners []Listener `yaml:"listeners"`
+}
+
+// Listener is an mqtt listener with its own tls, auth chain, connection limit and capabilities.
+type Listener struct {
+	ID             string    `yaml:"id"`
+	Type           string    `yaml:"type"` // tcp, tls, ws, wss, unix or quic
+	Address        string    `yaml:"address"`
+	Tls            tls       `yaml:"tls"` // used by tls, wss and quic listeners
+	ProxyProtocol  bool      `yaml:"proxy-protocol"`
+	TrustedProxies []string  `yaml:"trusted-proxies"`
+	Auth           *Auth     `yaml:"auth"`            // replaces the global auth for the clients of the listener
+	MaxConnections int64     `yaml:"max-connections"` // 0 unlimited
+	Capabilities   yaml.Node `yaml:"capabilities"`    // overrides of the capabilities of the server options
 }
 
 type tls struct {
@@ -127,6 +181,14 @@ type redis struct {
 	Options redisOptions
 }
 
+type sql struct {
+	Driver       string `json:"driver" yaml:"driver"`
+	DSN          string `json:"dsn" yaml:"dsn"`
+	TablePrefix  string `json:"table-prefix" yaml:"table-prefix"`
+	MaxOpenConns int    `json:"max-open-conns" yaml:"max-open-conns"`
+	MaxIdleConns int    `json:"max-idle-conns" yaml:"max-idle-conns"`
+}
+
 type Cluster struct {
 	DiscoveryWay         uint              `yaml:"discovery-way"  json:"discovery-way"`
 	NodeName             string            `yaml:"node-name" json:"node-name"`
@@ -151,15 +213,19 @@ type Cluster struct {
 }
 
 func GenTlsConfig(conf *Config) (*tls2.Config, error) {
-	if conf.Mqtt.Tls.ServerKey == "" && conf.Mqtt.Tls.ServerCert == "" {
+	return genTlsConfig(conf.Mqtt.Tls)
+}
+
+func genTlsConfig(t tls) (*tls2.Config, error) {
+	if t.ServerKey == "" && t.ServerCert == "" {
 		return nil, nil
 	}
 
-	if conf.Mqtt.Tls.ServerKey == "" || conf.Mqtt.Tls.ServerCert == "" {
+	if t.ServerKey == "" || t.ServerCert == "" {
 		return nil, ErrMissingCertOrKey
 	}
 
-	cert, err := tls2.LoadX509KeyPair(conf.Mqtt.Tls.ServerCert, conf.Mqtt.Tls.ServerKey)
+	cert, err := tls2.LoadX509KeyPair(t.ServerCert, t.ServerKey)
 	if err != nil {
 		return nil, err
 	}
@@ -169,8 +235,8 @@ func GenTlsConfig(conf *Config) (*tls2.Config, error) {
 	}
 
 	// enable bidirectional authentication
-	if conf.Mqtt.Tls.CACert != "" {
-		pem, err := os.ReadFile(conf.Mqtt.Tls.CACert)
+	if t.CACert != "" {
+		pem, err := os.ReadFile(t.CACert)
 		if err != nil {
 			return nil, err
 		}
@@ -186,3 +252,58 @@ func GenTlsConfig(conf *Config) (*tls2.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// GenListener returns a new mqtt listener of the type of a listener config.
+func GenListener(l *Listener) (listeners.Listener, error) {
+	if l.ID == "" {
+		return nil, ErrListenerID
+	}
+
+	config := &listeners.Config{
+		ProxyProtocol:  l.ProxyProtocol,
+		TrustedProxies: l.TrustedProxies,
+	}
+
+	switch l.Type {
+	case ListenerTypeTLS, ListenerTypeWSS, ListenerTypeQUIC:
+		tlsConfig, err := genTlsConfig(l.Tls)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("%w: %s", ErrListenerTls, l.ID)
+		}
+		config.TLSConfig = tlsConfig
+	}
+
+	switch l.Type {
+	case ListenerTypeTCP, ListenerTypeTLS:
+		return listeners.NewTCP(l.ID, l.Address, config), nil
+	case ListenerTypeWS, ListenerTypeWSS:
+		return listeners.NewWebsocket(l.ID, l.Address, config), nil
+	case ListenerTypeUnix:
+		return listeners.NewUnixSock(l.ID, l.Address), nil
+	case ListenerTypeQUIC:
+		return listeners.NewQUIC(l.ID, l.Address, config), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrListenerType, l.Type)
+	}
+}
+
+// GenListenerOptions returns the options of a listener, whose capabilities are the server
+// capabilities with the overrides of the listener config.
+func GenListenerOptions(l *Listener, caps *comqtt.Capabilities) (*comqtt.ListenerOptions, error) {
+	opts := &comqtt.ListenerOptions{
+		MaxConnections: l.MaxConnections,
+	}
+
+	if !l.Capabilities.IsZero() {
+		lc := *caps
+		if err := l.Capabilities.Decode(&lc); err != nil {
+			return nil, err
+		}
+		opts.Capabilities = &lc
+	}
+
+	return opts, nil
+}
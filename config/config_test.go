@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	comqtt "github.com/wind-c/comqtt/v2/mqtt"
 )
 
 var buf = []byte(`
@@ -85,3 +86,112 @@ func TestParse(t *testing.T) {
 	require.Equal(t, "127.0.0.1:6379", cfg.Redis.Options.Addr)
 	require.Equal(t, 10240, cfg.Cluster.QueueDepth)
 }
+
+var listenersBuf = []byte(`
+mqtt:
+  listeners:
+    - id: local
+      type: tcp
+      address: 127.0.0.1:1883
+      auth:
+        way: 0
+    - id: public
+      type: wss
+      address: :8883
+      tls:
+        server-cert: server.pem
+        server-key: server.key
+      auth:
+        way: 1
+        datasource: 5
+        conf-path: ./config/auth/jwt.yml
+      max-connections: 1000
+      capabilities:
+        maximum-qos: 1
+        maximum-packet-size: 65536
+        compatibilities:
+          obscure-not-authorized: true
+    - id: sock
+      type: unix
+      address: /tmp/comqtt.sock
+`)
+
+func TestParseListeners(t *testing.T) {
+	cfg, err := parse(listenersBuf)
+	require.NoError(t, err)
+	require.Len(t, cfg.Mqtt.Listeners, 3)
+
+	l := cfg.Mqtt.Listeners[0]
+	require.Equal(t, "local", l.ID)
+	require.Equal(t, ListenerTypeTCP, l.Type)
+	require.Equal(t, "127.0.0.1:1883", l.Address)
+	require.Equal(t, &Auth{Way: AuthModeAnonymous}, l.Auth)
+	require.True(t, l.Capabilities.IsZero())
+
+	l = cfg.Mqtt.Listeners[1]
+	require.Equal(t, ListenerTypeWSS, l.Type)
+	require.Equal(t, "server.pem", l.Tls.ServerCert)
+	require.Equal(t, AuthDSJwt, l.Auth.Datasource)
+	require.Equal(t, int64(1000), l.MaxConnections)
+
+	require.Nil(t, cfg.Mqtt.Listeners[2].Auth)
+}
+
+func TestGenListener(t *testing.T) {
+	tt := []struct {
+		l        Listener
+		protocol string
+	}{
+		{l: Listener{ID: "t1", Type: ListenerTypeTCP, Address: ":1883"}, protocol: "tcp"},
+		{l: Listener{ID: "t2", Type: ListenerTypeWS, Address: ":1882"}, protocol: "ws"},
+		{l: Listener{ID: "t3", Type: ListenerTypeUnix, Address: "/tmp/comqtt.sock"}, protocol: "unix"},
+	}
+
+	for _, tx := range tt {
+		ln, err := GenListener(&tx.l)
+		require.NoError(t, err)
+		require.Equal(t, tx.l.ID, ln.ID())
+		require.Equal(t, tx.l.Address, ln.Address())
+		require.Equal(t, tx.protocol, ln.Protocol())
+	}
+}
+
+func TestGenListenerErrors(t *testing.T) {
+	_, err := GenListener(&Listener{Type: ListenerTypeTCP, Address: ":1883"})
+	require.ErrorIs(t, err, ErrListenerID)
+
+	_, err = GenListener(&Listener{ID: "t1", Type: "udp", Address: ":1883"})
+	require.ErrorIs(t, err, ErrListenerType)
+
+	for _, typ := range []string{ListenerTypeTLS, ListenerTypeWSS, ListenerTypeQUIC} {
+		_, err = GenListener(&Listener{ID: "t1", Type: typ, Address: ":8883"})
+		require.ErrorIs(t, err, ErrListenerTls)
+	}
+
+	_, err = GenListener(&Listener{ID: "t1", Type: ListenerTypeTLS, Address: ":8883", Tls: tls{ServerCert: "server.pem"}})
+	require.ErrorIs(t, err, ErrMissingCertOrKey)
+}
+
+func TestGenListenerOptions(t *testing.T) {
+	cfg, err := parse(listenersBuf)
+	require.NoError(t, err)
+
+	caps := *comqtt.DefaultServerCapabilities
+	opts, err := GenListenerOptions(&cfg.Mqtt.Listeners[1], &caps)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), opts.MaxConnections)
+	require.Equal(t, byte(1), opts.Capabilities.MaximumQos)
+	require.Equal(t, uint32(65536), opts.Capabilities.MaximumPacketSize)
+	require.True(t, opts.Capabilities.Compatibilities.ObscureNotAuthorized)
+	require.Equal(t, caps.ReceiveMaximum, opts.Capabilities.ReceiveMaximum) // not overridden
+	require.Equal(t, byte(2), caps.MaximumQos)                              // the server capabilities are not changed
+
+	opts, err = GenListenerOptions(&cfg.Mqtt.Listeners[0], &caps)
+	require.NoError(t, err)
+	require.Nil(t, opts.Capabilities)
+
+	cfg, err = parse([]byte("mqtt:\n  listeners:\n    - id: t1\n      capabilities:\n        maximum-qos: high\n"))
+	require.NoError(t, err)
+	_, err = GenListenerOptions(&cfg.Mqtt.Listeners[0], &caps)
+	require.Error(t, err)
+}
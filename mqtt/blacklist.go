@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+)
+
+// The kinds of value which can be banned.
+const (
+	BlacklistClientID = "client-id" // a client id
+	BlacklistUsername = "username"  // a username
+	BlacklistIP       = "ip"        // an ip address or cidr network
+)
+
+// blacklistTombstoneTTL is the least time in seconds a tombstone of a deleted entry is kept.
+const blacklistTombstoneTTL = 24 * 60 * 60
+
+// ErrInvalidBlacklistEntry indicates a blacklist entry has an unknown kind or an empty or malformed value.
+var ErrInvalidBlacklistEntry = errors.New("invalid blacklist entry")
+
+// Blacklist is a concurrency safe set of banned client ids, usernames and ip networks.
+// Each entry may expire, after which it no longer matches. Deleted entries leave a tombstone
+// with the time of the deletion, so older copies of an entry which are replicated later
+// are ignored. Tombstones are kept for the longest ttl of the entries.
+type Blacklist struct {
+	sync.RWMutex
+	internal   map[string]storage.BlacklistEntry // entries keyed on kind and value
+	networks   map[string]netip.Prefix           // the networks of ip entries, keyed as internal
+	tombstones map[string]storage.BlacklistEntry // deleted entries, created at the time of the deletion
+	ttl        int64                             // the longest ttl of the entries in seconds
+}
+
+// NewBlacklist returns a new instance of Blacklist.
+func NewBlacklist() *Blacklist {
+	return &Blacklist{
+		internal:   map[string]storage.BlacklistEntry{},
+		networks:   map[string]netip.Prefix{},
+		tombstones: map[string]storage.BlacklistEntry{},
+	}
+}
+
+// blacklistKey returns the key of an entry.
+func blacklistKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// normalizeBlacklistEntry validates an entry and returns its canonical value, and the
+// network of an ip entry.
+func normalizeBlacklistEntry(kind, value string) (string, netip.Prefix, error) {
+	switch kind {
+	case BlacklistClientID, BlacklistUsername:
+		if value == "" {
+			return "", netip.Prefix{}, ErrInvalidBlacklistEntry
+		}
+		return value, netip.Prefix{}, nil
+	case BlacklistIP:
+		if addr, err := netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap()
+			return addr.String(), netip.PrefixFrom(addr, addr.BitLen()), nil
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return "", netip.Prefix{}, ErrInvalidBlacklistEntry
+		}
+		prefix = prefix.Masked()
+		return prefix.String(), prefix, nil
+	default:
+		return "", netip.Prefix{}, ErrInvalidBlacklistEntry
+	}
+}
+
+// Add adds or updates an entry, returning the entry as stored and true if the blacklist
+// changed. An entry older than the existing entry or the tombstone for the same value is
+// ignored, so replicated updates converge on the most recent.
+func (b *Blacklist) Add(e storage.BlacklistEntry) (storage.BlacklistEntry, bool, error) {
+	value, prefix, err := normalizeBlacklistEntry(e.Kind, e.Value)
+	if err != nil {
+		return e, false, err
+	}
+	e.Value = value
+
+	b.Lock()
+	defer b.Unlock()
+	key := blacklistKey(e.Kind, e.Value)
+	if t, ok := b.tombstones[key]; ok {
+		if e.Created <= t.Created {
+			return e, false, nil
+		}
+		delete(b.tombstones, key)
+	}
+
+	if existing, ok := b.internal[key]; ok {
+		if e.Created < existing.Created || (existing.Reason == e.Reason && existing.Expiry == e.Expiry) {
+			return existing, false, nil
+		}
+	}
+
+	b.internal[key] = e
+	if e.Kind == BlacklistIP {
+		b.networks[key] = prefix
+	}
+
+	if e.Expiry > 0 && e.Expiry-e.Created > b.ttl {
+		b.ttl = e.Expiry - e.Created
+	}
+
+	return e, true, nil
+}
+
+// Delete removes the entry for a value which was created before the deletion time, and leaves
+// a tombstone for the value. It returns the removed entry and true if it existed.
+func (b *Blacklist) Delete(kind, value string, deleted int64) (storage.BlacklistEntry, bool) {
+	value, _, err := normalizeBlacklistEntry(kind, value)
+	if err != nil {
+		return storage.BlacklistEntry{}, false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	key := blacklistKey(kind, value)
+	if t, ok := b.tombstones[key]; !ok || t.Created < deleted {
+		b.tombstones[key] = storage.BlacklistEntry{Kind: kind, Value: value, Created: deleted}
+	}
+
+	e, ok := b.internal[key]
+	if !ok || e.Created > deleted {
+		return storage.BlacklistEntry{}, false
+	}
+
+	delete(b.internal, key)
+	delete(b.networks, key)
+	return e, true
+}
+
+// Tombstone returns the tombstone for a deleted value, created at the time of the deletion.
+func (b *Blacklist) Tombstone(kind, value string) (storage.BlacklistEntry, bool) {
+	value, _, err := normalizeBlacklistEntry(kind, value)
+	if err != nil {
+		return storage.BlacklistEntry{}, false
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	t, ok := b.tombstones[blacklistKey(kind, value)]
+	return t, ok
+}
+
+// Tombstones returns all tombstones, ordered by kind and value.
+func (b *Blacklist) Tombstones() []storage.BlacklistEntry {
+	b.RLock()
+	defer b.RUnlock()
+	return sortedBlacklistEntries(b.tombstones)
+}
+
+// Get returns the entry for a value.
+func (b *Blacklist) Get(kind, value string) (storage.BlacklistEntry, bool) {
+	value, _, err := normalizeBlacklistEntry(kind, value)
+	if err != nil {
+		return storage.BlacklistEntry{}, false
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	e, ok := b.internal[blacklistKey(kind, value)]
+	return e, ok
+}
+
+// GetAll returns all entries, ordered by kind and value.
+func (b *Blacklist) GetAll() []storage.BlacklistEntry {
+	b.RLock()
+	defer b.RUnlock()
+	return sortedBlacklistEntries(b.internal)
+}
+
+// sortedBlacklistEntries returns the entries of a map, ordered by kind and value.
+func sortedBlacklistEntries(m map[string]storage.BlacklistEntry) []storage.BlacklistEntry {
+	v := make([]storage.BlacklistEntry, 0, len(m))
+	for _, e := range m {
+		v = append(v, e)
+	}
+
+	sort.Slice(v, func(i, j int) bool {
+		return blacklistKey(v[i].Kind, v[i].Value) < blacklistKey(v[j].Kind, v[j].Value)
+	})
+
+	return v
+}
+
+// Len returns the number of entries.
+func (b *Blacklist) Len() int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.internal)
+}
+
+// Match returns the unexpired entry which bans a client by its id, username or remote address.
+func (b *Blacklist) Match(cl *Client, now int64) (storage.BlacklistEntry, bool) {
+	b.RLock()
+	defer b.RUnlock()
+	if len(b.internal) == 0 {
+		return storage.BlacklistEntry{}, false
+	}
+
+	if e, ok := b.active(blacklistKey(BlacklistClientID, cl.ID), now); ok {
+		return e, true
+	}
+
+	if len(cl.Properties.Username) > 0 {
+		if e, ok := b.active(blacklistKey(BlacklistUsername, string(cl.Properties.Username)), now); ok {
+			return e, true
+		}
+	}
+
+	addr, ok := remoteAddr(cl.Net.Remote)
+	if !ok {
+		return storage.BlacklistEntry{}, false
+	}
+
+	for key, prefix := range b.networks {
+		if prefix.Contains(addr) {
+			if e, ok := b.active(key, now); ok {
+				return e, true
+			}
+		}
+	}
+
+	return storage.BlacklistEntry{}, false
+}
+
+// active returns the entry for a key if it has not expired.
+func (b *Blacklist) active(key string, now int64) (storage.BlacklistEntry, bool) {
+	e, ok := b.internal[key]
+	if !ok || (e.Expiry > 0 && e.Expiry <= now) {
+		return storage.BlacklistEntry{}, false
+	}
+	return e, true
+}
+
+// ClearExpired removes and returns all entries which have expired. Tombstones older than
+// the longest ttl of the entries are removed too, as no copy of an entry they shadow can
+// still be in use.
+func (b *Blacklist) ClearExpired(now int64) []storage.BlacklistEntry {
+	b.Lock()
+	defer b.Unlock()
+	var expired []storage.BlacklistEntry
+	for key, e := range b.internal {
+		if e.Expiry > 0 && e.Expiry <= now {
+			expired = append(expired, e)
+			delete(b.internal, key)
+			delete(b.networks, key)
+		}
+	}
+
+	ttl := max(b.ttl, blacklistTombstoneTTL)
+	for key, t := range b.tombstones {
+		if t.Created+ttl <= now {
+			delete(b.tombstones, key)
+		}
+	}
+
+	return expired
+}
+
+// remoteAddr returns the ip address of a client remote address, which may include a port.
+func remoteAddr(remote string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	addr, err := netip.ParseAddr(remote)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// matchBlacklistEntry returns true if a single entry bans a client.
+func matchBlacklistEntry(e storage.BlacklistEntry, cl *Client) bool {
+	switch e.Kind {
+	case BlacklistClientID:
+		return cl.ID == e.Value
+	case BlacklistUsername:
+		return string(cl.Properties.Username) == e.Value
+	case BlacklistIP:
+		_, prefix, err := normalizeBlacklistEntry(e.Kind, e.Value)
+		if err != nil {
+			return false
+		}
+		addr, ok := remoteAddr(cl.Net.Remote)
+		return ok && prefix.Contains(addr)
+	default:
+		return false
+	}
+}
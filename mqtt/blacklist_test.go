@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+)
+
+func TestBlacklistAdd(t *testing.T) {
+	b := NewBlacklist()
+
+	_, _, err := b.Add(storage.BlacklistEntry{Kind: "serial", Value: "x"})
+	require.ErrorIs(t, err, ErrInvalidBlacklistEntry)
+	_, _, err = b.Add(storage.BlacklistEntry{Kind: BlacklistClientID})
+	require.ErrorIs(t, err, ErrInvalidBlacklistEntry)
+	_, _, err = b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0.300"})
+	require.ErrorIs(t, err, ErrInvalidBlacklistEntry)
+
+	e, changed, err := b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.1.2.3/8", Created: 10})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, "10.0.0.0/8", e.Value)
+
+	e, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "::ffff:192.0.2.1", Created: 10})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, "192.0.2.1", e.Value)
+
+	// unchanged
+	_, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0.0/8", Created: 11})
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// stale
+	e, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0.0/8", Reason: "old", Created: 9})
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Equal(t, "", e.Reason)
+
+	// updated
+	_, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0.0/8", Reason: "abuse", Created: 12})
+	require.NoError(t, err)
+	require.True(t, changed)
+	e, ok := b.Get(BlacklistIP, "10.0.0.0/8")
+	require.True(t, ok)
+	require.Equal(t, "abuse", e.Reason)
+	require.Equal(t, 2, b.Len())
+}
+
+func TestBlacklistDelete(t *testing.T) {
+	b := NewBlacklist()
+	_, _, err := b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0.0/8", Created: 10})
+	require.NoError(t, err)
+
+	_, ok := b.Delete(BlacklistIP, "10.0.0.0/16", 11)
+	require.False(t, ok)
+	_, ok = b.Delete("serial", "x", 11)
+	require.False(t, ok)
+
+	// an entry created after the deletion is kept
+	_, ok = b.Delete(BlacklistIP, "10.0.0.0/8", 9)
+	require.False(t, ok)
+	require.Equal(t, 1, b.Len())
+
+	e, ok := b.Delete(BlacklistIP, "10.2.3.4/8", 11)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.0/8", e.Value)
+	require.Equal(t, 0, b.Len())
+	require.Empty(t, b.networks)
+
+	ts, ok := b.Tombstone(BlacklistIP, "10.0.0.0/8")
+	require.True(t, ok)
+	require.Equal(t, int64(11), ts.Created)
+}
+
+func TestBlacklistTombstone(t *testing.T) {
+	b := NewBlacklist()
+
+	// a deletion which arrives before the entry it deleted
+	_, ok := b.Delete(BlacklistClientID, "c1", 10)
+	require.False(t, ok)
+	_, changed, err := b.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1", Created: 9})
+	require.NoError(t, err)
+	require.False(t, changed)
+	_, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1", Created: 10})
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Equal(t, 0, b.Len())
+
+	// an older deletion does not replace a newer tombstone
+	_, ok = b.Delete(BlacklistClientID, "c1", 8)
+	require.False(t, ok)
+	ts, ok := b.Tombstone(BlacklistClientID, "c1")
+	require.True(t, ok)
+	require.Equal(t, int64(10), ts.Created)
+
+	// a newer entry replaces the tombstone
+	_, changed, err = b.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1", Created: 11})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Empty(t, b.Tombstones())
+
+	_, ok = b.Tombstone("serial", "x")
+	require.False(t, ok)
+}
+
+func TestBlacklistClearExpiredTombstones(t *testing.T) {
+	b := NewBlacklist()
+	_, _, err := b.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1", Created: 0, Expiry: 2 * blacklistTombstoneTTL})
+	require.NoError(t, err)
+	_, ok := b.Delete(BlacklistClientID, "c1", 10)
+	require.True(t, ok)
+	_, ok = b.Delete(BlacklistUsername, "u1", 20)
+	require.False(t, ok)
+	require.Len(t, b.Tombstones(), 2)
+
+	// tombstones are kept for the longest ttl of the entries
+	require.Empty(t, b.ClearExpired(10+blacklistTombstoneTTL))
+	require.Len(t, b.Tombstones(), 2)
+
+	b.ClearExpired(10 + 2*blacklistTombstoneTTL)
+	v := b.Tombstones()
+	require.Len(t, v, 1)
+	require.Equal(t, "u1", v[0].Value)
+
+	b.ClearExpired(20 + 2*blacklistTombstoneTTL)
+	require.Empty(t, b.Tombstones())
+}
+
+func TestBlacklistGetAll(t *testing.T) {
+	b := NewBlacklist()
+	for _, e := range []storage.BlacklistEntry{
+		{Kind: BlacklistUsername, Value: "u1"},
+		{Kind: BlacklistIP, Value: "10.0.0.1"},
+		{Kind: BlacklistClientID, Value: "c1"},
+	} {
+		_, _, err := b.Add(e)
+		require.NoError(t, err)
+	}
+
+	v := b.GetAll()
+	require.Len(t, v, 3)
+	require.Equal(t, "c1", v[0].Value)
+	require.Equal(t, "10.0.0.1", v[1].Value)
+	require.Equal(t, "u1", v[2].Value)
+}
+
+func TestBlacklistMatch(t *testing.T) {
+	b := NewBlacklist()
+	cl := &Client{ID: "c1", Net: ClientConnection{Remote: "10.1.2.3:51000"}}
+	cl.Properties.Username = []byte("u1")
+
+	_, ok := b.Match(cl, 100)
+	require.False(t, ok)
+
+	_, _, err := b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.1.0.0/16", Expiry: 100})
+	require.NoError(t, err)
+	e, ok := b.Match(cl, 99)
+	require.True(t, ok)
+	require.Equal(t, BlacklistIP, e.Kind)
+	_, ok = b.Match(cl, 100) // expired
+	require.False(t, ok)
+
+	_, _, err = b.Add(storage.BlacklistEntry{Kind: BlacklistUsername, Value: "u1"})
+	require.NoError(t, err)
+	e, ok = b.Match(cl, 100)
+	require.True(t, ok)
+	require.Equal(t, BlacklistUsername, e.Kind)
+
+	_, _, err = b.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1"})
+	require.NoError(t, err)
+	e, ok = b.Match(cl, 100)
+	require.True(t, ok)
+	require.Equal(t, BlacklistClientID, e.Kind)
+
+	_, ok = b.Match(&Client{ID: "c2", Net: ClientConnection{Remote: "pipe"}}, 100)
+	require.False(t, ok)
+}
+
+func TestBlacklistMatchIPv6(t *testing.T) {
+	b := NewBlacklist()
+	_, _, err := b.Add(storage.BlacklistEntry{Kind: BlacklistIP, Value: "2001:db8::/32"})
+	require.NoError(t, err)
+
+	_, ok := b.Match(&Client{ID: "c1", Net: ClientConnection{Remote: "[2001:db8::1]:1883"}}, 0)
+	require.True(t, ok)
+	_, ok = b.Match(&Client{ID: "c1", Net: ClientConnection{Remote: "[2001:db9::1]:1883"}}, 0)
+	require.False(t, ok)
+}
+
+func TestBlacklistClearExpired(t *testing.T) {
+	b := NewBlacklist()
+	for _, e := range []storage.BlacklistEntry{
+		{Kind: BlacklistIP, Value: "10.0.0.1", Expiry: 10},
+		{Kind: BlacklistClientID, Value: "c1", Expiry: 20},
+		{Kind: BlacklistClientID, Value: "c2"},
+	} {
+		_, _, err := b.Add(e)
+		require.NoError(t, err)
+	}
+
+	expired := b.ClearExpired(10)
+	require.Len(t, expired, 1)
+	require.Equal(t, "10.0.0.1", expired[0].Value)
+	require.Equal(t, 2, b.Len())
+	require.Empty(t, b.networks)
+}
+
+func TestMatchBlacklistEntry(t *testing.T) {
+	cl := &Client{ID: "c1", Net: ClientConnection{Remote: "10.1.2.3:51000"}}
+	cl.Properties.Username = []byte("u1")
+
+	require.True(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "c1"}, cl))
+	require.True(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: BlacklistUsername, Value: "u1"}, cl))
+	require.True(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.1.2.3"}, cl))
+	require.False(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.2.0.0/16"}, cl))
+	require.False(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: BlacklistIP, Value: "bad"}, cl))
+	require.False(t, matchBlacklistEntry(storage.BlacklistEntry{Kind: "serial", Value: "c1"}, cl))
+}
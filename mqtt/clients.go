@@ -8,6 +8,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -102,6 +104,19 @@ func (cl *Clients) GetByListener(id string) []*Client {
 	return clients
 }
 
+// GetByTenant returns the clients of a tenant, including those with an offline session.
+func (cl *Clients) GetByTenant(tenant string) []*Client {
+	cl.RLock()
+	defer cl.RUnlock()
+	clients := make([]*Client, 0)
+	for _, client := range cl.internal {
+		if client.Properties.Tenant == tenant {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
 // Client contains information about a client known by the broker.
 type Client struct {
 	Properties   ClientProperties       // client properties
@@ -116,11 +131,13 @@ type Client struct {
 
 // ClientConnection contains the connection transport and metadata for the client.
 type ClientConnection struct {
-	Conn     net.Conn          // the net.Conn used to establish the connection
-	bconn    *bufio.ReadWriter // a buffered net.Conn for reading packets
-	Remote   string            // the remote address of the client
-	Listener string            // listener id of the client
-	Inline   bool              // if true, the client is the built-in 'inline' embedded client
+	Conn             net.Conn            // the net.Conn used to establish the connection
+	bconn            *bufio.ReadWriter   // a buffered net.Conn for reading packets
+	Remote           string              // the remote address of the client
+	Listener         string              // listener id of the client
+	Inline           bool                // if true, the client is the built-in 'inline' embedded client
+	PeerCertificates []*x509.Certificate // the verified certificate chain of a tls client, leaf first
+	ProxyTLVs        map[byte][]byte     // the tlv fields of the PROXY protocol v2 header sent by a load balancer, keyed on type
 }
 
 // ClientProperties contains the properties which define the client behaviour.
@@ -130,6 +147,7 @@ type ClientProperties struct {
 	Username        []byte
 	ProtocolVersion byte
 	Clean           bool
+	Tenant          string // the tenant whose topic namespace the client uses, if any
 }
 
 // Will contains the last will and testament details for a client connection.
@@ -145,20 +163,31 @@ type Will struct {
 
 // ClientState tracks the state of the client.
 type ClientState struct {
-	TopicAliases    TopicAliases         // a map of topic aliases
-	stopCause       atomic.Value         // reason for stopping
-	Inflight        *Inflight            // a map of in-flight qos messages
-	Subscriptions   *Subscriptions       // a map of the subscription filters a client maintains
-	disconnected    int64                // the time the client disconnected in unix time, for calculating expiry
-	outbound        chan *packets.Packet // queue for pending outbound packets
-	endOnce         sync.Once            // only end once
-	isTakenOver     uint32               // used to identify orphaned clients
-	packetID        uint32               // the current highest packetID
-	open            context.Context      // indicate that the client is open for packet exchange
-	cancelOpen      context.CancelFunc   // cancel function for open context
-	outboundQty     int32                // number of messages currently in the outbound queue
-	Keepalive       uint16               // the number of seconds the connection can wait
-	ServerKeepalive bool                 // keepalive was set by the server
+	TopicAliases     TopicAliases         // a map of topic aliases
+	stopCause        atomic.Value         // reason for stopping
+	Inflight         *Inflight            // a map of in-flight qos messages
+	Offline          *OfflineQueue        // qos messages queued while a persistent session is disconnected
+	Subscriptions    *Subscriptions       // a map of the subscription filters a client maintains
+	disconnected     int64                // the time the client disconnected in unix time, for calculating expiry
+	outbound         chan *packets.Packet // queue for pending outbound packets
+	endOnce          sync.Once            // only end once
+	isTakenOver      uint32               // used to identify orphaned clients
+	reauthenticating uint32               // a v5 re-authentication exchange is in progress
+	packetID         uint32               // the current highest packetID
+	open             context.Context      // indicate that the client is open for packet exchange
+	cancelOpen       context.CancelFunc   // cancel function for open context
+	outboundQty      int32                // number of messages currently in the outbound queue
+	Keepalive        uint16               // the number of seconds the connection can wait
+	ServerKeepalive  bool                 // keepalive was set by the server
+	Stats            ClientStats          // traffic counters for the client
+}
+
+// ClientStats contains atomic traffic counters for a single client.
+type ClientStats struct {
+	BytesReceived    int64 // total number of bytes received from the client
+	BytesSent        int64 // total number of bytes sent to the client
+	MessagesReceived int64 // total number of publish messages received from the client
+	MessagesSent     int64 // total number of publish messages sent to the client
 }
 
 // newClient returns a new instance of Client. This is almost exclusively used by Server
@@ -168,6 +197,7 @@ func newClient(c net.Conn, o *ops) *Client {
 	cl := &Client{
 		State: ClientState{
 			Inflight:      NewInflights(),
+			Offline:       NewOfflineQueue(),
 			Subscriptions: NewSubscriptions(),
 			TopicAliases:  NewTopicAliases(o.options.Capabilities.TopicAliasMaximum),
 			open:          ctx,
@@ -196,6 +226,55 @@ func newClient(c net.Conn, o *ops) *Client {
 	return cl
 }
 
+// tlsConn is implemented by connections established over tls, such as *tls.Conn.
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// peerCertificates returns the verified certificate chain of a tls connection, or nil if
+// the client did not present a certificate which was verified by the listener.
+func peerCertificates(c net.Conn) []*x509.Certificate {
+	tc, ok := c.(tlsConn)
+	if !ok {
+		return nil
+	}
+
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0]
+}
+
+// proxyConn is implemented by connections established through a PROXY protocol header.
+type proxyConn interface {
+	ProxyTLVs() map[byte][]byte
+}
+
+// wrappedConn is implemented by connections which wrap another connection, such as *tls.Conn.
+type wrappedConn interface {
+	NetConn() net.Conn
+}
+
+// proxyTLVs returns the tlv fields of the PROXY protocol v2 header of a connection, such as
+// the tls sni under listeners.ProxyTLVAuthority, or nil if there were none.
+func proxyTLVs(c net.Conn) map[byte][]byte {
+	for c != nil {
+		if pc, ok := c.(proxyConn); ok {
+			return pc.ProxyTLVs()
+		}
+
+		wc, ok := c.(wrappedConn)
+		if !ok {
+			return nil
+		}
+		c = wc.NetConn()
+	}
+
+	return nil
+}
+
 // WriteLoop ranges over pending outbound messages and writes them to the client connection.
 func (cl *Client) WriteLoop() {
 	for {
@@ -206,6 +285,9 @@ func (cl *Client) WriteLoop() {
 				cl.ops.log.Debug("failed publishing packet", "error", err, "client", cl.ID, "packet", pk)
 			}
 			atomic.AddInt32(&cl.State.outboundQty, -1)
+			if cl.ops.drain != nil && cl.State.Offline.Len() > 0 {
+				cl.ops.drain(cl) // there is room for the next queued messages
+			}
 		case <-cl.State.open.Done():
 			return
 		}
@@ -215,6 +297,8 @@ func (cl *Client) WriteLoop() {
 // ParseConnect parses the connect parameters and properties for a client.
 func (cl *Client) ParseConnect(lid string, pk packets.Packet) {
 	cl.Net.Listener = lid
+	cl.Net.PeerCertificates = peerCertificates(cl.Net.Conn)
+	cl.Net.ProxyTLVs = proxyTLVs(cl.Net.Conn)
 
 	cl.Properties.ProtocolVersion = pk.ProtocolVersion
 	cl.Properties.Username = pk.Connect.Username
@@ -399,6 +483,14 @@ func (cl *Client) Closed() bool {
 	return cl.State.open == nil || cl.State.open.Err() != nil
 }
 
+// persistent returns true if the session of the client is kept after it disconnects.
+func (cl *Client) persistent() bool {
+	if cl.Properties.ProtocolVersion == 5 {
+		return cl.Properties.Props.SessionExpiryInterval > 0
+	}
+	return !cl.Properties.Clean
+}
+
 // ReadFixedHeader reads in the values of the next packet's fixed header.
 func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	if cl.Net.bconn == nil {
@@ -426,6 +518,7 @@ func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	}
 
 	atomic.AddInt64(&cl.ops.info.BytesReceived, int64(bu+1))
+	atomic.AddInt64(&cl.State.Stats.BytesReceived, int64(bu+1))
 	return nil
 }
 
@@ -442,6 +535,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	}
 
 	atomic.AddInt64(&cl.ops.info.BytesReceived, int64(n))
+	atomic.AddInt64(&cl.State.Stats.BytesReceived, int64(n))
 
 	// Decode the remaining packet values using a fresh copy of the bytes,
 	// otherwise the next packet will change the data of this one.
@@ -457,6 +551,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 		err = pk.PublishDecode(px)
 		if err == nil {
 			atomic.AddInt64(&cl.ops.info.MessagesReceived, 1)
+			atomic.AddInt64(&cl.State.Stats.MessagesReceived, 1)
 		}
 	case packets.Puback:
 		err = pk.PubackDecode(px)
@@ -574,9 +669,11 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 	}
 
 	atomic.AddInt64(&cl.ops.info.BytesSent, n)
+	atomic.AddInt64(&cl.State.Stats.BytesSent, n)
 	atomic.AddInt64(&cl.ops.info.PacketsSent, 1)
 	if pk.FixedHeader.Type == packets.Publish {
 		atomic.AddInt64(&cl.ops.info.MessagesSent, 1)
+		atomic.AddInt64(&cl.State.Stats.MessagesSent, 1)
 	}
 
 	cl.ops.hooks.OnPacketSent(cl, pk, buf.Bytes())
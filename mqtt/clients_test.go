@@ -6,6 +6,9 @@ package mqtt
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"io"
 	"net"
@@ -13,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 
@@ -126,6 +130,18 @@ func TestClientsGetByListener(t *testing.T) {
 	require.Equal(t, "tcp1", clients[0].Net.Listener)
 }
 
+func TestClientsGetByTenant(t *testing.T) {
+	cl := NewClients()
+	cl.Add(&Client{ID: "t1", Properties: ClientProperties{Tenant: "acme"}})
+	cl.Add(&Client{ID: "t2", Properties: ClientProperties{Tenant: "other"}})
+	cl.Add(&Client{ID: "t3"})
+
+	clients := cl.GetByTenant("acme")
+	require.Equal(t, 1, len(clients))
+	require.Equal(t, "t1", clients[0].ID)
+	require.Empty(t, cl.GetByTenant("none"))
+}
+
 func TestNewClient(t *testing.T) {
 	cl, _, _ := newTestClient()
 
@@ -350,6 +366,7 @@ func TestClientReadFixedHeader(t *testing.T) {
 	err := cl.ReadFixedHeader(fh)
 	require.NoError(t, err)
 	require.Equal(t, int64(2), atomic.LoadInt64(&cl.ops.info.BytesReceived))
+	require.Equal(t, int64(2), atomic.LoadInt64(&cl.State.Stats.BytesReceived))
 }
 
 func TestClientReadFixedHeaderDecodeError(t *testing.T) {
@@ -462,6 +479,7 @@ func TestClientReadOK(t *testing.T) {
 	}, pks)
 
 	require.Equal(t, int64(2), atomic.LoadInt64(&cl.ops.info.MessagesReceived))
+	require.Equal(t, int64(2), atomic.LoadInt64(&cl.State.Stats.MessagesReceived))
 }
 
 func TestClientReadDone(t *testing.T) {
@@ -640,9 +658,11 @@ func TestClientWritePacket(t *testing.T) {
 				errors.Is(err, io.ErrClosedPipe))
 
 		require.Equal(t, int64(len(tt.RawBytes)), atomic.LoadInt64(&cl.ops.info.BytesSent))
+		require.Equal(t, int64(len(tt.RawBytes)), atomic.LoadInt64(&cl.State.Stats.BytesSent))
 		require.Equal(t, int64(1), atomic.LoadInt64(&cl.ops.info.PacketsSent))
 		if tt.Packet.FixedHeader.Type == packets.Publish {
 			require.Equal(t, int64(1), atomic.LoadInt64(&cl.ops.info.MessagesSent))
+			require.Equal(t, int64(1), atomic.LoadInt64(&cl.State.Stats.MessagesSent))
 		}
 	}
 }
@@ -744,3 +764,69 @@ var (
 		packets.TPacketData[packets.Auth].Get(packets.TAuth),
 	}
 )
+
+// tlsTestConn is a net.Conn with a fixed tls connection state.
+type tlsTestConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *tlsTestConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func TestClientParseConnectPeerCertificates(t *testing.T) {
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}}
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}
+
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = &tlsTestConn{
+		Conn: cl.Net.Conn,
+		state: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, ca}},
+		},
+	}
+	cl.ParseConnect("tls", packets.Packet{ProtocolVersion: 4})
+	require.Equal(t, []*x509.Certificate{leaf, ca}, cl.Net.PeerCertificates)
+
+	// certificates which were not verified are not exposed
+	cl.Net.Conn = &tlsTestConn{
+		Conn:  cl.Net.Conn,
+		state: tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}},
+	}
+	cl.ParseConnect("tls", packets.Packet{ProtocolVersion: 4})
+	require.Nil(t, cl.Net.PeerCertificates)
+
+	cl, _, _ = newTestClient()
+	cl.ParseConnect("tcp", packets.Packet{ProtocolVersion: 4})
+	require.Nil(t, cl.Net.PeerCertificates)
+}
+
+// proxyTestConn is a net.Conn with fixed PROXY protocol tlv fields.
+type proxyTestConn struct {
+	net.Conn
+	tlvs map[byte][]byte
+}
+
+func (c *proxyTestConn) ProxyTLVs() map[byte][]byte {
+	return c.tlvs
+}
+
+func TestClientParseConnectProxyTLVs(t *testing.T) {
+	tlvs := map[byte][]byte{listeners.ProxyTLVAuthority: []byte("broker.example.com")}
+
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = &proxyTestConn{Conn: cl.Net.Conn, tlvs: tlvs}
+	cl.ParseConnect("tcp", packets.Packet{ProtocolVersion: 4})
+	require.Equal(t, tlvs, cl.Net.ProxyTLVs)
+
+	// tls started after the PROXY protocol header
+	cl.Net.Conn = tls.Server(&proxyTestConn{Conn: cl.Net.Conn, tlvs: tlvs}, &tls.Config{})
+	cl.ParseConnect("tls", packets.Packet{ProtocolVersion: 4})
+	require.Equal(t, tlvs, cl.Net.ProxyTLVs)
+
+	cl, _, _ = newTestClient()
+	cl.ParseConnect("tcp", packets.Packet{ProtocolVersion: 4})
+	require.Nil(t, cl.Net.ProxyTLVs)
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// DelayedPrefix is the topic prefix of delayed publishes, such as $delayed/60/a/b/c
+// which is published to a/b/c after 60 seconds.
+const DelayedPrefix = "$delayed"
+
+// DelayedMessage is a message held by the server until it is due to be published.
+type DelayedMessage struct {
+	ID     string         // the unique id of the delayed message
+	Packet packets.Packet // the message, with the topic it will be published to
+	Due    int64          // the unix time the message is due to be published
+}
+
+// DelayedMessages is a map of the delayed messages held by the server, keyed on id.
+type DelayedMessages struct {
+	sync.RWMutex
+	internal map[string]DelayedMessage
+}
+
+// NewDelayedMessages returns a new instance of DelayedMessages.
+func NewDelayedMessages() *DelayedMessages {
+	return &DelayedMessages{
+		internal: map[string]DelayedMessage{},
+	}
+}
+
+// Add adds a delayed message, replacing any message with the same id.
+func (d *DelayedMessages) Add(m DelayedMessage) {
+	d.Lock()
+	defer d.Unlock()
+	d.internal[m.ID] = m
+}
+
+// Get returns a delayed message by id.
+func (d *DelayedMessages) Get(id string) (DelayedMessage, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	m, ok := d.internal[id]
+	return m, ok
+}
+
+// GetAll returns all delayed messages, the earliest due first.
+func (d *DelayedMessages) GetAll() []DelayedMessage {
+	d.RLock()
+	v := make([]DelayedMessage, 0, len(d.internal))
+	for _, m := range d.internal {
+		v = append(v, m)
+	}
+	d.RUnlock()
+
+	sortDelayed(v)
+	return v
+}
+
+// Len returns the number of delayed messages.
+func (d *DelayedMessages) Len() int {
+	d.RLock()
+	defer d.RUnlock()
+	return len(d.internal)
+}
+
+// Delete removes a delayed message by id, returning false if it did not exist.
+func (d *DelayedMessages) Delete(id string) (DelayedMessage, bool) {
+	d.Lock()
+	defer d.Unlock()
+	m, ok := d.internal[id]
+	delete(d.internal, id)
+	return m, ok
+}
+
+// Due removes and returns the messages which are due at the given unix time, the earliest due first.
+func (d *DelayedMessages) Due(now int64) []DelayedMessage {
+	d.Lock()
+	var v []DelayedMessage
+	for id, m := range d.internal {
+		if m.Due <= now {
+			v = append(v, m)
+			delete(d.internal, id)
+		}
+	}
+	d.Unlock()
+
+	sortDelayed(v)
+	return v
+}
+
+// sortDelayed sorts delayed messages by due time, and then by creation and id so that
+// messages due at the same time keep the order they were published in.
+func sortDelayed(v []DelayedMessage) {
+	sort.Slice(v, func(i, j int) bool {
+		if v[i].Due != v[j].Due {
+			return v[i].Due < v[j].Due
+		}
+		if v[i].Packet.Created != v[j].Packet.Created {
+			return v[i].Packet.Created < v[j].Packet.Created
+		}
+		return v[i].ID < v[j].ID
+	})
+}
+
+// IsDelayedTopic returns true if a topic name is a delayed publish topic.
+func IsDelayedTopic(topic string) bool {
+	return strings.HasPrefix(topic, DelayedPrefix+"/")
+}
+
+// ParseDelayedTopic splits a delayed publish topic, such as $delayed/60/a/b/c, into the
+// delay in seconds and the topic the message will be published to. It returns false if
+// the topic is not a valid delayed publish topic. The only $ topics which can be delayed
+// are those in the namespace of a tenant.
+func ParseDelayedTopic(topic string) (int64, string, bool) {
+	if !IsDelayedTopic(topic) {
+		return 0, "", false
+	}
+
+	seconds, name, ok := strings.Cut(topic[len(DelayedPrefix)+1:], "/")
+	if !ok || name == "" || !IsValidFilter(name, true) {
+		return 0, "", false
+	}
+
+	if strings.HasPrefix(name, "$") && !strings.HasPrefix(name, TenantPrefix+"/") {
+		return 0, "", false
+	}
+
+	delay, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return int64(delay), name, true
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestNewDelayedMessages(t *testing.T) {
+	d := NewDelayedMessages()
+	require.NotNil(t, d.internal)
+	require.Equal(t, 0, d.Len())
+}
+
+func TestDelayedMessagesAddGetDelete(t *testing.T) {
+	d := NewDelayedMessages()
+	d.Add(DelayedMessage{ID: "d1", Packet: packets.Packet{TopicName: "a/b/c"}, Due: 100})
+	require.Equal(t, 1, d.Len())
+
+	m, ok := d.Get("d1")
+	require.True(t, ok)
+	require.Equal(t, "a/b/c", m.Packet.TopicName)
+
+	_, ok = d.Get("d2")
+	require.False(t, ok)
+
+	m, ok = d.Delete("d1")
+	require.True(t, ok)
+	require.Equal(t, "d1", m.ID)
+	require.Equal(t, 0, d.Len())
+
+	_, ok = d.Delete("d1")
+	require.False(t, ok)
+}
+
+func TestDelayedMessagesGetAll(t *testing.T) {
+	d := NewDelayedMessages()
+	d.Add(DelayedMessage{ID: "d3", Due: 300})
+	d.Add(DelayedMessage{ID: "d2", Due: 100, Packet: packets.Packet{Created: 20}})
+	d.Add(DelayedMessage{ID: "d1", Due: 100, Packet: packets.Packet{Created: 10}})
+	d.Add(DelayedMessage{ID: "d0", Due: 100, Packet: packets.Packet{Created: 20}})
+
+	ids := []string{}
+	for _, m := range d.GetAll() {
+		ids = append(ids, m.ID)
+	}
+	require.Equal(t, []string{"d1", "d0", "d2", "d3"}, ids)
+}
+
+func TestDelayedMessagesDue(t *testing.T) {
+	d := NewDelayedMessages()
+	d.Add(DelayedMessage{ID: "d1", Due: 200})
+	d.Add(DelayedMessage{ID: "d2", Due: 100})
+	d.Add(DelayedMessage{ID: "d3", Due: 300})
+
+	require.Empty(t, d.Due(99))
+
+	v := d.Due(200)
+	require.Len(t, v, 2)
+	require.Equal(t, "d2", v[0].ID)
+	require.Equal(t, "d1", v[1].ID)
+	require.Equal(t, 1, d.Len())
+
+	_, ok := d.Get("d3")
+	require.True(t, ok)
+}
+
+func TestIsDelayedTopic(t *testing.T) {
+	require.True(t, IsDelayedTopic("$delayed/60/a/b/c"))
+	require.False(t, IsDelayedTopic("$delayed"))
+	require.False(t, IsDelayedTopic("$delayedx/60/a"))
+	require.False(t, IsDelayedTopic("a/$delayed/60/b"))
+}
+
+func TestParseDelayedTopic(t *testing.T) {
+	tt := []struct {
+		topic string
+		delay int64
+		name  string
+		ok    bool
+	}{
+		{topic: "$delayed/60/a/b/c", delay: 60, name: "a/b/c", ok: true},
+		{topic: "$delayed/0/a", delay: 0, name: "a", ok: true},
+		{topic: "$delayed/4294967295/a", delay: 4294967295, name: "a", ok: true},
+		{topic: "$delayed/4294967296/a"},
+		{topic: "$delayed/-1/a"},
+		{topic: "$delayed/x/a"},
+		{topic: "$delayed//a"},
+		{topic: "$delayed/60"},
+		{topic: "$delayed/60/"},
+		{topic: "$delayed/60/a/+/c"},
+		{topic: "$delayed/60/$SYS/a"},
+		{topic: "$delayed/60/$delayed/1/a"},
+		{topic: "$delayed/60/$tenant/acme/a", delay: 60, name: "$tenant/acme/a", ok: true},
+		{topic: "a/b/c"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.topic, func(t *testing.T) {
+			delay, name, ok := ParseDelayedTopic(tx.topic)
+			require.Equal(t, tx.ok, ok)
+			require.Equal(t, tx.delay, delay)
+			require.Equal(t, tx.name, name)
+		})
+	}
+}
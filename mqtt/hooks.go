@@ -8,8 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
@@ -51,6 +53,13 @@ const (
 	OnClientExpired
 	OnRetainedExpired
 	OnPublishedWithSharedFilters
+	OnBlacklistAdded
+	OnBlacklistDeleted
+	OnOfflineQueued
+	OnOfflineDequeued
+	OnDelayedAdded
+	OnDelayedDeleted
+	OnSelectSharedNodes
 	StoredClients
 	StoredSubscriptions
 	StoredInflightMessages
@@ -60,11 +69,18 @@ const (
 	StoredSubscriptionsByCid
 	StoredInflightMessagesByCid
 	StoredRetainedMessageByTopic
+	StoredBlacklist
+	StoredOfflineMessages
+	StoredRetainedMessagesByFilter
+	StoredDelayedMessages
 )
 
 var (
 	// ErrInvalidConfigType indicates a different Type of config value was expected to what was received.
 	ErrInvalidConfigType = errors.New("invalid config type provided")
+
+	// ErrHookNotFound indicates no hook with the id of a replacement hook has been added.
+	ErrHookNotFound = errors.New("hook not found")
 )
 
 // Hook provides an interface of handlers for different events which occur
@@ -84,7 +100,7 @@ type Hook interface {
 	OnSessionEstablish(cl *Client, pk packets.Packet)
 	OnSessionEstablished(cl *Client, pk packets.Packet)
 	OnDisconnect(cl *Client, err error, expire bool)
-	OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error)
+	OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error) // a step of a v5 enhanced authentication exchange, returns the auth packet to respond with
 	OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) // triggers when a new packet is received by a client, but before packet validation
 	OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet        // modify a packet before it is byte-encoded and written to the client
 	OnPacketSent(cl *Client, pk packets.Packet, b []byte)               // triggers when packet bytes have been written to the client
@@ -108,6 +124,13 @@ type Hook interface {
 	OnClientExpired(cl *Client)
 	OnRetainedExpired(filter string)
 	OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters map[string]bool)
+	OnBlacklistAdded(e storage.BlacklistEntry)      // triggers when an entry is added to or updated in the blacklist
+	OnBlacklistDeleted(e storage.BlacklistEntry)    // triggers when an entry is deleted from the blacklist, or has expired
+	OnOfflineQueued(cl *Client, m OfflineMessage)   // triggers when a message is queued for a disconnected persistent session
+	OnOfflineDequeued(cl *Client, m OfflineMessage) // triggers when a queued message is sent, dropped, expired or cleared
+	OnDelayedAdded(m DelayedMessage)                // triggers when a message is held to be published after a delay
+	OnDelayedDeleted(m DelayedMessage)              // triggers when a delayed message is published or cancelled
+	OnSelectSharedNodes(subs *Subscribers, pk packets.Packet) *Subscribers
 	StoredClients() ([]storage.Client, error)
 	StoredSubscriptions() ([]storage.Subscription, error)
 	StoredInflightMessages() ([]storage.Message, error)
@@ -117,6 +140,10 @@ type Hook interface {
 	StoredSubscriptionsByCid(cid string) ([]storage.Subscription, error)
 	StoredInflightMessagesByCid(cid string) ([]storage.Message, error)
 	StoredRetainedMessageByTopic(topic string) (storage.Message, error)
+	StoredBlacklist() ([]storage.BlacklistEntry, error)
+	StoredOfflineMessages() ([]storage.Message, error)
+	StoredRetainedMessagesByFilter(filter string) ([]storage.Message, error)
+	StoredDelayedMessages() ([]storage.Message, error)
 }
 
 // HookOptions contains values which are inherited from the server on initialisation.
@@ -130,9 +157,86 @@ type Hooks struct {
 	internal   atomic.Value   // a slice of []Hook
 	wg         sync.WaitGroup // a waitgroup for syncing hook shutdown
 	qty        int64          // the number of hooks in use
+	latency    sync.Map       // a map of HookLatencyKey to *system.Histogram
+	errs       sync.Map       // a map of hook id to the number of errors returned by the hook
 	sync.Mutex                // a mutex for locking when adding hooks
 }
 
+// HookLatencyKey identifies the latency histogram of a single hook method.
+type HookLatencyKey struct {
+	Hook   string // the id of the hook
+	Method byte   // the hook method byte, such as OnPublish
+}
+
+// hookMethodNames contains the names of the hook methods which are timed.
+var hookMethodNames = map[byte]string{
+	OnConnectAuthenticate: "OnConnectAuthenticate",
+	OnACLCheck:            "OnACLCheck",
+	OnConnect:             "OnConnect",
+	OnSessionEstablished:  "OnSessionEstablished",
+	OnDisconnect:          "OnDisconnect",
+	OnAuthPacket:          "OnAuthPacket",
+	OnSubscribe:           "OnSubscribe",
+	OnSubscribed:          "OnSubscribed",
+	OnSelectSubscribers:   "OnSelectSubscribers",
+	OnSelectSharedNodes:   "OnSelectSharedNodes",
+	OnUnsubscribe:         "OnUnsubscribe",
+	OnPublish:             "OnPublish",
+	OnPublished:           "OnPublished",
+	OnRetainMessage:       "OnRetainMessage",
+	OnQosPublish:          "OnQosPublish",
+}
+
+// HookMethodName returns the name of a timed hook method.
+func HookMethodName(b byte) string {
+	return hookMethodNames[b]
+}
+
+// observe records the time taken by a hook method since start.
+func (h *Hooks) observe(hook Hook, method byte, start time.Time) {
+	k := HookLatencyKey{Hook: hook.ID(), Method: method}
+	v, ok := h.latency.Load(k)
+	if !ok {
+		v, _ = h.latency.LoadOrStore(k, system.NewHistogram())
+	}
+	v.(*system.Histogram).Observe(time.Since(start))
+}
+
+// countError increments the error count of a hook.
+func (h *Hooks) countError(hook Hook) {
+	v, ok := h.errs.Load(hook.ID())
+	if !ok {
+		v, _ = h.errs.LoadOrStore(hook.ID(), new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// Errors returns the number of errors returned by each hook, keyed on hook id.
+func (h *Hooks) Errors() map[string]int64 {
+	m := make(map[string]int64)
+	for _, hook := range h.GetAll() {
+		m[hook.ID()] = 0
+	}
+
+	h.errs.Range(func(k, v any) bool {
+		m[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+
+	return m
+}
+
+// Latencies returns a snapshot of the latency histograms of each timed hook method.
+func (h *Hooks) Latencies() map[HookLatencyKey]system.HistogramSnapshot {
+	m := make(map[HookLatencyKey]system.HistogramSnapshot)
+	h.latency.Range(func(k, v any) bool {
+		m[k.(HookLatencyKey)] = v.(*system.Histogram).Snapshot()
+		return true
+	})
+
+	return m
+}
+
 // Len returns the number of hooks added.
 func (h *Hooks) Len() int64 {
 	return atomic.LoadInt64(&h.qty)
@@ -174,6 +278,53 @@ func (h *Hooks) Add(hook Hook, config any) error {
 	return nil
 }
 
+// ACLRestrictor is implemented by hooks whose OnACLCheck restricts the topics of every
+// client, such as the namespaces of tenants, instead of granting access to them. A topic
+// refused by a restricting hook is refused even if another hook allows it, while a topic
+// it allows must still be allowed by another hook.
+type ACLRestrictor interface {
+	RestrictsACL() bool
+}
+
+// HookInheritor is implemented by hooks which keep per-client state, such as sessions, so
+// that a replacement hook can take over the state of the hook it replaces.
+type HookInheritor interface {
+	Inherit(old Hook)
+}
+
+// Replace initializes a hook and atomically swaps it for the added hook with the same id,
+// which is then stopped. If the new hook fails to initialize, the existing hook is kept.
+func (h *Hooks) Replace(hook Hook, config any) error {
+	h.Lock()
+	defer h.Unlock()
+
+	i, _ := h.internal.Load().([]Hook)
+	n := slices.IndexFunc(i, func(v Hook) bool { return v.ID() == hook.ID() })
+	if n < 0 {
+		return fmt.Errorf("%w: %s", ErrHookNotFound, hook.ID())
+	}
+
+	err := hook.Init(config)
+	if err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", hook.ID(), err)
+	}
+
+	old := i[n]
+	i = slices.Clone(i)
+	i[n] = hook
+	h.internal.Store(i)
+
+	if r, ok := hook.(HookInheritor); ok {
+		r.Inherit(old)
+	}
+
+	if err := old.Stop(); err != nil {
+		h.Log.Debug("problem stopping hook", "error", err, "hook", old.ID())
+	}
+
+	return nil
+}
+
 // GetAll returns a slice of all the hooks.
 func (h *Hooks) GetAll() []Hook {
 	i, ok := h.internal.Load().([]Hook)
@@ -231,7 +382,9 @@ func (h *Hooks) OnStopped() {
 func (h *Hooks) OnConnect(cl *Client, pk packets.Packet) error {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnConnect) {
+			start := time.Now()
 			err := hook.OnConnect(cl, pk)
+			h.observe(hook, OnConnect, start)
 			if err != nil {
 				return err
 			}
@@ -254,7 +407,9 @@ func (h *Hooks) OnSessionEstablish(cl *Client, pk packets.Packet) {
 func (h *Hooks) OnSessionEstablished(cl *Client, pk packets.Packet) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnSessionEstablished) {
+			start := time.Now()
 			hook.OnSessionEstablished(cl, pk)
+			h.observe(hook, OnSessionEstablished, start)
 		}
 	}
 }
@@ -263,7 +418,9 @@ func (h *Hooks) OnSessionEstablished(cl *Client, pk packets.Packet) {
 func (h *Hooks) OnDisconnect(cl *Client, err error, expire bool) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnDisconnect) {
+			start := time.Now()
 			hook.OnDisconnect(cl, err, expire)
+			h.observe(hook, OnDisconnect, start)
 		}
 	}
 }
@@ -278,6 +435,7 @@ func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet,
 				h.Log.Debug("packet rejected", "hook", hook.ID(), "packet", pkx)
 				return pk, err
 			} else if err != nil {
+				h.countError(hook)
 				continue
 			}
 
@@ -288,13 +446,20 @@ func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet,
 	return
 }
 
-// OnAuthPacket is called when an auth packet is received. It is intended to allow developers
-// to create their own auth packet handling mechanisms.
+// OnAuthPacket is called with each step of a v5 enhanced authentication exchange. The packet
+// is the connect packet which began the exchange, or an auth packet with a continue or
+// re-authenticate reason code. A hook which supports the authentication method returns an
+// auth packet with a continue reason code and the challenge in the authentication data, or
+// a success reason code once the client is authenticated. Hooks which do not support the
+// method should return the packet unchanged. Returning an error fails the exchange. If no
+// hook provides OnAuthPacket, connect packets are authenticated with OnConnectAuthenticate.
 func (h *Hooks) OnAuthPacket(cl *Client, pk packets.Packet) (pkx packets.Packet, err error) {
 	pkx = pk
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnAuthPacket) {
+			start := time.Now()
 			npk, err := hook.OnAuthPacket(cl, pkx)
+			h.observe(hook, OnAuthPacket, start)
 			if err != nil {
 				return pk, err
 			}
@@ -338,12 +503,15 @@ func (h *Hooks) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
 
 // OnSubscribe is called when a client subscribes to one or more filters. This method
 // differs from OnSubscribed in that it allows you to modify the subscription values
-// before the packet is processed. The return values of the hook methods are passed-through
+// before the packet is processed. A filter may be rejected by setting its pk.ReasonCodes
+// entry to an error code. The return values of the hook methods are passed-through
 // in the order the hooks were attached.
 func (h *Hooks) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnSubscribe) {
+			start := time.Now()
 			pk = hook.OnSubscribe(cl, pk)
+			h.observe(hook, OnSubscribe, start)
 		}
 	}
 	return pk
@@ -353,7 +521,9 @@ func (h *Hooks) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
 func (h *Hooks) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte, counts []int) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnSubscribed) {
+			start := time.Now()
 			hook.OnSubscribed(cl, pk, reasonCodes, counts)
+			h.observe(hook, OnSubscribed, start)
 		}
 	}
 }
@@ -365,7 +535,24 @@ func (h *Hooks) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte,
 func (h *Hooks) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subscribers {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnSelectSubscribers) {
+			start := time.Now()
 			subs = hook.OnSelectSubscribers(subs, pk)
+			h.observe(hook, OnSelectSubscribers, start)
+		}
+	}
+	return subs
+}
+
+// OnSelectSharedNodes is called when a message published on this node matches shared
+// subscriptions, before OnSelectSubscribers. Hooks which route messages across a cluster
+// can remove the groups whose member is selected on another node, so they are not also
+// delivered locally.
+func (h *Hooks) OnSelectSharedNodes(subs *Subscribers, pk packets.Packet) *Subscribers {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnSelectSharedNodes) {
+			start := time.Now()
+			subs = hook.OnSelectSharedNodes(subs, pk)
+			h.observe(hook, OnSelectSharedNodes, start)
 		}
 	}
 	return subs
@@ -378,7 +565,9 @@ func (h *Hooks) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subsc
 func (h *Hooks) OnUnsubscribe(cl *Client, pk packets.Packet) packets.Packet {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnUnsubscribe) {
+			start := time.Now()
 			pk = hook.OnUnsubscribe(cl, pk)
+			h.observe(hook, OnUnsubscribe, start)
 		}
 	}
 	return pk
@@ -400,15 +589,18 @@ func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, er
 	pkx = pk
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnPublish) {
+			start := time.Now()
 			npk, err := hook.OnPublish(cl, pkx)
+			h.observe(hook, OnPublish, start)
 			if err != nil {
-				if errors.Is(err, packets.ErrRejectPacket) {
-					h.Log.Debug("publish packet rejected",
+				if errors.As(err, new(packets.Code)) { // a reason code, such as a rejection or an exceeded quota, is not a hook error
+					h.Log.Debug("publish packet refused",
 						"error", err,
 						"hook", hook.ID(),
 						"packet", pkx)
 					return pk, err
 				}
+				h.countError(hook)
 				h.Log.Error("publish packet error",
 					"error", err,
 					"hook", hook.ID(),
@@ -426,7 +618,9 @@ func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, er
 func (h *Hooks) OnPublished(cl *Client, pk packets.Packet) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnPublished) {
+			start := time.Now()
 			hook.OnPublished(cl, pk)
+			h.observe(hook, OnPublished, start)
 		}
 	}
 }
@@ -445,7 +639,9 @@ func (h *Hooks) OnPublishDropped(cl *Client, pk packets.Packet) {
 func (h *Hooks) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnRetainMessage) {
+			start := time.Now()
 			hook.OnRetainMessage(cl, pk, r)
+			h.observe(hook, OnRetainMessage, start)
 		}
 	}
 }
@@ -465,7 +661,9 @@ func (h *Hooks) OnRetainPublished(cl *Client, pk packets.Packet) {
 func (h *Hooks) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnQosPublish) {
+			start := time.Now()
 			hook.OnQosPublish(cl, pk, sent, resends)
+			h.observe(hook, OnQosPublish, start)
 		}
 	}
 }
@@ -511,6 +709,7 @@ func (h *Hooks) OnWill(cl *Client, will Will) Will {
 		if hook.Provides(OnWill) {
 			mlwt, err := hook.OnWill(cl, will)
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("parse will error",
 					"error", err,
 					"hook", hook.ID(),
@@ -560,6 +759,62 @@ func (h *Hooks) OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters ma
 	}
 }
 
+// OnBlacklistAdded is called when an entry has been added to or updated in the blacklist.
+func (h *Hooks) OnBlacklistAdded(e storage.BlacklistEntry) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnBlacklistAdded) {
+			hook.OnBlacklistAdded(e)
+		}
+	}
+}
+
+// OnBlacklistDeleted is called when an entry has been deleted from the blacklist, or has expired.
+func (h *Hooks) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnBlacklistDeleted) {
+			hook.OnBlacklistDeleted(e)
+		}
+	}
+}
+
+// OnOfflineQueued is called when a message has been queued for a disconnected persistent session.
+func (h *Hooks) OnOfflineQueued(cl *Client, m OfflineMessage) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnOfflineQueued) {
+			hook.OnOfflineQueued(cl, m)
+		}
+	}
+}
+
+// OnOfflineDequeued is called when a queued message has been removed from the offline
+// queue of a session, because it was sent, dropped, expired or the session was cleared.
+func (h *Hooks) OnOfflineDequeued(cl *Client, m OfflineMessage) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnOfflineDequeued) {
+			hook.OnOfflineDequeued(cl, m)
+		}
+	}
+}
+
+// OnDelayedAdded is called when a message has been held to be published after a delay.
+func (h *Hooks) OnDelayedAdded(m DelayedMessage) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedAdded) {
+			hook.OnDelayedAdded(m)
+		}
+	}
+}
+
+// OnDelayedDeleted is called when a delayed message has been removed, because it was
+// published or cancelled.
+func (h *Hooks) OnDelayedDeleted(m DelayedMessage) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDelayedDeleted) {
+			hook.OnDelayedDeleted(m)
+		}
+	}
+}
+
 // StoredClients returns all clients, e.g. from a persistent store, is used to
 // populate the server clients list before start.
 func (h *Hooks) StoredClients() (v []storage.Client, err error) {
@@ -567,6 +822,7 @@ func (h *Hooks) StoredClients() (v []storage.Client, err error) {
 		if hook.Provides(StoredClients) {
 			v, err := hook.StoredClients()
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load clients", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -587,6 +843,7 @@ func (h *Hooks) StoredSubscriptions() (v []storage.Subscription, err error) {
 		if hook.Provides(StoredSubscriptions) {
 			v, err := hook.StoredSubscriptions()
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load subscriptions", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -607,6 +864,7 @@ func (h *Hooks) StoredInflightMessages() (v []storage.Message, err error) {
 		if hook.Provides(StoredInflightMessages) {
 			v, err := hook.StoredInflightMessages()
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load inflight messages", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -627,6 +885,7 @@ func (h *Hooks) StoredRetainedMessages() (v []storage.Message, err error) {
 		if hook.Provides(StoredRetainedMessages) {
 			v, err := hook.StoredRetainedMessages()
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load retained messages", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -646,6 +905,7 @@ func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 		if hook.Provides(StoredSysInfo) {
 			v, err := hook.StoredSysInfo()
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load $SYS info", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -665,6 +925,7 @@ func (h *Hooks) StoredClientByCid(cid string) (v storage.Client, err error) {
 		if hook.Provides(StoredClientByCid) {
 			v, err := hook.StoredClientByCid(cid)
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to load clients", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -684,6 +945,7 @@ func (h *Hooks) StoredSubscriptionsByCid(cid string) (v []storage.Subscription,
 		if hook.Provides(StoredSubscriptionsByCid) {
 			v, err := hook.StoredSubscriptionsByCid(cid)
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to get subscriptions", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -703,6 +965,7 @@ func (h *Hooks) StoredInflightMessagesByCid(cid string) (v []storage.Message, er
 		if hook.Provides(StoredInflightMessagesByCid) {
 			v, err := hook.StoredInflightMessagesByCid(cid)
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to get inflight messages", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -722,6 +985,7 @@ func (h *Hooks) StoredRetainedMessageByTopic(topic string) (v storage.Message, e
 		if hook.Provides(StoredRetainedMessageByTopic) {
 			v, err := hook.StoredRetainedMessageByTopic(topic)
 			if err != nil {
+				h.countError(hook)
 				h.Log.Error("failed to get retained message", "error", err, "hook", hook.ID())
 				return v, err
 			}
@@ -735,6 +999,87 @@ func (h *Hooks) StoredRetainedMessageByTopic(topic string) (v storage.Message, e
 	return
 }
 
+// StoredBlacklist returns all blacklist entries, e.g. from a persistent store, and is
+// used to populate the server blacklist before start.
+func (h *Hooks) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredBlacklist) {
+			v, err := hook.StoredBlacklist()
+			if err != nil {
+				h.countError(hook)
+				h.Log.Error("failed to load blacklist", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
+// StoredRetainedMessagesByFilter returns the retained messages on topics matching a filter,
+// e.g. from a persistent store, and is used to look up retained messages on demand.
+func (h *Hooks) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredRetainedMessagesByFilter) {
+			v, err := hook.StoredRetainedMessagesByFilter(filter)
+			if err != nil {
+				h.countError(hook)
+				h.Log.Error("failed to get retained messages", "error", err, "hook", hook.ID(), "filter", filter)
+			}
+
+			return v, err
+		}
+	}
+
+	return
+}
+
+// StoredOfflineMessages returns all offline queued messages, e.g. from a persistent store,
+// and is used to populate the session queues before start.
+func (h *Hooks) StoredOfflineMessages() (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredOfflineMessages) {
+			v, err := hook.StoredOfflineMessages()
+			if err != nil {
+				h.countError(hook)
+				h.Log.Error("failed to load offline messages", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
+// StoredDelayedMessages returns all delayed messages, e.g. from a persistent store,
+// and is used to restore the delayed messages before start.
+func (h *Hooks) StoredDelayedMessages() (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredDelayedMessages) {
+			v, err := hook.StoredDelayedMessages()
+			if err != nil {
+				h.countError(hook)
+				h.Log.Error("failed to load delayed messages", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
 // OnConnectAuthenticate is called when a user attempts to authenticate with the server.
 // An implementation of this method MUST be used to allow or deny access to the
 // server (see hooks/auth/allow_all or basic). It can be used in custom hooks to
@@ -742,7 +1087,10 @@ func (h *Hooks) StoredRetainedMessageByTopic(topic string) (v storage.Message, e
 func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnConnectAuthenticate) {
-			if ok := hook.OnConnectAuthenticate(cl, pk); ok {
+			start := time.Now()
+			ok := hook.OnConnectAuthenticate(cl, pk)
+			h.observe(hook, OnConnectAuthenticate, start)
+			if ok {
 				return true
 			}
 		}
@@ -755,16 +1103,30 @@ func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 // An implementation of this method MUST be used to allow or deny access to the
 // (see hooks/auth/allow_all or basic). It can be used in custom hooks to
 // check publishing and subscribing users against an existing permissions or roles database.
+// A topic is allowed by the first hook which allows it, unless an ACLRestrictor refuses it.
 func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
+	allowed := false
 	for _, hook := range h.GetAll() {
 		if hook.Provides(OnACLCheck) {
-			if ok := hook.OnACLCheck(cl, topic, write); ok {
-				return true
+			r, restricts := hook.(ACLRestrictor)
+			restricts = restricts && r.RestrictsACL()
+			if allowed && !restricts {
+				continue
+			}
+
+			start := time.Now()
+			ok := hook.OnACLCheck(cl, topic, write)
+			h.observe(hook, OnACLCheck, start)
+			if restricts && !ok {
+				return false
+			}
+			if !restricts && ok {
+				allowed = true
 			}
 		}
 	}
 
-	return false
+	return allowed
 }
 
 // HookBase provides a set of default methods for each hook. It should be embedded in
@@ -838,7 +1200,7 @@ func (h *HookBase) OnSessionEstablished(cl *Client, pk packets.Packet) {}
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *HookBase) OnDisconnect(cl *Client, err error, expire bool) {}
 
-// OnAuthPacket is called when an auth packet is received from the client.
+// OnAuthPacket is called with each step of an enhanced authentication exchange.
 func (h *HookBase) OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error) {
 	return pk, nil
 }
@@ -926,6 +1288,29 @@ func (h *HookBase) OnRetainedExpired(topic string) {}
 // OnPublishedWithSharedFilters is called when a client has published a message to cluster.
 func (h *HookBase) OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters map[string]bool) {}
 
+// OnBlacklistAdded is called when an entry has been added to or updated in the blacklist.
+func (h *HookBase) OnBlacklistAdded(e storage.BlacklistEntry) {}
+
+// OnBlacklistDeleted is called when an entry has been deleted from the blacklist, or has expired.
+func (h *HookBase) OnBlacklistDeleted(e storage.BlacklistEntry) {}
+
+// OnOfflineQueued is called when a message has been queued for a disconnected persistent session.
+func (h *HookBase) OnOfflineQueued(cl *Client, m OfflineMessage) {}
+
+// OnOfflineDequeued is called when a queued message has been removed from the offline queue of a session.
+func (h *HookBase) OnOfflineDequeued(cl *Client, m OfflineMessage) {}
+
+// OnDelayedAdded is called when a message has been held to be published after a delay.
+func (h *HookBase) OnDelayedAdded(m DelayedMessage) {}
+
+// OnDelayedDeleted is called when a delayed message has been published or cancelled.
+func (h *HookBase) OnDelayedDeleted(m DelayedMessage) {}
+
+// OnSelectSharedNodes is called when a message published on this node matches shared subscriptions.
+func (h *HookBase) OnSelectSharedNodes(subs *Subscribers, pk packets.Packet) *Subscribers {
+	return subs
+}
+
 // StoredClients returns all clients from a store.
 func (h *HookBase) StoredClients() (v []storage.Client, err error) {
 	return
@@ -970,3 +1355,23 @@ func (h *HookBase) StoredInflightMessagesByCid(cid string) (v []storage.Message,
 func (h *HookBase) StoredRetainedMessageByTopic(topic string) (v storage.Message, err error) {
 	return
 }
+
+// StoredBlacklist returns all blacklist entries from a store.
+func (h *HookBase) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	return
+}
+
+// StoredOfflineMessages returns all offline queued messages from a store.
+func (h *HookBase) StoredOfflineMessages() (v []storage.Message, err error) {
+	return
+}
+
+// StoredRetainedMessagesByFilter returns the retained messages on topics matching a filter from a store.
+func (h *HookBase) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	return
+}
+
+// StoredDelayedMessages returns all delayed messages from a store.
+func (h *HookBase) StoredDelayedMessages() (v []storage.Message, err error) {
+	return
+}
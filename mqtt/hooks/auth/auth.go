@@ -74,6 +74,22 @@ func (h *Hook) Init(config any) error {
 	return nil
 }
 
+// Update replaces the rules of the ledger with rules decoded from a JSON or YAML
+// document. If the document is malformed, the existing rules are kept.
+func (h *Hook) Update(data []byte) error {
+	ln := new(Ledger)
+	if err := ln.Unmarshal(data); err != nil {
+		return err
+	}
+
+	h.ledger.Update(ln)
+	h.Log.Info("updated auth rules",
+		"authentication", len(ln.Auth),
+		"acl", len(ln.ACL))
+
+	return nil
+}
+
 // OnConnectAuthenticate returns true if the connecting client has rules which provide access
 // in the auth ledger.
 func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
@@ -116,6 +116,24 @@ func TestBasicInitWithLedgerBadDAta(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestUpdate(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	require.Empty(t, h.ledger.Auth)
+
+	require.NoError(t, h.Update(ledgerYAML))
+	require.Equal(t, ledgerStruct.Auth[0].Username, h.ledger.Auth[0].Username)
+	require.Equal(t, ledgerStruct.ACL[0].Client, h.ledger.ACL[0].Client)
+
+	require.Error(t, h.Update([]byte("fdsfdsafasd")))
+	require.Equal(t, ledgerStruct.Auth[0].Username, h.ledger.Auth[0].Username)
+
+	require.NoError(t, h.Update([]byte(`{"auth":[]}`)))
+	require.Empty(t, h.ledger.Auth)
+	require.Empty(t, h.ledger.ACL)
+}
+
 func TestOnConnectAuthenticate(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package auth
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// ListenerHook limits the authentication and acl checks of an auth hook to the clients of
+// some listeners, so that each listener can have its own auth chain, such as anonymous
+// access on a local port and jwt on a public port. Clients of other listeners are not
+// allowed by the hook. All other hook methods are called as they are.
+type ListenerHook struct {
+	mqtt.Hook
+	listeners []string // the ids of the listeners whose clients are checked by the hook
+}
+
+// NewListenerHook returns a hook which checks the clients of the listeners with the
+// given ids using an auth hook.
+func NewListenerHook(hook mqtt.Hook, listeners ...string) *ListenerHook {
+	ids := slices.Clone(listeners)
+	slices.Sort(ids)
+
+	return &ListenerHook{
+		Hook:      hook,
+		listeners: slices.Compact(ids),
+	}
+}
+
+// ID returns the ID of the hook, which is the ID of the auth hook and its listeners,
+// so the same auth hook can be added once for each auth chain.
+func (h *ListenerHook) ID() string {
+	return h.Hook.ID() + "@" + strings.Join(h.listeners, ",")
+}
+
+// Inherit passes the state of a replaced hook to the auth hook, if the auth hook keeps
+// per-client state.
+func (h *ListenerHook) Inherit(old mqtt.Hook) {
+	if lh, ok := old.(*ListenerHook); ok {
+		old = lh.Hook
+	}
+
+	if r, ok := h.Hook.(mqtt.HookInheritor); ok {
+		r.Inherit(old)
+	}
+}
+
+// allowed returns true if a client is connected to one of the listeners of the hook.
+func (h *ListenerHook) allowed(cl *mqtt.Client) bool {
+	_, ok := slices.BinarySearch(h.listeners, cl.Net.Listener)
+	return ok
+}
+
+// OnConnectAuthenticate authenticates the clients of the listeners of the hook.
+func (h *ListenerHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	return h.allowed(cl) && h.Hook.OnConnectAuthenticate(cl, pk)
+}
+
+// OnACLCheck checks the topic access of the clients of the listeners of the hook.
+func (h *ListenerHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.allowed(cl) && h.Hook.OnACLCheck(cl, topic, write)
+}
+
+// OnAuthPacket handles the enhanced authentication exchanges of the clients of the
+// listeners of the hook, and passes on the packets of other clients unchanged.
+func (h *ListenerHook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if !h.allowed(cl) {
+		return pk, nil
+	}
+	return h.Hook.OnAuthPacket(cl, pk)
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// inheritHook is an auth hook which records the hooks it inherits and fails enhanced
+// authentication exchanges.
+type inheritHook struct {
+	AllowHook
+	inherited mqtt.Hook
+}
+
+func (h *inheritHook) Inherit(old mqtt.Hook) {
+	h.inherited = old
+}
+
+func (h *inheritHook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	return pk, errors.New("test")
+}
+
+func newListenerClient(listener string) *mqtt.Client {
+	cl := new(mqtt.Client)
+	cl.Net.Listener = listener
+	return cl
+}
+
+func TestNewListenerHook(t *testing.T) {
+	h := NewListenerHook(new(AllowHook), "ws", "local", "ws")
+	require.Equal(t, []string{"local", "ws"}, h.listeners)
+	require.Equal(t, "allow-all-auth@local,ws", h.ID())
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestListenerHookOnConnectAuthenticate(t *testing.T) {
+	h := NewListenerHook(new(AllowHook), "local")
+	require.True(t, h.OnConnectAuthenticate(newListenerClient("local"), packets.Packet{}))
+	require.False(t, h.OnConnectAuthenticate(newListenerClient("public"), packets.Packet{}))
+}
+
+func TestListenerHookOnACLCheck(t *testing.T) {
+	h := NewListenerHook(new(AllowHook), "local")
+	require.True(t, h.OnACLCheck(newListenerClient("local"), "a/b", true))
+	require.False(t, h.OnACLCheck(newListenerClient("public"), "a/b", true))
+}
+
+func TestListenerHookOnAuthPacket(t *testing.T) {
+	h := NewListenerHook(new(inheritHook), "local")
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connect}}
+
+	_, err := h.OnAuthPacket(newListenerClient("local"), pk)
+	require.Error(t, err)
+
+	pkx, err := h.OnAuthPacket(newListenerClient("public"), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, pkx)
+}
+
+func TestListenerHookInherit(t *testing.T) {
+	old := new(inheritHook)
+	inner := new(inheritHook)
+	h := NewListenerHook(inner, "local")
+	h.Inherit(NewListenerHook(old, "local"))
+	require.Same(t, old, inner.inherited)
+
+	h.Inherit(old)
+	require.Same(t, old, inner.inherited)
+
+	NewListenerHook(new(AllowHook), "local").Inherit(old) // coverage: no state to inherit
+}
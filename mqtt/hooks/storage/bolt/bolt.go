@@ -8,6 +8,8 @@ package bolt
 import (
 	"bytes"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
@@ -48,6 +50,21 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// blacklistKey returns a primary key for a blacklist entry.
+func blacklistKey(e storage.BlacklistEntry) string {
+	return storage.BlacklistKey + "_" + e.Kind + ":" + e.Value
+}
+
+// offlineKey returns a primary key for an offline message.
+func offlineKey(cl *mqtt.Client, seq uint64) string {
+	return storage.OfflineKey + "_" + cl.ID + ":" + strconv.FormatUint(seq, 10)
+}
+
+// delayedKey returns a primary key for a delayed message.
+func delayedKey(id string) string {
+	return storage.DelayedKey + "_" + id
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -86,11 +103,21 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
+		mqtt.OnBlacklistAdded,
+		mqtt.OnBlacklistDeleted,
+		mqtt.OnOfflineQueued,
+		mqtt.OnOfflineDequeued,
+		mqtt.OnDelayedAdded,
+		mqtt.OnDelayedDeleted,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
+		mqtt.StoredBlacklist,
+		mqtt.StoredOfflineMessages,
+		mqtt.StoredRetainedMessagesByFilter,
+		mqtt.StoredDelayedMessages,
 	}, []byte{b})
 }
 
@@ -387,6 +414,131 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 	}
 }
 
+// OnBlacklistAdded adds or updates a blacklist entry in the store.
+func (h *Hook) OnBlacklistAdded(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	e.ID = blacklistKey(e)
+	e.T = storage.BlacklistKey
+	err := h.db.Save(&e)
+	if err != nil {
+		h.Log.Error("failed to save blacklist data", "error", err, "data", e)
+	}
+}
+
+// OnBlacklistDeleted deletes a deleted or expired blacklist entry from the store.
+func (h *Hook) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.DeleteStruct(&storage.BlacklistEntry{ID: blacklistKey(e)})
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		h.Log.Error("failed to delete blacklist data", "error", err, "id", blacklistKey(e))
+	}
+}
+
+// OnOfflineQueued adds a message queued for a disconnected client to the store.
+func (h *Hook) OnOfflineQueued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          offlineKey(cl, m.Seq),
+		T:           storage.OfflineKey,
+		Client:      cl.ID,
+		Seq:         m.Seq,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	err := h.db.Save(in)
+	if err != nil {
+		h.Log.Error("failed to save offline message data", "error", err, "client", cl.ID, "data", in)
+	}
+}
+
+// OnOfflineDequeued removes a sent, dropped or expired offline message from the store.
+func (h *Hook) OnOfflineDequeued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.DeleteStruct(&storage.Message{ID: offlineKey(cl, m.Seq)})
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		h.Log.Error("failed to delete offline message data", "error", err, "id", offlineKey(cl, m.Seq))
+	}
+}
+
+// OnDelayedAdded adds a message held to be published after a delay to the store.
+func (h *Hook) OnDelayedAdded(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          delayedKey(m.ID),
+		T:           storage.DelayedKey,
+		Due:         m.Due,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	err := h.db.Save(in)
+	if err != nil {
+		h.Log.Error("failed to save delayed message data", "error", err, "data", in)
+	}
+}
+
+// OnDelayedDeleted removes a published or cancelled delayed message from the store.
+func (h *Hook) OnDelayedDeleted(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.DeleteStruct(&storage.Message{ID: delayedKey(m.ID)})
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		h.Log.Error("failed to delete delayed message data", "error", err, "id", delayedKey(m.ID))
+	}
+}
+
 // StoredClients returns all stored clients from the store.
 func (h *Hook) StoredClients() (v []storage.Client, err error) {
 	if h.db == nil {
@@ -432,6 +584,28 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredRetainedMessagesByFilter returns the stored retained messages on topics matching a filter.
+func (h *Hook) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var rows []storage.Message
+	err = h.db.Prefix("ID", retainedKey(mqtt.FilterPrefix(filter)), &rows)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for _, row := range rows {
+		if mqtt.MatchFilter(filter, row.TopicName) {
+			v = append(v, row)
+		}
+	}
+
+	return v, nil
+}
+
 // StoredInflightMessages returns all stored inflight messages from the store.
 func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	if h.db == nil {
@@ -447,6 +621,56 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredBlacklist returns all stored blacklist entries from the store.
+func (h *Hook) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.Find("T", storage.BlacklistKey, &v)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	return v, nil
+}
+
+// StoredOfflineMessages returns all stored offline messages from the store.
+func (h *Hook) StoredOfflineMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.Find("T", storage.OfflineKey, &v)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	return v, nil
+}
+
+// StoredDelayedMessages returns all stored delayed messages from the store, with the
+// ids they were added with.
+func (h *Hook) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.Find("T", storage.DelayedKey, &v)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for i := range v {
+		v[i].ID = strings.TrimPrefix(v[i].ID, storage.DelayedKey+"_")
+	}
+
+	return v, nil
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
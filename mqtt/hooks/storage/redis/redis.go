@@ -9,6 +9,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
@@ -18,6 +20,9 @@ import (
 	redis "github.com/redis/go-redis/v9"
 )
 
+// globEscaper escapes the special characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
 // defaultAddr is the default address to the redis service.
 const defaultAddr = "localhost:6379"
 
@@ -44,6 +49,21 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return cl.ID + ":" + pk.FormatID()
 }
 
+// blacklistKey returns a primary key for a blacklist entry.
+func blacklistKey(e storage.BlacklistEntry) string {
+	return storage.BlacklistKey + "_" + e.Kind + ":" + e.Value
+}
+
+// offlineKey returns a primary key for an offline message.
+func offlineKey(cl *mqtt.Client, seq uint64) string {
+	return cl.ID + ":" + strconv.FormatUint(seq, 10)
+}
+
+// delayedKey returns a primary key for a delayed message.
+func delayedKey(id string) string {
+	return id
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -83,11 +103,21 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
+		mqtt.OnBlacklistAdded,
+		mqtt.OnBlacklistDeleted,
+		mqtt.OnOfflineQueued,
+		mqtt.OnOfflineDequeued,
+		mqtt.OnDelayedAdded,
+		mqtt.OnDelayedDeleted,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
+		mqtt.StoredBlacklist,
+		mqtt.StoredOfflineMessages,
+		mqtt.StoredRetainedMessagesByFilter,
+		mqtt.StoredDelayedMessages,
 	}, []byte{b})
 }
 
@@ -398,6 +428,131 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 	}
 }
 
+// OnBlacklistAdded adds or updates a blacklist entry in the store.
+func (h *Hook) OnBlacklistAdded(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	e.ID = blacklistKey(e)
+	e.T = storage.BlacklistKey
+	err := h.db.HSet(h.ctx, h.hKey(storage.BlacklistKey), e.ID, e).Err()
+	if err != nil {
+		h.Log.Error("failed to hset blacklist data", "error", err, "data", e)
+	}
+}
+
+// OnBlacklistDeleted deletes a deleted or expired blacklist entry from the store.
+func (h *Hook) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.HDel(h.ctx, h.hKey(storage.BlacklistKey), blacklistKey(e)).Err()
+	if err != nil {
+		h.Log.Error("failed to delete blacklist data", "error", err, "id", blacklistKey(e))
+	}
+}
+
+// OnOfflineQueued adds a message queued for a disconnected client to the store.
+func (h *Hook) OnOfflineQueued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          offlineKey(cl, m.Seq),
+		T:           storage.OfflineKey,
+		Client:      cl.ID,
+		Seq:         m.Seq,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	err := h.db.HSet(h.ctx, h.hKey(storage.OfflineKey), in.ID, in).Err()
+	if err != nil {
+		h.Log.Error("failed to hset offline message data", "error", err, "data", in)
+	}
+}
+
+// OnOfflineDequeued removes a sent, dropped or expired offline message from the store.
+func (h *Hook) OnOfflineDequeued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.HDel(h.ctx, h.hKey(storage.OfflineKey), offlineKey(cl, m.Seq)).Err()
+	if err != nil {
+		h.Log.Error("failed to delete offline message data", "error", err, "id", offlineKey(cl, m.Seq))
+	}
+}
+
+// OnDelayedAdded adds a message held to be published after a delay to the store.
+func (h *Hook) OnDelayedAdded(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          delayedKey(m.ID),
+		T:           storage.DelayedKey,
+		Due:         m.Due,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	err := h.db.HSet(h.ctx, h.hKey(storage.DelayedKey), in.ID, in).Err()
+	if err != nil {
+		h.Log.Error("failed to hset delayed message data", "error", err, "data", in)
+	}
+}
+
+// OnDelayedDeleted removes a published or cancelled delayed message from the store.
+func (h *Hook) OnDelayedDeleted(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.HDel(h.ctx, h.hKey(storage.DelayedKey), delayedKey(m.ID)).Err()
+	if err != nil {
+		h.Log.Error("failed to delete delayed message data", "error", err, "id", delayedKey(m.ID))
+	}
+}
+
 // StoredClients returns all stored clients from the store.
 func (h *Hook) StoredClients() (v []storage.Client, err error) {
 	if h.db == nil {
@@ -473,6 +628,40 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredRetainedMessagesByFilter returns the stored retained messages on topics matching a filter,
+// scanning only the topics which begin with the part of the filter before any wildcard.
+func (h *Hook) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	pattern := globEscaper.Replace(retainedKey(mqtt.FilterPrefix(filter))) + "*"
+	iter := h.db.HScan(h.ctx, h.hKey(storage.RetainedKey), 0, pattern, 0).Iterator()
+	for iter.Next(h.ctx) {
+		if !iter.Next(h.ctx) { // fields are followed by their values
+			break
+		}
+
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(iter.Val())); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", iter.Val())
+			continue
+		}
+
+		if mqtt.MatchFilter(filter, d.TopicName) {
+			v = append(v, d)
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		h.Log.Error("failed to HScan retained message data", "error", err)
+		return
+	}
+
+	return v, nil
+}
+
 // StoredInflightMessages returns all stored inflight messages from the store.
 func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	if h.db == nil {
@@ -498,6 +687,81 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredBlacklist returns all stored blacklist entries from the store.
+func (h *Hook) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.BlacklistKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.Log.Error("failed to HGetAll blacklist data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.BlacklistEntry
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal blacklist data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredOfflineMessages returns all stored offline messages from the store.
+func (h *Hook) StoredOfflineMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.OfflineKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.Log.Error("failed to HGetAll offline message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal offline message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredDelayedMessages returns all stored delayed messages from the store.
+func (h *Hook) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.DelayedKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.Log.Error("failed to HGetAll delayed message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal delayed message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
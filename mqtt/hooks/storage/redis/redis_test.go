@@ -81,6 +81,11 @@ func TestInflightKey(t *testing.T) {
 	require.Equal(t, "cl1:1", k)
 }
 
+func TestOfflineKey(t *testing.T) {
+	k := offlineKey(&mqtt.Client{ID: "cl1"}, 7)
+	require.Equal(t, "cl1:7", k)
+}
+
 func TestSysInfoKey(t *testing.T) {
 	require.Equal(t, storage.SysInfoKey, sysInfoKey())
 }
@@ -108,6 +113,15 @@ func TestProvides(t *testing.T) {
 	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
 	require.True(t, h.Provides(mqtt.StoredSubscriptions))
 	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.True(t, h.Provides(mqtt.StoredBlacklist))
+	require.True(t, h.Provides(mqtt.OnBlacklistAdded))
+	require.True(t, h.Provides(mqtt.OnBlacklistDeleted))
+	require.True(t, h.Provides(mqtt.StoredOfflineMessages))
+	require.True(t, h.Provides(mqtt.OnOfflineQueued))
+	require.True(t, h.Provides(mqtt.OnDelayedAdded))
+	require.True(t, h.Provides(mqtt.StoredDelayedMessages))
+	require.True(t, h.Provides(mqtt.OnOfflineDequeued))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessagesByFilter))
 	require.False(t, h.Provides(mqtt.OnACLCheck))
 	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
 }
@@ -697,6 +711,55 @@ func TestStoredRetainedMessages(t *testing.T) {
 	require.Equal(t, "m3", r[2].ID)
 }
 
+func TestStoredRetainedMessagesByFilter(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	for _, topic := range []string{"a/b/c", "a/b/d", "a/x", "ab/c", "a"} {
+		h.OnRetainMessage(client, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   topic,
+			Payload:     []byte(topic),
+		}, 1)
+	}
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/e", PacketID: 1}, 0, 0)
+
+	topics := func(filter string) []string {
+		r, err := h.StoredRetainedMessagesByFilter(filter)
+		require.NoError(t, err)
+		names := []string{}
+		for _, m := range r {
+			names = append(names, m.TopicName)
+		}
+		return names
+	}
+
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d", "a/x", "a"}, topics("a/#"))
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d"}, topics("a/b/+"))
+	require.ElementsMatch(t, []string{"ab/c"}, topics("+/c"))
+	require.ElementsMatch(t, []string{"a/b/c"}, topics("+/b/c"))
+	require.ElementsMatch(t, []string{"a/x"}, topics("a/x"))
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d", "a/x", "ab/c", "a"}, topics("#"))
+	require.Empty(t, topics("x/y"))
+
+	// glob characters in topics are matched literally
+	h.OnRetainMessage(client, packets.Packet{TopicName: "[a]*/b", Payload: []byte("1")}, 1)
+	require.Equal(t, []string{"[a]*/b"}, topics("[a]*/+"))
+	require.Empty(t, topics("[a]x/+"))
+}
+
+func TestStoredRetainedMessagesByFilterNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	v, err := h.StoredRetainedMessagesByFilter("a/#")
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
 func TestStoredRetainedMessagesNoDB(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -809,3 +872,151 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestOnBlacklistAddedThenDeleted(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	e := storage.BlacklistEntry{Kind: "ip", Value: "10.0.0.0/8", Reason: "abuse", Created: 1}
+	h.OnBlacklistAdded(e)
+	h.OnBlacklistAdded(storage.BlacklistEntry{Kind: "client-id", Value: "c1", Created: 2})
+
+	r, err := h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	h.OnBlacklistDeleted(e)
+	r, err = h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "c1", r[0].Value)
+	require.Equal(t, storage.BlacklistKey, r[0].T)
+}
+
+func TestStoredBlacklistNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	v, err := h.StoredBlacklist()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestOnDelayedAddedThenDeleted(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	m := mqtt.DelayedMessage{
+		ID:  "d1",
+		Due: 160,
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Origin:      client.ID,
+			Created:     100,
+			Properties:  packets.Properties{MessageExpiryInterval: 10},
+		},
+	}
+	h.OnDelayedAdded(m)
+	h.OnDelayedAdded(mqtt.DelayedMessage{ID: "d2", Due: 200, Packet: packets.Packet{TopicName: "d/e/f"}})
+
+	r, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	h.OnDelayedDeleted(m)
+	r, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "d2", r[0].ID)
+	require.Equal(t, storage.DelayedKey, r[0].T)
+	require.Equal(t, int64(200), r[0].Due)
+	require.Equal(t, "d/e/f", r[0].TopicName)
+
+	h.OnDelayedAdded(m)
+	r, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	for _, d := range r {
+		if d.ID == m.ID {
+			pk := d.ToPacket()
+			require.Equal(t, m.Packet.FixedHeader, pk.FixedHeader)
+			require.Equal(t, m.Packet.Payload, pk.Payload)
+			require.Equal(t, m.Packet.Origin, pk.Origin)
+			require.Equal(t, m.Packet.Created, pk.Created)
+			require.Equal(t, m.Packet.Properties.MessageExpiryInterval, pk.Properties.MessageExpiryInterval)
+		}
+	}
+}
+
+func TestOnDelayedAddedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnDelayedAdded(mqtt.DelayedMessage{ID: "d1"})
+	h.OnDelayedDeleted(mqtt.DelayedMessage{ID: "d1"})
+}
+
+func TestStoredDelayedMessagesNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	v, err := h.StoredDelayedMessages()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestOnOfflineQueuedThenDequeued(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	m := mqtt.OfflineMessage{
+		Seq: 1,
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Created:     100,
+			Properties:  packets.Properties{MessageExpiryInterval: 10},
+		},
+	}
+	h.OnOfflineQueued(client, m)
+	h.OnOfflineQueued(client, mqtt.OfflineMessage{Seq: 2, Packet: packets.Packet{TopicName: "d/e/f"}})
+
+	r, err := h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	h.OnOfflineDequeued(client, m)
+	r, err = h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, storage.OfflineKey, r[0].T)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, uint64(2), r[0].Seq)
+	require.Equal(t, "d/e/f", r[0].TopicName)
+}
+
+func TestOnOfflineQueuedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnOfflineQueued(client, mqtt.OfflineMessage{Seq: 1})
+	h.OnOfflineDequeued(client, mqtt.OfflineMessage{Seq: 1})
+}
+
+func TestStoredOfflineMessagesNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	v, err := h.StoredOfflineMessages()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
@@ -0,0 +1,955 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package sql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+	_ "modernc.org/sqlite"
+)
+
+// The supported database drivers.
+const (
+	DriverSqlite   = "sqlite"
+	DriverMysql    = "mysql"
+	DriverPostgres = "postgres"
+)
+
+// defaultDSN is the default sqlite database file.
+const defaultDSN = "comqtt.sqlite"
+
+// defaultTablePrefix is a prefix to better identify tables created by comqtt.
+const defaultTablePrefix = "comqtt_"
+
+// The tables of the store.
+const (
+	clientTable       = "clients"
+	subscriptionTable = "subscriptions"
+	retainedTable     = "retained"
+	inflightTable     = "inflight"
+	sysInfoTable      = "sysinfo"
+	blacklistTable    = "blacklist"
+	offlineTable      = "offline"
+	delayedTable      = "delayed"
+)
+
+// indexPrefix is the number of characters of the full ids and topics which are indexed, as
+// indexes limit the size of their keys.
+const indexPrefix = 255
+
+// likeEscaper escapes the wildcards of a LIKE pattern, using an escape character which
+// is not special in the string literals of any driver.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// ErrUnknownDriver indicates the driver is not one of sqlite, mysql or postgres.
+var ErrUnknownDriver = errors.New("unknown sql storage driver")
+
+// columns are the inspectable columns of each table, besides the id primary key, the full_id
+// it is the hash of, and the json encoded data of the row.
+var columns = map[string][]string{
+	clientTable:       {"username", "remote", "listener"},
+	subscriptionTable: {"client", "filter", "qos"},
+	retainedTable:     {"topic"},
+	inflightTable:     {"client", "topic", "packet_id"},
+	sysInfoTable:      {},
+	blacklistTable:    {"kind", "value"},
+	offlineTable:      {"client", "topic", "seq"},
+	delayedTable:      {"topic", "due"},
+}
+
+// indexed are the columns of each table which are indexed, besides the id primary key and
+// the full_id.
+var indexed = map[string][]string{
+	retainedTable: {"topic"},
+}
+
+// rowID returns the primary key of a row, the hex sha256 of its full id, so ids of any
+// length fit the fixed length key.
+func rowID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientKey returns the full id of the row of a client.
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// subscriptionKey returns the full id of the row of a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return cl.ID + ":" + filter
+}
+
+// retainedKey returns the full id of the row of a retained message.
+func retainedKey(topic string) string {
+	return topic
+}
+
+// inflightKey returns the full id of the row of an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return cl.ID + ":" + pk.FormatID()
+}
+
+// blacklistKey returns the full id of the row of a blacklist entry.
+func blacklistKey(e storage.BlacklistEntry) string {
+	return storage.BlacklistKey + "_" + e.Kind + ":" + e.Value
+}
+
+// offlineKey returns the full id of the row of an offline message.
+func offlineKey(cl *mqtt.Client, seq uint64) string {
+	return cl.ID + ":" + strconv.FormatUint(seq, 10)
+}
+
+// delayedKey returns the full id of the row of a delayed message.
+func delayedKey(id string) string {
+	return id
+}
+
+// sysInfoKey returns the full id of the row of system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the sql database.
+type Options struct {
+	Driver       string `json:"driver" yaml:"driver"`                 // sqlite (default), mysql or postgres
+	DSN          string `json:"dsn" yaml:"dsn"`                       // the data source name of the driver, defaults to comqtt.sqlite
+	TablePrefix  string `json:"table-prefix" yaml:"table-prefix"`     // prefix of the table names, defaults to comqtt_
+	MaxOpenConns int    `json:"max-open-conns" yaml:"max-open-conns"` // ignored by sqlite, which uses a single connection
+	MaxIdleConns int    `json:"max-idle-conns" yaml:"max-idle-conns"`
+}
+
+// Hook is a persistent storage hook using a sql database as a backend.
+type Hook struct {
+	mqtt.HookBase
+	config *Options // options for connecting to the database.
+	db     *sqlx.DB // the database connection pool
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "sql-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.OnBlacklistAdded,
+		mqtt.OnBlacklistDeleted,
+		mqtt.OnOfflineQueued,
+		mqtt.OnOfflineDequeued,
+		mqtt.OnDelayedAdded,
+		mqtt.OnDelayedDeleted,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredBlacklist,
+		mqtt.StoredOfflineMessages,
+		mqtt.StoredRetainedMessagesByFilter,
+		mqtt.StoredDelayedMessages,
+	}, []byte{b})
+}
+
+// Init connects to the database and creates the tables which do not exist.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Driver == "" {
+		h.config.Driver = DriverSqlite
+	}
+	if h.config.DSN == "" && h.config.Driver == DriverSqlite {
+		h.config.DSN = defaultDSN
+	}
+	if h.config.TablePrefix == "" {
+		h.config.TablePrefix = defaultTablePrefix
+	}
+
+	switch h.config.Driver {
+	case DriverSqlite, DriverMysql, DriverPostgres:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownDriver, h.config.Driver)
+	}
+
+	h.Log.Info("connecting to sql database", "driver", h.config.Driver, "table-prefix", h.config.TablePrefix)
+
+	db, err := sqlx.Connect(h.config.Driver, h.config.DSN)
+	if err != nil {
+		return fmt.Errorf("failed to connect database: %w", err)
+	}
+
+	if h.config.Driver == DriverSqlite {
+		db.SetMaxOpenConns(1) // sqlite allows a single writer, and each connection to :memory: is a new database
+	} else {
+		db.SetMaxOpenConns(h.config.MaxOpenConns)
+		db.SetMaxIdleConns(h.config.MaxIdleConns)
+	}
+	h.db = db
+
+	for _, table := range []string{clientTable, subscriptionTable, retainedTable, inflightTable, sysInfoTable, blacklistTable, offlineTable, delayedTable} {
+		for _, stmt := range append([]string{h.createTable(table)}, h.createIndexes(table)...) {
+			if _, err := h.db.Exec(stmt); err != nil {
+				h.db.Close()
+				return fmt.Errorf("failed to create table %s: %w", h.table(table), err)
+			}
+		}
+	}
+
+	h.Log.Info("connected to sql database")
+
+	return nil
+}
+
+// Stop closes the database connection.
+func (h *Hook) Stop() error {
+	h.Log.Info("disconnecting from sql database")
+
+	return h.db.Close()
+}
+
+// table returns a table name with the configured prefix.
+func (h *Hook) table(name string) string {
+	return h.config.TablePrefix + name
+}
+
+// createTable returns the statement which creates a table if it does not exist. Rows are
+// keyed on the hash of their full id, which is kept in the full_id column.
+func (h *Hook) createTable(name string) string {
+	dataType := "TEXT"
+	if h.config.Driver == DriverMysql {
+		dataType = "LONGTEXT" // TEXT is limited to 64KB in mysql
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (id CHAR(64) NOT NULL PRIMARY KEY, full_id TEXT NOT NULL", h.table(name))
+	for _, col := range columns[name] {
+		if col == "qos" || col == "packet_id" || col == "seq" {
+			fmt.Fprintf(&b, ", %s INTEGER", col)
+		} else if col == "due" {
+			fmt.Fprintf(&b, ", %s BIGINT", col) // unix time
+		} else {
+			fmt.Fprintf(&b, ", %s TEXT", col)
+		}
+	}
+	fmt.Fprintf(&b, ", data %s NOT NULL", dataType)
+	if h.config.Driver == DriverMysql {
+		for _, col := range h.indexedColumns(name) {
+			fmt.Fprintf(&b, ", INDEX %s_%s_idx (%s(%d))", h.table(name), col, col, indexPrefix) // mysql only indexes text by prefix
+		}
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// createIndexes returns the statements which create the indexes of a table if they do not
+// exist. The indexes of mysql tables are created with the table.
+func (h *Hook) createIndexes(name string) []string {
+	if h.config.Driver == DriverMysql {
+		return nil
+	}
+
+	stmts := make([]string, 0, len(h.indexedColumns(name)))
+	for _, col := range h.indexedColumns(name) {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_idx ON %s (%s)", h.table(name), col, h.table(name), h.prefixed(col)))
+	}
+	return stmts
+}
+
+// indexedColumns returns the indexed columns of a table.
+func (h *Hook) indexedColumns(name string) []string {
+	return append([]string{"full_id"}, indexed[name]...)
+}
+
+// prefixed returns the indexed expression of a text column. Mysql indexes a prefix of the
+// column itself, and the other drivers index the same prefix as an expression.
+func (h *Hook) prefixed(col string) string {
+	if h.config.Driver == DriverMysql {
+		return col
+	}
+	return fmt.Sprintf("substr(%s, 1, %d)", col, indexPrefix)
+}
+
+// upsert inserts or replaces a row of a table, keyed on the hash of its full id. The values
+// are those of the table columns, followed by the json encoded data.
+func (h *Hook) upsert(name, key string, values ...any) error {
+	cols := append([]string{"id", "full_id"}, columns[name]...)
+	cols = append(cols, "data")
+
+	updates := make([]string, 0, len(cols)-1)
+	for _, col := range cols[1:] {
+		if h.config.Driver == DriverMysql {
+			updates = append(updates, col+"=VALUES("+col+")")
+		} else {
+			updates = append(updates, col+"=excluded."+col)
+		}
+	}
+
+	conflict := " ON CONFLICT (id) DO UPDATE SET "
+	if h.config.Driver == DriverMysql {
+		conflict = " ON DUPLICATE KEY UPDATE "
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)%s%s",
+		h.table(name), strings.Join(cols, ", "), strings.Repeat(", ?", len(cols)-1), conflict, strings.Join(updates, ", "))
+	_, err := h.db.Exec(h.db.Rebind(query), append([]any{rowID(key), key}, values...)...)
+	return err
+}
+
+// delete removes a row from a table.
+func (h *Hook) delete(name, key string) error {
+	_, err := h.db.Exec(h.db.Rebind("DELETE FROM "+h.table(name)+" WHERE id = ?"), rowID(key))
+	return err
+}
+
+// rows returns the json encoded data of all rows of a table, ordered by their full ids.
+func (h *Hook) rows(name string) ([]string, error) {
+	rows := make([]string, 0)
+	err := h.db.Select(&rows, "SELECT data FROM "+h.table(name)+" ORDER BY full_id")
+	return rows, err
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	data, _ := in.MarshalBinary()
+	err := h.upsert(clientTable, in.ID, string(in.Username), in.Remote, in.Listener, string(data))
+	if err != nil {
+		h.Log.Error("failed to upsert client data", "error", err, "data", in)
+	}
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	if err := h.delete(clientTable, clientKey(cl)); err != nil {
+		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:     subscriptionKey(cl, pk.Filters[i].Filter),
+			T:      storage.SubscriptionKey,
+			Client: cl.ID,
+			Filter: pk.Filters[i].Filter,
+			Qos:    reasonCodes[i],
+		}
+		if pk.ProtocolVersion == 5 {
+			in.Identifier = pk.Filters[i].Identifier
+			in.NoLocal = pk.Filters[i].NoLocal
+			in.RetainHandling = pk.Filters[i].RetainHandling
+			in.RetainAsPublished = pk.Filters[i].RetainAsPublished
+		}
+
+		data, _ := in.MarshalBinary()
+		err := h.upsert(subscriptionTable, in.ID, in.Client, in.Filter, in.Qos, string(data))
+		if err != nil {
+			h.Log.Error("failed to upsert subscription data", "error", err, "data", in)
+		}
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		if err := h.delete(subscriptionTable, subscriptionKey(cl, pk.Filters[i].Filter)); err != nil {
+			h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
+		}
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		if err := h.delete(retainedTable, retainedKey(pk.TopicName)); err != nil {
+			h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(pk.TopicName))
+		}
+
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          retainedKey(pk.TopicName),
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, _ := in.MarshalBinary()
+	err := h.upsert(retainedTable, in.ID, in.TopicName, string(data))
+	if err != nil {
+		h.Log.Error("failed to upsert retained message data", "error", err, "data", in)
+	}
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          inflightKey(cl, pk),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, _ := in.MarshalBinary()
+	err := h.upsert(inflightTable, in.ID, cl.ID, in.TopicName, pk.PacketID, string(data))
+	if err != nil {
+		h.Log.Error("failed to upsert qos inflight message data", "error", err, "data", in)
+	}
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(inflightTable, inflightKey(cl, pk)); err != nil {
+		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", inflightKey(cl, pk))
+	}
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+	}
+
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	data, _ := in.MarshalBinary()
+	if err := h.upsert(sysInfoTable, in.ID, string(data)); err != nil {
+		h.Log.Error("failed to upsert server info data", "error", err, "data", in)
+	}
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(retainedTable, retainedKey(filter)); err != nil {
+		h.Log.Error("failed to delete expired retained message", "error", err, "id", retainedKey(filter))
+	}
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(clientTable, clientKey(cl)); err != nil {
+		h.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnBlacklistAdded adds or updates a blacklist entry in the store.
+func (h *Hook) OnBlacklistAdded(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	e.ID = blacklistKey(e)
+	e.T = storage.BlacklistKey
+	data, _ := e.MarshalBinary()
+	if err := h.upsert(blacklistTable, e.ID, e.Kind, e.Value, string(data)); err != nil {
+		h.Log.Error("failed to upsert blacklist data", "error", err, "data", e)
+	}
+}
+
+// OnBlacklistDeleted deletes a deleted or expired blacklist entry from the store.
+func (h *Hook) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(blacklistTable, blacklistKey(e)); err != nil {
+		h.Log.Error("failed to delete blacklist data", "error", err, "id", blacklistKey(e))
+	}
+}
+
+// OnOfflineQueued adds a message queued for a disconnected client to the store.
+func (h *Hook) OnOfflineQueued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          offlineKey(cl, m.Seq),
+		T:           storage.OfflineKey,
+		Client:      cl.ID,
+		Seq:         m.Seq,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	data, _ := in.MarshalBinary()
+	err := h.upsert(offlineTable, in.ID, cl.ID, in.TopicName, m.Seq, string(data))
+	if err != nil {
+		h.Log.Error("failed to upsert offline message data", "error", err, "data", in)
+	}
+}
+
+// OnOfflineDequeued removes a sent, dropped or expired offline message from the store.
+func (h *Hook) OnOfflineDequeued(cl *mqtt.Client, m mqtt.OfflineMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(offlineTable, offlineKey(cl, m.Seq)); err != nil {
+		h.Log.Error("failed to delete offline message data", "error", err, "id", offlineKey(cl, m.Seq))
+	}
+}
+
+// OnDelayedAdded adds a message held to be published after a delay to the store.
+func (h *Hook) OnDelayedAdded(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := m.Packet.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          delayedKey(m.ID),
+		T:           storage.DelayedKey,
+		Due:         m.Due,
+		Origin:      m.Packet.Origin,
+		FixedHeader: m.Packet.FixedHeader,
+		TopicName:   m.Packet.TopicName,
+		Payload:     m.Packet.Payload,
+		Created:     m.Packet.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	data, _ := in.MarshalBinary()
+	err := h.upsert(delayedTable, in.ID, in.TopicName, in.Due, string(data))
+	if err != nil {
+		h.Log.Error("failed to upsert delayed message data", "error", err, "data", in)
+	}
+}
+
+// OnDelayedDeleted removes a published or cancelled delayed message from the store.
+func (h *Hook) OnDelayedDeleted(m mqtt.DelayedMessage) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(delayedTable, delayedKey(m.ID)); err != nil {
+		h.Log.Error("failed to delete delayed message data", "error", err, "id", delayedKey(m.ID))
+	}
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(clientTable)
+	if err != nil {
+		h.Log.Error("failed to select client data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Client
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(subscriptionTable)
+	if err != nil {
+		h.Log.Error("failed to select subscription data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Subscription
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(retainedTable)
+	if err != nil {
+		h.Log.Error("failed to select retained message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessagesByFilter returns the stored retained messages on topics matching a filter,
+// selecting only the topics which begin with the part of the filter before any wildcard. The
+// indexed prefix of the topics narrows the selection before the whole topic is compared.
+func (h *Hook) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	prefix := mqtt.FilterPrefix(filter)
+	indexedPrefix := prefix
+	if r := []rune(prefix); len(r) > indexPrefix {
+		indexedPrefix = string(r[:indexPrefix])
+	}
+
+	rows := make([]string, 0)
+	query := "SELECT data FROM " + h.table(retainedTable) + " WHERE " + h.prefixed("topic") + " LIKE ? ESCAPE '!' AND topic LIKE ? ESCAPE '!' ORDER BY topic"
+	err = h.db.Select(&rows, h.db.Rebind(query), likeEscaper.Replace(indexedPrefix)+"%", likeEscaper.Replace(prefix)+"%")
+	if err != nil {
+		h.Log.Error("failed to select retained message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+			continue
+		}
+
+		if mqtt.MatchFilter(filter, d.TopicName) {
+			v = append(v, d)
+		}
+	}
+
+	return v, nil
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(inflightTable)
+	if err != nil {
+		h.Log.Error("failed to select inflight message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredBlacklist returns all stored blacklist entries from the store.
+func (h *Hook) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(blacklistTable)
+	if err != nil {
+		h.Log.Error("failed to select blacklist data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.BlacklistEntry
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal blacklist data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredOfflineMessages returns all stored offline messages from the store.
+func (h *Hook) StoredOfflineMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(offlineTable)
+	if err != nil {
+		h.Log.Error("failed to select offline message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal offline message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredDelayedMessages returns all stored delayed messages from the store.
+func (h *Hook) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(delayedTable)
+	if err != nil {
+		h.Log.Error("failed to select delayed message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error("failed to unmarshal delayed message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(sysInfoTable)
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	if err = v.UnmarshalBinary([]byte(rows[0])); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", rows[0])
+	}
+
+	return v, nil
+}
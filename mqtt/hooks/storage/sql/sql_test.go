@@ -0,0 +1,678 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package sql
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func newHook(t *testing.T) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		DSN: filepath.Join(t.TempDir(), "test.sqlite"),
+	})
+	require.NoError(t, err)
+
+	return h
+}
+
+func teardown(t *testing.T, h *Hook) {
+	if h.db != nil {
+		require.NoError(t, h.Stop())
+	}
+}
+
+// row returns the json data of a row, or sql.ErrNoRows if it does not exist.
+func row(h *Hook, table, id string) (string, error) {
+	var data string
+	err := h.db.Get(&data, h.db.Rebind("SELECT data FROM "+h.table(table)+" WHERE id = ?"), rowID(id))
+	return data, err
+}
+
+func TestKeys(t *testing.T) {
+	require.Equal(t, "cl1", clientKey(&mqtt.Client{ID: "cl1"}))
+	require.Equal(t, "cl1:a/b/c", subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c"))
+	require.Equal(t, "a/b/c", retainedKey("a/b/c"))
+	require.Equal(t, "cl1:1", inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1}))
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+	require.Equal(t, "bl_ip:1.2.3.4", blacklistKey(storage.BlacklistEntry{Kind: "ip", Value: "1.2.3.4"}))
+	require.Equal(t, "cl1:7", offlineKey(&mqtt.Client{ID: "cl1"}, 7))
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, "sql-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.True(t, h.Provides(mqtt.StoredBlacklist))
+	require.True(t, h.Provides(mqtt.OnBlacklistAdded))
+	require.True(t, h.Provides(mqtt.OnBlacklistDeleted))
+	require.True(t, h.Provides(mqtt.StoredOfflineMessages))
+	require.True(t, h.Provides(mqtt.OnOfflineQueued))
+	require.True(t, h.Provides(mqtt.OnDelayedAdded))
+	require.True(t, h.Provides(mqtt.StoredDelayedMessages))
+	require.True(t, h.Provides(mqtt.OnOfflineDequeued))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessagesByFilter))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	defer teardown(t, h)
+
+	require.Equal(t, DriverSqlite, h.config.Driver)
+	require.Equal(t, defaultDSN, h.config.DSN)
+	require.Equal(t, defaultTablePrefix, h.config.TablePrefix)
+	require.FileExists(t, defaultDSN)
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitUnknownDriver(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Driver: "oracle"})
+	require.ErrorIs(t, err, ErrUnknownDriver)
+}
+
+func TestInitBadDSN(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{DSN: filepath.Join(t.TempDir(), "missing", "test.sqlite")})
+	require.Error(t, err)
+}
+
+func TestInitExistingTables(t *testing.T) {
+	h := newHook(t)
+	h.OnSessionEstablished(client, packets.Packet{})
+	dsn := h.config.DSN
+	teardown(t, h)
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{DSN: dsn}))
+	defer teardown(t, h)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+}
+
+func TestCreateTable(t *testing.T) {
+	h := &Hook{config: &Options{Driver: DriverMysql, TablePrefix: defaultTablePrefix}}
+	require.Equal(t,
+		"CREATE TABLE IF NOT EXISTS comqtt_subscriptions (id CHAR(64) NOT NULL PRIMARY KEY, full_id TEXT NOT NULL, client TEXT, filter TEXT, qos INTEGER, data LONGTEXT NOT NULL, INDEX comqtt_subscriptions_full_id_idx (full_id(255)))",
+		h.createTable(subscriptionTable))
+	require.Empty(t, h.createIndexes(subscriptionTable))
+
+	h.config.Driver = DriverPostgres
+	require.Equal(t,
+		"CREATE TABLE IF NOT EXISTS comqtt_sysinfo (id CHAR(64) NOT NULL PRIMARY KEY, full_id TEXT NOT NULL, data TEXT NOT NULL)",
+		h.createTable(sysInfoTable))
+	require.Equal(t, []string{
+		"CREATE INDEX IF NOT EXISTS comqtt_retained_full_id_idx ON comqtt_retained (substr(full_id, 1, 255))",
+		"CREATE INDEX IF NOT EXISTS comqtt_retained_topic_idx ON comqtt_retained (substr(topic, 1, 255))",
+	}, h.createIndexes(retainedTable))
+}
+
+func TestRowID(t *testing.T) {
+	require.Len(t, rowID("a"), 64)
+	require.Equal(t, rowID("a"), rowID("a"))
+	require.NotEqual(t, rowID("a"), rowID("b"))
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(storage.Client)
+	data, err := row(h, clientTable, clientKey(client))
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(data)))
+	require.Equal(t, client.ID, r.ID)
+	require.Equal(t, client.Net.Remote, r.Remote)
+	require.Equal(t, client.Net.Listener, r.Listener)
+	require.Equal(t, client.Properties.Username, r.Username)
+	require.Equal(t, client.Properties.Clean, r.Clean)
+
+	var username string
+	require.NoError(t, h.db.Get(&username, "SELECT username FROM comqtt_clients WHERE full_id = 'test'"))
+	require.Equal(t, "username", username)
+
+	// the client is updated rather than duplicated
+	h.OnSessionEstablished(client, packets.Packet{})
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	h.OnDisconnect(client, nil, false)
+	_, err = row(h, clientTable, clientKey(client))
+	require.NoError(t, err)
+
+	h.OnDisconnect(client, nil, true)
+	_, err = row(h, clientTable, clientKey(client))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	testClient := &mqtt.Client{ID: "test"}
+	h.OnSessionEstablished(testClient, packets.Packet{})
+	testClient.Stop(packets.ErrSessionTakenOver)
+	h.OnDisconnect(testClient, nil, true)
+
+	_, err := row(h, clientTable, clientKey(testClient))
+	require.NoError(t, err)
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	c1 := &mqtt.Client{ID: client.ID}
+	c1.Properties.Will.Flag = 1
+	h.OnWillSent(c1, packets.Packet{})
+
+	r := new(storage.Client)
+	data, err := row(h, clientTable, clientKey(client))
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(data)))
+	require.Equal(t, uint32(1), r.Will.Flag)
+}
+
+func TestOnClientExpired(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnClientExpired(client)
+	_, err := row(h, clientTable, clientKey(client))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	h.OnSubscribed(client, pkf, []byte{1}, nil)
+
+	r := new(storage.Subscription)
+	data, err := row(h, subscriptionTable, subscriptionKey(client, pkf.Filters[0].Filter))
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(data)))
+	require.Equal(t, client.ID, r.Client)
+	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
+	require.Equal(t, byte(1), r.Qos)
+
+	var qos int
+	require.NoError(t, h.db.Get(&qos, "SELECT qos FROM comqtt_subscriptions WHERE client = 'test' AND filter = 'a/b/c'"))
+	require.Equal(t, 1, qos)
+
+	h.OnUnsubscribed(client, pkf, nil, nil)
+	_, err = row(h, subscriptionTable, subscriptionKey(client, pkf.Filters[0].Filter))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+
+	r := new(storage.Message)
+	data, err := row(h, retainedTable, retainedKey(pk.TopicName))
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(data)))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	_, err = row(h, retainedTable, retainedKey(pk.TopicName))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// coverage: delete deleted
+	h.OnRetainMessage(client, pk, -1)
+}
+
+func TestOnRetainedExpired(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, 1)
+	h.OnRetainedExpired("a/b/c")
+	_, err := row(h, retainedTable, retainedKey("a/b/c"))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		PacketID:  7,
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r := new(storage.Message)
+	data, err := row(h, inflightTable, inflightKey(client, pk))
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(data)))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+	require.NotZero(t, r.Sent)
+
+	var packetID int
+	require.NoError(t, h.db.Get(&packetID, "SELECT packet_id FROM comqtt_inflight WHERE client = 'test'"))
+	require.Equal(t, 7, packetID)
+
+	h.OnQosComplete(client, pk)
+	_, err = row(h, inflightTable, inflightKey(client, pk))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnQosDropped(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 1}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQosDropped(client, pk)
+	_, err := row(h, inflightTable, inflightKey(client, pk))
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+
+	h.OnSysInfoTick(info)
+	info.BytesReceived = 200
+	h.OnSysInfoTick(info)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, int64(200), r.BytesReceived)
+}
+
+func TestOnBlacklistAddedThenDeleted(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	e := storage.BlacklistEntry{Kind: "ip", Value: "1.2.3.4", Expiry: 100}
+	h.OnBlacklistAdded(e)
+
+	r, err := h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, blacklistKey(e), r[0].ID)
+	require.Equal(t, storage.BlacklistKey, r[0].T)
+	require.Equal(t, int64(100), r[0].Expiry)
+
+	h.OnBlacklistDeleted(e)
+	r, err = h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnDelayedAddedThenDeleted(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	m := mqtt.DelayedMessage{
+		ID:  "d1",
+		Due: 160,
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Origin:      client.ID,
+			Created:     100,
+			Properties:  packets.Properties{MessageExpiryInterval: 10},
+		},
+	}
+	h.OnDelayedAdded(m)
+	h.OnDelayedAdded(mqtt.DelayedMessage{ID: "d2", Due: 200, Packet: packets.Packet{TopicName: "d/e/f"}})
+
+	r, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	var due int64
+	require.NoError(t, h.db.Get(&due, "SELECT due FROM comqtt_delayed WHERE topic = 'a/b/c'"))
+	require.Equal(t, int64(160), due)
+
+	h.OnDelayedDeleted(m)
+	r, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "d2", r[0].ID)
+	require.Equal(t, storage.DelayedKey, r[0].T)
+	require.Equal(t, int64(200), r[0].Due)
+	require.Equal(t, "d/e/f", r[0].TopicName)
+
+	h.OnDelayedAdded(m)
+	r, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	for _, d := range r {
+		if d.ID == m.ID {
+			pk := d.ToPacket()
+			require.Equal(t, m.Packet.FixedHeader, pk.FixedHeader)
+			require.Equal(t, m.Packet.Payload, pk.Payload)
+			require.Equal(t, m.Packet.Origin, pk.Origin)
+			require.Equal(t, m.Packet.Created, pk.Created)
+			require.Equal(t, m.Packet.Properties.MessageExpiryInterval, pk.Properties.MessageExpiryInterval)
+		}
+	}
+}
+
+func TestOnOfflineQueuedThenDequeued(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	m := mqtt.OfflineMessage{
+		Seq: 1,
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			TopicName:   "a/b/c",
+			Payload:     []byte("hello"),
+			Created:     100,
+			Properties:  packets.Properties{MessageExpiryInterval: 10},
+		},
+	}
+	h.OnOfflineQueued(client, m)
+	h.OnOfflineQueued(client, mqtt.OfflineMessage{Seq: 2, Packet: packets.Packet{TopicName: "d/e/f"}})
+
+	r, err := h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, offlineKey(client, 1), r[0].ID)
+	require.Equal(t, storage.OfflineKey, r[0].T)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, uint64(1), r[0].Seq)
+	require.Equal(t, []byte("hello"), r[0].Payload)
+	require.Equal(t, uint32(10), r[0].Properties.MessageExpiryInterval)
+
+	var seq int
+	require.NoError(t, h.db.Get(&seq, "SELECT seq FROM comqtt_offline WHERE topic = 'd/e/f'"))
+	require.Equal(t, 2, seq)
+
+	h.OnOfflineDequeued(client, m)
+	r, err = h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, uint64(2), r[0].Seq)
+}
+
+func TestStoredRetainedMessagesByFilter(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	for _, topic := range []string{"a/b/c", "a/b/d", "a/x", "ab/c", "a"} {
+		h.OnRetainMessage(client, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   topic,
+			Payload:     []byte(topic),
+		}, 1)
+	}
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/e", PacketID: 1}, 0, 0)
+
+	topics := func(filter string) []string {
+		r, err := h.StoredRetainedMessagesByFilter(filter)
+		require.NoError(t, err)
+		names := []string{}
+		for _, m := range r {
+			names = append(names, m.TopicName)
+		}
+		return names
+	}
+
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d", "a/x", "a"}, topics("a/#"))
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d"}, topics("a/b/+"))
+	require.ElementsMatch(t, []string{"ab/c"}, topics("+/c"))
+	require.ElementsMatch(t, []string{"a/b/c"}, topics("+/b/c"))
+	require.ElementsMatch(t, []string{"a/x"}, topics("a/x"))
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d", "a/x", "ab/c", "a"}, topics("#"))
+	require.Empty(t, topics("x/y"))
+
+	// like wildcards in topics are matched literally
+	h.OnRetainMessage(client, packets.Packet{TopicName: "1%_!/b", Payload: []byte("1")}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "1xy!/b", Payload: []byte("1")}, 1)
+	require.Equal(t, []string{"1%_!/b"}, topics("1%_!/+"))
+
+	// topics longer than the indexed prefix are stored and selected by their whole prefix
+	long := strings.Repeat("l", 600)
+	h.OnRetainMessage(client, packets.Packet{TopicName: long + "/a/1", Payload: []byte("1")}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: long + "/b/1", Payload: []byte("1")}, 1)
+	require.Equal(t, []string{long + "/a/1"}, topics(long+"/a/#"))
+}
+
+func TestStored(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	cl2 := &mqtt.Client{ID: "cl2"}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSessionEstablished(cl2, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, nil)
+	h.OnSubscribed(cl2, packets.Packet{Filters: packets.Subscriptions{{Filter: "d/e/f"}, {Filter: "g/h/i"}}}, []byte{1, 2}, nil)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("1")}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f", Payload: []byte("2")}, 1)
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/c", PacketID: 1}, 0, 0)
+	h.OnQosPublish(cl2, packets.Packet{TopicName: "d/e/f", PacketID: 2}, 0, 0)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl2", clients[0].ID)
+	require.Equal(t, "test", clients[1].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 3)
+	require.Equal(t, "d/e/f", subs[0].Filter)
+	require.Equal(t, byte(1), subs[0].Qos)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 2)
+	require.Equal(t, []byte("1"), retained[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 2)
+	require.Equal(t, "cl2:2", inflight[0].ID)
+}
+
+func TestStoredBadData(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	_, err := h.db.Exec("INSERT INTO comqtt_clients (id, full_id, data) VALUES ('bad', 'bad', 'not json')")
+	require.NoError(t, err)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+}
+
+func TestStoredEmpty(t *testing.T) {
+	h := newHook(t)
+	defer teardown(t, h)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+
+	sys, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, sys.ID)
+}
+
+func TestClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.Stop())
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+	h.OnSubscribed(client, pkf, []byte{0}, nil)
+
+	_, err := h.StoredClients()
+	require.Error(t, err)
+	_, err = h.StoredSubscriptions()
+	require.Error(t, err)
+	_, err = h.StoredRetainedMessages()
+	require.Error(t, err)
+	_, err = h.StoredInflightMessages()
+	require.Error(t, err)
+	_, err = h.StoredBlacklist()
+	require.Error(t, err)
+	_, err = h.StoredOfflineMessages()
+	require.Error(t, err)
+	_, err = h.StoredRetainedMessagesByFilter("a/#")
+	require.Error(t, err)
+	_, err = h.StoredDelayedMessages()
+	require.Error(t, err)
+	_, err = h.StoredSysInfo()
+	require.Error(t, err)
+}
+
+func TestNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnWillSent(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+	h.OnSubscribed(client, pkf, []byte{0}, nil)
+	h.OnUnsubscribed(client, pkf, nil, nil)
+	h.OnRetainMessage(client, packets.Packet{}, 1)
+	h.OnRetainedExpired("a/b/c")
+	h.OnQosPublish(client, packets.Packet{}, 0, 0)
+	h.OnQosComplete(client, packets.Packet{})
+	h.OnQosDropped(client, packets.Packet{})
+	h.OnSysInfoTick(new(system.Info))
+	h.OnClientExpired(client)
+	h.OnBlacklistAdded(storage.BlacklistEntry{})
+	h.OnBlacklistDeleted(storage.BlacklistEntry{})
+	h.OnOfflineQueued(client, mqtt.OfflineMessage{})
+	h.OnOfflineDequeued(client, mqtt.OfflineMessage{})
+	h.OnDelayedAdded(mqtt.DelayedMessage{})
+	h.OnDelayedDeleted(mqtt.DelayedMessage{})
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, retained)
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+	bl, err := h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Empty(t, bl)
+	offline, err := h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Empty(t, offline)
+	retainedByFilter, err := h.StoredRetainedMessagesByFilter("a/#")
+	require.NoError(t, err)
+	require.Empty(t, retainedByFilter)
+	delayed, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Empty(t, delayed)
+	_, err = h.StoredSysInfo()
+	require.NoError(t, err)
+}
@@ -18,6 +18,9 @@ const (
 	RetainedKey     = "ret" // unique key to denote retained messages in a store
 	InflightKey     = "ifm" // unique key to denote inflight messages in a store
 	ClientKey       = "cl"  // unique key to denote clients in a store
+	BlacklistKey    = "bl"  // unique key to denote blacklist entries in a store
+	OfflineKey      = "off" // unique key to denote offline queued messages in a store
+	DelayedKey      = "dly" // unique key to denote delayed messages in a store
 )
 
 var (
@@ -89,6 +92,9 @@ type Message struct {
 	Created     int64               `json:"created"`                 // the time the message was created in unixtime
 	Sent        int64               `json:"sent,omitempty"`          // the last time the message was sent (for retries) in unixtime (if inflight)
 	PacketID    uint16              `json:"packet_id"`               // the unique id of the packet (if inflight)
+	Client      string              `json:"client,omitempty"`        // the id of the client the message is queued for (if offline)
+	Seq         uint64              `json:"seq,omitempty"`           // the position of the message in the client queue (if offline)
+	Due         int64               `json:"due,omitempty"`           // the time the message is due to be published in unixtime (if delayed)
 }
 
 // MessageProperties contains a limited subset of mqtt v5 properties specific to publish messages.
@@ -192,3 +198,27 @@ func (d *SystemInfo) UnmarshalBinary(data []byte) error {
 	}
 	return json.Unmarshal(data, d)
 }
+
+// BlacklistEntry is a storable representation of a banned client id, username or ip address.
+type BlacklistEntry struct {
+	T       string `json:"t,omitempty"`             // the data type
+	ID      string `json:"id,omitempty" storm:"id"` // the storage key
+	Kind    string `json:"kind"`                    // client-id, username or ip
+	Value   string `json:"value"`                   // the banned value, an ip address or cidr network for ip entries
+	Reason  string `json:"reason,omitempty"`        // why the value was banned
+	Created int64  `json:"created"`                 // the time the entry was created in unixtime
+	Expiry  int64  `json:"expiry,omitempty"`        // the time the entry expires in unixtime, or 0 if it never expires
+}
+
+// MarshalBinary encodes the values into a json string.
+func (d BlacklistEntry) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(d)
+}
+
+// UnmarshalBinary decodes a json string into a struct.
+func (d *BlacklistEntry) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, d)
+}
@@ -113,6 +113,17 @@ var (
 		},
 	}
 	sysInfoJSON = []byte(`{"version":"2.0.0","started":1,"time":0,"uptime":2,"bytes_received":3,"bytes_sent":4,"clients_connected":5,"clients_disconnected":0,"clients_maximum":7,"clients_total":0,"messages_received":10,"messages_sent":11,"messages_dropped":20,"retained":15,"inflight":16,"inflight_dropped":17,"subscriptions":0,"packets_received":12,"packets_sent":13,"memory_alloc":0,"threads":0,"t":"info","id":"id"}`)
+
+	blacklistStruct = BlacklistEntry{
+		T:       "bl",
+		ID:      "id",
+		Kind:    "ip",
+		Value:   "10.0.0.0/8",
+		Reason:  "abuse",
+		Created: 1,
+		Expiry:  2,
+	}
+	blacklistJSON = []byte(`{"t":"bl","id":"id","kind":"ip","value":"10.0.0.0/8","reason":"abuse","created":1,"expiry":2}`)
 )
 
 func TestClientMarshalBinary(t *testing.T) {
@@ -195,6 +206,26 @@ func TestSysInfoUnmarshalBinaryEmpty(t *testing.T) {
 	require.Equal(t, SystemInfo{}, d)
 }
 
+func TestBlacklistEntryMarshalBinary(t *testing.T) {
+	data, err := blacklistStruct.MarshalBinary()
+	require.NoError(t, err)
+	require.JSONEq(t, string(blacklistJSON), string(data))
+}
+
+func TestBlacklistEntryUnmarshalBinary(t *testing.T) {
+	d := BlacklistEntry{}
+	err := d.UnmarshalBinary(blacklistJSON)
+	require.NoError(t, err)
+	require.Equal(t, blacklistStruct, d)
+}
+
+func TestBlacklistEntryUnmarshalBinaryEmpty(t *testing.T) {
+	d := BlacklistEntry{}
+	err := d.UnmarshalBinary([]byte{})
+	require.NoError(t, err)
+	require.Equal(t, BlacklistEntry{}, d)
+}
+
 func TestMessageToPacket(t *testing.T) {
 	d := messageStruct
 	pk := d.ToPacket()
@@ -6,7 +6,9 @@ package mqtt
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -158,6 +160,50 @@ func (h *modifiedHookBase) StoredInflightMessages() (v []storage.Message, err er
 	}, nil
 }
 
+func (h *modifiedHookBase) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	if h.fail {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "r1", TopicName: filter},
+	}, nil
+}
+
+func (h *modifiedHookBase) StoredOfflineMessages() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 7 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "o1", Client: "mochi", Seq: 1},
+		{ID: "o2", Client: "mochi", Seq: 2},
+	}, nil
+}
+
+func (h *modifiedHookBase) StoredDelayedMessages() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 8 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "d1", TopicName: "a/b/c", Due: 100},
+		{ID: "d2", TopicName: "d/e/f", Due: 200},
+	}, nil
+}
+
+func (h *modifiedHookBase) StoredBlacklist() (v []storage.BlacklistEntry, err error) {
+	if h.fail || h.failAt == 6 {
+		return v, errTestHook
+	}
+
+	return []storage.BlacklistEntry{
+		{Kind: BlacklistClientID, Value: "b1"},
+		{Kind: BlacklistUsername, Value: "b2"},
+		{Kind: BlacklistIP, Value: "192.0.2.0/24"},
+	}, nil
+}
+
 func (h *modifiedHookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.fail || h.failAt == 5 {
 		return v, errTestHook
@@ -213,6 +259,55 @@ func TestHooksAddInitFailure(t *testing.T) {
 	require.Equal(t, int64(0), atomic.LoadInt64(&h.qty))
 }
 
+func TestHooksReplace(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(HookBase), nil))
+	old := &modifiedHookBase{fail: true}
+	require.NoError(t, h.Add(old, nil))
+
+	err := h.Replace(new(providesCheckHook), nil) // id "base" is found, but a different hook type
+	require.NoError(t, err)
+	require.IsType(t, new(providesCheckHook), h.GetAll()[0])
+
+	err = h.Replace(new(modifiedHookBase), map[string]any{})
+	require.Error(t, err)
+	require.Same(t, old, h.GetAll()[1])
+
+	nh := new(modifiedHookBase)
+	require.NoError(t, h.Replace(nh, nil))
+	require.Same(t, nh, h.GetAll()[1])
+	require.Equal(t, int64(2), h.Len())
+
+	err = h.Replace(new(HookBase), nil)
+	require.NoError(t, err)
+
+	h2 := new(Hooks)
+	require.ErrorIs(t, h2.Replace(new(HookBase), nil), ErrHookNotFound)
+
+	h.Stop()
+}
+
+type inheritHook struct {
+	modifiedHookBase
+	inherited Hook
+}
+
+func (h *inheritHook) Inherit(old Hook) {
+	h.inherited = old
+}
+
+func TestHooksReplaceInherit(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	old := new(modifiedHookBase)
+	require.NoError(t, h.Add(old, nil))
+
+	nh := new(inheritHook)
+	require.NoError(t, h.Replace(nh, nil))
+	require.Same(t, old, nh.inherited)
+}
+
 func TestHooksStop(t *testing.T) {
 	h := new(Hooks)
 	h.Log = logger
@@ -254,6 +349,13 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnWillSent(cl, packets.Packet{})
 			h.OnClientExpired(cl)
 			h.OnRetainedExpired("a/b/c")
+			h.OnBlacklistAdded(storage.BlacklistEntry{})
+			h.OnBlacklistDeleted(storage.BlacklistEntry{})
+			h.OnOfflineQueued(cl, OfflineMessage{})
+			h.OnOfflineDequeued(cl, OfflineMessage{})
+			h.OnDelayedAdded(DelayedMessage{})
+			h.OnDelayedDeleted(DelayedMessage{})
+			h.OnSelectSharedNodes(new(Subscribers), packets.Packet{})
 
 			// on second iteration, check added hook methods
 			err := h.Add(new(modifiedHookBase), nil)
@@ -288,6 +390,83 @@ func TestHooksOnACLCheck(t *testing.T) {
 	require.True(t, ok)
 }
 
+// restrictHook is an acl hook which refuses the topics under a prefix.
+type restrictHook struct {
+	HookBase
+	prefix string
+}
+
+func (h *restrictHook) ID() string {
+	return "restrict-" + h.prefix
+}
+
+func (h *restrictHook) Provides(b byte) bool {
+	return b == OnACLCheck
+}
+
+func (h *restrictHook) RestrictsACL() bool {
+	return true
+}
+
+func (h *restrictHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return !strings.HasPrefix(topic, h.prefix)
+}
+
+func TestHooksOnACLCheckRestrictor(t *testing.T) {
+	h := new(Hooks)
+	require.NoError(t, h.Add(&restrictHook{prefix: "a/"}, nil))
+	require.False(t, h.OnACLCheck(new(Client), "b/c", true)) // restrictors do not allow topics
+
+	require.NoError(t, h.Add(new(modifiedHookBase), nil))
+	require.NoError(t, h.Add(&restrictHook{prefix: "c/"}, nil)) // after the allowing hook
+	require.True(t, h.OnACLCheck(new(Client), "b/c", true))
+	require.False(t, h.OnACLCheck(new(Client), "a/b", true))
+	require.False(t, h.OnACLCheck(new(Client), "c/d", false))
+}
+
+func TestHooksLatencies(t *testing.T) {
+	h := new(Hooks)
+	require.Empty(t, h.Latencies())
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+
+	h.OnACLCheck(new(Client), "a/b/c", true)
+	h.OnACLCheck(new(Client), "a/b/c", false)
+	h.OnSessionEstablish(new(Client), packets.Packet{})
+
+	lats := h.Latencies()
+	require.Len(t, lats, 1)
+	require.Equal(t, uint64(2), lats[HookLatencyKey{Hook: "modified", Method: OnACLCheck}].Count)
+	require.Equal(t, "OnACLCheck", HookMethodName(OnACLCheck))
+}
+
+func TestHooksErrors(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	hook := new(modifiedHookBase)
+	err := h.Add(hook, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"modified": 0}, h.Errors())
+
+	hook.fail = true
+	_, _ = h.OnPublish(new(Client), packets.Packet{})
+	_, _ = h.OnPacketRead(new(Client), packets.Packet{})
+	require.Equal(t, int64(2), h.Errors()["modified"])
+
+	hook.err = packets.ErrRejectPacket // rejections are not errors
+	_, _ = h.OnPublish(new(Client), packets.Packet{})
+	require.Equal(t, int64(2), h.Errors()["modified"])
+
+	for _, code := range []error{packets.ErrQuotaExceeded, packets.CodeSuccessIgnore, fmt.Errorf("wrapped: %w", packets.ErrNotAuthorized)} {
+		hook.err = code // nor are other reason codes
+		_, err = h.OnPublish(new(Client), packets.Packet{})
+		require.ErrorIs(t, err, code)
+	}
+	require.Equal(t, int64(2), h.Errors()["modified"])
+}
+
 func TestHooksOnSubscribe(t *testing.T) {
 	h := new(Hooks)
 	err := h.Add(new(modifiedHookBase), nil)
@@ -317,6 +496,21 @@ func TestHooksOnSelectSubscribers(t *testing.T) {
 	require.EqualValues(t, subs, subs2)
 }
 
+func TestHooksOnSelectSharedNodes(t *testing.T) {
+	h := new(Hooks)
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+
+	subs := &Subscribers{
+		Shared: map[string]map[string]packets.Subscription{
+			"$share/g/a/b/c": {"cl1": {Filter: "$share/g/a/b/c"}},
+		},
+	}
+
+	subs2 := h.OnSelectSharedNodes(subs, packets.Packet{})
+	require.EqualValues(t, subs, subs2)
+}
+
 func TestHooksOnUnsubscribe(t *testing.T) {
 	h := new(Hooks)
 	err := h.Add(new(modifiedHookBase), nil)
@@ -652,6 +846,123 @@ func TestHookBaseStoredInflightMessages(t *testing.T) {
 	require.Empty(t, v)
 }
 
+func TestHooksStoredBlacklist(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Len(t, v, 3)
+
+	hook.fail = true
+	v, err = h.StoredBlacklist()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
+func TestHooksStoredOfflineMessages(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 2)
+
+	hook.fail = true
+	v, err = h.StoredOfflineMessages()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
+func TestHooksStoredDelayedMessages(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 2)
+
+	hook.fail = true
+	v, err = h.StoredDelayedMessages()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
+func TestHooksStoredRetainedMessagesByFilter(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredRetainedMessagesByFilter("a/b/c")
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredRetainedMessagesByFilter("a/b/c")
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+	require.Equal(t, "a/b/c", v[0].TopicName)
+
+	hook.fail = true
+	v, err = h.StoredRetainedMessagesByFilter("a/b/c")
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
+func TestHookBaseStoredRetainedMessagesByFilter(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredRetainedMessagesByFilter("a/b/c")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestHookBaseStoredDelayedMessages(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredDelayedMessages()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestHookBaseStoredOfflineMessages(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredOfflineMessages()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestHookBaseStoredBlacklist(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredBlacklist()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
 func TestHookBaseStoredRetainedMessages(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredRetainedMessages()
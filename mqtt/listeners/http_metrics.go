@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+const (
+	// MetricsNamespace prefixes all exported metric names.
+	MetricsNamespace = "comqtt"
+
+	// MetricsPath is the path the metrics are served on.
+	MetricsPath = "/metrics"
+
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// MetricsCollector writes a set of metrics to w whenever the endpoint is scraped.
+type MetricsCollector func(w *MetricsWriter)
+
+// HTTPMetrics is a listener for presenting the server stats in the Prometheus text exposition format.
+type HTTPMetrics struct {
+	sync.RWMutex
+	id         string             // the internal id of the listener
+	address    string             // the network address to bind to
+	config     *Config            // configuration values for the listener
+	listen     *http.Server       // the http server
+	sysInfo    *system.Info       // pointers to the server data
+	collectors []MetricsCollector // additional collectors, such as the server or cluster collectors
+	end        uint32             // ensure the close methods are only called once
+}
+
+// NewHTTPMetrics initialises and returns a new HTTP metrics listener, listening on an address.
+func NewHTTPMetrics(id, address string, config *Config, sysInfo *system.Info, collectors ...MetricsCollector) *HTTPMetrics {
+	if config == nil {
+		config = new(Config)
+	}
+	return &HTTPMetrics{
+		id:         id,
+		address:    address,
+		config:     config,
+		sysInfo:    sysInfo,
+		collectors: collectors,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *HTTPMetrics) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *HTTPMetrics) Address() string {
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *HTTPMetrics) Protocol() string {
+	if l.listen != nil && l.listen.TLSConfig != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Init initializes the listener.
+func (l *HTTPMetrics) Init(_ *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, l.Handler)
+	l.listen = &http.Server{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Addr:         l.address,
+		Handler:      mux,
+	}
+
+	if l.config.TLSConfig != nil {
+		l.listen.TLSConfig = l.config.TLSConfig
+	}
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving responses.
+func (l *HTTPMetrics) Serve(establish EstablishFn) {
+	if l.listen.TLSConfig != nil {
+		_ = l.listen.ListenAndServeTLS("", "")
+	} else {
+		_ = l.listen.ListenAndServe()
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *HTTPMetrics) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = l.listen.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
+
+// Handler is an HTTP handler which outputs all metrics. It may also be mounted
+// on an existing mux, such as the stats listener.
+func (l *HTTPMetrics) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	mw := NewMetricsWriter(w)
+	if l.sysInfo != nil {
+		WriteSysInfoMetrics(mw, l.sysInfo)
+	}
+
+	for _, c := range l.collectors {
+		c(mw)
+	}
+}
+
+// WriteSysInfoMetrics writes every field of the $SYS info as a metric.
+func WriteSysInfoMetrics(mw *MetricsWriter, sysInfo *system.Info) {
+	info := sysInfo.Clone()
+	mw.Gauge("info", "Broker version information.", 1, "version", info.Version)
+	mw.Gauge("started_timestamp_seconds", "The time the server started in unix seconds.", float64(info.Started))
+	mw.Gauge("time_seconds", "The current time on the server in unix seconds.", float64(info.Time))
+	mw.Gauge("uptime_seconds", "The number of seconds the server has been online.", float64(info.Uptime))
+	mw.Counter("bytes_received_total", "Total number of bytes received since the broker started.", float64(info.BytesReceived))
+	mw.Counter("bytes_sent_total", "Total number of bytes sent since the broker started.", float64(info.BytesSent))
+	mw.Gauge("clients_connected", "Number of currently connected clients.", float64(info.ClientsConnected))
+	mw.Gauge("clients_disconnected", "Number of persistent clients registered but currently disconnected.", float64(info.ClientsDisconnected))
+	mw.Gauge("clients_maximum", "Maximum number of active clients that have been connected.", float64(info.ClientsMaximum))
+	mw.Gauge("clients_total", "Total number of connected and disconnected persistent clients.", float64(info.ClientsTotal))
+	mw.Counter("messages_received_total", "Total number of publish messages received.", float64(info.MessagesReceived))
+	mw.Counter("messages_sent_total", "Total number of publish messages sent.", float64(info.MessagesSent))
+	mw.Counter("messages_dropped_total", "Total number of publish messages dropped to slow subscribers.", float64(info.MessagesDropped))
+	mw.Gauge("retained", "Number of retained messages active on the broker.", float64(info.Retained))
+	mw.Gauge("inflight", "Number of messages currently in-flight.", float64(info.Inflight))
+	mw.Counter("inflight_dropped_total", "Total number of inflight messages which were dropped.", float64(info.InflightDropped))
+	mw.Gauge("subscriptions", "Number of subscriptions active on the broker.", float64(info.Subscriptions))
+	mw.Counter("packets_received_total", "Total number of packets received.", float64(info.PacketsReceived))
+	mw.Counter("packets_sent_total", "Total number of packets sent.", float64(info.PacketsSent))
+	mw.Gauge("memory_alloc_bytes", "Memory currently allocated.", float64(info.MemoryAlloc))
+	mw.Gauge("threads", "Number of active goroutines.", float64(info.Threads))
+}
+
+// MetricsWriter writes metrics in the Prometheus text exposition format. The HELP
+// and TYPE lines are written once for each metric name, so samples of the same
+// metric should be written consecutively.
+type MetricsWriter struct {
+	w    io.Writer
+	seen map[string]struct{}
+}
+
+// NewMetricsWriter returns a new metrics writer which writes to w.
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{
+		w:    w,
+		seen: make(map[string]struct{}),
+	}
+}
+
+// Gauge writes a gauge sample. Labels are given as key, value pairs.
+func (m *MetricsWriter) Gauge(name, help string, value float64, labels ...string) {
+	name = MetricsNamespace + "_" + name
+	m.header(name, help, "gauge")
+	m.sample(name, value, labels)
+}
+
+// Counter writes a counter sample. Labels are given as key, value pairs.
+func (m *MetricsWriter) Counter(name, help string, value float64, labels ...string) {
+	name = MetricsNamespace + "_" + name
+	m.header(name, help, "counter")
+	m.sample(name, value, labels)
+}
+
+// Histogram writes the buckets, sum and count of a histogram snapshot. Labels are
+// given as key, value pairs.
+func (m *MetricsWriter) Histogram(name, help string, s system.HistogramSnapshot, labels ...string) {
+	name = MetricsNamespace + "_" + name
+	m.header(name, help, "histogram")
+	labels = labels[:len(labels):len(labels)] // force a copy when appending the bucket label
+	for i, b := range s.Bounds {
+		m.sample(name+"_bucket", float64(s.Counts[i]), append(labels, "le", formatFloat(b)))
+	}
+	m.sample(name+"_bucket", float64(s.Count), append(labels, "le", "+Inf"))
+	m.sample(name+"_sum", s.Sum, labels)
+	m.sample(name+"_count", float64(s.Count), labels)
+}
+
+// header writes the HELP and TYPE lines for a metric if they have not yet been written.
+func (m *MetricsWriter) header(name, help, typ string) {
+	if _, ok := m.seen[name]; ok {
+		return
+	}
+
+	m.seen[name] = struct{}{}
+	_, _ = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single sample line.
+func (m *MetricsWriter) sample(name string, value float64, labels []string) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 1 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(labels[i])
+			sb.WriteString(`="`)
+			sb.WriteString(labelEscaper.Replace(labels[i+1]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	sb.WriteByte('\n')
+	_, _ = io.WriteString(m.w, sb.String())
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
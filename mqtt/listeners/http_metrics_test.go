@@ -0,0 +1,168 @@
+package listeners
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPMetrics(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.NotNil(t, l.config)
+}
+
+func TestHTTPMetricsID(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, nil)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestHTTPMetricsAddress(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, nil)
+	require.Equal(t, testAddr, l.Address())
+}
+
+func TestHTTPMetricsProtocol(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, nil)
+	require.Equal(t, "http", l.Protocol())
+}
+
+func TestHTTPMetricsTLSProtocol(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	}, nil)
+
+	_ = l.Init(logger)
+	require.Equal(t, "https", l.Protocol())
+}
+
+func TestHTTPMetricsInit(t *testing.T) {
+	sysInfo := new(system.Info)
+	l := NewHTTPMetrics("t1", testAddr, nil, sysInfo)
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	require.Equal(t, sysInfo, l.sysInfo)
+	require.NotNil(t, l.listen)
+	require.Equal(t, testAddr, l.listen.Addr)
+}
+
+func TestHTTPMetricsHandler(t *testing.T) {
+	sysInfo := &system.Info{
+		Version:          "test",
+		ClientsConnected: 3,
+		BytesSent:        42,
+	}
+
+	l := NewHTTPMetrics("t1", testAddr, nil, sysInfo, func(w *MetricsWriter) {
+		w.Gauge("listener_connections", "Connections.", 2, "listener", "t1")
+		w.Gauge("listener_connections", "Connections.", 1, "listener", "t2")
+	})
+
+	rec := httptest.NewRecorder()
+	l.Handler(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, metricsContentType, rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	require.Contains(t, body, `comqtt_info{version="test"} 1`)
+	require.Contains(t, body, "# TYPE comqtt_clients_connected gauge\ncomqtt_clients_connected 3\n")
+	require.Contains(t, body, "# TYPE comqtt_bytes_sent_total counter\ncomqtt_bytes_sent_total 42\n")
+	require.Contains(t, body, "comqtt_listener_connections{listener=\"t1\"} 2\ncomqtt_listener_connections{listener=\"t2\"} 1\n")
+	require.Equal(t, 1, bytes.Count(rec.Body.Bytes(), []byte("# TYPE comqtt_listener_connections")))
+}
+
+func TestHTTPMetricsHandlerMethodNotAllowed(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, new(system.Info))
+	rec := httptest.NewRecorder()
+	l.Handler(rec, httptest.NewRequest(http.MethodPost, MetricsPath, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Empty(t, rec.Body.String())
+}
+
+func TestMetricsWriterHistogram(t *testing.T) {
+	var buf bytes.Buffer
+	h := system.NewHistogram(0.001, 0.01)
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Second)
+
+	labels := make([]string, 2, 8)
+	labels[0], labels[1] = "hook", "OnPublish"
+	mw := NewMetricsWriter(&buf)
+	mw.Histogram("hook_duration_seconds", "Hook latency.", h.Snapshot(), labels...)
+
+	out := buf.String()
+	require.Contains(t, out, "# TYPE comqtt_hook_duration_seconds histogram\n")
+	require.Contains(t, out, `comqtt_hook_duration_seconds_bucket{hook="OnPublish",le="0.001"} 1`)
+	require.Contains(t, out, `comqtt_hook_duration_seconds_bucket{hook="OnPublish",le="0.01"} 1`)
+	require.Contains(t, out, `comqtt_hook_duration_seconds_bucket{hook="OnPublish",le="+Inf"} 2`)
+	require.Contains(t, out, `comqtt_hook_duration_seconds_sum{hook="OnPublish"} 1.0005`)
+	require.Contains(t, out, `comqtt_hook_duration_seconds_count{hook="OnPublish"} 2`)
+	require.Equal(t, []string{"hook", "OnPublish"}, labels)
+}
+
+func TestMetricsWriterEscapesLabels(t *testing.T) {
+	var buf bytes.Buffer
+	NewMetricsWriter(&buf).Gauge("x", "X.", 1, "id", "a\"b\\c\nd")
+	require.Contains(t, buf.String(), `comqtt_x{id="a\"b\\c\nd"} 1`)
+}
+
+func TestHTTPMetricsServeAndClose(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, nil, &system.Info{Version: "test"})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	resp, err := http.Get("http://localhost" + testAddr + MetricsPath)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `comqtt_info{version="test"} 1`)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.Equal(t, true, closed)
+
+	_, err = http.Get("http://localhost" + testAddr)
+	require.Error(t, err)
+	<-o
+}
+
+func TestHTTPMetricsServeTLSAndClose(t *testing.T) {
+	l := NewHTTPMetrics("t1", testAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	}, new(system.Info))
+
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+	l.Close(MockCloser)
+}
@@ -17,6 +17,16 @@ type Config struct {
 	// TLSConfig is a tls.Config configuration to be used with the listener.
 	// See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+
+	// ProxyProtocol reads the PROXY protocol v1 or v2 header which a load balancer sends at
+	// the start of each TCP connection, so the client address is that of the real client.
+	ProxyProtocol bool
+
+	// TrustedProxies are the ip addresses or networks, such as 10.0.0.0/8, of the proxies
+	// whose PROXY protocol headers or Forwarded and X-Forwarded-For headers are trusted.
+	// Proxy headers are only read from trusted proxies, so the PROXY protocol requires them;
+	// 0.0.0.0/0 and ::/0 trust every address.
+	TrustedProxies []string
 }
 
 // EstablishFn is a callback function for establishing new clients.
@@ -65,6 +75,17 @@ func (l *Listeners) Get(id string) (Listener, bool) {
 	return val, ok
 }
 
+// GetAll returns a copy of the listeners map.
+func (l *Listeners) GetAll() map[string]Listener {
+	l.RLock()
+	defer l.RUnlock()
+	m := make(map[string]Listener, len(l.internal))
+	for k, v := range l.internal {
+		m[k] = v
+	}
+	return m
+}
+
 // Len returns the length of the listeners map.
 func (l *Listeners) Len() int {
 	l.RLock()
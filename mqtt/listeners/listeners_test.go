@@ -90,6 +90,20 @@ func TestGetListener(t *testing.T) {
 	require.Equal(t, g.ID(), "t1")
 }
 
+func TestGetAllListeners(t *testing.T) {
+	l := New()
+	l.Add(NewMockListener("t1", testAddr))
+	l.Add(NewMockListener("t2", testAddr))
+
+	m := l.GetAll()
+	require.Len(t, m, 2)
+	require.Contains(t, m, "t1")
+	require.Contains(t, m, "t2")
+
+	delete(m, "t1")
+	require.Equal(t, 2, l.Len())
+}
+
 func TestLenListener(t *testing.T) {
 	l := New()
 	l.Add(NewMockListener("t1", testAddr))
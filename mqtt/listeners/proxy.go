@@ -0,0 +1,372 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types of the TLV fields of a PROXY protocol v2 header.
+const (
+	ProxyTLVALPN      byte = 0x01 // the application protocol negotiated by the proxy
+	ProxyTLVAuthority byte = 0x02 // the host name sent by the client, such as the tls sni
+	ProxyTLVCRC32C    byte = 0x03 // the checksum of the header
+	ProxyTLVNoop      byte = 0x04 // padding
+	ProxyTLVUniqueID  byte = 0x05 // an id of the connection given by the proxy
+	ProxyTLVSSL       byte = 0x20 // the tls details of a connection terminated by the proxy
+	ProxyTLVNetNS     byte = 0x30 // the network namespace of the proxy
+)
+
+const proxyHeaderTimeout = 5 * time.Second // the time a proxy has to send the PROXY protocol header
+
+var (
+	// ErrInvalidProxyHeader indicates that a connection did not start with a valid PROXY protocol header.
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+	// ErrInvalidTrustedProxy indicates that a trusted proxy is not an ip address or network.
+	ErrInvalidTrustedProxy = errors.New("invalid trusted proxy")
+
+	// ErrNoTrustedProxies indicates that the PROXY protocol is enabled without trusted proxies.
+	ErrNoTrustedProxies = errors.New("the proxy protocol requires trusted proxies")
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyConn is a connection whose addresses were given by the PROXY protocol header sent
+// by the proxy which accepted it.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader   // reads the connection after the header
+	remote net.Addr        // the address of the client, if given by the header
+	local  net.Addr        // the address the client connected to, if given by the header
+	tlvs   map[byte][]byte // the tlv fields of a v2 header, keyed on type
+}
+
+// newProxyConn reads the PROXY protocol v1 or v2 header of a connection.
+func newProxyConn(c net.Conn) (*proxyConn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+	}
+
+	b, err := pc.r.Peek(len(proxyV2Signature)) // shorter than any v1 header
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+
+	switch {
+	case bytes.Equal(b, proxyV2Signature):
+		err = pc.readV2()
+	case bytes.HasPrefix(b, proxyV1Prefix):
+		err = pc.readV1()
+	default:
+		err = ErrInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, c.SetReadDeadline(time.Time{})
+}
+
+// readV1 reads a human-readable v1 header, such as PROXY TCP4 1.2.3.4 5.6.7.8 1234 1883.
+func (c *proxyConn) readV1() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil // the proxy does not know the addresses, so the connection is used as is
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrInvalidProxyHeader
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	if src.Addr().Is4() != (fields[1] == "TCP4") {
+		return ErrInvalidProxyHeader
+	}
+
+	c.remote, c.local = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+	return nil
+}
+
+// parseProxyV1Addr parses an address and port of a v1 header.
+func parseProxyV1Addr(addr, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// readV2 reads a binary v2 header and its tlv fields.
+func (c *proxyConn) readV2() error {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		return ErrInvalidProxyHeader
+	}
+
+	if head[12]>>4 != 2 {
+		return ErrInvalidProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return ErrInvalidProxyHeader
+	}
+
+	switch head[12] & 0x0f {
+	case 0x00: // LOCAL, such as a health check of the proxy, which uses the connection as is
+		return nil
+	case 0x01: // PROXY
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	var n int
+	switch head[13] >> 4 {
+	case 0x01: // AF_INET
+		n = 12
+		if len(body) < n {
+			return ErrInvalidProxyHeader
+		}
+		src, _ := netip.AddrFromSlice(body[0:4])
+		dst, _ := netip.AddrFromSlice(body[4:8])
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[10:12])))
+	case 0x02: // AF_INET6
+		n = 36
+		if len(body) < n {
+			return ErrInvalidProxyHeader
+		}
+		src, _ := netip.AddrFromSlice(body[0:16])
+		dst, _ := netip.AddrFromSlice(body[16:32])
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:34])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[34:36])))
+	case 0x03: // AF_UNIX, whose addresses are not used
+		n = 216
+		if len(body) < n {
+			return ErrInvalidProxyHeader
+		}
+	}
+
+	tlvs, err := parseProxyTLVs(body[n:])
+	if err != nil {
+		return err
+	}
+	c.tlvs = tlvs
+
+	return nil
+}
+
+// parseProxyTLVs parses the tlv fields which follow the addresses of a v2 header.
+func parseProxyTLVs(b []byte) (map[byte][]byte, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	tlvs := map[byte][]byte{}
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		if b[0] != ProxyTLVNoop {
+			tlvs[b[0]] = append([]byte{}, b[3:3+n]...)
+		}
+		b = b[3+n:]
+	}
+
+	return tlvs, nil
+}
+
+// Read reads the connection after the header.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the client given by the header, or the address of the
+// proxy if the header did not give one.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to given by the header, or the local
+// address of the connection if the header did not give one.
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyTLVs returns the tlv fields of a v2 header, keyed on type.
+func (c *proxyConn) ProxyTLVs() map[byte][]byte {
+	return c.tlvs
+}
+
+// trustedProxies returns the trusted proxies of a listener config. Any client could send a
+// proxy header, so the PROXY protocol must name the proxies it trusts.
+func trustedProxies(config *Config) ([]netip.Prefix, error) {
+	if config.ProxyProtocol && len(config.TrustedProxies) == 0 {
+		return nil, ErrNoTrustedProxies
+	}
+
+	return parseTrustedProxies(config.TrustedProxies)
+}
+
+// parseTrustedProxies parses trusted proxy ip addresses and networks, such as 10.0.0.1 or 10.0.0.0/8.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	trusted := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if prefix, err := netip.ParsePrefix(p); err == nil {
+			trusted = append(trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, p)
+		}
+		trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return trusted, nil
+}
+
+// isTrustedProxy returns true if the ip of an address is one of the trusted proxies.
+func isTrustedProxy(trusted []netip.Prefix, addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := ap.Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the address of the client of a request forwarded by trusted proxies,
+// taken from the Forwarded header, or the X-Forwarded-For header if there is none. The
+// addresses are read from the last, skipping trusted proxies, so a client cannot choose its
+// address by sending the header itself. It returns nil if the request was not sent by a
+// trusted proxy.
+func forwardedFor(trusted []netip.Prefix, r *http.Request) net.Addr {
+	if len(trusted) == 0 {
+		return nil
+	}
+
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(trusted, net.TCPAddrFromAddrPort(remote)) {
+		return nil
+	}
+
+	hops := forwardedHops(r.Header)
+	var addr net.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ap, ok := parseForwardedNode(hops[i])
+		if !ok {
+			break // such as unknown or an obfuscated identifier
+		}
+
+		addr = net.TCPAddrFromAddrPort(ap)
+		if !isTrustedProxy(trusted, addr) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// forwardedHops returns the client addresses of the Forwarded or X-Forwarded-For headers
+// of a request, with the client first.
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hops = append(hops, strings.Trim(v, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// parseForwardedNode parses a forwarded client address, which may have a port.
+func parseForwardedNode(s string) (netip.AddrPort, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(addr.Unmap(), 0), true
+}
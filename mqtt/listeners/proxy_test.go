@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a v2 header with a command, family, address block and tlv field.
+func proxyV2Header(cmd, fam byte, addrs []byte, tlv byte, value []byte) []byte {
+	body := append([]byte{}, addrs...)
+	if value != nil {
+		body = append(body, tlv)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(value)))
+		body = append(body, value...)
+	}
+
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+// readTestProxyConn writes a header and payload to a connection, and reads the header.
+func readTestProxyConn(t *testing.T, header []byte) (*proxyConn, error) {
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+
+	go func() {
+		_, _ = w.Write(append(header, 0x10, 0x00))
+	}()
+
+	return newProxyConn(r)
+}
+
+func TestProxyConnV1(t *testing.T) {
+	pc, err := readTestProxyConn(t, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:51000", pc.RemoteAddr().String())
+	require.Equal(t, "192.0.2.1:1883", pc.LocalAddr().String())
+	require.Nil(t, pc.ProxyTLVs())
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(pc, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, buf)
+}
+
+func TestProxyConnV1IPv6(t *testing.T) {
+	pc, err := readTestProxyConn(t, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:51000", pc.RemoteAddr().String())
+}
+
+func TestProxyConnV1Unknown(t *testing.T) {
+	pc, err := readTestProxyConn(t, []byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "pipe", pc.RemoteAddr().String())
+	require.Equal(t, "pipe", pc.LocalAddr().String())
+}
+
+func TestProxyConnV1Invalid(t *testing.T) {
+	tt := []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51000\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 51000 1883\n",
+		"PROXY TCP4 2001:db8::7 192.0.2.1 51000 1883\r\n",
+		"PROXY TCP4 203.0.113.x 192.0.2.1 51000 1883\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.x 51000 1883\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 510000 1883\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 51000 1883\r\n",
+		"\x10\x10\x00\x04MQTT\x05\x02\x00\x3c\x00\x00\x00\x00",
+	}
+
+	for _, tx := range tt {
+		t.Run(tx, func(t *testing.T) {
+			_, err := readTestProxyConn(t, []byte(tx))
+			require.ErrorIs(t, err, ErrInvalidProxyHeader)
+		})
+	}
+}
+
+func TestProxyConnV2(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x07, 0x5b}
+	pc, err := readTestProxyConn(t, proxyV2Header(0x21, 0x11, addrs, ProxyTLVAuthority, []byte("broker.example.com")))
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:51000", pc.RemoteAddr().String())
+	require.Equal(t, "192.0.2.1:1883", pc.LocalAddr().String())
+	require.Equal(t, map[byte][]byte{ProxyTLVAuthority: []byte("broker.example.com")}, pc.ProxyTLVs())
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(pc, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, buf)
+}
+
+func TestProxyConnV2IPv6(t *testing.T) {
+	src := netip.MustParseAddr("2001:db8::7").As16()
+	dst := netip.MustParseAddr("2001:db8::1").As16()
+	addrs := append(append(src[:], dst[:]...), 0xc7, 0x38, 0x07, 0x5b)
+	pc, err := readTestProxyConn(t, proxyV2Header(0x21, 0x21, addrs, 0, nil))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:51000", pc.RemoteAddr().String())
+	require.Equal(t, "[2001:db8::1]:1883", pc.LocalAddr().String())
+	require.Nil(t, pc.ProxyTLVs())
+}
+
+func TestProxyConnV2Local(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x07, 0x5b}
+	pc, err := readTestProxyConn(t, proxyV2Header(0x20, 0x11, addrs, 0, nil))
+	require.NoError(t, err)
+	require.Equal(t, "pipe", pc.RemoteAddr().String())
+}
+
+func TestProxyConnV2Noop(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x07, 0x5b}
+	pc, err := readTestProxyConn(t, proxyV2Header(0x21, 0x11, addrs, ProxyTLVNoop, []byte{0, 0}))
+	require.NoError(t, err)
+	require.Empty(t, pc.ProxyTLVs())
+}
+
+func TestProxyConnV2Invalid(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x07, 0x5b}
+	shortTLV := append(proxyV2Header(0x21, 0x11, addrs, 0, nil), ProxyTLVAuthority, 0x00, 0x10, 'a')
+	binary.BigEndian.PutUint16(shortTLV[14:16], uint16(len(addrs)+4))
+
+	tt := []struct {
+		desc   string
+		header []byte
+	}{
+		{desc: "version", header: proxyV2Header(0x11, 0x11, addrs, 0, nil)},
+		{desc: "command", header: proxyV2Header(0x22, 0x11, addrs, 0, nil)},
+		{desc: "short ipv4", header: proxyV2Header(0x21, 0x11, addrs[:8], 0, nil)},
+		{desc: "short ipv6", header: proxyV2Header(0x21, 0x21, addrs, 0, nil)},
+		{desc: "short unix", header: proxyV2Header(0x21, 0x31, addrs, 0, nil)},
+		{desc: "short tlv", header: shortTLV},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			_, err := readTestProxyConn(t, tx.header)
+			require.ErrorIs(t, err, ErrInvalidProxyHeader)
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.1.2.3/8", "192.0.2.1", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}, trusted)
+
+	_, err = parseTrustedProxies([]string{"proxy"})
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.True(t, isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}))
+	require.True(t, isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 80}))
+	require.True(t, isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}))
+	require.False(t, isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}))
+	require.False(t, isTrustedProxy(trusted, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tt := []struct {
+		desc   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{
+			desc:   "x-forwarded-for",
+			remote: "10.0.0.1:40000",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+			want:   "203.0.113.7:0",
+		},
+		{
+			desc:   "x-forwarded-for spoofed by client",
+			remote: "10.0.0.1:40000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.2"}},
+			want:   "203.0.113.7:0",
+		},
+		{
+			desc:   "forwarded",
+			remote: "10.0.0.1:40000",
+			header: http.Header{
+				"Forwarded":       {`for="[2001:db8::7]:51000";proto=https, for=10.0.0.2;by=10.0.0.1`},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "[2001:db8::7]:51000",
+		},
+		{
+			desc:   "forwarded with port",
+			remote: "10.0.0.1:40000",
+			header: http.Header{"Forwarded": {"For=203.0.113.7:51000"}},
+			want:   "203.0.113.7:51000",
+		},
+		{
+			desc:   "obfuscated client",
+			remote: "10.0.0.1:40000",
+			header: http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+			want:   "10.0.0.2:0",
+		},
+		{
+			desc:   "untrusted remote",
+			remote: "192.0.2.1:40000",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.7"}},
+		},
+		{
+			desc:   "no header",
+			remote: "10.0.0.1:40000",
+			header: http.Header{},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			addr := forwardedFor(trusted, &http.Request{RemoteAddr: tx.remote, Header: tx.header})
+			if tx.want == "" {
+				require.Nil(t, addr)
+				return
+			}
+			require.NotNil(t, addr)
+			require.Equal(t, tx.want, addr.String())
+		})
+	}
+
+	addr := forwardedFor(nil, &http.Request{RemoteAddr: "10.0.0.1:40000", Header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}})
+	require.Nil(t, addr)
+}
@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICNextProto is the ALPN protocol negotiated by MQTT over QUIC clients.
+const QUICNextProto = "mqtt"
+
+const (
+	quicStreamTimeout = 10 * time.Second // the time a new connection has to open its stream
+	quicCloseTimeout  = time.Second      // the time a client has to read the last packets before its connection is closed
+)
+
+var (
+	// ErrQUICRequiresTLS indicates that a QUIC listener was created without a tls config.
+	ErrQUICRequiresTLS = errors.New("quic listener requires a tls config")
+)
+
+// QUIC is a listener for establishing client connections over QUIC, carrying MQTT on
+// the first bidirectional stream of each connection. As QUIC connections are not bound to
+// the address of the client, a client keeps its session when its address changes.
+type QUIC struct {
+	sync.RWMutex
+	id        string          // the internal id of the listener
+	address   string          // the network address to bind to
+	transport *quic.Transport // the udp socket shared by the connections of the listener
+	listen    *quic.Listener  // a quic.Listener which will listen for new clients
+	config    *Config         // configuration values for the listener
+	log       *slog.Logger    // server logger
+	end       uint32          // ensure the close methods are only called once
+}
+
+// NewQUIC initialises and returns a new QUIC listener, listening on an address.
+func NewQUIC(id, address string, config *Config) *QUIC {
+	if config == nil {
+		config = new(Config)
+	}
+
+	return &QUIC{
+		id:      id,
+		address: address,
+		config:  config,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *QUIC) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *QUIC) Address() string {
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *QUIC) Protocol() string {
+	return "quic"
+}
+
+// Init initializes the listener.
+func (l *QUIC) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.config.TLSConfig == nil {
+		return ErrQUICRequiresTLS
+	}
+
+	tlsConfig := l.config.TLSConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{QUICNextProto}
+	}
+
+	conn, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return err
+	}
+
+	l.transport = &quic.Transport{Conn: conn}
+	l.listen, err = l.transport.Listen(tlsConfig, &quic.Config{
+		KeepAlivePeriod: 15 * time.Second,
+	})
+	if err != nil {
+		_ = l.transport.Close()
+		_ = conn.Close()
+	}
+
+	return err
+}
+
+// Serve starts waiting for new QUIC connections, and calls the establish
+// connection callback for the stream of any received.
+func (l *QUIC) Serve(establish EstablishFn) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go func() {
+				ctx, cancel := context.WithTimeout(conn.Context(), quicStreamTimeout)
+				defer cancel()
+
+				stream, err := conn.AcceptStream(ctx)
+				if err != nil {
+					_ = conn.CloseWithError(0, "no stream")
+					return
+				}
+
+				err = establish(l.id, &quicConn{Stream: stream, conn: conn})
+				if err != nil {
+					l.log.Warn("", "error", err)
+				}
+			}()
+		}
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *QUIC) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.listen != nil {
+		_ = l.listen.Close()
+		_ = l.transport.Close()
+		_ = l.transport.Conn.Close()
+	}
+}
+
+// quicConn is the stream of a QUIC connection which satisfies the net.Conn interface.
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the current address of the client, which changes if the client migrates.
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the stream, and closes the connection once the client has closed it or
+// the close timeout has passed, so the client can read the last packets sent to it.
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	go func() {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(quicCloseTimeout):
+		}
+		_ = c.conn.CloseWithError(0, "")
+	}()
+
+	return err
+}
+
+// ConnectionState returns the tls state of the connection.
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+const testQUICAddr = "127.0.0.1:22223"
+
+func newTestQUICTransport(t *testing.T) *quic.Transport {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	tr := &quic.Transport{Conn: udp}
+	t.Cleanup(func() {
+		_ = tr.Close()
+	})
+	return tr
+}
+
+func dialTestQUIC(t *testing.T, tr *quic.Transport) *quic.Conn {
+	addr, err := net.ResolveUDPAddr("udp", testQUICAddr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := tr.Dial(ctx, addr, &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec
+		NextProtos:         []string{QUICNextProto},
+	}, nil)
+	require.NoError(t, err)
+	return conn
+}
+
+func TestNewQUIC(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testQUICAddr, l.address)
+	require.NotNil(t, l.config)
+}
+
+func TestQUICID(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, nil)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestQUICAddress(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, nil)
+	require.Equal(t, testQUICAddr, l.Address())
+}
+
+func TestQUICProtocol(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, nil)
+	require.Equal(t, "quic", l.Protocol())
+}
+
+func TestQUICInitRequiresTLS(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, nil)
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrQUICRequiresTLS)
+}
+
+func TestQUICInit(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	l.Close(MockCloser)
+	require.Empty(t, tlsConfigBasic.NextProtos) // the shared tls config is not modified
+}
+
+func TestQUICServeAndClose(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
+
+func TestQUICEstablish(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	received := make(chan []byte)
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Equal(t, "t1", id)
+		require.Equal(t, "127.0.0.1:22223", c.LocalAddr().String())
+		require.NotNil(t, c.RemoteAddr())
+		require.Equal(t, QUICNextProto, c.(*quicConn).ConnectionState().NegotiatedProtocol)
+
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(c, buf)
+		require.NoError(t, err)
+		received <- buf
+
+		_, err = c.Write([]byte("pong"))
+		require.NoError(t, err)
+		return c.Close()
+	})
+
+	conn := dialTestQUIC(t, newTestQUICTransport(t))
+	stream, err := conn.OpenStreamSync(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	require.Equal(t, []byte("ping"), <-received)
+
+	// the last packets are read before the connection is closed
+	buf, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), buf)
+}
+
+func TestQUICConnectionMigration(t *testing.T) {
+	l := NewQUIC("t1", testQUICAddr, &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	conns := make(chan net.Conn, 1)
+	received := make(chan []byte)
+	go l.Serve(func(id string, c net.Conn) error {
+		conns <- c
+		for {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				return err
+			}
+			received <- buf
+		}
+	})
+
+	tr1 := newTestQUICTransport(t)
+	conn := dialTestQUIC(t, tr1)
+	stream, err := conn.OpenStreamSync(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), <-received)
+
+	c := <-conns
+	require.Equal(t, tr1.Conn.LocalAddr().String(), c.RemoteAddr().String())
+
+	// the client moves to a new address, keeping the same stream
+	tr2 := newTestQUICTransport(t)
+	path, err := conn.AddPath(tr2)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, path.Probe(ctx))
+	require.NoError(t, path.Switch())
+
+	_, err = stream.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), <-received)
+	require.Eventually(t, func() bool {
+		return c.RemoteAddr().String() == tr2.Conn.LocalAddr().String()
+	}, time.Second, time.Millisecond*10)
+}
@@ -7,6 +7,7 @@ package listeners
 import (
 	"crypto/tls"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 
@@ -16,12 +17,13 @@ import (
 // TCP is a listener for establishing client connections on basic TCP protocol.
 type TCP struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
-	id      string       // the internal id of the listener
-	address string       // the network address to bind to
-	listen  net.Listener // a net.Listener which will listen for new clients
-	config  *Config      // configuration values for the listener
-	log     *slog.Logger // server logger
-	end     uint32       // ensure the close methods are only called once
+	id      string         // the internal id of the listener
+	address string         // the network address to bind to
+	listen  net.Listener   // a net.Listener which will listen for new clients
+	config  *Config        // configuration values for the listener
+	trusted []netip.Prefix // the proxies whose PROXY protocol headers are read
+	log     *slog.Logger   // server logger
+	end     uint32         // ensure the close methods are only called once
 }
 
 // NewTCP initialises and returns a new TCP listener, listening on an address.
@@ -57,15 +59,38 @@ func (l *TCP) Init(log *slog.Logger) error {
 	l.log = log
 
 	var err error
-	if l.config.TLSConfig != nil {
+	l.trusted, err = trustedProxies(l.config)
+	if err != nil {
+		return err
+	}
+
+	if l.config.TLSConfig != nil && !l.config.ProxyProtocol {
 		l.listen, err = tls.Listen("tcp", l.address, l.config.TLSConfig)
 	} else {
-		l.listen, err = net.Listen("tcp", l.address)
+		l.listen, err = net.Listen("tcp", l.address) // tls starts after the proxy protocol header
 	}
 
 	return err
 }
 
+// proxy reads the PROXY protocol header of a connection from a trusted proxy, and starts
+// tls on the connection after the header.
+func (l *TCP) proxy(conn net.Conn) (net.Conn, error) {
+	if isTrustedProxy(l.trusted, conn.RemoteAddr()) {
+		pc, err := newProxyConn(conn)
+		if err != nil {
+			return conn, err
+		}
+		conn = pc
+	}
+
+	if l.config.TLSConfig != nil {
+		conn = tls.Server(conn, l.config.TLSConfig)
+	}
+
+	return conn, nil
+}
+
 // Serve starts waiting for new TCP connections, and calls the establish
 // connection callback for any received.
 func (l *TCP) Serve(establish EstablishFn) {
@@ -81,6 +106,15 @@ func (l *TCP) Serve(establish EstablishFn) {
 
 		if atomic.LoadUint32(&l.end) == 0 {
 			go func() {
+				if l.config.ProxyProtocol {
+					conn, err = l.proxy(conn)
+					if err != nil {
+						_ = conn.Close()
+						l.log.Warn("", "error", err, "remote", conn.RemoteAddr())
+						return
+					}
+				}
+
 				err = establish(l.id, conn)
 				if err != nil {
 					l.log.Warn("", "error", err)
@@ -5,7 +5,9 @@
 package listeners
 
 import (
+	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -129,3 +131,137 @@ func TestTCPEstablishThenEnd(t *testing.T) {
 	l.Close(MockCloser)
 	<-o
 }
+
+func TestTCPInitInvalidTrustedProxies(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"10.0.0.0/33"},
+	})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+}
+
+func TestTCPInitNoTrustedProxies(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		ProxyProtocol: true,
+	})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	established := make(chan net.Conn)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- c
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 1883\r\n\x10\x00"))
+	require.NoError(t, err)
+
+	c := <-established
+	require.Equal(t, "203.0.113.7:51000", c.RemoteAddr().String())
+	require.Equal(t, "192.0.2.1:1883", c.LocalAddr().String())
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, buf)
+}
+
+func TestTCPProxyProtocolTLS(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		TLSConfig:      tlsConfigBasic,
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	established := make(chan net.Conn, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- c
+		_, err := c.Write([]byte("ok"))
+		return err
+	})
+
+	conn, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(proxyV2Header(0x21, 0x11, []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x07, 0x5b},
+		ProxyTLVAuthority, []byte("broker.example.com")))
+	require.NoError(t, err)
+
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}) // nolint:gosec
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(tc, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ok"), buf)
+
+	c := <-established
+	require.IsType(t, &tls.Conn{}, c)
+	require.Equal(t, "203.0.113.7:51000", c.RemoteAddr().String())
+	pc := c.(*tls.Conn).NetConn().(*proxyConn)
+	require.Equal(t, []byte("broker.example.com"), pc.ProxyTLVs()[ProxyTLVAuthority])
+}
+
+func TestTCPProxyProtocolUntrusted(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	established := make(chan net.Conn)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- c
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the header of a client which is not a trusted proxy is not read
+	c := <-established
+	require.Equal(t, conn.LocalAddr().String(), c.RemoteAddr().String())
+}
+
+func TestTCPProxyProtocolInvalidHeader(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Fail(t, "connection without a header should not be established")
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0x10, 0x10, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3c, 0x00})
+	require.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
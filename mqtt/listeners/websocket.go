@@ -6,10 +6,12 @@ package listeners
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,6 +36,7 @@ type Websocket struct { // [MQTT-4.2.0-1]
 	log       *slog.Logger        // server logger
 	establish EstablishFn         // the server's establish connection handler
 	upgrader  *websocket.Upgrader //  upgrade the incoming http/tcp connection to a websocket compliant connection.
+	trusted   []netip.Prefix      // the proxies whose forwarded headers are read
 	end       uint32              // ensure the close methods are only called once
 }
 
@@ -79,6 +82,12 @@ func (l *Websocket) Protocol() string {
 func (l *Websocket) Init(log *slog.Logger) error {
 	l.log = log
 
+	var err error
+	l.trusted, err = trustedProxies(l.config)
+	if err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", l.handler)
 	l.listen = &http.Server{
@@ -100,7 +109,7 @@ func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
-	err = l.establish(l.id, &wsConn{Conn: c.UnderlyingConn(), c: c})
+	err = l.establish(l.id, &wsConn{Conn: c.UnderlyingConn(), c: c, remote: forwardedFor(l.trusted, r)})
 	if err != nil {
 		l.log.Warn("", "error", err)
 	}
@@ -139,6 +148,9 @@ type wsConn struct {
 
 	// reader for the current message (can be nil)
 	r io.Reader
+
+	// the address of the client forwarded by trusted proxies (can be nil)
+	remote net.Addr
 }
 
 // Read reads the next span of bytes from the websocket connection and returns the number of bytes read.
@@ -189,7 +201,27 @@ func (ws *wsConn) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// RemoteAddr returns the address of the client forwarded by trusted proxies, or the remote
+// address of the connection.
+func (ws *wsConn) RemoteAddr() net.Addr {
+	if ws.remote != nil {
+		return ws.remote
+	}
+
+	return ws.Conn.RemoteAddr()
+}
+
 // Close signals the underlying websocket conn to close.
 func (ws *wsConn) Close() error {
 	return ws.Conn.Close()
 }
+
+// ConnectionState returns the tls state of the underlying conn, which is empty if the
+// websocket was not established over tls.
+func (ws *wsConn) ConnectionState() tls.ConnectionState {
+	if c, ok := ws.Conn.(*tls.Conn); ok {
+		return c.ConnectionState()
+	}
+
+	return tls.ConnectionState{}
+}
@@ -5,6 +5,7 @@
 package listeners
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -113,6 +114,74 @@ func TestWebsocketUpgrade(t *testing.T) {
 	_ = ws.Close()
 }
 
+func TestWebsocketInitInvalidTrustedProxies(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, &Config{
+		TrustedProxies: []string{"proxy"},
+	})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+}
+
+func TestWebsocketInitNoTrustedProxies(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, &Config{
+		ProxyProtocol: true,
+	})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+}
+
+func TestWebsocketUpgradeForwarded(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, &Config{
+		TrustedProxies: []string{"127.0.0.1"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	remote := make(chan string)
+	l.establish = func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr().String()
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "203.0.113.7, 127.0.0.1")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:0", <-remote)
+	_ = ws.Close()
+
+	// without forwarded headers, the address of the connection is used
+	ws, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(<-remote, "127.0.0.1:"))
+	_ = ws.Close()
+}
+
+func TestWebsocketUpgradeForwardedUntrusted(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, nil)
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	remote := make(chan string)
+	l.establish = func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr().String()
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "203.0.113.7")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(<-remote, "127.0.0.1:"))
+	_ = ws.Close()
+}
+
 func TestWebsocketConnectionReads(t *testing.T) {
 	l := NewWebsocket("t1", testAddr, nil)
 	_ = l.Init(nil)
@@ -153,3 +222,10 @@ func TestWebsocketConnectionReads(t *testing.T) {
 	s.Close()
 	_ = ws.Close()
 }
+
+func TestWebsocketConnectionState(t *testing.T) {
+	r, _ := net.Pipe()
+	defer r.Close()
+	ws := &wsConn{Conn: r}
+	require.Equal(t, tls.ConnectionState{}, ws.ConnectionState())
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+// CollectMetrics writes the per-listener connection counts, client queue depths, hook
+// latencies and hook error counts of the server. It can be passed to listeners.NewHTTPMetrics as a
+// listeners.MetricsCollector.
+func (s *Server) CollectMetrics(w *listeners.MetricsWriter) {
+	conns := make(map[string]int)
+	for id := range s.Listeners.GetAll() {
+		conns[id] = 0
+	}
+
+	var inflight, outbound int
+	for _, cl := range s.Clients.GetAll() {
+		if cl.Net.Inline || cl.Closed() {
+			continue
+		}
+
+		conns[cl.Net.Listener]++
+		inflight += cl.State.Inflight.Len()
+		outbound += int(atomic.LoadInt32(&cl.State.outboundQty))
+	}
+
+	ids := make([]string, 0, len(conns))
+	for id := range conns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		w.Gauge("listener_connections", "Number of connected clients per listener.", float64(conns[id]), "listener", id)
+	}
+
+	w.Gauge("client_inflight_messages", "Number of inflight messages held for connected clients.", float64(inflight))
+	w.Gauge("client_outbound_queue_depth", "Number of packets waiting in the outbound queues of connected clients.", float64(outbound))
+
+	lats := s.hooks.Latencies()
+	keys := make([]HookLatencyKey, 0, len(lats))
+	for k := range lats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Hook != keys[j].Hook {
+			return keys[i].Hook < keys[j].Hook
+		}
+		return keys[i].Method < keys[j].Method
+	})
+	for _, k := range keys {
+		w.Histogram("hook_duration_seconds", "Time spent in hook methods.", lats[k], "hook", k.Hook, "method", HookMethodName(k.Method))
+	}
+
+	errs := s.hooks.Errors()
+	hooks := make([]string, 0, len(errs))
+	for id := range errs {
+		hooks = append(hooks, id)
+	}
+	sort.Strings(hooks)
+	for _, id := range hooks {
+		w.Counter("hook_errors_total", "Total number of errors returned by hook methods.", float64(errs[id]), "hook", id)
+	}
+}
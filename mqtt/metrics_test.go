@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerCollectMetrics(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883")))
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	s.Clients.Add(cl)
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1})
+	s.hooks.OnACLCheck(cl, "a/b/c", true)
+
+	var buf bytes.Buffer
+	s.CollectMetrics(listeners.NewMetricsWriter(&buf))
+
+	out := buf.String()
+	require.Contains(t, out, `comqtt_listener_connections{listener="t1"} 1`)
+	require.Contains(t, out, `comqtt_listener_connections{listener="t2"} 0`)
+	require.Contains(t, out, "comqtt_client_inflight_messages 1\n")
+	require.Contains(t, out, "comqtt_client_outbound_queue_depth 0\n")
+	require.Contains(t, out, `comqtt_hook_duration_seconds_count{hook="allow-all-auth",method="OnACLCheck"} 1`)
+}
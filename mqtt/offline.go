@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// The overflow policies of a full offline queue.
+const (
+	OfflineDropOldest byte = iota // drop the oldest queued messages to make room for a new one
+	OfflineDropNewest             // drop the new message
+)
+
+// OfflineMessage is a qos message held for a persistent session while its client is disconnected.
+type OfflineMessage struct {
+	Packet packets.Packet // the message as it will be sent to the client, without a packet id
+	Seq    uint64         // the position of the message in the session queue
+}
+
+// OfflineQueue is a fifo queue of the qos messages published to a persistent session while
+// its client is disconnected, which are sent in order once it reconnects.
+type OfflineQueue struct {
+	sync.Mutex
+	messages []OfflineMessage // the queued messages, oldest first
+	bytes    int64            // the payload size of the queued messages
+	seq      uint64           // the sequence number of the newest message
+}
+
+// NewOfflineQueue returns a new instance of an OfflineQueue.
+func NewOfflineQueue() *OfflineQueue {
+	return &OfflineQueue{
+		messages: []OfflineMessage{},
+	}
+}
+
+// Len returns the number of queued messages.
+func (q *OfflineQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.messages)
+}
+
+// Bytes returns the payload size of the queued messages.
+func (q *OfflineQueue) Bytes() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.bytes
+}
+
+// GetAll returns the queued messages, oldest first.
+func (q *OfflineQueue) GetAll() []OfflineMessage {
+	q.Lock()
+	defer q.Unlock()
+	return append([]OfflineMessage{}, q.messages...)
+}
+
+// push appends a message to the queue, giving it the next sequence number. The lock must be held.
+func (q *OfflineQueue) push(pk packets.Packet) OfflineMessage {
+	q.seq++
+	m := OfflineMessage{Packet: pk, Seq: q.seq}
+	q.messages = append(q.messages, m)
+	q.bytes += int64(len(pk.Payload))
+	return m
+}
+
+// restore appends a message loaded from a store, keeping its sequence number. The lock must be held.
+func (q *OfflineQueue) restore(m OfflineMessage) {
+	if m.Seq > q.seq {
+		q.seq = m.Seq
+	}
+	q.messages = append(q.messages, m)
+	q.bytes += int64(len(m.Packet.Payload))
+}
+
+// shift removes and returns the oldest message. The lock must be held.
+func (q *OfflineQueue) shift() OfflineMessage {
+	m := q.messages[0]
+	q.messages[0] = OfflineMessage{}
+	q.messages = q.messages[1:]
+	q.bytes -= int64(len(m.Packet.Payload))
+	return m
+}
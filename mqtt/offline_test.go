@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestOfflineQueuePushShift(t *testing.T) {
+	q := NewOfflineQueue()
+	require.Equal(t, 0, q.Len())
+
+	m1 := q.push(packets.Packet{Payload: []byte("abc")})
+	m2 := q.push(packets.Packet{Payload: []byte("de")})
+	require.Equal(t, uint64(1), m1.Seq)
+	require.Equal(t, uint64(2), m2.Seq)
+	require.Equal(t, 2, q.Len())
+	require.Equal(t, int64(5), q.Bytes())
+	require.Equal(t, []OfflineMessage{m1, m2}, q.GetAll())
+
+	require.Equal(t, m1, q.shift())
+	require.Equal(t, 1, q.Len())
+	require.Equal(t, int64(2), q.Bytes())
+
+	// sequence numbers are not reused
+	m3 := q.push(packets.Packet{})
+	require.Equal(t, uint64(3), m3.Seq)
+}
+
+func TestOfflineQueueRestore(t *testing.T) {
+	q := NewOfflineQueue()
+	q.restore(OfflineMessage{Seq: 4, Packet: packets.Packet{Payload: []byte("a")}})
+	q.restore(OfflineMessage{Seq: 7, Packet: packets.Packet{Payload: []byte("b")}})
+	require.Equal(t, 2, q.Len())
+	require.Equal(t, int64(2), q.Bytes())
+
+	m := q.push(packets.Packet{})
+	require.Equal(t, uint64(8), m.Seq)
+}
@@ -91,6 +91,9 @@ var (
 	ErrProtocolViolationDupNoQos              = Code{Code: 0x82, Reason: "protocol violation: dup true with no qos"}
 	ErrProtocolViolationUnsupportedProperty   = Code{Code: 0x82, Reason: "protocol violation: unsupported property"}
 	ErrProtocolViolationNoTopic               = Code{Code: 0x82, Reason: "protocol violation: no topic or alias"}
+	ErrProtocolViolationAuthDataNoMethod      = Code{Code: 0x82, Reason: "protocol violation: authentication data without method"}
+	ErrProtocolViolationUnexpectedAuth        = Code{Code: 0x82, Reason: "protocol violation: unexpected auth packet"}
+	ErrProtocolViolationAuthMethodMismatch    = Code{Code: 0x82, Reason: "protocol violation: authentication method mismatch"}
 	ErrImplementationSpecificError            = Code{Code: 0x83, Reason: "implementation specific error"}
 	ErrRejectPacket                           = Code{Code: 0x83, Reason: "packet rejected"}
 	ErrUnsupportedProtocolVersion             = Code{Code: 0x84, Reason: "unsupported protocol version"}
@@ -145,5 +148,7 @@ var (
 		ErrMalformedUsername:          ErrMalformedUsernameOrPassword,
 		ErrMalformedPassword:          ErrMalformedUsernameOrPassword,
 		ErrBadUsernameOrPassword:      Err3NotAuthorized,
+		ErrBanned:                     Err3NotAuthorized,
+		ErrQuotaExceeded:              Err3ServerUnavailable,
 	}
 )
@@ -493,6 +493,10 @@ func (pk *Packet) ConnectValidate() Code {
 		return ErrProtocolViolationWillFlagSurplusRetain // [MQTT-3.1.2-13]
 	}
 
+	if pk.Properties.AuthenticationMethod == "" && len(pk.Properties.AuthenticationData) > 0 {
+		return ErrProtocolViolationAuthDataNoMethod // 3.1.2.11.10 Authentication Data
+	}
+
 	return CodeSuccess
 }
 
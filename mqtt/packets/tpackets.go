@@ -69,6 +69,7 @@ const (
 	TConnectInvalidWillFlagNoPayload
 	TConnectInvalidWillFlagQosOutOfRange
 	TConnectInvalidWillSurplusRetain
+	TConnectInvalidAuthDataNoMethod
 	TConnectZeroByteUsername
 	TConnectSpecInvalidUTF8D800
 	TConnectSpecInvalidUTF8DFFF
@@ -963,6 +964,22 @@ var TPacketData = map[byte]TPacketCases{
 				},
 			},
 		},
+		{
+			Case:   TConnectInvalidAuthDataNoMethod,
+			Desc:   "authentication data without method",
+			Group:  "validate",
+			Expect: ErrProtocolViolationAuthDataNoMethod,
+			Packet: &Packet{
+				FixedHeader:     FixedHeader{Type: Connect},
+				ProtocolVersion: 5,
+				Connect: ConnectParams{
+					ProtocolName: []byte("MQTT"),
+				},
+				Properties: Properties{
+					AuthenticationData: []byte("auth-data"),
+				},
+			},
+		},
 
 		// Spec Tests
 		{
@@ -1,11 +1,16 @@
 package rest
 
 import (
+	"time"
+
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
 type client struct {
 	ID              string   `json:"id"`
+	Tenant          string   `json:"tenant,omitempty"`
 	IP              string   `json:"ip"`
 	Online          bool     `json:"online"`
 	Username        string   `json:"username"`
@@ -26,6 +31,7 @@ func genClient(cl *mqtt.Client) client {
 
 	nc := client{
 		ID:              cl.ID,
+		Tenant:          cl.Properties.Tenant,
 		IP:              cl.Net.Remote,
 		Online:          !cl.Closed(),
 		Username:        string(cl.Properties.Username),
@@ -49,3 +55,76 @@ type message struct {
 	Retain    bool   `json:"retain"`
 	Qos       byte   `json:"qos"`
 }
+
+type retainedMessage struct {
+	TopicName string `json:"topic_name"`
+	Payload   string `json:"payload"`
+	Qos       byte   `json:"qos"`
+	Origin    string `json:"origin"`
+	Created   int64  `json:"created"`
+	Expiry    int64  `json:"expiry"` // unix time the message expires, 0 never expires
+}
+
+func genRetainedMessage(pk packets.Packet) retainedMessage {
+	return retainedMessage{
+		TopicName: pk.TopicName,
+		Payload:   string(pk.Payload),
+		Qos:       pk.FixedHeader.Qos,
+		Origin:    pk.Origin,
+		Created:   pk.Created,
+		Expiry:    pk.Expiry,
+	}
+}
+
+type delayedMessage struct {
+	ID        string `json:"id"`
+	TopicName string `json:"topic_name"`
+	Payload   string `json:"payload"`
+	Retain    bool   `json:"retain"`
+	Qos       byte   `json:"qos"`
+	Origin    string `json:"origin"`
+	Created   int64  `json:"created"`
+	Due       int64  `json:"due"` // unix time the message is published
+}
+
+func genDelayedMessage(m mqtt.DelayedMessage) delayedMessage {
+	return delayedMessage{
+		ID:        m.ID,
+		TopicName: m.Packet.TopicName,
+		Payload:   string(m.Packet.Payload),
+		Retain:    m.Packet.FixedHeader.Retain,
+		Qos:       m.Packet.FixedHeader.Qos,
+		Origin:    m.Packet.Origin,
+		Created:   m.Packet.Created,
+		Due:       m.Due,
+	}
+}
+
+type tenant struct {
+	Name          string `json:"name"`
+	Clients       int    `json:"clients"` // sessions, including offline sessions
+	Online        int    `json:"online"`
+	Subscriptions int    `json:"subscriptions"`
+	Retained      int    `json:"retained"`
+}
+
+type blacklistEntry struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	TTL    int64  `json:"ttl"` // seconds until the entry expires, 0 never expires
+}
+
+func (e blacklistEntry) toStorage() storage.BlacklistEntry {
+	se := storage.BlacklistEntry{
+		Kind:    e.Kind,
+		Value:   e.Value,
+		Reason:  e.Reason,
+		Created: time.Now().Unix(),
+	}
+	if e.TTL > 0 {
+		se.Expiry = se.Created + e.TTL
+	}
+
+	return se
+}
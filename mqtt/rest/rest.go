@@ -2,10 +2,11 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/wind-c/comqtt/v2/mqtt"
-	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"io"
 	"net/http"
-	"slices"
+	"sort"
 )
 
 const (
@@ -15,8 +16,18 @@ const (
 	MqttGetBlacklistPath   = "/api/v1/mqtt/blacklist"
 	MqttAddBlacklistPath   = "/api/v1/mqtt/blacklist/{id}"
 	MqttDelBlacklistPath   = "/api/v1/mqtt/blacklist/{id}"
+	MqttAddBlacklistEntry  = "/api/v1/mqtt/blacklist"
+	MqttDelBlacklistEntry  = "/api/v1/mqtt/blacklist"
 	MqttPublishMessagePath = "/api/v1/mqtt/message"
 	MqttGetConfigPath      = "/api/v1/mqtt/config"
+	MqttGetRetainedPath    = "/api/v1/mqtt/retained"
+	MqttRetainedTopicPath  = "/api/v1/mqtt/retained/{topic...}"
+	MqttGetDelayedPath     = "/api/v1/mqtt/delayed"
+	MqttDelayedIDPath      = "/api/v1/mqtt/delayed/{id}"
+	MqttGetTenantsPath     = "/api/v1/mqtt/tenants"
+	MqttGetTenantPath      = "/api/v1/mqtt/tenants/{tenant}"
+	MqttTenantClientsPath  = "/api/v1/mqtt/tenants/{tenant}/clients"
+	MqttTenantRetainedPath = "/api/v1/mqtt/tenants/{tenant}/retained"
 )
 
 type Handler = func(http.ResponseWriter, *http.Request)
@@ -33,14 +44,26 @@ func New(server *mqtt.Server) *Rest {
 
 func (s *Rest) GenHandlers() map[string]Handler {
 	return map[string]Handler{
-		"GET " + MqttGetConfigPath:       s.viewConfig,
-		"GET " + MqttGetOverallPath:      s.getOverallInfo,
-		"GET " + MqttGetOnlinePath:       s.getOnlineCount,
-		"GET " + MqttGetClientPath:       s.getClient,
-		"GET " + MqttGetBlacklistPath:    s.blacklist,
-		"POST " + MqttAddBlacklistPath:   s.kickClient,
-		"DELETE " + MqttDelBlacklistPath: s.blanchClient,
-		"POST " + MqttPublishMessagePath: s.publishMessage,
+		"GET " + MqttGetConfigPath:        s.viewConfig,
+		"GET " + MqttGetOverallPath:       s.getOverallInfo,
+		"GET " + MqttGetOnlinePath:        s.getOnlineCount,
+		"GET " + MqttGetClientPath:        s.getClient,
+		"GET " + MqttGetBlacklistPath:     s.blacklist,
+		"POST " + MqttAddBlacklistPath:    s.kickClient,
+		"DELETE " + MqttDelBlacklistPath:  s.blanchClient,
+		"POST " + MqttAddBlacklistEntry:   s.addBlacklist,
+		"DELETE " + MqttDelBlacklistEntry: s.delBlacklist,
+		"POST " + MqttPublishMessagePath:  s.publishMessage,
+		"GET " + MqttGetRetainedPath:      s.retainedMessages,
+		"GET " + MqttRetainedTopicPath:    s.getRetained,
+		"DELETE " + MqttRetainedTopicPath: s.delRetained,
+		"GET " + MqttGetDelayedPath:       s.delayedMessages,
+		"GET " + MqttDelayedIDPath:        s.getDelayed,
+		"DELETE " + MqttDelayedIDPath:     s.delDelayed,
+		"GET " + MqttGetTenantsPath:       s.tenants,
+		"GET " + MqttGetTenantPath:        s.getTenant,
+		"GET " + MqttTenantClientsPath:    s.tenantClients,
+		"GET " + MqttTenantRetainedPath:   s.tenantRetained,
 	}
 }
 
@@ -92,37 +115,247 @@ func (s *Rest) publishMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// kickClient disconnect the client and add it to the blacklist
+// kickClient disconnect the client and add it to the blacklist, the optional body sets the reason and ttl
 // POST api/v1/mqtt/blacklist/{id}
 func (s *Rest) kickClient(w http.ResponseWriter, r *http.Request) {
-	cid := r.PathValue("id")
-	if !slices.Contains(s.server.Blacklist, cid) {
-		s.server.Blacklist = append(s.server.Blacklist, cid)
+	defer r.Body.Close()
+
+	var e blacklistEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil && !errors.Is(err, io.EOF) {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if cl, ol := s.server.Clients.Get(cid); ol {
-		s.server.DisconnectClient(cl, packets.ErrNotAuthorized)
-		Ok(w, cid)
+
+	e.Kind = mqtt.BlacklistClientID
+	e.Value = r.PathValue("id")
+	if err := s.server.AddBlacklist(e.toStorage()); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
 	} else {
-		Error(w, http.StatusNotFound, "client not found")
+		Ok(w, e.Value)
 	}
 }
 
-// blanchClient remove from the blacklist
+// blanchClient remove the client from the blacklist
 // DELETE api/v1/mqtt/blacklist/{id}
 func (s *Rest) blanchClient(w http.ResponseWriter, r *http.Request) {
 	cid := r.PathValue("id")
-	if slices.Contains(s.server.Blacklist, cid) {
-		slices.DeleteFunc(s.server.Blacklist, func(s string) bool { return s == cid })
+	if s.server.DeleteBlacklist(mqtt.BlacklistClientID, cid) {
 		Ok(w, cid)
+	} else {
+		Error(w, http.StatusNotFound, "blacklist entry not found")
+	}
+}
+
+// addBlacklist add a client id, username or ip entry to the blacklist
+// POST api/v1/mqtt/blacklist
+func (s *Rest) addBlacklist(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var e blacklistEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.server.AddBlacklist(e.toStorage()); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+	} else {
+		stored, _ := s.server.Blacklist.Get(e.Kind, e.Value)
+		Ok(w, stored)
+	}
+}
+
+// delBlacklist remove an entry from the blacklist
+// DELETE api/v1/mqtt/blacklist?kind=ip&value=10.0.0.0/8
+func (s *Rest) delBlacklist(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	value := r.URL.Query().Get("value")
+	if s.server.DeleteBlacklist(kind, value) {
+		Ok(w, value)
+	} else {
+		Error(w, http.StatusNotFound, "blacklist entry not found")
 	}
 }
 
 // blacklist return to the blacklist
 // GET api/v1/mqtt/blacklist
 func (s *Rest) blacklist(w http.ResponseWriter, r *http.Request) {
-	if s.server.Blacklist == nil {
-		Error(w, http.StatusNotFound, "blacklist not found")
+	Ok(w, s.server.Blacklist.GetAll())
+}
+
+// retainedMessages return the retained messages on topics matching the filter, all of them by default
+// GET api/v1/mqtt/retained?filter=a/%23
+func (s *Rest) retainedMessages(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	if !mqtt.IsValidFilter(filter, false) {
+		Error(w, http.StatusBadRequest, "invalid topic filter")
+		return
+	}
+
+	pks := s.server.Retained.Messages(filter)
+	msgs := make([]retainedMessage, 0, len(pks))
+	for _, pk := range pks {
+		msgs = append(msgs, genRetainedMessage(pk))
+	}
+
+	Ok(w, msgs)
+}
+
+// getRetained return the retained message of a topic
+// GET api/v1/mqtt/retained/{topic}
+func (s *Rest) getRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if !mqtt.IsValidFilter(topic, true) {
+		Error(w, http.StatusBadRequest, "invalid topic name")
+		return
+	}
+
+	if pks := s.server.Retained.Messages(topic); len(pks) > 0 {
+		Ok(w, genRetainedMessage(pks[0]))
+	} else {
+		Error(w, http.StatusNotFound, "retained message not found")
+	}
+}
+
+// delRetained remove the retained message of a topic
+// DELETE api/v1/mqtt/retained/{topic}
+func (s *Rest) delRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if s.server.DeleteRetained(topic) {
+		Ok(w, topic)
+	} else {
+		Error(w, http.StatusNotFound, "retained message not found")
+	}
+}
+
+// delayedMessages return the messages waiting to be published, the earliest due first
+// GET api/v1/mqtt/delayed
+func (s *Rest) delayedMessages(w http.ResponseWriter, r *http.Request) {
+	all := s.server.Delayed.GetAll()
+	msgs := make([]delayedMessage, 0, len(all))
+	for _, m := range all {
+		msgs = append(msgs, genDelayedMessage(m))
+	}
+
+	Ok(w, msgs)
+}
+
+// getDelayed return a delayed message
+// GET api/v1/mqtt/delayed/{id}
+func (s *Rest) getDelayed(w http.ResponseWriter, r *http.Request) {
+	if m, ok := s.server.Delayed.Get(r.PathValue("id")); ok {
+		Ok(w, genDelayedMessage(m))
 	} else {
-		Ok(w, s.server.Blacklist)
+		Error(w, http.StatusNotFound, "delayed message not found")
 	}
 }
+
+// delDelayed cancel a delayed message
+// DELETE api/v1/mqtt/delayed/{id}
+func (s *Rest) delDelayed(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if s.server.DeleteDelayed(id) {
+		Ok(w, id)
+	} else {
+		Error(w, http.StatusNotFound, "delayed message not found")
+	}
+}
+
+// tenants return the usage of the tenants with clients on this node
+// GET api/v1/mqtt/tenants
+func (s *Rest) tenants(w http.ResponseWriter, r *http.Request) {
+	names := map[string]struct{}{}
+	for _, cl := range s.server.Clients.GetAll() {
+		if cl.Properties.Tenant != "" {
+			names[cl.Properties.Tenant] = struct{}{}
+		}
+	}
+
+	ts := make([]tenant, 0, len(names))
+	for name := range names {
+		ts = append(ts, s.genTenant(name))
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Name < ts[j].Name
+	})
+
+	Ok(w, ts)
+}
+
+// getTenant return the usage of a tenant
+// GET api/v1/mqtt/tenants/{tenant}
+func (s *Rest) getTenant(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !mqtt.IsValidTenant(name) {
+		Error(w, http.StatusBadRequest, "invalid tenant")
+		return
+	}
+
+	Ok(w, s.genTenant(name))
+}
+
+// tenantClients return the clients of a tenant
+// GET api/v1/mqtt/tenants/{tenant}/clients
+func (s *Rest) tenantClients(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !mqtt.IsValidTenant(name) {
+		Error(w, http.StatusBadRequest, "invalid tenant")
+		return
+	}
+
+	clients := s.server.Clients.GetByTenant(name)
+	v := make([]client, 0, len(clients))
+	for _, cl := range clients {
+		v = append(v, genClient(cl))
+	}
+
+	Ok(w, v)
+}
+
+// tenantRetained return the retained messages of a tenant on topics matching the filter, as the tenant sees them
+// GET api/v1/mqtt/tenants/{tenant}/retained?filter=a/%23
+func (s *Rest) tenantRetained(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !mqtt.IsValidTenant(name) {
+		Error(w, http.StatusBadRequest, "invalid tenant")
+		return
+	}
+
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	if !mqtt.IsValidFilter(filter, false) || mqtt.IsSharedFilter(filter) {
+		Error(w, http.StatusBadRequest, "invalid topic filter")
+		return
+	}
+
+	pks := s.server.Retained.Messages(mqtt.TenantTopic(name, filter))
+	msgs := make([]retainedMessage, 0, len(pks))
+	for _, pk := range pks {
+		pk.TopicName, _ = mqtt.StripTenant(name, pk.TopicName)
+		msgs = append(msgs, genRetainedMessage(pk))
+	}
+
+	Ok(w, msgs)
+}
+
+// genTenant return the usage of a tenant on this node
+func (s *Rest) genTenant(name string) tenant {
+	t := tenant{Name: name}
+	for _, cl := range s.server.Clients.GetByTenant(name) {
+		t.Clients++
+		if !cl.Closed() {
+			t.Online++
+		}
+		t.Subscriptions += cl.State.Subscriptions.Len()
+	}
+	t.Retained = len(s.server.Retained.Messages(mqtt.TenantTopic(name, "#")))
+
+	return t
+}
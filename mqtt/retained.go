@@ -0,0 +1,251 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// defaultRetainedCacheSize is the default number of filters cached by a LazyRetainedStore.
+const defaultRetainedCacheSize = 1024
+
+// RetainedStore holds the retained messages of the server. By default they are kept in
+// memory by the TopicsIndex, and LazyRetainedStore looks them up in a persistent store.
+type RetainedStore interface {
+	// RetainMessage adds, replaces or, for an empty payload, removes the retained message of
+	// a topic. It returns 1 if a message was retained, -1 if one was removed, otherwise 0.
+	RetainMessage(pk packets.Packet) int64
+
+	// Messages returns the retained messages on topics matching a filter.
+	Messages(filter string) []packets.Packet
+
+	// Count returns the number of retained messages.
+	Count() int64
+}
+
+// retainedCacheEntry is the result of a retained messages lookup for a filter.
+type retainedCacheEntry struct {
+	filter string
+	pks    []packets.Packet
+}
+
+// LazyRetainedStore is a RetainedStore which looks up the retained messages matching a
+// filter on demand from the storage hooks providing StoredRetainedMessagesByFilter, with
+// an lru cache of the most recent lookups in front of the store. The retained messages
+// themselves are written to the store by the OnRetainMessage storage hooks.
+// $SYS messages are never persisted, so they remain in the TopicsIndex.
+type LazyRetainedStore struct {
+	sync.Mutex
+	hooks  *Hooks
+	topics *TopicsIndex
+	caps   *Capabilities
+	size   int                                 // the maximum number of cached filters
+	gen    uint64                              // incremented whenever a retained message changes
+	count  int64                               // the number of retained messages
+	cache  map[string]*list.Element            // cached lookups keyed on filter
+	levels map[string]map[string]*list.Element // cached lookups keyed on the first level and filter
+	lru    *list.List                          // cached lookups, most recently used first
+}
+
+// NewLazyRetainedStore returns a new instance of a LazyRetainedStore which caches the
+// lookups of up to size filters.
+func NewLazyRetainedStore(hooks *Hooks, topics *TopicsIndex, caps *Capabilities, size int) *LazyRetainedStore {
+	if size <= 0 {
+		size = defaultRetainedCacheSize
+	}
+
+	return &LazyRetainedStore{
+		hooks:  hooks,
+		topics: topics,
+		caps:   caps,
+		size:   size,
+		cache:  map[string]*list.Element{},
+		levels: map[string]map[string]*list.Element{},
+		lru:    list.New(),
+	}
+}
+
+// firstLevel returns the first level of a topic or filter.
+func firstLevel(topic string) string {
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+// RetainMessage drops the cached lookups matching the topic of a retained message. It
+// returns 1 if the message has a payload, or -1 if it removes a stored retained message.
+func (r *LazyRetainedStore) RetainMessage(pk packets.Packet) int64 {
+	if strings.HasPrefix(pk.TopicName, SysPrefix) {
+		n := r.topics.RetainMessage(pk)
+		r.addCount(n)
+		return n
+	}
+
+	r.Invalidate(pk.TopicName)
+	existed := len(r.lookup(pk.TopicName)) > 0
+	if len(pk.Payload) > 0 {
+		if !existed {
+			r.addCount(1)
+		}
+		return 1
+	}
+
+	if existed {
+		r.addCount(-1)
+		return -1
+	}
+
+	return 0
+}
+
+// Count returns the number of retained messages, counted from those the store had on start.
+func (r *LazyRetainedStore) Count() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+// setCount sets the number of retained messages held by the store on start.
+func (r *LazyRetainedStore) setCount(n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.count = max(n, 0)
+}
+
+// addCount adds to the number of retained messages, which is never negative.
+func (r *LazyRetainedStore) addCount(n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.count = max(r.count+n, 0)
+}
+
+// Invalidate drops the cached lookups of filters matching a topic. It must be called once
+// the retained message of the topic has been written to the store. Only the filters with
+// the same first level as the topic, or a wildcard first level, are matched.
+func (r *LazyRetainedStore) Invalidate(topic string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.gen++
+	for _, level := range []string{firstLevel(topic), "+", "#"} {
+		for filter, e := range r.levels[level] {
+			if MatchFilter(filter, topic) {
+				r.remove(e)
+			}
+		}
+	}
+}
+
+// remove drops a cached lookup. The store must be locked.
+func (r *LazyRetainedStore) remove(e *list.Element) {
+	filter := e.Value.(*retainedCacheEntry).filter
+	r.lru.Remove(e)
+	delete(r.cache, filter)
+
+	level := firstLevel(filter)
+	delete(r.levels[level], filter)
+	if len(r.levels[level]) == 0 {
+		delete(r.levels, level)
+	}
+}
+
+// Len returns the number of cached filters.
+func (r *LazyRetainedStore) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.lru.Len()
+}
+
+// Messages returns the retained messages on topics matching a filter, from the cache if
+// the filter was looked up recently. Expired messages are deleted from the store.
+func (r *LazyRetainedStore) Messages(filter string) []packets.Packet {
+	if strings.HasPrefix(filter, SysPrefix) {
+		return r.topics.Messages(filter)
+	}
+
+	r.Lock()
+	if e, ok := r.cache[filter]; ok {
+		r.lru.MoveToFront(e)
+		pks := e.Value.(*retainedCacheEntry).pks
+		r.Unlock()
+		return r.unexpired(pks)
+	}
+	gen := r.gen
+	r.Unlock()
+
+	pks := r.lookup(filter)
+
+	r.Lock()
+	if _, ok := r.cache[filter]; !ok && gen == r.gen { // don't cache a lookup which may have missed a change
+		e := r.lru.PushFront(&retainedCacheEntry{filter: filter, pks: pks})
+		r.cache[filter] = e
+		level := firstLevel(filter)
+		if r.levels[level] == nil {
+			r.levels[level] = map[string]*list.Element{}
+		}
+		r.levels[level][filter] = e
+		if r.lru.Len() > r.size {
+			r.remove(r.lru.Back())
+		}
+	}
+	r.Unlock()
+
+	return r.unexpired(pks)
+}
+
+// lookup returns the stored retained messages matching a filter.
+func (r *LazyRetainedStore) lookup(filter string) []packets.Packet {
+	pks := []packets.Packet{}
+	v, err := r.hooks.StoredRetainedMessagesByFilter(filter)
+	if err != nil {
+		return pks // logged by hooks
+	}
+
+	for _, msg := range v {
+		if len(msg.Payload) == 0 || !MatchFilter(filter, msg.TopicName) {
+			continue
+		}
+
+		pks = append(pks, r.toPacket(msg))
+	}
+
+	return pks
+}
+
+// toPacket converts a stored retained message to a packet with its expiry.
+func (r *LazyRetainedStore) toPacket(msg storage.Message) packets.Packet {
+	pk := msg.ToPacket()
+	pk.Expiry = pk.Created + r.caps.MaximumMessageExpiryInterval
+	if pk.Properties.MessageExpiryInterval > 0 {
+		pk.Expiry = pk.Created + int64(pk.Properties.MessageExpiryInterval)
+	}
+
+	return pk
+}
+
+// unexpired returns the messages which have not expired, and deletes the expired ones.
+func (r *LazyRetainedStore) unexpired(pks []packets.Packet) []packets.Packet {
+	now := time.Now().Unix()
+	out := make([]packets.Packet, 0, len(pks))
+	for _, pk := range pks {
+		if pk.Expiry > 0 && pk.Expiry < now {
+			r.hooks.OnRetainedExpired(pk.TopicName)
+			r.Invalidate(pk.TopicName)
+			r.addCount(-1)
+			continue
+		}
+
+		out = append(out, pk)
+	}
+
+	return out
+}
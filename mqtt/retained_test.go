@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// retainedHook is an in-memory store of retained messages which counts its lookups.
+type retainedHook struct {
+	HookBase
+	sync.Mutex
+	messages map[string]storage.Message
+	lookups  int
+	expired  []string
+	onLookup func()
+}
+
+func newRetainedHook() *retainedHook {
+	return &retainedHook{
+		messages: map[string]storage.Message{},
+	}
+}
+
+func (h *retainedHook) ID() string {
+	return "retained"
+}
+
+func (h *retainedHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		OnRetainMessage,
+		OnRetainedExpired,
+		StoredRetainedMessagesByFilter,
+	}, []byte{b})
+}
+
+func (h *retainedHook) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
+	h.Lock()
+	defer h.Unlock()
+	if r == -1 {
+		delete(h.messages, pk.TopicName)
+		return
+	}
+
+	h.messages[pk.TopicName] = storage.Message{
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		FixedHeader: pk.FixedHeader,
+		Created:     pk.Created,
+		Properties:  storage.MessageProperties{MessageExpiryInterval: pk.Properties.MessageExpiryInterval},
+	}
+}
+
+func (h *retainedHook) OnRetainedExpired(topic string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.messages, topic)
+	h.expired = append(h.expired, topic)
+}
+
+func (h *retainedHook) StoredRetainedMessagesByFilter(filter string) (v []storage.Message, err error) {
+	h.Lock()
+	h.lookups++
+	for _, m := range h.messages {
+		if MatchFilter(filter, m.TopicName) {
+			v = append(v, m)
+		}
+	}
+	onLookup := h.onLookup
+	h.Unlock()
+
+	if onLookup != nil {
+		onLookup()
+	}
+
+	return v, nil
+}
+
+func (h *retainedHook) retain(topic, payload string) {
+	h.OnRetainMessage(nil, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Created:     time.Now().Unix(),
+	}, 1)
+}
+
+func newLazyRetainedStore(t *testing.T, size int) (*LazyRetainedStore, *retainedHook) {
+	hooks := &Hooks{Log: logger}
+	hook := newRetainedHook()
+	require.NoError(t, hooks.Add(hook, nil))
+	return NewLazyRetainedStore(hooks, NewTopicsIndex(), DefaultServerCapabilities, size), hook
+}
+
+func topicNames(pks []packets.Packet) []string {
+	topics := []string{}
+	for _, pk := range pks {
+		topics = append(topics, pk.TopicName)
+	}
+	return topics
+}
+
+func TestNewLazyRetainedStore(t *testing.T) {
+	r, _ := newLazyRetainedStore(t, 0)
+	require.Equal(t, defaultRetainedCacheSize, r.size)
+	require.NotNil(t, r.cache)
+	require.NotNil(t, r.lru)
+}
+
+func TestLazyRetainedStoreMessages(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	hook.retain("a/b/c", "1")
+	hook.retain("a/b/d", "2")
+	hook.retain("x/y", "3")
+
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d"}, topicNames(r.Messages("a/#")))
+	require.Equal(t, []string{"x/y"}, topicNames(r.Messages("x/y")))
+	require.Empty(t, r.Messages("z"))
+	require.Equal(t, 3, hook.lookups)
+	require.Equal(t, 3, r.Len())
+
+	// cached lookups are not queried again
+	require.Len(t, r.Messages("a/#"), 2)
+	require.Equal(t, 3, hook.lookups)
+}
+
+func TestLazyRetainedStoreEviction(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 2)
+	hook.retain("a", "1")
+
+	r.Messages("a")
+	r.Messages("b")
+	r.Messages("a") // a is now the most recently used
+	r.Messages("c") // evicts b
+	require.Equal(t, 2, r.Len())
+	require.Contains(t, r.cache, "a")
+	require.Contains(t, r.cache, "c")
+	require.NotContains(t, r.cache, "b")
+}
+
+func TestLazyRetainedStoreRetainMessage(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	hook.retain("a/b/c", "1")
+	r.Messages("a/#")
+	r.Messages("a/b/c")
+	r.Messages("x/y")
+	require.Equal(t, 3, r.Len())
+
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("2")}
+	require.Equal(t, int64(1), r.RetainMessage(pk))
+	require.Equal(t, 1, r.Len())
+	require.Contains(t, r.cache, "x/y")
+
+	pk.Payload = []byte{}
+	require.Equal(t, int64(-1), r.RetainMessage(pk))
+	require.Equal(t, int64(0), r.RetainMessage(packets.Packet{TopicName: "d/e/f"}))
+}
+
+func TestLazyRetainedStoreCount(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	r.setCount(1)
+	hook.retain("a/b/c", "1")
+	require.Equal(t, int64(1), r.Count())
+
+	// replacing a stored message is not counted again
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("2")}
+	require.Equal(t, int64(1), r.RetainMessage(pk))
+	require.Equal(t, int64(1), r.Count())
+
+	require.Equal(t, int64(1), r.RetainMessage(packets.Packet{TopicName: "d/e", Payload: []byte("3")}))
+	require.Equal(t, int64(2), r.Count())
+
+	pk.Payload = []byte{}
+	require.Equal(t, int64(-1), r.RetainMessage(pk))
+	require.Equal(t, int64(1), r.Count())
+	hook.OnRetainMessage(nil, pk, -1)
+
+	require.Equal(t, int64(0), r.RetainMessage(pk))
+	require.Equal(t, int64(1), r.Count())
+
+	r.setCount(-1)
+	require.Equal(t, int64(0), r.Count())
+}
+
+func TestLazyRetainedStoreInvalidateLevels(t *testing.T) {
+	r, _ := newLazyRetainedStore(t, 10)
+	for _, filter := range []string{"a/#", "a/c", "+/b", "#", "x/y", "a"} {
+		r.Messages(filter)
+	}
+	require.Equal(t, 6, r.Len())
+
+	r.Invalidate("a/b")
+	require.Equal(t, 3, r.Len())
+	require.Contains(t, r.cache, "a/c")
+	require.Contains(t, r.cache, "x/y")
+	require.Contains(t, r.cache, "a")
+	require.NotContains(t, r.levels, "+")
+	require.NotContains(t, r.levels, "#")
+	require.Len(t, r.levels["a"], 2)
+}
+
+func TestLazyRetainedStoreChangedDuringLookup(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	hook.onLookup = func() {
+		r.Invalidate("a/b/c")
+	}
+
+	r.Messages("a/#")
+	require.Equal(t, 0, r.Len())
+}
+
+func TestLazyRetainedStoreExpired(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	hook.retain("a/b/c", "1")
+	hook.OnRetainMessage(nil, packets.Packet{
+		TopicName:  "a/b/d",
+		Payload:    []byte("2"),
+		Created:    time.Now().Unix() - 10,
+		Properties: packets.Properties{MessageExpiryInterval: 5},
+	}, 1)
+
+	require.Equal(t, []string{"a/b/c"}, topicNames(r.Messages("a/#")))
+	require.Equal(t, []string{"a/b/d"}, hook.expired)
+	require.NotContains(t, hook.messages, "a/b/d")
+}
+
+func TestLazyRetainedStoreSys(t *testing.T) {
+	r, hook := newLazyRetainedStore(t, 10)
+	r.RetainMessage(packets.Packet{TopicName: SysPrefix + "/broker/uptime", Payload: []byte("1")})
+
+	require.Len(t, r.Messages(SysPrefix+"/#"), 1)
+	require.Equal(t, 0, hook.lookups)
+	require.Equal(t, 0, r.Len())
+}
@@ -12,13 +12,14 @@ import (
 	"net"
 	"os"
 	"runtime"
-	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/rs/xid"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
@@ -68,10 +69,13 @@ type Capabilities struct {
 	SharedSubAvailable           byte   `yaml:"shared-sub-available"`
 	MinimumProtocolVersion       byte   `yaml:"minimum-protocol-version"`
 	Compatibilities              Compatibilities
-	MaximumQos                   byte `yaml:"maximum-qos"`
-	RetainAvailable              byte `yaml:"retain-available"`
-	WildcardSubAvailable         byte `yaml:"wildcard-sub-available"`
-	SubIDAvailable               byte `yaml:"sub-id-available"`
+	MaximumQos                   byte  `yaml:"maximum-qos"`
+	RetainAvailable              byte  `yaml:"retain-available"`
+	WildcardSubAvailable         byte  `yaml:"wildcard-sub-available"`
+	SubIDAvailable               byte  `yaml:"sub-id-available"`
+	MaximumOfflineMessages       int   `yaml:"maximum-offline-messages"` // maximum messages queued per disconnected session, 0 disables the offline queue
+	MaximumOfflineBytes          int64 `yaml:"maximum-offline-bytes"`    // maximum payload bytes queued per disconnected session, 0 unlimited
+	OfflineOverflow              byte  `yaml:"offline-overflow"`         // OfflineDropOldest or OfflineDropNewest when the offline queue is full
 }
 
 // Compatibilities provides flags for using compatibility modes.
@@ -110,9 +114,45 @@ type Options struct {
 	// SysTopicResendInterval specifies the interval between $SYS topic updates in seconds.
 	SysTopicResendInterval int64 `yaml:"sys-topic-resend-interval"`
 
+	// SysTopics selects which $SYS subtrees are published and how often.
+	SysTopics SysTopicsOptions `yaml:"sys-topics"`
+
 	// Enable Inline client to allow direct subscribing and publishing from the parent codebase,
 	// with negligible performance difference (disabled by default to prevent confusion in statistics).
 	InlineClient bool `yaml:"inline-client"`
+
+	// LazyRetained looks up the retained messages matching new subscriptions in the storage
+	// hooks providing StoredRetainedMessagesByFilter, instead of loading every retained message
+	// into memory on start (see LazyRetainedStore).
+	LazyRetained bool `yaml:"lazy-retained"`
+
+	// RetainedCacheSize is the number of filters whose retained messages are cached when
+	// LazyRetained is enabled, defaulting to 1024.
+	RetainedCacheSize int `yaml:"retained-cache-size"`
+
+	// SharedSubscriptions selects how the member of a shared subscription group which receives
+	// a message is chosen, globally or for each group.
+	SharedSubscriptions SharedOptions `yaml:"shared-subscriptions"`
+}
+
+// ListenerOptions contains the options of a listener which override the server options
+// for the clients connected to it.
+type ListenerOptions struct {
+	// Capabilities replaces the server capabilities for the clients of the listener, such
+	// as to lower the maximum qos or packet size of a public port. Nil uses the server
+	// capabilities.
+	Capabilities *Capabilities
+
+	// MaxConnections is the maximum number of clients connected to the listener at once,
+	// or 0 for no limit.
+	MaxConnections int64
+}
+
+// listenerOptions contains the options and the connection count of a listener.
+type listenerOptions struct {
+	ListenerOptions
+	options   *Options // the server options with the capabilities of the listener
+	connected int64    // the number of clients connected to the listener
 }
 
 // Server is an MQTT broker server. It should be created with server.New()
@@ -122,31 +162,39 @@ type Server struct {
 	Listeners    *listeners.Listeners // listeners are network interfaces which listen for new connections
 	Clients      *Clients             // clients known to the broker
 	Topics       *TopicsIndex         // an index of topic filter subscriptions and retained messages
+	Retained     RetainedStore        // the retained messages, held by Topics unless looked up lazily
 	Info         *system.Info         // values about the server commonly known as $SYS topics
 	loop         *loop                // loop contains tickers for the system event loop
 	done         chan bool            // indicate that the server is ending
 	Log          *slog.Logger         // minimal no-alloc logger
 	hooks        *Hooks               // hooks contains hooks for extra functionality such as auth and persistent storage
 	inlineClient *Client              // inlineClient is a special client used for inline subscriptions and inline Publish
-	Blacklist    []string             // blacklist of client id
+	Blacklist    *Blacklist           // banned client ids, usernames and ip networks
+	Delayed      *DelayedMessages     // messages held to be published after a delay
+	sysTrees     sysTrees             // the $SYS subtrees published on the sys topics ticker
+	shared       *SharedSelector      // selects the members of shared subscription groups
+	listenerOpts sync.Map             // *listenerOptions keyed on listener id
 }
 
 // loop contains interval tickers for the system events loop.
 type loop struct {
-	sysTopics      *time.Ticker     // interval ticker for sending updating $SYS topics
-	clientExpiry   *time.Ticker     // interval ticker for cleaning expired clients
-	inflightExpiry *time.Ticker     // interval ticker for cleaning up expired inflight messages
-	retainedExpiry *time.Ticker     // interval ticker for cleaning retained messages
-	willDelaySend  *time.Ticker     // interval ticker for sending Will Messages with a delay
-	willDelayed    *packets.Packets // activate LWT packets which will be sent after a delay
+	sysTopics       *time.Ticker     // interval ticker for sending updating $SYS topics
+	clientExpiry    *time.Ticker     // interval ticker for cleaning expired clients
+	inflightExpiry  *time.Ticker     // interval ticker for cleaning up expired inflight messages
+	retainedExpiry  *time.Ticker     // interval ticker for cleaning retained messages
+	blacklistExpiry *time.Ticker     // interval ticker for cleaning expired blacklist entries
+	willDelaySend   *time.Ticker     // interval ticker for sending Will Messages with a delay
+	willDelayed     *packets.Packets // activate LWT packets which will be sent after a delay
+	delayedSend     *time.Ticker     // interval ticker for publishing delayed messages which are due
 }
 
 // ops contains server values which can be propagated to other structs.
 type ops struct {
-	options *Options     // a pointer to the server options and capabilities, for referencing in clients
-	info    *system.Info // pointers to server system info
-	hooks   *Hooks       // pointer to the server hooks
-	log     *slog.Logger // a structured logger for the client
+	options *Options         // a pointer to the server options and capabilities, for referencing in clients
+	info    *system.Info     // pointers to server system info
+	hooks   *Hooks           // pointer to the server hooks
+	log     *slog.Logger     // a structured logger for the client
+	drain   func(cl *Client) // sends the offline queue of a client as its pending writes are written
 }
 
 // New returns a new instance of comqtt broker. Optional parameters
@@ -163,13 +211,18 @@ func New(opts *Options) *Server {
 		Clients:   NewClients(),
 		Topics:    NewTopicsIndex(),
 		Listeners: listeners.New(),
+		Blacklist: NewBlacklist(),
+		Delayed:   NewDelayedMessages(),
+		shared:    NewSharedSelector(),
 		loop: &loop{
-			sysTopics:      time.NewTicker(time.Second * time.Duration(opts.SysTopicResendInterval)),
-			clientExpiry:   time.NewTicker(time.Second * 10),
-			inflightExpiry: time.NewTicker(time.Second * 10),
-			retainedExpiry: time.NewTicker(time.Second * 30),
-			willDelaySend:  time.NewTicker(time.Second * 5),
-			willDelayed:    packets.NewPackets(),
+			sysTopics:       time.NewTicker(opts.sysTickInterval()),
+			clientExpiry:    time.NewTicker(time.Second * 10),
+			inflightExpiry:  time.NewTicker(time.Second * 10),
+			retainedExpiry:  time.NewTicker(time.Second * 30),
+			blacklistExpiry: time.NewTicker(time.Second * 10),
+			willDelaySend:   time.NewTicker(time.Second * 5),
+			willDelayed:     packets.NewPackets(),
+			delayedSend:     time.NewTicker(time.Second),
 		},
 		Options: opts,
 		Info: &system.Info{
@@ -182,11 +235,15 @@ func New(opts *Options) *Server {
 		},
 	}
 
+	s.Retained = s.Topics
+
 	if s.Options.InlineClient {
 		s.inlineClient = s.NewClient(nil, LocalListener, InlineClientId, true)
 		s.Clients.Add(s.inlineClient)
 	}
 
+	s.registerSysTopics()
+
 	return s
 }
 
@@ -221,11 +278,17 @@ func (o *Options) ensureDefaults() {
 // messages from the embedding application, set the inline flag to true to bypass ACL and
 // topic validation checks.
 func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool) *Client {
+	options := s.Options
+	if lo, ok := s.listenerOptions(listener); ok {
+		options = lo.options
+	}
+
 	cl := newClient(c, &ops{ // [MQTT-3.1.2-6] implicit
-		options: s.Options,
+		options: options,
 		info:    s.Info,
 		hooks:   s.hooks,
 		log:     s.Log,
+		drain:   s.drainOffline,
 	})
 
 	cl.ID = id
@@ -255,6 +318,18 @@ func (s *Server) AddHook(hook Hook, config any) error {
 	return s.hooks.Add(hook, config)
 }
 
+// ReplaceHook atomically replaces the added hook with the same id, such as to apply a
+// changed config. If the new hook fails to initialize, the existing hook is kept.
+func (s *Server) ReplaceHook(hook Hook, config any) error {
+	nl := s.Log.With("hook", hook.ID())
+	hook.SetOpts(nl, &HookOptions{
+		Capabilities: s.Options.Capabilities,
+	})
+
+	s.Log.Info("replaced hook", "hook", hook.ID())
+	return s.hooks.Replace(hook, config)
+}
+
 // AddListener adds a new network listener to the server, for receiving incoming client connections.
 func (s *Server) AddListener(l listeners.Listener) error {
 	if _, ok := s.Listeners.Get(l.ID()); ok {
@@ -272,12 +347,69 @@ func (s *Server) AddListener(l listeners.Listener) error {
 	return nil
 }
 
+// AddListenerWithOptions adds a new network listener to the server, whose clients use the
+// capabilities and connection limit of the listener options instead of the server options.
+func (s *Server) AddListenerWithOptions(l listeners.Listener, o *ListenerOptions) error {
+	if o == nil {
+		return s.AddListener(l)
+	}
+
+	if _, ok := s.Listeners.Get(l.ID()); ok {
+		return ErrListenerIDExists
+	}
+
+	lo := &listenerOptions{
+		ListenerOptions: *o,
+		options:         s.Options,
+	}
+
+	if o.Capabilities != nil {
+		caps := *o.Capabilities
+		caps.maximumPacketID = math.MaxUint16 // spec maximum is 65535
+		lo.Capabilities = &caps
+
+		options := *s.Options
+		options.Capabilities = &caps
+		lo.options = &options
+	}
+
+	s.listenerOpts.Store(l.ID(), lo)
+	if err := s.AddListener(l); err != nil {
+		s.listenerOpts.Delete(l.ID())
+		return err
+	}
+
+	return nil
+}
+
+// listenerOptions returns the options of a listener added with AddListenerWithOptions.
+func (s *Server) listenerOptions(id string) (*listenerOptions, bool) {
+	v, ok := s.listenerOpts.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*listenerOptions), true
+}
+
+// capabilities returns the capabilities for a client, which are the capabilities of its
+// listener if the listener has its own, or else the server capabilities.
+func (s *Server) capabilities(cl *Client) *Capabilities {
+	if lo, ok := s.listenerOptions(cl.Net.Listener); ok && lo.Capabilities != nil {
+		return lo.Capabilities
+	}
+	return s.Options.Capabilities
+}
+
 // Serve starts the event loops responsible for establishing client connections
 // on all attached listeners, publishing the system topics, and starting all hooks.
 func (s *Server) Serve() error {
 	//s.Log.Info("version", Version).Msg("comqtt starting")
 	defer s.Log.Info("comqtt server started")
 
+	if err := s.Options.SharedSubscriptions.validate(); err != nil {
+		return err
+	}
+
 	if s.hooks.Provides(
 		StoredClients,
 		StoredInflightMessages,
@@ -315,8 +447,12 @@ func (s *Server) eventLoop() {
 			s.clearExpiredClients(time.Now().Unix())
 		case <-s.loop.retainedExpiry.C:
 			s.clearExpiredRetainedMessages(time.Now().Unix())
+		case <-s.loop.blacklistExpiry.C:
+			s.clearExpiredBlacklist(time.Now().Unix())
 		case <-s.loop.willDelaySend.C:
 			s.sendDelayedLWT(time.Now().Unix())
+		case <-s.loop.delayedSend.C:
+			s.sendDelayedMessages(time.Now().Unix())
 		case <-s.loop.inflightExpiry.C:
 			s.clearExpiredInflights(time.Now().Unix())
 		}
@@ -339,9 +475,6 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	}
 
 	cl.ParseConnect(listener, pk)
-	if slices.Contains(s.Blacklist, cl.ID) {
-		return fmt.Errorf("blacklisted client: %s", cl.ID)
-	}
 
 	code := s.validateConnect(cl, pk) // [MQTT-3.1.4-1] [MQTT-3.1.4-2]
 	if code != packets.CodeSuccess {
@@ -351,13 +484,44 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		return code // [MQTT-3.2.2-7] [MQTT-3.1.4-6]
 	}
 
+	if lo, ok := s.listenerOptions(listener); ok && lo.MaxConnections > 0 {
+		defer atomic.AddInt64(&lo.connected, -1)
+		if atomic.AddInt64(&lo.connected, 1) > lo.MaxConnections {
+			s.Log.Info("listener connection limit reached", "client", cl.ID, "remote", cl.Net.Remote, "listener", listener)
+			if err := s.SendConnack(cl, packets.ErrServerBusy, false, nil); err != nil {
+				return fmt.Errorf("refused connection send ack: %w", err)
+			}
+			return packets.ErrServerBusy
+		}
+	}
+
 	err = s.hooks.OnConnect(cl, pk)
 	if err != nil {
+		if code, ok := err.(packets.Code); ok && code.Code >= packets.ErrUnspecifiedError.Code {
+			if err := s.SendConnack(cl, code, false, nil); err != nil {
+				return fmt.Errorf("refused connection send ack: %w", err)
+			}
+		}
 		return err
 	}
 
 	cl.refreshDeadline(cl.State.Keepalive)
-	if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
+	var ackProps *packets.Properties
+	if pk.Properties.AuthenticationMethod != "" && s.hooks.Provides(OnAuthPacket) {
+		ackProps, err = s.authenticate(cl, pk) // enhanced authentication replaces OnConnectAuthenticate
+		if err != nil {
+			code, ok := err.(packets.Code)
+			if !ok {
+				return fmt.Errorf("enhanced authentication: %w", err)
+			}
+
+			if err := s.SendConnack(cl, code, false, nil); err != nil {
+				return fmt.Errorf("invalid connection send ack: %w", err)
+			}
+
+			return code
+		}
+	} else if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
 		err := s.SendConnack(cl, packets.ErrBadUsernameOrPassword, false, nil)
 		if err != nil {
 			return fmt.Errorf("invalid connection send ack: %w", err)
@@ -374,7 +538,7 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	sessionPresent := s.inheritClientSession(pk, cl)
 	s.Clients.Add(cl) // [MQTT-4.1.0-1]
 
-	err = s.SendConnack(cl, code, sessionPresent, nil) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
+	err = s.SendConnack(cl, code, sessionPresent, ackProps) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
 	if err != nil {
 		return fmt.Errorf("ack connection packet: %w", err)
 	}
@@ -388,6 +552,7 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		}
 	}
 
+	s.drainOffline(cl)
 	s.hooks.OnSessionEstablished(cl, pk)
 
 	err = cl.Read(s.receivePacket)
@@ -399,11 +564,12 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	}
 	s.Log.Debug("client disconnected", "error", err, "client", cl.ID, "remote", cl.Net.Remote, "listener", listener)
 
-	expire := (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) || (cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
+	expire := !cl.persistent()
 	s.hooks.OnDisconnect(cl, err, expire)
 
 	if expire && atomic.LoadUint32(&cl.State.isTakenOver) == 0 {
 		cl.ClearInflights(math.MaxInt64, 0)
+		s.clearOffline(cl)
 		s.UnsubscribeClient(cl)
 		s.Clients.Delete(cl.ID) // [MQTT-4.1.0-2] ![MQTT-3.1.2-23]
 	}
@@ -462,11 +628,17 @@ func (s *Server) validateConnect(cl *Client, pk packets.Packet) packets.Code {
 		return packets.ErrUnspecifiedError
 	}
 
-	if cl.Properties.ProtocolVersion < s.Options.Capabilities.MinimumProtocolVersion {
+	if e, ok := s.Blacklist.Match(cl, time.Now().Unix()); ok {
+		s.Log.Info("client is blacklisted", "client", cl.ID, "remote", cl.Net.Remote, "kind", e.Kind, "value", e.Value, "reason", e.Reason)
+		return packets.ErrBanned
+	}
+
+	caps := s.capabilities(cl)
+	if cl.Properties.ProtocolVersion < caps.MinimumProtocolVersion {
 		return packets.ErrUnsupportedProtocolVersion // [MQTT-3.1.2-2]
-	} else if cl.Properties.Will.Qos > s.Options.Capabilities.MaximumQos {
+	} else if cl.Properties.Will.Qos > caps.MaximumQos {
 		return packets.ErrQosNotSupported // [MQTT-3.2.2-12]
-	} else if cl.Properties.Will.Retain && s.Options.Capabilities.RetainAvailable == 0x00 {
+	} else if cl.Properties.Will.Retain && caps.RetainAvailable == 0x00 {
 		return packets.ErrRetainNotSupported // [MQTT-3.2.2-13]
 	}
 
@@ -482,6 +654,7 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		if pk.Connect.Clean || (existing.Properties.Clean && existing.Properties.ProtocolVersion < 5) { // [MQTT-3.1.2-4] [MQTT-3.1.4-4]
 			s.UnsubscribeClient(existing)
 			existing.ClearInflights(math.MaxInt64, 0)
+			s.clearOffline(existing)
 			atomic.StoreUint32(&existing.State.isTakenOver, 1) // only set isTakenOver after unsubscribe has occurred
 			return false                                       // [MQTT-3.2.2-3]
 		}
@@ -495,6 +668,8 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 			}
 		}
 
+		cl.State.Offline = existing.State.Offline // drained in order once the connack has been sent
+
 		for _, sub := range existing.State.Subscriptions.GetAll() {
 			isNew, count := s.Topics.Subscribe(cl.ID, sub) // [MQTT-3.8.4-3]
 			if isNew {
@@ -534,14 +709,15 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 
 // SendConnack returns a Connack packet to a client.
 func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, properties *packets.Properties) error {
+	caps := s.capabilities(cl)
 	if properties == nil {
 		properties = &packets.Properties{
-			ReceiveMaximum: s.Options.Capabilities.ReceiveMaximum,
+			ReceiveMaximum: caps.ReceiveMaximum,
 		}
 	}
 
-	properties.ReceiveMaximum = s.Options.Capabilities.ReceiveMaximum // 3.2.2.3.3 Receive Maximum
-	if cl.State.ServerKeepalive {                                     // You can set this dynamically using the OnConnect hook.
+	properties.ReceiveMaximum = caps.ReceiveMaximum // 3.2.2.3.3 Receive Maximum
+	if cl.State.ServerKeepalive {                   // You can set this dynamically using the OnConnect hook.
 		properties.ServerKeepAlive = cl.State.Keepalive // [MQTT-3.1.2-21]
 		properties.ServerKeepAliveFlag = true
 	}
@@ -565,8 +741,8 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 		return cl.WritePacket(ack)
 	}
 
-	if s.Options.Capabilities.MaximumQos < 2 {
-		properties.MaximumQos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+	if caps.MaximumQos < 2 {
+		properties.MaximumQos = caps.MaximumQos // [MQTT-3.2.2-9]
 		properties.MaximumQosFlag = true
 	}
 
@@ -574,8 +750,8 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 		properties.AssignedClientID = cl.Properties.Props.AssignedClientID // [MQTT-3.1.3-7] [MQTT-3.2.2-16]
 	}
 
-	if cl.Properties.Props.SessionExpiryInterval > s.Options.Capabilities.MaximumSessionExpiryInterval {
-		properties.SessionExpiryInterval = s.Options.Capabilities.MaximumSessionExpiryInterval
+	if cl.Properties.Props.SessionExpiryInterval > caps.MaximumSessionExpiryInterval {
+		properties.SessionExpiryInterval = caps.MaximumSessionExpiryInterval
 		properties.SessionExpiryIntervalFlag = true
 		cl.Properties.Props.SessionExpiryInterval = properties.SessionExpiryInterval
 		cl.Properties.Props.SessionExpiryIntervalFlag = true
@@ -626,7 +802,7 @@ func (s *Server) processPacket(cl *Client, pk packets.Packet) error {
 	case packets.Pingreq:
 		err = s.processPingreq(cl, pk)
 	case packets.Publish:
-		code := pk.PublishValidate(s.Options.Capabilities.TopicAliasMaximum)
+		code := pk.PublishValidate(s.capabilities(cl).TopicAliasMaximum)
 		if code != packets.CodeSuccess {
 			return code
 		}
@@ -677,6 +853,10 @@ func (s *Server) processPacket(cl *Client, pk packets.Packet) error {
 		}
 	}
 
+	if cl.State.Offline.Len() > 0 {
+		s.drainOffline(cl)
+	}
+
 	return nil
 }
 
@@ -752,7 +932,7 @@ func (s *Server) Subscribe(filter string, subscriptionId int, handler InlineSubF
 	s.hooks.OnSubscribed(s.inlineClient, pk, []byte{packets.CodeSuccess.Code}, []int{count})
 
 	// Handling retained messages.
-	for _, pkv := range s.Topics.Messages(filter) { // [MQTT-3.8.4-4]
+	for _, pkv := range s.Retained.Messages(filter) { // [MQTT-3.8.4-4]
 		handler(s.inlineClient, inlineSubscription.Subscription, pkv)
 	}
 	return nil
@@ -799,6 +979,7 @@ func (s *Server) InjectPacket(cl *Client, pk packets.Packet) error {
 	atomic.AddInt64(&cl.ops.info.PacketsReceived, 1)
 	if pk.FixedHeader.Type == packets.Publish {
 		atomic.AddInt64(&cl.ops.info.MessagesReceived, 1)
+		atomic.AddInt64(&cl.State.Stats.MessagesReceived, 1)
 	}
 
 	return nil
@@ -814,22 +995,21 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return s.DisconnectClient(cl, packets.ErrReceiveMaximum) // ~[MQTT-3.3.4-7] ~[MQTT-3.3.4-8]
 	}
 
-	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
-		if pk.FixedHeader.Qos == 0 {
-			return nil
-		}
-
-		if cl.Properties.ProtocolVersion != 5 {
-			return s.DisconnectClient(cl, packets.ErrNotAuthorized)
-		}
+	if pk.Properties.TopicAliasFlag && pk.Properties.TopicAlias > 0 { // [MQTT-3.3.2-11]
+		pk.TopicName = cl.State.TopicAliases.Inbound.Set(pk.Properties.TopicAlias, pk.TopicName)
+	}
 
-		ackType := packets.Puback
-		if pk.FixedHeader.Qos == 2 {
-			ackType = packets.Pubrec
+	var delay int64
+	if IsDelayedTopic(pk.TopicName) { // $delayed/{seconds}/topic
+		d, topic, ok := ParseDelayedTopic(pk.TopicName)
+		if !ok {
+			return s.refusePublish(cl, pk, packets.ErrTopicNameInvalid)
 		}
+		delay, pk.TopicName = d, topic
+	}
 
-		ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrNotAuthorized)
-		return cl.WritePacket(ack)
+	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
+		return s.refusePublish(cl, pk, packets.ErrNotAuthorized)
 	}
 
 	pk.Origin = cl.ID
@@ -847,12 +1027,8 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		}
 	}
 
-	if pk.Properties.TopicAliasFlag && pk.Properties.TopicAlias > 0 { // [MQTT-3.3.2-11]
-		pk.TopicName = cl.State.TopicAliases.Inbound.Set(pk.Properties.TopicAlias, pk.TopicName)
-	}
-
-	if pk.FixedHeader.Qos > s.Options.Capabilities.MaximumQos {
-		pk.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9] Reduce qos based on server max qos capability
+	if maxQos := s.capabilities(cl).MaximumQos; pk.FixedHeader.Qos > maxQos {
+		pk.FixedHeader.Qos = maxQos // [MQTT-3.2.2-9] Reduce qos based on server max qos capability
 	}
 
 	pkx, err := s.hooks.OnPublish(cl, pk)
@@ -862,15 +1038,11 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return nil
 	} else if errors.Is(err, packets.CodeSuccessIgnore) {
 		pk.Ignore = true
-	} else if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 && errors.As(err, new(packets.Code)) {
-		err = cl.WritePacket(s.buildAck(pk.PacketID, packets.Puback, 0, pk.Properties, err.(packets.Code)))
-		if err != nil {
-			return err
-		}
-		return nil
+	} else if code := new(packets.Code); cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 && errors.As(err, code) {
+		return s.refusePublish(cl, pk, *code)
 	}
 
-	if pk.FixedHeader.Retain { // [MQTT-3.3.1-5] ![MQTT-3.3.1-8]
+	if pk.FixedHeader.Retain && delay == 0 { // [MQTT-3.3.1-5] ![MQTT-3.3.1-8]
 		s.retainMessage(cl, pk)
 	}
 
@@ -878,8 +1050,7 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	// When it publishes a package with a qos > 0, the server treats
 	// the package as qos=0, and the client receives it as qos=1 or 2.
 	if pk.FixedHeader.Qos == 0 || cl.Net.Inline {
-		s.publishToSubscribers(pk)
-		s.hooks.OnPublished(cl, pk)
+		s.publishOrDelay(cl, pk, delay)
 		return nil
 	}
 
@@ -907,23 +1078,107 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		s.hooks.OnQosComplete(cl, ack)
 	}
 
-	s.publishToSubscribers(pk)
-	s.hooks.OnPublished(cl, pk)
+	s.publishOrDelay(cl, pk, delay)
 
 	return nil
 }
 
+// refusePublish answers a qos publish which was refused with a reason code in its PUBACK or
+// PUBREC, or disconnects the client if it cannot receive the reason code. Refused qos 0
+// messages are dropped.
+func (s *Server) refusePublish(cl *Client, pk packets.Packet, code packets.Code) error {
+	if pk.FixedHeader.Qos == 0 {
+		return nil
+	}
+
+	if cl.Properties.ProtocolVersion != 5 {
+		return s.DisconnectClient(cl, code)
+	}
+
+	ackType := packets.Puback
+	if pk.FixedHeader.Qos == 2 {
+		ackType = packets.Pubrec
+	}
+
+	ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, code)
+	return cl.WritePacket(ack)
+}
+
+// publishOrDelay publishes a message to its subscribers, or if the message was published
+// to a delayed topic, holds it to be published once the delay in seconds has passed.
+func (s *Server) publishOrDelay(cl *Client, pk packets.Packet, delay int64) {
+	if delay > 0 && !pk.Ignore {
+		m := DelayedMessage{
+			ID:     xid.New().String(),
+			Packet: pk.Copy(false),
+			Due:    pk.Created + delay,
+		}
+		s.Delayed.Add(m)
+		s.hooks.OnDelayedAdded(m)
+		return
+	}
+
+	s.publishToSubscribers(pk)
+	s.hooks.OnPublished(cl, pk)
+}
+
 // retainMessage adds a message to a topic, and if a persistent store is provided,
 // adds the message to the store to be reloaded if necessary.
 func (s *Server) retainMessage(cl *Client, pk packets.Packet) {
-	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore {
+	if s.capabilities(cl).RetainAvailable == 0 || pk.Ignore {
 		return
 	}
 
 	out := pk.Copy(false)
-	r := s.Topics.RetainMessage(out)
+	r := s.Retained.RetainMessage(out)
 	s.hooks.OnRetainMessage(cl, pk, r)
-	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	if lazy, ok := s.Retained.(*LazyRetainedStore); ok {
+		lazy.Invalidate(pk.TopicName) // drop any lookups made before the store was updated
+	}
+	atomic.StoreInt64(&s.Info.Retained, s.Retained.Count())
+}
+
+// DeleteRetained removes the retained message of a topic, as if an empty retained message
+// was published to it. It returns false if the topic had no retained message.
+func (s *Server) DeleteRetained(topic string) bool {
+	if !IsValidFilter(topic, true) {
+		return false
+	}
+
+	cl := s.localClient()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+		Origin:      cl.ID,
+		Created:     time.Now().Unix(),
+	}
+
+	if len(s.Retained.Messages(topic)) == 0 {
+		return false
+	}
+
+	s.retainMessage(cl, pk)
+	return true
+}
+
+// DeleteDelayed cancels a delayed message, returning true if it existed.
+func (s *Server) DeleteDelayed(id string) bool {
+	m, ok := s.Delayed.Delete(id)
+	if ok {
+		s.hooks.OnDelayedDeleted(m)
+	}
+
+	return ok
+}
+
+// localClient returns the inline client, or a new local client if the inline client is not
+// enabled, which server issued messages are attributed to.
+func (s *Server) localClient() *Client {
+	if s.inlineClient != nil {
+		return s.inlineClient
+	}
+
+	return s.NewClient(nil, LocalListener, InlineClientId, true)
 }
 
 // PublishToSubscribers publishes a publish packet to all subscribers with matching topic filters.
@@ -949,10 +1204,14 @@ func (s *Server) PublishToSubscribers(pk packets.Packet, local bool) {
 
 	sharedFilters := make(map[string]bool)
 	subscribers := s.Topics.Subscribers(pk.TopicName)
+	if len(subscribers.Shared) > 0 && local && !strings.HasPrefix(pk.TopicName, SysPrefix) {
+		subscribers = s.hooks.OnSelectSharedNodes(subscribers, pk)
+	}
+
 	if len(subscribers.Shared) > 0 {
 		subscribers = s.hooks.OnSelectSubscribers(subscribers, pk)
 		if len(subscribers.SharedSelected) == 0 {
-			subscribers.SelectShared()
+			s.selectShared(subscribers, pk)
 		}
 
 		// records shared subscriptions for different groups
@@ -993,6 +1252,42 @@ func (s *Server) PublishToSubscribers(pk packets.Packet, local bool) {
 	}
 }
 
+// selectShared selects one member of each shared subscription group to receive a message,
+// using the strategy of the group.
+func (s *Server) selectShared(subs *Subscribers, pk packets.Packet) {
+	subs.SharedSelected = map[string]packets.Subscription{}
+	for filter, members := range subs.Shared {
+		ids := make([]string, 0, len(members))
+		for id := range members {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		id := s.shared.Select(s.Options.SharedSubscriptions.GroupStrategy(filter), filter, pk, ids, s.inflightLen)
+		sub := members[id]
+		if cls, ok := subs.SharedSelected[id]; ok {
+			sub = cls.Merge(sub)
+		}
+		subs.SharedSelected[id] = sub
+	}
+}
+
+// inflightLen returns the number of inflight messages of a client.
+func (s *Server) inflightLen(id string) int {
+	if cl, ok := s.Clients.Get(id); ok {
+		return cl.State.Inflight.Len()
+	}
+
+	return math.MaxInt
+}
+
+// forgetShared resets the turns of a shared subscription group when its members change.
+func (s *Server) forgetShared(filter string) {
+	if IsSharedFilter(filter) {
+		s.shared.Forget(filter)
+	}
+}
+
 func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packets.Packet) (packets.Packet, error) {
 	if sub.NoLocal && pk.Origin == cl.ID {
 		return pk, nil // [MQTT-3.8.3-3]
@@ -1018,13 +1313,23 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		out.FixedHeader.Qos = sub.Qos
 	}
 
-	if out.FixedHeader.Qos > s.Options.Capabilities.MaximumQos {
-		out.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+	if maxQos := s.capabilities(cl).MaximumQos; out.FixedHeader.Qos > maxQos {
+		out.FixedHeader.Qos = maxQos // [MQTT-3.2.2-9]
 	}
 
+	if out.FixedHeader.Qos > 0 && s.Options.Capabilities.MaximumOfflineMessages > 0 && !cl.Net.Inline && s.queueOffline(cl, out) {
+		return out, nil
+	}
+
+	return s.sendToClient(cl, out)
+}
+
+// sendToClient assigns a topic alias and packet id to a message prepared for a client,
+// and writes it to the client.
+func (s *Server) sendToClient(cl *Client, out packets.Packet) (packets.Packet, error) {
 	if cl.Properties.Props.TopicAliasMaximum > 0 {
 		var aliasExists bool
-		out.Properties.TopicAlias, aliasExists = cl.State.TopicAliases.Outbound.Set(pk.TopicName)
+		out.Properties.TopicAlias, aliasExists = cl.State.TopicAliases.Outbound.Set(out.TopicName)
 		if out.Properties.TopicAlias > 0 {
 			out.Properties.TopicAliasFlag = true
 			if aliasExists {
@@ -1036,7 +1341,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	if out.FixedHeader.Qos > 0 {
 		i, err := cl.NextPacketID() // [MQTT-4.3.2-1] [MQTT-4.3.3-1]
 		if err != nil {
-			s.hooks.OnPacketIDExhausted(cl, pk)
+			s.hooks.OnPacketIDExhausted(cl, out)
 			s.Log.Warn("packet ids exhausted", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
 			return out, packets.ErrQuotaExceeded
 		}
@@ -1066,7 +1371,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		atomic.AddInt32(&cl.State.outboundQty, 1)
 	default:
 		atomic.AddInt64(&s.Info.MessagesDropped, 1)
-		cl.ops.hooks.OnPublishDropped(cl, pk)
+		cl.ops.hooks.OnPublishDropped(cl, out)
 		cl.State.Inflight.Delete(out.PacketID) // packet was dropped due to irregular circumstances, so rollback inflight.
 		cl.State.Inflight.IncreaseSendQuota()
 		return out, packets.ErrPendingClientWritesExceeded
@@ -1075,6 +1380,97 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	return out, nil
 }
 
+// queueOffline holds a qos message for a persistent session while its client is disconnected,
+// or while earlier queued messages are still being sent, dropping messages by the overflow
+// policy when the queue is full. It returns false if the message should be sent directly,
+// including to clients without a persistent session.
+func (s *Server) queueOffline(cl *Client, pk packets.Packet) bool {
+	q := cl.State.Offline
+	q.Lock()
+	defer q.Unlock()
+
+	if !cl.persistent() || (len(q.messages) == 0 && cl.Net.Conn != nil && !cl.Closed()) {
+		return false
+	}
+
+	caps := s.Options.Capabilities
+	size := int64(len(pk.Payload))
+	if caps.MaximumOfflineBytes > 0 && size > caps.MaximumOfflineBytes {
+		s.dropOffline(cl, pk) // the message can never fit
+		return true
+	}
+
+	for len(q.messages) >= caps.MaximumOfflineMessages || (caps.MaximumOfflineBytes > 0 && q.bytes+size > caps.MaximumOfflineBytes) {
+		if caps.OfflineOverflow == OfflineDropNewest {
+			s.dropOffline(cl, pk)
+			return true
+		}
+
+		m := q.shift()
+		s.hooks.OnOfflineDequeued(cl, m)
+		s.dropOffline(cl, m.Packet)
+	}
+
+	s.hooks.OnOfflineQueued(cl, q.push(pk))
+	return true
+}
+
+// dropOffline records a message which was dropped from or could not be added to an offline queue.
+func (s *Server) dropOffline(cl *Client, pk packets.Packet) {
+	atomic.AddInt64(&s.Info.MessagesDropped, 1)
+	s.hooks.OnPublishDropped(cl, pk)
+	s.Log.Debug("offline queue full, message dropped", "client", cl.ID, "topic", pk.TopicName)
+}
+
+// drainOffline sends the queued messages of a session to its connected client in order, for
+// as long as the client has send quota and room for pending writes. The remaining messages
+// are sent as the client acknowledges the earlier ones, or as its pending writes are written.
+func (s *Server) drainOffline(cl *Client) {
+	q := cl.State.Offline
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now().Unix()
+	for len(q.messages) > 0 {
+		if cl.Net.Conn == nil || cl.Closed() {
+			return
+		}
+
+		if atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 && atomic.LoadInt32(&cl.State.Inflight.sendQuota) <= 0 {
+			return
+		}
+
+		if atomic.LoadInt32(&cl.State.outboundQty) >= int32(cap(cl.State.outbound)) {
+			return
+		}
+
+		m := q.messages[0]
+		if m.Packet.Expiry > 0 && m.Packet.Expiry < now {
+			s.hooks.OnOfflineDequeued(cl, q.shift())
+			continue
+		}
+
+		_, err := s.sendToClient(cl, m.Packet)
+		if err == packets.ErrQuotaExceeded || err == packets.ErrPendingClientWritesExceeded {
+			return // keep the message for the next attempt
+		}
+
+		s.hooks.OnOfflineDequeued(cl, q.shift())
+	}
+}
+
+// clearOffline deletes all queued messages of a session, e.g. when it has expired or a
+// client has connected with a clean start.
+func (s *Server) clearOffline(cl *Client) {
+	q := cl.State.Offline
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.messages) > 0 {
+		s.hooks.OnOfflineDequeued(cl, q.shift())
+	}
+}
+
 func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, existed bool) {
 	if IsSharedFilter(sub.Filter) {
 		return // 4.8.2 Non-normative - Shared Subscriptions - No Retained Messages are sent to the Session when it first subscribes.
@@ -1085,7 +1481,7 @@ func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, e
 	}
 
 	sub.FwdRetainedFlag = true
-	for _, pkv := range s.Topics.Messages(sub.Filter) { // [MQTT-3.8.4-4]
+	for _, pkv := range s.Retained.Messages(sub.Filter) { // [MQTT-3.8.4-4]
 		_, err := s.publishToClient(cl, sub, pkv)
 		if err != nil {
 			s.Log.Debug("failed to publish retained message", "error", err, "client", cl.ID, "listener", cl.Net.Listener, "packet", pkv)
@@ -1218,6 +1614,8 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 			reasonCodes[i] = packets.ErrTopicFilterInvalid.Code
 		} else if sub.NoLocal && IsSharedFilter(sub.Filter) {
 			reasonCodes[i] = packets.ErrProtocolViolationInvalidSharedNoLocal.Code // [MQTT-3.8.3-4]
+		} else if i < len(pk.ReasonCodes) && pk.ReasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			reasonCodes[i] = pk.ReasonCodes[i] // rejected by an OnSubscribe hook
 		} else if !s.hooks.OnACLCheck(cl, sub.Filter, false) {
 			reasonCodes[i] = packets.ErrNotAuthorized.Code
 			if s.Options.Capabilities.Compatibilities.ObscureNotAuthorized {
@@ -1230,8 +1628,8 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 			}
 			cl.State.Subscriptions.Add(sub.Filter, sub) // [MQTT-3.2.2-10]
 
-			if sub.Qos > s.Options.Capabilities.MaximumQos {
-				sub.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+			if maxQos := s.capabilities(cl).MaximumQos; sub.Qos > maxQos {
+				sub.Qos = maxQos // [MQTT-3.2.2-9]
 			}
 
 			filterExisted[i] = !isNew
@@ -1295,6 +1693,7 @@ func (s *Server) processUnsubscribe(cl *Client, pk packets.Packet) error {
 		q, count := s.Topics.Unsubscribe(sub.Filter, cl.ID)
 		if q {
 			atomic.AddInt64(&s.Info.Subscriptions, -1)
+			s.forgetShared(sub.Filter)
 			reasonCodes[i] = packets.CodeSuccess.Code
 		} else {
 			reasonCodes[i] = packets.CodeNoSubscriptionExisted.Code
@@ -1344,6 +1743,7 @@ func (s *Server) UnsubscribeClient(cl *Client) {
 		q, count := s.Topics.Unsubscribe(k, cl.ID)
 		if q {
 			atomic.AddInt64(&s.Info.Subscriptions, -1)
+			s.forgetShared(k)
 			reasonCodes[i] = packets.CodeSuccess.Code
 		} else {
 			reasonCodes[i] = packets.CodeNoSubscriptionExisted.Code
@@ -1358,12 +1758,136 @@ func (s *Server) UnsubscribeClient(cl *Client) {
 
 // processAuth processes an Auth packet.
 func (s *Server) processAuth(cl *Client, pk packets.Packet) error {
-	_, err := s.hooks.OnAuthPacket(cl, pk)
+	if cl.Properties.Props.AuthenticationMethod == "" {
+		return packets.ErrProtocolViolationUnexpectedAuth // [MQTT-4.12.0-6]
+	}
+
+	if pk.Properties.AuthenticationMethod != cl.Properties.Props.AuthenticationMethod {
+		return packets.ErrProtocolViolationAuthMethodMismatch // [MQTT-4.12.1-1]
+	}
+
+	if !s.hooks.Provides(OnAuthPacket) {
+		return packets.ErrBadAuthenticationMethod
+	}
+
+	switch pk.ReasonCode {
+	case packets.CodeReAuthenticate.Code:
+		atomic.StoreUint32(&cl.State.reauthenticating, 1)
+	case packets.CodeContinueAuthentication.Code:
+		if atomic.LoadUint32(&cl.State.reauthenticating) == 0 {
+			return packets.ErrProtocolViolationUnexpectedAuth
+		}
+	default:
+		return packets.ErrProtocolViolationInvalidReason // only the server sends success
+	}
+
+	res, err := s.hooks.OnAuthPacket(cl, pk)
 	if err != nil {
+		atomic.StoreUint32(&cl.State.reauthenticating, 0)
+		if _, ok := err.(packets.Code); !ok {
+			_ = s.DisconnectClient(cl, packets.ErrNotAuthorized) // [MQTT-4.12.1-2]
+		}
 		return err
 	}
 
-	return nil
+	switch res.ReasonCode {
+	case packets.CodeSuccess.Code:
+		atomic.StoreUint32(&cl.State.reauthenticating, 0)
+	case packets.CodeContinueAuthentication.Code:
+	default:
+		atomic.StoreUint32(&cl.State.reauthenticating, 0)
+		return packets.ErrNotAuthorized
+	}
+
+	return s.sendAuth(cl, res)
+}
+
+// authenticate performs a v5 enhanced authentication exchange with a connecting client,
+// beginning with the authentication method and data of the connect packet. Each step is
+// passed to the OnAuthPacket hooks, which return an auth packet with a continue reason
+// code to send a challenge to the client, or a success reason code to complete the exchange.
+// It returns the properties to be sent with the connack.
+func (s *Server) authenticate(cl *Client, pk packets.Packet) (*packets.Properties, error) {
+	for {
+		res, err := s.hooks.OnAuthPacket(cl, pk)
+		if err != nil {
+			if code, ok := err.(packets.Code); ok && code.Code >= packets.ErrUnspecifiedError.Code {
+				return nil, code
+			}
+			return nil, packets.ErrNotAuthorized
+		}
+
+		if res.FixedHeader.Type != packets.Auth {
+			return nil, packets.ErrBadAuthenticationMethod // no hook supports the method
+		}
+
+		switch res.ReasonCode {
+		case packets.CodeSuccess.Code:
+			return &packets.Properties{
+				AuthenticationMethod: cl.Properties.Props.AuthenticationMethod, // the same method as the connect packet
+				AuthenticationData:   res.Properties.AuthenticationData,
+				User:                 res.Properties.User,
+			}, nil
+		case packets.CodeContinueAuthentication.Code:
+			if err := s.sendAuth(cl, res); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, packets.ErrNotAuthorized
+		}
+
+		pk, err = s.readAuthPacket(cl)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readAuthPacket reads the next packet of an enhanced authentication exchange from a
+// connecting client, which must be an auth packet continuing the exchange.
+func (s *Server) readAuthPacket(cl *Client) (pk packets.Packet, err error) {
+	cl.refreshDeadline(cl.State.Keepalive)
+
+	fh := new(packets.FixedHeader)
+	if err = cl.ReadFixedHeader(fh); err != nil {
+		return
+	}
+
+	if fh.Type != packets.Auth {
+		return pk, packets.ErrProtocolViolationUnexpectedAuth
+	}
+
+	pk, err = cl.ReadPacket(fh)
+	if err != nil {
+		return
+	}
+
+	if pk.ReasonCode != packets.CodeContinueAuthentication.Code {
+		return pk, packets.ErrProtocolViolationInvalidReason
+	}
+
+	if pk.Properties.AuthenticationMethod != cl.Properties.Props.AuthenticationMethod {
+		return pk, packets.ErrProtocolViolationAuthMethodMismatch
+	}
+
+	return
+}
+
+// sendAuth sends an auth packet containing the reason code, authentication data and user
+// properties of a hook response to the client.
+func (s *Server) sendAuth(cl *Client, res packets.Packet) error {
+	return cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Auth,
+		},
+		ReasonCode: res.ReasonCode,
+		Properties: packets.Properties{
+			AuthenticationMethod: cl.Properties.Props.AuthenticationMethod,
+			AuthenticationData:   res.Properties.AuthenticationData,
+			ReasonString:         res.Properties.ReasonString,
+			User:                 res.Properties.User,
+		},
+	})
 }
 
 // processDisconnect processes a Disconnect packet.
@@ -1383,6 +1907,77 @@ func (s *Server) processDisconnect(cl *Client, pk packets.Packet) error {
 	return nil
 }
 
+// AddBlacklist adds or updates a blacklist entry and disconnects the connected clients
+// it bans. An entry without a created time is created now. If the entry is new or changed,
+// the OnBlacklistAdded hooks are called so it can be persisted and replicated.
+func (s *Server) AddBlacklist(e storage.BlacklistEntry) error {
+	if e.Created == 0 {
+		e.Created = time.Now().Unix()
+	}
+
+	e, changed, err := s.Blacklist.Add(e)
+	if err != nil || !changed {
+		return err
+	}
+
+	s.hooks.OnBlacklistAdded(e)
+	for _, cl := range s.Clients.GetAll() {
+		if cl.Net.Inline || cl.Closed() || !matchBlacklistEntry(e, cl) {
+			continue
+		}
+
+		s.Log.Info("client is blacklisted", "client", cl.ID, "remote", cl.Net.Remote, "kind", e.Kind, "value", e.Value, "reason", e.Reason)
+		_ = s.DisconnectClient(cl, packets.ErrBanned)
+	}
+
+	return nil
+}
+
+// DeleteBlacklist deletes the blacklist entry for a value, returning true if it existed.
+func (s *Server) DeleteBlacklist(kind, value string) bool {
+	return s.DeleteBlacklistAt(kind, value, time.Now().Unix())
+}
+
+// DeleteBlacklistAt deletes the blacklist entry for a value as of a deletion time, such as
+// a deletion replicated from another node. An entry created after the deletion is kept.
+// It returns true if an entry was deleted.
+func (s *Server) DeleteBlacklistAt(kind, value string, deleted int64) bool {
+	e, ok := s.Blacklist.Delete(kind, value, deleted)
+	if ok {
+		s.hooks.OnBlacklistDeleted(e)
+	}
+
+	return ok
+}
+
+// ReauthorizeClients disconnects each connected client which is no longer authorized
+// to read from all of its subscriptions, or for which authOk returns false. It should be
+// called after auth rules change. It returns the number of disconnected clients.
+func (s *Server) ReauthorizeClients(authOk func(cl *Client) bool) int {
+	var n int
+	for _, cl := range s.Clients.GetAll() {
+		if cl.Net.Inline || cl.Closed() {
+			continue
+		}
+
+		ok := authOk == nil || authOk(cl)
+		for filter := range cl.State.Subscriptions.GetAll() {
+			if !ok {
+				break
+			}
+			ok = s.hooks.OnACLCheck(cl, filter, false)
+		}
+
+		if !ok {
+			s.Log.Info("client no longer authorized", "client", cl.ID, "remote", cl.Net.Remote)
+			_ = s.DisconnectClient(cl, packets.ErrNotAuthorized)
+			n++
+		}
+	}
+
+	return n
+}
+
 // DisconnectClient sends a Disconnect packet to a client and then closes the client connection.
 func (s *Server) DisconnectClient(cl *Client, code packets.Code) error {
 	out := packets.Packet{
@@ -1414,52 +2009,18 @@ func (s *Server) DisconnectClient(cl *Client, code packets.Code) error {
 // Due to the int to string conversions this method is not as cheap as
 // some of the others so the publishing interval should be set appropriately.
 func (s *Server) publishSysTopics() {
-	pk := packets.Packet{
-		FixedHeader: packets.FixedHeader{
-			Type:   packets.Publish,
-			Retain: true,
-		},
-		Created: time.Now().Unix(),
-	}
+	now := time.Now().Unix()
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	atomic.StoreInt64(&s.Info.MemoryAlloc, int64(m.HeapInuse))
 	atomic.StoreInt64(&s.Info.Threads, int64(runtime.NumGoroutine()))
-	atomic.StoreInt64(&s.Info.Time, time.Now().Unix())
-	atomic.StoreInt64(&s.Info.Uptime, time.Now().Unix()-atomic.LoadInt64(&s.Info.Started))
+	atomic.StoreInt64(&s.Info.Time, now)
+	atomic.StoreInt64(&s.Info.Uptime, now-atomic.LoadInt64(&s.Info.Started))
 	atomic.StoreInt64(&s.Info.ClientsTotal, int64(s.Clients.Len()))
 	atomic.StoreInt64(&s.Info.ClientsDisconnected, atomic.LoadInt64(&s.Info.ClientsTotal)-atomic.LoadInt64(&s.Info.ClientsConnected))
 
-	topics := map[string]string{
-		SysPrefix + "/broker/version":              s.Info.Version,
-		SysPrefix + "/broker/time":                 AtomicItoa(&s.Info.Time),
-		SysPrefix + "/broker/uptime":               AtomicItoa(&s.Info.Uptime),
-		SysPrefix + "/broker/started":              AtomicItoa(&s.Info.Started),
-		SysPrefix + "/broker/load/bytes/received":  AtomicItoa(&s.Info.BytesReceived),
-		SysPrefix + "/broker/load/bytes/sent":      AtomicItoa(&s.Info.BytesSent),
-		SysPrefix + "/broker/clients/connected":    AtomicItoa(&s.Info.ClientsConnected),
-		SysPrefix + "/broker/clients/disconnected": AtomicItoa(&s.Info.ClientsDisconnected),
-		SysPrefix + "/broker/clients/maximum":      AtomicItoa(&s.Info.ClientsMaximum),
-		SysPrefix + "/broker/clients/total":        AtomicItoa(&s.Info.ClientsTotal),
-		SysPrefix + "/broker/packets/received":     AtomicItoa(&s.Info.PacketsReceived),
-		SysPrefix + "/broker/packets/sent":         AtomicItoa(&s.Info.PacketsSent),
-		SysPrefix + "/broker/messages/received":    AtomicItoa(&s.Info.MessagesReceived),
-		SysPrefix + "/broker/messages/sent":        AtomicItoa(&s.Info.MessagesSent),
-		SysPrefix + "/broker/messages/dropped":     AtomicItoa(&s.Info.MessagesDropped),
-		SysPrefix + "/broker/messages/inflight":    AtomicItoa(&s.Info.Inflight),
-		SysPrefix + "/broker/retained":             AtomicItoa(&s.Info.Retained),
-		SysPrefix + "/broker/subscriptions":        AtomicItoa(&s.Info.Subscriptions),
-		SysPrefix + "/broker/system/memory":        AtomicItoa(&s.Info.MemoryAlloc),
-		SysPrefix + "/broker/system/threads":       AtomicItoa(&s.Info.Threads),
-	}
-
-	for topic, payload := range topics {
-		pk.TopicName = topic
-		pk.Payload = []byte(payload)
-		s.Topics.RetainMessage(pk.Copy(false))
-		s.publishToSubscribers(pk)
-	}
+	s.publishSysTopicTrees(now)
 
 	s.hooks.OnSysInfoTick(s.Info)
 }
@@ -1559,7 +2120,28 @@ func (s *Server) readStore() error {
 		s.Log.Debug("loaded inflights from store", "len", len(inflight))
 	}
 
-	if s.hooks.Provides(StoredRetainedMessages) {
+	if s.hooks.Provides(StoredOfflineMessages) {
+		offline, err := s.hooks.StoredOfflineMessages()
+		if err != nil {
+			return fmt.Errorf("load offline messages; %w", err)
+		}
+		s.loadOffline(offline)
+		s.Log.Debug("loaded offline messages from store", "len", len(offline))
+	}
+
+	if s.hooks.Provides(StoredDelayedMessages) {
+		delayed, err := s.hooks.StoredDelayedMessages()
+		if err != nil {
+			return fmt.Errorf("load delayed messages; %w", err)
+		}
+		s.loadDelayed(delayed)
+		s.Log.Debug("loaded delayed messages from store", "len", len(delayed))
+	}
+
+	if s.Options.LazyRetained && s.hooks.Provides(StoredRetainedMessagesByFilter) {
+		s.Retained = NewLazyRetainedStore(s.hooks, s.Topics, s.Options.Capabilities, s.Options.RetainedCacheSize)
+		s.Log.Debug("looking up retained messages lazily from store", "cache-size", s.Options.RetainedCacheSize)
+	} else if s.hooks.Provides(StoredRetainedMessages) {
 		retained, err := s.hooks.StoredRetainedMessages()
 		if err != nil {
 			return fmt.Errorf("load retained; %w", err)
@@ -1568,6 +2150,15 @@ func (s *Server) readStore() error {
 		s.Log.Debug("loaded retained messages from store", "len", len(retained))
 	}
 
+	if s.hooks.Provides(StoredBlacklist) {
+		blacklist, err := s.hooks.StoredBlacklist()
+		if err != nil {
+			return fmt.Errorf("load blacklist; %w", err)
+		}
+		s.loadBlacklist(blacklist)
+		s.Log.Debug("loaded blacklist from store", "len", len(blacklist))
+	}
+
 	if s.hooks.Provides(StoredSysInfo) {
 		sysInfo, err := s.hooks.StoredSysInfo()
 		if err != nil {
@@ -1575,6 +2166,9 @@ func (s *Server) readStore() error {
 		}
 		s.loadServerInfo(sysInfo.Info)
 		s.Log.Debug("loaded $SYS info from store")
+		if lazy, ok := s.Retained.(*LazyRetainedStore); ok {
+			lazy.setCount(sysInfo.Retained) // the stored messages are not loaded to be counted
+		}
 	}
 
 	return nil
@@ -1656,6 +2250,52 @@ func (s *Server) loadInflight(v []storage.Message) {
 	}
 }
 
+// loadOffline restores the offline queues of sessions from the datastore, in the order
+// the messages were queued.
+func (s *Server) loadOffline(v []storage.Message) {
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Seq < v[j].Seq
+	})
+
+	for _, msg := range v {
+		client, ok := s.Clients.Get(msg.Client)
+		if !ok {
+			continue
+		}
+
+		pk := msg.ToPacket()
+		pk.Expiry = pk.Created + s.Options.Capabilities.MaximumMessageExpiryInterval
+		if pk.Properties.MessageExpiryInterval > 0 {
+			pk.Expiry = pk.Created + int64(pk.Properties.MessageExpiryInterval)
+		}
+
+		client.State.Offline.Lock()
+		client.State.Offline.restore(OfflineMessage{Packet: pk, Seq: msg.Seq})
+		client.State.Offline.Unlock()
+	}
+}
+
+// loadDelayed restores delayed messages from the datastore. Messages which fell due while
+// the server was stopped are published on the next tick.
+func (s *Server) loadDelayed(v []storage.Message) {
+	for _, msg := range v {
+		s.Delayed.Add(DelayedMessage{
+			ID:     msg.ID,
+			Packet: msg.ToPacket(),
+			Due:    msg.Due,
+		})
+	}
+}
+
+// loadBlacklist restores blacklist entries from the datastore.
+func (s *Server) loadBlacklist(v []storage.BlacklistEntry) {
+	for _, e := range v {
+		if _, _, err := s.Blacklist.Add(e); err != nil {
+			s.Log.Warn("skipped invalid blacklist entry", "error", err, "kind", e.Kind, "value", e.Value)
+		}
+	}
+}
+
 // loadRetained restores retained messages from the datastore.
 func (s *Server) loadRetained(v []storage.Message) {
 	for _, msg := range v {
@@ -1678,6 +2318,7 @@ func (s *Server) clearExpiredClients(dt int64) {
 		}
 
 		if disconnected+int64(expire) < dt {
+			s.clearOffline(client)
 			s.hooks.OnClientExpired(client)
 			s.Clients.Delete(id) // [MQTT-4.1.0-2]
 		}
@@ -1694,6 +2335,13 @@ func (s *Server) clearExpiredRetainedMessages(now int64) {
 	}
 }
 
+// clearExpiredBlacklist deletes blacklist entries which have expired.
+func (s *Server) clearExpiredBlacklist(now int64) {
+	for _, e := range s.Blacklist.ClearExpired(now) {
+		s.hooks.OnBlacklistDeleted(e)
+	}
+}
+
 // clearExpiredInflights deletes any inflight messages which have expired.
 func (s *Server) clearExpiredInflights(now int64) {
 	for _, client := range s.Clients.GetAll() {
@@ -1722,6 +2370,28 @@ func (s *Server) sendDelayedLWT(dt int64) {
 	}
 }
 
+// sendDelayedMessages publishes any delayed messages which are due, as if their publishers
+// had just published them.
+func (s *Server) sendDelayedMessages(now int64) {
+	for _, m := range s.Delayed.Due(now) {
+		s.hooks.OnDelayedDeleted(m)
+
+		cl, ok := s.Clients.Get(m.Packet.Origin)
+		if !ok {
+			cl = s.localClient()
+		}
+
+		pk := m.Packet
+		pk.Created = now
+		if pk.FixedHeader.Retain {
+			s.retainMessage(cl, pk)
+		}
+
+		s.publishToSubscribers(pk)
+		s.hooks.OnPublished(cl, pk)
+	}
+}
+
 // AtomicItoa converts an int64 point to a string.
 func AtomicItoa(ptr *int64) string {
 	return strconv.FormatInt(atomic.LoadInt64(ptr), 10)
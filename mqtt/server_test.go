@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"strconv"
 	"sync"
@@ -53,6 +54,76 @@ func (h *AllowHook) Provides(b byte) bool {
 func (h *AllowHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool { return true }
 func (h *AllowHook) OnACLCheck(cl *Client, topic string, write bool) bool     { return true }
 
+// filterACLHook replaces AllowHook, denying access to a single filter.
+type filterACLHook struct {
+	AllowHook
+	deny string
+}
+
+func (h *filterACLHook) Init(config any) error {
+	if config != nil {
+		return ErrInvalidConfigType
+	}
+	return nil
+}
+
+func (h *filterACLHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return topic != h.deny
+}
+
+// blacklistRecordHook records the values of added and deleted blacklist entries.
+type blacklistRecordHook struct {
+	HookBase
+	sync.Mutex
+	added   []string
+	deleted []string
+}
+
+func (h *blacklistRecordHook) ID() string {
+	return "blacklist-record"
+}
+
+func (h *blacklistRecordHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnBlacklistAdded, OnBlacklistDeleted}, []byte{b})
+}
+
+func (h *blacklistRecordHook) OnBlacklistAdded(e storage.BlacklistEntry) {
+	h.Lock()
+	defer h.Unlock()
+	h.added = append(h.added, e.Value)
+}
+
+func (h *blacklistRecordHook) OnBlacklistDeleted(e storage.BlacklistEntry) {
+	h.Lock()
+	defer h.Unlock()
+	h.deleted = append(h.deleted, e.Value)
+}
+
+// quotaHook refuses connections and rejects subscriptions with quota exceeded.
+type quotaHook struct {
+	HookBase
+}
+
+func (h *quotaHook) ID() string {
+	return "quota"
+}
+
+func (h *quotaHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnect, OnSubscribe}, []byte{b})
+}
+
+func (h *quotaHook) OnConnect(cl *Client, pk packets.Packet) error {
+	return packets.ErrQuotaExceeded
+}
+
+func (h *quotaHook) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
+	pk.ReasonCodes = make([]byte, len(pk.Filters))
+	for i := range pk.ReasonCodes {
+		pk.ReasonCodes[i] = packets.ErrQuotaExceeded.Code
+	}
+	return pk
+}
+
 type DenyHook struct {
 	HookBase
 }
@@ -73,6 +144,105 @@ func (h *DenyHook) Provides(b byte) bool {
 func (h *DenyHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool { return false }
 func (h *DenyHook) OnACLCheck(cl *Client, topic string, write bool) bool     { return false }
 
+const testAuthMethod = "TEST"
+
+// challengeAuthHook implements a single challenge enhanced authentication method.
+type challengeAuthHook struct {
+	HookBase
+}
+
+func (h *challengeAuthHook) ID() string {
+	return "challenge-auth"
+}
+
+func (h *challengeAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnAuthPacket}, []byte{b})
+}
+
+func (h *challengeAuthHook) OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.Properties.AuthenticationMethod != testAuthMethod {
+		return pk, nil
+	}
+
+	if pk.FixedHeader.Type == packets.Connect || pk.ReasonCode == packets.CodeReAuthenticate.Code {
+		return testAuthPacket(packets.CodeContinueAuthentication, []byte("challenge")), nil
+	}
+
+	if !bytes.Equal(pk.Properties.AuthenticationData, []byte("response")) {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	return testAuthPacket(packets.CodeSuccess, []byte("ok")), nil
+}
+
+func testAuthPacket(code packets.Code, data []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: testAuthMethod,
+			AuthenticationData:   data,
+		},
+	}
+}
+
+func testAuthConnect() packets.Packet {
+	return packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: "zen",
+		},
+		Properties: packets.Properties{
+			AuthenticationMethod: testAuthMethod,
+			AuthenticationData:   []byte("hello"),
+		},
+	}
+}
+
+// testAuthPeer is the client side of a connection, used to encode and decode packets
+// exchanged with the server.
+type testAuthPeer struct {
+	*Client
+}
+
+func newTestAuthPeer(c net.Conn) *testAuthPeer {
+	cc := *DefaultServerCapabilities
+	cl := newClient(c, &ops{
+		info:    new(system.Info),
+		hooks:   new(Hooks),
+		log:     logger,
+		options: &Options{Capabilities: &cc},
+	})
+	cl.Properties.ProtocolVersion = 5
+	return &testAuthPeer{Client: cl}
+}
+
+func (p *testAuthPeer) write(t *testing.T, pk packets.Packet) {
+	pk.ProtocolVersion = 5
+	buf := new(bytes.Buffer)
+	var err error
+	if pk.FixedHeader.Type == packets.Connect {
+		err = pk.ConnectEncode(buf)
+	} else {
+		err = pk.AuthEncode(buf)
+	}
+	require.NoError(t, err)
+	_, err = p.Net.Conn.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+func (p *testAuthPeer) read(t *testing.T) packets.Packet {
+	fh := new(packets.FixedHeader)
+	require.NoError(t, p.ReadFixedHeader(fh))
+	pk, err := p.ReadPacket(fh)
+	require.NoError(t, err)
+	return pk
+}
+
 type DelayHook struct {
 	HookBase
 	DisconnectDelay time.Duration
@@ -232,6 +402,63 @@ func TestServerAddListenerInitFailure(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestServerAddListenerWithOptions(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListenerWithOptions(listeners.NewMockListener("t1", ":1882"), nil)
+	require.NoError(t, err)
+	_, ok := s.listenerOptions("t1")
+	require.False(t, ok)
+
+	caps := *DefaultServerCapabilities
+	caps.MaximumQos = 1
+	caps.MaximumPacketSize = 1024
+	err = s.AddListenerWithOptions(listeners.NewMockListener("t2", ":1883"), &ListenerOptions{
+		Capabilities:   &caps,
+		MaxConnections: 10,
+	})
+	require.NoError(t, err)
+
+	lo, ok := s.listenerOptions("t2")
+	require.True(t, ok)
+	require.Equal(t, int64(10), lo.MaxConnections)
+	require.Equal(t, byte(1), lo.Capabilities.MaximumQos)
+	require.Equal(t, uint32(math.MaxUint16), lo.Capabilities.maximumPacketID)
+	require.Equal(t, s.Options.ClientNetReadBufferSize, lo.options.ClientNetReadBufferSize)
+	require.Equal(t, byte(2), s.Options.Capabilities.MaximumQos) // the server capabilities are not changed
+
+	cl := s.NewClient(nil, "t2", "cl1", true)
+	require.Same(t, lo.Capabilities, cl.ops.options.Capabilities)
+	require.Same(t, lo.Capabilities, s.capabilities(cl))
+
+	cl = s.NewClient(nil, "t1", "cl2", true)
+	require.Same(t, s.Options.Capabilities, cl.ops.options.Capabilities)
+	require.Same(t, s.Options.Capabilities, s.capabilities(cl))
+
+	// options without capabilities only limit the connections
+	err = s.AddListenerWithOptions(listeners.NewMockListener("t3", ":1884"), &ListenerOptions{MaxConnections: 1})
+	require.NoError(t, err)
+	cl = s.NewClient(nil, "t3", "cl3", true)
+	require.Same(t, s.Options.Capabilities, cl.ops.options.Capabilities)
+
+	err = s.AddListenerWithOptions(listeners.NewMockListener("t2", ":1883"), &ListenerOptions{})
+	require.ErrorIs(t, err, ErrListenerIDExists)
+}
+
+func TestServerAddListenerWithOptionsInitFailure(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	m := listeners.NewMockListener("t1", ":1882")
+	m.ErrListen = true
+	err := s.AddListenerWithOptions(m, &ListenerOptions{MaxConnections: 1})
+	require.Error(t, err)
+
+	_, ok := s.listenerOptions("t1")
+	require.False(t, ok)
+}
+
 func TestServerServe(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -271,6 +498,15 @@ func TestServerServeReadStoreFailure(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestServerServeInvalidSharedStrategy(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	s.Options.SharedSubscriptions.Groups = map[string]string{"g1": "fastest"}
+	err := s.Serve()
+	require.ErrorIs(t, err, ErrInvalidSharedStrategy)
+}
+
 func TestServerEventLoop(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -407,6 +643,80 @@ func TestEstablishConnection(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestEstablishConnectionListenerMaxConnections(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListenerWithOptions(listeners.NewMockListener("t1", ":1882"), &ListenerOptions{MaxConnections: 1})
+	require.NoError(t, err)
+	lo, _ := s.listenerOptions("t1")
+	atomic.StoreInt64(&lo.connected, 1) // another client is connected
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrServerBusy)
+	_ = r.Close()
+
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrServerBusy.Code, buf[3])
+	require.Equal(t, int64(1), atomic.LoadInt64(&lo.connected))
+
+	_, ok := s.Clients.Get(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).Packet.Connect.ClientIdentifier)
+	require.False(t, ok)
+}
+
+func TestEstablishConnectionListenerCapabilities(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	caps := *DefaultServerCapabilities
+	caps.MaximumQos = 1
+	err := s.AddListenerWithOptions(listeners.NewMockListener("t1", ":1882"), &ListenerOptions{
+		Capabilities:   &caps,
+		MaxConnections: 1,
+	})
+	require.NoError(t, err)
+	lo, _ := s.listenerOptions("t1")
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	pk := newTestAuthPeer(w).read(t)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.True(t, pk.Properties.MaximumQosFlag)
+	require.Equal(t, byte(1), pk.Properties.MaximumQos)
+	require.Equal(t, int64(1), atomic.LoadInt64(&lo.connected))
+
+	_ = w.Close()
+	<-o
+	_ = r.Close()
+	require.Equal(t, int64(0), atomic.LoadInt64(&lo.connected))
+}
+
 func TestEstablishConnectionAckFailure(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -811,6 +1121,37 @@ func TestServerEstablishConnectionInvalidConnect(t *testing.T) {
 	_ = r.Close()
 }
 
+func TestServerEstablishConnectionBanned(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "zen", Reason: "abuse"}))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	}()
+
+	// receive the connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrBanned)
+	buf := <-recv
+	require.Len(t, buf, 4)
+	require.Equal(t, packets.Err3NotAuthorized.Code, buf[3]) // v3 clients receive not authorized
+
+	_ = r.Close()
+}
+
 // See https://github.com/mochi-mqtt/server/issues/178
 func TestServerEstablishConnectionZeroByteUsernameIsValid(t *testing.T) {
 	s := newServer()
@@ -904,6 +1245,37 @@ func TestServerEstablishConnectionOnConnectError(t *testing.T) {
 	_ = r.Close()
 }
 
+func TestServerEstablishConnectionOnConnectCode(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(quotaHook), nil))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	}()
+
+	// receive the connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	buf := <-recv
+	require.Len(t, buf, 4)
+	require.Equal(t, packets.Err3ServerUnavailable.Code, buf[3])
+
+	_ = r.Close()
+}
+
 func TestServerSendConnack(t *testing.T) {
 	s := newServer()
 	cl, r, w := newTestClient()
@@ -997,6 +1369,13 @@ func TestServerValidateConnect(t *testing.T) {
 			packet:       invalidBitPacket,
 			expect:       packets.ErrProtocolViolationReservedBit,
 		},
+		{
+			desc:         "banned client",
+			client:       &Client{ID: "banned"},
+			capabilities: Capabilities{},
+			packet:       packet,
+			expect:       packets.ErrBanned,
+		},
 		{
 			desc:         "mqtt3 clean no client id ",
 			client:       &Client{Properties: ClientProperties{ProtocolVersion: 3}},
@@ -1007,6 +1386,7 @@ func TestServerValidateConnect(t *testing.T) {
 	}
 
 	s := newServer()
+	_, _, _ = s.Blacklist.Add(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "banned"})
 	for _, tx := range tt {
 		t.Run(tx.desc, func(t *testing.T) {
 			s.Options.Capabilities = &tx.capabilities
@@ -1395,6 +1775,32 @@ func TestServerProcessPublishOnPublishAckErrorContinue(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Puback].Get(packets.TPubackUnexpectedError).RawBytes, buf)
 }
 
+func TestServerProcessPublishOnPublishAckErrorQos2(t *testing.T) {
+	s := newServer()
+	hook := new(modifiedHookBase)
+	hook.fail = true
+	hook.err = packets.ErrQuotaExceeded
+	err := s.AddHook(hook, nil)
+	require.NoError(t, err)
+	_ = s.Serve()
+	defer s.Close()
+
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	go func() {
+		err := s.processPacket(cl, *packets.TPacketData[packets.Publish].Get(packets.TPublishQos2Mqtt5).Packet)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.Pubrec<<4, buf[0]) // a qos 2 publish is refused in its pubrec
+	require.Equal(t, packets.ErrQuotaExceeded.Code, buf[4])
+}
+
 func TestServerProcessPublishOnPublishPkIgnore(t *testing.T) {
 	s := newServer()
 	hook := new(modifiedHookBase)
@@ -1771,35 +2177,134 @@ func TestPublishToSubscribers(t *testing.T) {
 	require.True(t, ok)
 }
 
-func TestPublishToSubscribersMessageExpiryDelta(t *testing.T) {
+func TestServerSelectShared(t *testing.T) {
 	s := newServer()
-	s.Options.Capabilities.MaximumMessageExpiryInterval = 86400
-	cl, r1, w1 := newTestClient()
+	s.Options.SharedSubscriptions = SharedOptions{
+		Strategy: SharedRoundRobin,
+		Groups:   map[string]string{"g2": SharedLeastInflight},
+	}
+
+	cl, _, _ := newTestClient()
 	cl.ID = "cl1"
-	cl.Properties.ProtocolVersion = 5
+	cl2, _, _ := newTestClient()
+	cl2.ID = "cl2"
 	s.Clients.Add(cl)
-	subbed, _ := s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c"})
-	require.True(t, subbed)
+	s.Clients.Add(cl2)
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1})
+
+	subs := func() *Subscribers {
+		return &Subscribers{
+			Shared: map[string]map[string]packets.Subscription{
+				"$share/g1/a/b": {
+					"cl1": {Filter: "$share/g1/a/b", Qos: 1},
+					"cl2": {Filter: "$share/g1/a/b", Qos: 1},
+				},
+				"$share/g2/a/b": {
+					"cl1": {Filter: "$share/g2/a/b", Qos: 2},
+					"cl2": {Filter: "$share/g2/a/b", Qos: 2},
+				},
+			},
+		}
+	}
 
-	cl1Recv := make(chan []byte)
-	go func() {
-		buf, err := io.ReadAll(r1)
-		require.NoError(t, err)
-		cl1Recv <- buf
-	}()
+	sub := subs()
+	s.selectShared(sub, packets.Packet{})
+	require.Len(t, sub.SharedSelected, 2)
+	require.Equal(t, "$share/g1/a/b", sub.SharedSelected["cl1"].Filter)
+	require.Equal(t, "$share/g2/a/b", sub.SharedSelected["cl2"].Filter)
 
-	go func() {
-		pkx := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
-		pkx.Created = time.Now().Unix() - 30
-		s.publishToSubscribers(pkx)
-		time.Sleep(time.Millisecond)
-		_ = w1.Close()
-	}()
+	sub = subs()
+	s.selectShared(sub, packets.Packet{})
+	require.Len(t, sub.SharedSelected, 1)
+	require.Equal(t, byte(2), sub.SharedSelected["cl2"].Qos) // cl2 receives from both groups once
 
-	b := <-cl1Recv
-	pk := new(packets.Packet)
-	pk.ProtocolVersion = 5
-	require.Equal(t, uint32(s.Options.Capabilities.MaximumMessageExpiryInterval-30), binary.BigEndian.Uint32(b[11:15]))
+	// unknown clients are selected last by least-inflight
+	require.Equal(t, math.MaxInt, s.inflightLen("cl3"))
+}
+
+func TestServerForgetShared(t *testing.T) {
+	s := newServer()
+	s.Options.SharedSubscriptions.Strategy = SharedRoundRobin
+	s.shared.turn("$share/g1/a/b")
+	s.shared.turn("a/b")
+
+	s.forgetShared("a/b")
+	s.forgetShared("$share/g1/a/b")
+	require.NotContains(t, s.shared.turns, "$share/g1/a/b")
+	require.Contains(t, s.shared.turns, "a/b")
+}
+
+type sharedNodesHook struct {
+	HookBase
+	calls int
+}
+
+func (h *sharedNodesHook) ID() string {
+	return "shared-nodes"
+}
+
+func (h *sharedNodesHook) Provides(b byte) bool {
+	return b == OnSelectSharedNodes
+}
+
+func (h *sharedNodesHook) OnSelectSharedNodes(subs *Subscribers, pk packets.Packet) *Subscribers {
+	h.calls++
+	subs.Shared = map[string]map[string]packets.Subscription{} // delivered by another node
+	return subs
+}
+
+func TestPublishToSubscribersSelectSharedNodes(t *testing.T) {
+	s := newServer()
+	hook := new(sharedNodesHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient()
+	cl.ID = "cl1"
+	s.Clients.Add(cl)
+	cl.State.Inflight.ResetReceiveQuota(10)
+	cl.State.Inflight.ResetSendQuota(10)
+	s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: SharePrefix + "/g1/a/b/c", Qos: 1})
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	s.PublishToSubscribers(pk, true)
+	require.Equal(t, 1, hook.calls)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+
+	// messages forwarded from other nodes are delivered by this node
+	s.PublishToSubscribers(pk, false)
+	require.Equal(t, 1, hook.calls)
+	require.Equal(t, 1, cl.State.Inflight.Len())
+}
+
+func TestPublishToSubscribersMessageExpiryDelta(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 86400
+	cl, r1, w1 := newTestClient()
+	cl.ID = "cl1"
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	subbed, _ := s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c"})
+	require.True(t, subbed)
+
+	cl1Recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r1)
+		require.NoError(t, err)
+		cl1Recv <- buf
+	}()
+
+	go func() {
+		pkx := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+		pkx.Created = time.Now().Unix() - 30
+		s.publishToSubscribers(pkx)
+		time.Sleep(time.Millisecond)
+		_ = w1.Close()
+	}()
+
+	b := <-cl1Recv
+	pk := new(packets.Packet)
+	pk.ProtocolVersion = 5
+	require.Equal(t, uint32(s.Options.Capabilities.MaximumMessageExpiryInterval-30), binary.BigEndian.Uint32(b[11:15]))
 }
 
 func TestPublishToSubscribersIdentifiers(t *testing.T) {
@@ -2801,6 +3306,28 @@ func TestServerProcessSubscribeACLCheckDeny(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Suback].Get(packets.TSubackDeny).RawBytes, buf)
 }
 
+func TestServerProcessSubscribeHookReject(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	_ = s.Serve()
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	require.NoError(t, s.AddHook(new(quotaHook), nil))
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	go func() {
+		err := s.processSubscribe(cl, *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribe).Packet)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.ErrQuotaExceeded.Code, buf[len(buf)-1])
+	require.Equal(t, 0, cl.State.Subscriptions.Len())
+}
+
 func TestServerProcessSubscribeACLCheckDenyObscure(t *testing.T) {
 	s := New(&Options{
 		Logger: logger,
@@ -2922,6 +3449,105 @@ func TestServerRecievePacketDisconnectClient(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes, buf)
 }
 
+func TestServerReplaceHook(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	require.True(t, s.hooks.OnACLCheck(cl, "a/b", false))
+
+	err := s.ReplaceHook(&filterACLHook{deny: "a/b"}, map[string]any{})
+	require.Error(t, err)
+	require.True(t, s.hooks.OnACLCheck(cl, "a/b", false))
+
+	require.NoError(t, s.ReplaceHook(&filterACLHook{deny: "a/b"}, nil))
+	require.False(t, s.hooks.OnACLCheck(cl, "a/b", false))
+	require.True(t, s.hooks.OnACLCheck(cl, "c/d", false))
+	require.Equal(t, int64(1), s.hooks.Len())
+
+	require.ErrorIs(t, s.ReplaceHook(new(DenyHook), nil), ErrHookNotFound)
+}
+
+func TestServerReauthorizeClients(t *testing.T) {
+	s := newServer()
+
+	newSubscriber := func(id, filter string) *Client {
+		cl, r, _ := newTestClient()
+		cl.ID = id
+		cl.State.Subscriptions.Add(filter, packets.Subscription{Filter: filter})
+		s.Clients.Add(cl)
+		go func() { _, _ = io.ReadAll(r) }()
+		return cl
+	}
+
+	cl1 := newSubscriber("cl1", "a/b")
+	cl2 := newSubscriber("cl2", "c/d")
+	cl3 := newSubscriber("cl3", "e/f")
+	inline := newSubscriber("inline", "a/b")
+	inline.Net.Inline = true
+
+	require.Equal(t, 0, s.ReauthorizeClients(nil))
+
+	require.NoError(t, s.ReplaceHook(&filterACLHook{deny: "a/b"}, nil))
+	require.Equal(t, 2, s.ReauthorizeClients(func(cl *Client) bool { return cl.ID != "cl3" }))
+	require.True(t, cl1.Closed())
+	require.ErrorIs(t, cl1.StopCause(), packets.ErrNotAuthorized)
+	require.False(t, cl2.Closed())
+	require.True(t, cl3.Closed())
+	require.False(t, inline.Closed())
+
+	require.Equal(t, 0, s.ReauthorizeClients(nil))
+}
+
+func TestServerAddBlacklist(t *testing.T) {
+	s := newServer()
+	hook := new(blacklistRecordHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	newClient := func(id, username, remote string) *Client {
+		cl, r, _ := newTestClient()
+		cl.ID = id
+		cl.Properties.Username = []byte(username)
+		cl.Net.Remote = remote
+		s.Clients.Add(cl)
+		go func() { _, _ = io.ReadAll(r) }()
+		return cl
+	}
+
+	cl1 := newClient("cl1", "u1", "10.0.0.1:1883")
+	cl2 := newClient("cl2", "u2", "192.168.1.20:1883")
+	cl3 := newClient("cl3", "u3", "[2001:db8::1]:1883")
+
+	require.ErrorIs(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistIP, Value: "10.0.0"}), ErrInvalidBlacklistEntry)
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistIP, Value: "192.168.0.0/16", Reason: "abuse"}))
+	require.True(t, cl2.Closed())
+	require.ErrorIs(t, cl2.StopCause(), packets.ErrBanned)
+	require.False(t, cl1.Closed())
+
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistUsername, Value: "u3"}))
+	require.True(t, cl3.Closed())
+	require.False(t, cl1.Closed())
+
+	e, ok := s.Blacklist.Get(BlacklistIP, "192.168.0.0/16")
+	require.True(t, ok)
+	require.Equal(t, "abuse", e.Reason)
+	require.NotZero(t, e.Created)
+
+	// unchanged entries are not added again
+	require.NoError(t, s.AddBlacklist(e))
+	require.Equal(t, []string{"192.168.0.0/16", "u3"}, hook.added)
+}
+
+func TestServerDeleteBlacklist(t *testing.T) {
+	s := newServer()
+	hook := new(blacklistRecordHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "cl1"}))
+	require.False(t, s.DeleteBlacklist(BlacklistClientID, "cl2"))
+	require.True(t, s.DeleteBlacklist(BlacklistClientID, "cl1"))
+	require.Equal(t, 0, s.Blacklist.Len())
+	require.Equal(t, []string{"cl1"}, hook.deleted)
+}
+
 func TestServerProcessPacketDisconnect(t *testing.T) {
 	s := newServer()
 	cl, _, _ := newTestClient()
@@ -2954,17 +3580,9 @@ func TestServerProcessPacketDisconnectNonZeroExpiryViolation(t *testing.T) {
 
 func TestServerProcessPacketAuth(t *testing.T) {
 	s := newServer()
-	cl, r, w := newTestClient()
-
-	go func() {
-		err := s.processPacket(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
-		require.NoError(t, err)
-		_ = w.Close()
-	}()
-
-	buf, err := io.ReadAll(r)
-	require.NoError(t, err)
-	require.Equal(t, []byte{}, buf)
+	cl, _, _ := newTestClient()
+	err := s.processPacket(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
+	require.ErrorIs(t, err, packets.ErrProtocolViolationUnexpectedAuth)
 }
 
 func TestServerProcessPacketAuthInvalidReason(t *testing.T) {
@@ -2979,16 +3597,162 @@ func TestServerProcessPacketAuthInvalidReason(t *testing.T) {
 
 func TestServerProcessPacketAuthFailure(t *testing.T) {
 	s := newServer()
-	cl, _, _ := newTestClient()
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "SHA-1"
 
 	hook := new(modifiedHookBase)
 	hook.fail = true
 	err := s.AddHook(hook, nil)
 	require.NoError(t, err)
 
-	err = s.processAuth(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
+	pkx := *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet
+	pkx.ReasonCode = packets.CodeReAuthenticate.Code
+
+	go func() {
+		_, _ = io.ReadAll(r) // the disconnect packet
+	}()
+
+	err = s.processAuth(cl, pkx)
 	require.Error(t, err)
 	require.ErrorIs(t, errTestHook, err)
+	require.ErrorIs(t, cl.StopCause(), packets.ErrNotAuthorized)
+}
+
+func TestServerProcessAuthProtocolErrors(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = testAuthMethod
+
+	pkx := *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet
+	pkx.ReasonCode = packets.CodeReAuthenticate.Code
+	err := s.processAuth(cl, pkx)
+	require.ErrorIs(t, err, packets.ErrProtocolViolationAuthMethodMismatch)
+
+	pkx.Properties.AuthenticationMethod = testAuthMethod
+	err = s.processAuth(cl, pkx)
+	require.ErrorIs(t, err, packets.ErrBadAuthenticationMethod) // no hook provides enhanced auth
+
+	require.NoError(t, s.AddHook(new(challengeAuthHook), nil))
+	pkx.ReasonCode = packets.CodeContinueAuthentication.Code
+	err = s.processAuth(cl, pkx)
+	require.ErrorIs(t, err, packets.ErrProtocolViolationUnexpectedAuth) // not re-authenticating
+
+	pkx.ReasonCode = packets.CodeSuccess.Code
+	err = s.processAuth(cl, pkx)
+	require.ErrorIs(t, err, packets.ErrProtocolViolationInvalidReason)
+}
+
+func TestServerProcessAuthReauthenticate(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(challengeAuthHook), nil))
+
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = testAuthMethod
+	peer := newTestAuthPeer(r)
+
+	pkx := testAuthPacket(packets.CodeReAuthenticate, nil)
+	go func() {
+		require.NoError(t, s.processAuth(cl, pkx))
+	}()
+
+	pk := peer.read(t)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, testAuthMethod, pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("challenge"), pk.Properties.AuthenticationData)
+
+	pkx = testAuthPacket(packets.CodeContinueAuthentication, []byte("response"))
+	go func() {
+		require.NoError(t, s.processAuth(cl, pkx))
+	}()
+
+	pk = peer.read(t)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, []byte("ok"), pk.Properties.AuthenticationData)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl.State.reauthenticating))
+}
+
+func TestEstablishConnectionEnhancedAuth(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(challengeAuthHook), nil))
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	peer := newTestAuthPeer(w)
+	peer.write(t, testAuthConnect())
+
+	pk := peer.read(t)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, []byte("challenge"), pk.Properties.AuthenticationData)
+
+	peer.write(t, testAuthPacket(packets.CodeContinueAuthentication, []byte("response")))
+
+	pk = peer.read(t)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, testAuthMethod, pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("ok"), pk.Properties.AuthenticationData)
+
+	_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	require.NoError(t, <-o)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionEnhancedAuthFailure(t *testing.T) {
+	tt := []struct {
+		desc     string
+		method   string
+		response []byte
+		expect   packets.Code
+	}{
+		{desc: "bad response", method: testAuthMethod, response: []byte("wrong"), expect: packets.ErrNotAuthorized},
+		{desc: "unsupported method", method: "SHA-1", expect: packets.ErrBadAuthenticationMethod},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New(&Options{Logger: logger})
+			require.NoError(t, s.AddHook(new(challengeAuthHook), nil))
+			defer s.Close()
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r)
+			}()
+
+			peer := newTestAuthPeer(w)
+			cpk := testAuthConnect()
+			cpk.Properties.AuthenticationMethod = tx.method
+			peer.write(t, cpk)
+
+			pk := peer.read(t)
+			if pk.FixedHeader.Type == packets.Auth {
+				pkx := testAuthPacket(packets.CodeContinueAuthentication, tx.response)
+				pkx.Properties.AuthenticationMethod = tx.method
+				peer.write(t, pkx)
+				pk = peer.read(t)
+			}
+
+			require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+			require.Equal(t, tx.expect.Code, pk.ReasonCode)
+			require.ErrorIs(t, <-o, tx.expect)
+
+			_ = w.Close()
+			_ = r.Close()
+		})
+	}
 }
 
 func TestServerSendLWT(t *testing.T) {
@@ -3137,6 +3901,28 @@ func TestServerReadStore(t *testing.T) {
 	hook.failAt = 5 // sys info
 	err = s.readStore()
 	require.Error(t, err)
+
+	hook.failAt = 6 // blacklist
+	err = s.readStore()
+	require.Error(t, err)
+
+	hook.failAt = 7 // offline messages
+	err = s.readStore()
+	require.Error(t, err)
+
+	hook.failAt = 8 // delayed messages
+	err = s.readStore()
+	require.Error(t, err)
+}
+
+func TestServerLoadBlacklist(t *testing.T) {
+	s := newServer()
+	s.loadBlacklist([]storage.BlacklistEntry{
+		{Kind: BlacklistClientID, Value: "b1"},
+		{Kind: BlacklistIP, Value: "192.0.2.0/24"},
+		{Kind: "serial", Value: "b3"},
+	})
+	require.Equal(t, 2, s.Blacklist.Len())
 }
 
 func TestServerLoadClients(t *testing.T) {
@@ -3218,6 +4004,95 @@ func TestServerLoadRetainedMessages(t *testing.T) {
 	require.Equal(t, 0, len(s.Topics.Messages("w/x/y")))
 }
 
+func TestServerReadStoreLazyRetained(t *testing.T) {
+	s := newServer()
+	s.Options.LazyRetained = true
+	s.Options.RetainedCacheSize = 16
+	hook := newRetainedHook()
+	hook.retain("a/b/c", "hello")
+	_ = s.AddHook(hook, nil)
+
+	err := s.readStore()
+	require.NoError(t, err)
+	lazy, ok := s.Retained.(*LazyRetainedStore)
+	require.True(t, ok)
+	require.Equal(t, 16, lazy.size)
+	require.Equal(t, 0, s.Topics.Retained.Len())
+	require.Len(t, s.Retained.Messages("a/#"), 1)
+}
+
+func TestServerRetainMessageLazyCount(t *testing.T) {
+	s := newServer()
+	s.Options.LazyRetained = true
+	_ = s.AddHook(newRetainedHook(), nil)
+	require.NoError(t, s.readStore())
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: "a/b", Payload: []byte("1")}
+	s.retainMessage(new(Client), pk)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+	s.retainMessage(new(Client), pk) // replaces the stored message
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+
+	pk.TopicName = "c/d"
+	s.retainMessage(new(Client), pk)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.Retained))
+
+	pk.Payload = []byte{}
+	s.retainMessage(new(Client), pk)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+}
+
+func TestServerReadStoreLazyRetainedNotProvided(t *testing.T) {
+	s := newServer()
+	s.Options.LazyRetained = true
+	_ = s.AddHook(new(HookBase), nil)
+
+	err := s.readStore()
+	require.NoError(t, err)
+	require.Same(t, s.Topics, s.Retained)
+}
+
+func TestServerRetainMessageLazy(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 3600
+	s.Options.LazyRetained = true
+	hook := newRetainedHook()
+	_ = s.AddHook(hook, nil)
+	require.NoError(t, s.readStore())
+
+	cl, _, _ := newTestClient()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("1"),
+		Created:     time.Now().Unix(),
+	}
+	s.retainMessage(cl, pk)
+	require.Equal(t, []byte("1"), s.Retained.Messages("a/#")[0].Payload)
+
+	// the cached lookup is replaced once the store has been updated
+	pk.Payload = []byte("2")
+	s.retainMessage(cl, pk)
+	require.Equal(t, []byte("2"), s.Retained.Messages("a/#")[0].Payload)
+	require.Equal(t, 0, s.Topics.Retained.Len())
+
+	require.True(t, s.DeleteRetained("a/b/c"))
+	require.Empty(t, s.Retained.Messages("a/#"))
+	require.Empty(t, hook.messages)
+}
+
+func TestServerDeleteRetained(t *testing.T) {
+	s := newServer()
+	s.Topics.RetainMessage(*packets.TPacketData[packets.Publish].Get(packets.TPublishRetainMqtt5).Packet)
+	require.Equal(t, 1, s.Topics.Retained.Len())
+
+	require.False(t, s.DeleteRetained("a/+/c"))
+	require.False(t, s.DeleteRetained("d/e/f"))
+	require.True(t, s.DeleteRetained("a/b/c"))
+	require.Equal(t, 0, s.Topics.Retained.Len())
+	require.False(t, s.DeleteRetained("a/b/c"))
+}
+
 func TestServerClose(t *testing.T) {
 	s := newServer()
 
@@ -3294,6 +4169,21 @@ func TestServerClearExpiredRetained(t *testing.T) {
 	require.Len(t, s.Topics.Retained.GetAll(), 2)
 }
 
+func TestServerClearExpiredBlacklist(t *testing.T) {
+	s := newServer()
+	hook := new(blacklistRecordHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	n := time.Now().Unix()
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "b1", Expiry: n - 1}))
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "b2", Expiry: n + 10}))
+	require.NoError(t, s.AddBlacklist(storage.BlacklistEntry{Kind: BlacklistClientID, Value: "b3"}))
+
+	s.clearExpiredBlacklist(n)
+	require.Equal(t, 2, s.Blacklist.Len())
+	require.Equal(t, []string{"b1"}, hook.deleted)
+}
+
 func TestServerClearExpiredClients(t *testing.T) {
 	s := New(nil)
 	require.NotNil(t, s)
@@ -3661,3 +4551,503 @@ func TestServerSubscribeWithRetainDifferentIdentifier(t *testing.T) {
 		require.Equal(t, true, <-finishCh)
 	}
 }
+
+// offlineHook records the sequence numbers of queued and dequeued offline messages.
+type offlineHook struct {
+	HookBase
+	sync.Mutex
+	queued   []uint64
+	dequeued []uint64
+}
+
+func (h *offlineHook) ID() string {
+	return "offline"
+}
+
+func (h *offlineHook) Provides(b byte) bool {
+	return b == OnOfflineQueued || b == OnOfflineDequeued
+}
+
+func (h *offlineHook) OnOfflineQueued(cl *Client, m OfflineMessage) {
+	h.Lock()
+	defer h.Unlock()
+	h.queued = append(h.queued, m.Seq)
+}
+
+func (h *offlineHook) OnOfflineDequeued(cl *Client, m OfflineMessage) {
+	h.Lock()
+	defer h.Unlock()
+	h.dequeued = append(h.dequeued, m.Seq)
+}
+
+func newOfflineServer(maxMessages int, maxBytes int64, overflow byte) (*Server, *offlineHook) {
+	s := newServer()
+	s.Options.Capabilities.MaximumOfflineMessages = maxMessages
+	s.Options.Capabilities.MaximumOfflineBytes = maxBytes
+	s.Options.Capabilities.OfflineOverflow = overflow
+	hook := new(offlineHook)
+	_ = s.AddHook(hook, nil)
+	return s, hook
+}
+
+func offlinePayloads(cl *Client) []string {
+	payloads := []string{}
+	for _, m := range cl.State.Offline.GetAll() {
+		payloads = append(payloads, string(m.Packet.Payload))
+	}
+	return payloads
+}
+
+func publishOffline(t *testing.T, s *Server, cl *Client, qos byte, payloads ...string) {
+	for _, p := range payloads {
+		pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos}, TopicName: "a/b/c", Payload: []byte(p)}
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 2}, pk)
+		require.NoError(t, err)
+	}
+}
+
+func TestPublishToClientOfflineQueue(t *testing.T) {
+	s, hook := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	publishOffline(t, s, cl, 1, "1", "2")
+	require.Equal(t, []string{"1", "2"}, offlinePayloads(cl))
+	require.Equal(t, []uint64{1, 2}, hook.queued)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, uint16(0), cl.State.Offline.GetAll()[0].Packet.PacketID)
+
+	// qos 0 messages are not queued
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 2, cl.State.Offline.Len())
+}
+
+func TestPublishToClientOfflineQueueDisabled(t *testing.T) {
+	s, _ := newOfflineServer(0, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 0, cl.State.Offline.Len())
+	require.Equal(t, 1, cl.State.Inflight.Len())
+}
+
+func TestPublishToClientOfflineQueueConnected(t *testing.T) {
+	s, _ := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, r, _ := newTestClient()
+	defer r.Close()
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	publishOffline(t, s, cl, 1, "1")
+	require.Equal(t, 0, cl.State.Offline.Len())
+	require.Equal(t, 1, cl.State.Inflight.Len())
+}
+
+func TestPublishToClientOfflineQueueCleanSession(t *testing.T) {
+	s, _ := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	cl.Properties.Clean = true
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 0, cl.State.Offline.Len())
+
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Clean = false
+	cl.Properties.Props.SessionExpiryInterval = 0
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 0, cl.State.Offline.Len())
+}
+
+func TestPublishToClientOfflineDropOldest(t *testing.T) {
+	s, hook := newOfflineServer(2, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	publishOffline(t, s, cl, 1, "1", "2", "3")
+	require.Equal(t, []string{"2", "3"}, offlinePayloads(cl))
+	require.Equal(t, []uint64{1}, hook.dequeued)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+}
+
+func TestPublishToClientOfflineDropNewest(t *testing.T) {
+	s, hook := newOfflineServer(2, 0, OfflineDropNewest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	publishOffline(t, s, cl, 2, "1", "2", "3")
+	require.Equal(t, []string{"1", "2"}, offlinePayloads(cl))
+	require.Empty(t, hook.dequeued)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+}
+
+func TestPublishToClientOfflineMaximumBytes(t *testing.T) {
+	s, _ := newOfflineServer(10, 5, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	publishOffline(t, s, cl, 1, "abc", "de", "f")
+	require.Equal(t, []string{"de", "f"}, offlinePayloads(cl))
+	require.Equal(t, int64(3), cl.State.Offline.Bytes())
+
+	// a message larger than the queue is dropped
+	publishOffline(t, s, cl, 1, "123456")
+	require.Equal(t, []string{"de", "f"}, offlinePayloads(cl))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.MessagesDropped))
+}
+
+func TestDrainOffline(t *testing.T) {
+	s, hook := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, r, w := newTestClient()
+	defer r.Close()
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	cl.Net.Conn = nil
+	publishOffline(t, s, cl, 1, "1", "2", "3")
+	cl.Net.Conn = w
+
+	cl.State.Inflight.sendQuota = 2
+	s.drainOffline(cl)
+	require.Equal(t, []string{"3"}, offlinePayloads(cl))
+	require.Equal(t, []uint64{1, 2}, hook.dequeued)
+
+	pk, ok := cl.State.Inflight.Get(1)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), pk.Payload)
+	pk, ok = cl.State.Inflight.Get(2)
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), pk.Payload)
+
+	// new messages are queued behind the undelivered ones
+	publishOffline(t, s, cl, 1, "4")
+	require.Equal(t, []string{"3", "4"}, offlinePayloads(cl))
+
+	// acknowledging a message frees quota for the next
+	err := s.processPacket(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"4"}, offlinePayloads(cl))
+	pk, ok = cl.State.Inflight.Get(3)
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), pk.Payload)
+}
+
+func TestDrainOfflinePendingWrites(t *testing.T) {
+	s, _ := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, r, w := newTestClient()
+	defer r.Close()
+	cl.ops.drain = s.drainOffline
+
+	cl.Net.Conn = nil
+	publishOffline(t, s, cl, 1, "1", "2", "3", "4", "5")
+	cl.Net.Conn = w
+
+	// the pending writes are full until the client reads them
+	s.drainOffline(cl)
+	require.Equal(t, []string{"4", "5"}, offlinePayloads(cl))
+
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+	require.Eventually(t, func() bool {
+		return cl.State.Offline.Len() == 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 5, cl.State.Inflight.Len())
+}
+
+func TestDrainOfflineExpired(t *testing.T) {
+	s, hook := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, r, w := newTestClient()
+	defer r.Close()
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+
+	cl.Net.Conn = nil
+	publishOffline(t, s, cl, 1, "1")
+	cl.State.Offline.messages[0].Packet.Expiry = time.Now().Unix() - 1
+	cl.Net.Conn = w
+
+	s.drainOffline(cl)
+	require.Equal(t, 0, cl.State.Offline.Len())
+	require.Equal(t, []uint64{1}, hook.dequeued)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+}
+
+func TestDrainOfflineDisconnected(t *testing.T) {
+	s, _ := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	publishOffline(t, s, cl, 1, "1")
+	s.drainOffline(cl)
+	require.Equal(t, 1, cl.State.Offline.Len())
+}
+
+func TestInheritClientSessionOffline(t *testing.T) {
+	s, hook := newOfflineServer(10, 0, OfflineDropOldest)
+
+	existing, _, _ := newTestClient()
+	existing.Net.Conn = nil
+	s.Clients.Add(existing)
+	publishOffline(t, s, existing, 1, "1", "2")
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	b := s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "mochi"}}, cl)
+	require.True(t, b)
+	require.Same(t, existing.State.Offline, cl.State.Offline)
+	require.Equal(t, []string{"1", "2"}, offlinePayloads(cl))
+
+	// on clean, the queued messages are deleted
+	s.Clients.Add(cl)
+	cl.Net.Conn = nil
+	cl2, _, _ := newTestClient()
+	cl2.Properties.ProtocolVersion = 5
+	b = s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "mochi", Clean: true}}, cl2)
+	require.False(t, b)
+	require.Equal(t, 0, cl.State.Offline.Len())
+	require.Equal(t, 0, cl2.State.Offline.Len())
+	require.Equal(t, []uint64{1, 2}, hook.dequeued)
+}
+
+func TestServerClearExpiredClientsOffline(t *testing.T) {
+	s, hook := newOfflineServer(10, 0, OfflineDropOldest)
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	cl.State.disconnected = time.Now().Unix() - 10
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 5
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	s.Clients.Add(cl)
+	publishOffline(t, s, cl, 1, "1")
+
+	s.clearExpiredClients(time.Now().Unix())
+	require.Equal(t, 0, cl.State.Offline.Len())
+	require.Equal(t, []uint64{1}, hook.dequeued)
+}
+
+func TestServerLoadOffline(t *testing.T) {
+	s := newServer()
+	s.loadClients([]storage.Client{
+		{ID: "mochi"},
+		{ID: "zen"},
+	})
+
+	s.loadOffline([]storage.Message{
+		{Client: "mochi", Seq: 3, Payload: []byte("3"), TopicName: "a/b/c", Created: 100},
+		{Client: "zen", Seq: 1, Payload: []byte("z"), TopicName: "a/b/c"},
+		{Client: "mochi", Seq: 2, Payload: []byte("2"), TopicName: "a/b/c", Created: 100, Properties: storage.MessageProperties{MessageExpiryInterval: 10}},
+		{Client: "unknown", Seq: 1, Payload: []byte("u"), TopicName: "a/b/c"},
+	})
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, []string{"2", "3"}, offlinePayloads(cl))
+	msgs := cl.State.Offline.GetAll()
+	require.Equal(t, int64(110), msgs[0].Packet.Expiry)
+	require.Equal(t, int64(100), msgs[1].Packet.Expiry) // newServer has no maximum message expiry
+
+	cl.State.Offline.Lock()
+	m := cl.State.Offline.push(packets.Packet{})
+	cl.State.Offline.Unlock()
+	require.Equal(t, uint64(4), m.Seq)
+
+	cl, ok = s.Clients.Get("zen")
+	require.True(t, ok)
+	require.Equal(t, []string{"z"}, offlinePayloads(cl))
+}
+
+type delayedHook struct {
+	HookBase
+	sync.Mutex
+	added   []DelayedMessage
+	deleted []DelayedMessage
+}
+
+func (h *delayedHook) ID() string {
+	return "delayed"
+}
+
+func (h *delayedHook) Provides(b byte) bool {
+	return b == OnDelayedAdded || b == OnDelayedDeleted
+}
+
+func (h *delayedHook) OnDelayedAdded(m DelayedMessage) {
+	h.Lock()
+	defer h.Unlock()
+	h.added = append(h.added, m)
+}
+
+func (h *delayedHook) OnDelayedDeleted(m DelayedMessage) {
+	h.Lock()
+	defer h.Unlock()
+	h.deleted = append(h.deleted, m)
+}
+
+func newDelayedServer(t *testing.T) (*Server, *delayedHook, chan packets.Packet) {
+	s := newServerWithInlineClient()
+	hook := new(delayedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	recv := make(chan packets.Packet, 10)
+	err := s.Subscribe("a/b/c", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		recv <- pk
+	})
+	require.NoError(t, err)
+
+	return s, hook, recv
+}
+
+func delayedPublish(topic string, retain bool) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: retain},
+		TopicName:   topic,
+		Payload:     []byte("hello"),
+	}
+}
+
+func TestServerProcessPublishDelayed(t *testing.T) {
+	s, hook, recv := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+
+	err := s.processPublish(cl, delayedPublish("$delayed/60/a/b/c", false))
+	require.NoError(t, err)
+	require.Len(t, recv, 0)
+	require.Equal(t, 1, s.Delayed.Len())
+	require.Len(t, hook.added, 1)
+
+	m := hook.added[0]
+	require.Equal(t, "a/b/c", m.Packet.TopicName)
+	require.Equal(t, cl.ID, m.Packet.Origin)
+	require.Equal(t, m.Packet.Created+60, m.Due)
+
+	s.sendDelayedMessages(m.Due - 1)
+	require.Len(t, recv, 0)
+
+	s.sendDelayedMessages(m.Due)
+	require.Equal(t, 0, s.Delayed.Len())
+	require.Equal(t, []DelayedMessage{m}, hook.deleted)
+	pk := <-recv
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+	require.Equal(t, m.Due, pk.Created)
+}
+
+func TestServerProcessPublishDelayedRetain(t *testing.T) {
+	s, _, recv := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+
+	err := s.processPublish(cl, delayedPublish("$delayed/60/a/b/c", true))
+	require.NoError(t, err)
+	require.Equal(t, 0, s.Topics.Retained.Len())
+
+	s.sendDelayedMessages(time.Now().Unix() + 60)
+	require.Len(t, recv, 1)
+	require.Equal(t, 1, s.Topics.Retained.Len()) // the publisher is gone, so retained by the inline client
+}
+
+func TestServerProcessPublishDelayedZero(t *testing.T) {
+	s, hook, recv := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+
+	err := s.processPublish(cl, delayedPublish("$delayed/0/a/b/c", false))
+	require.NoError(t, err)
+	require.Len(t, recv, 1)
+	require.Equal(t, 0, s.Delayed.Len())
+	require.Empty(t, hook.added)
+}
+
+func TestServerProcessPublishDelayedInvalid(t *testing.T) {
+	s, hook, recv := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+
+	for _, topic := range []string{"$delayed/x/a/b/c", "$delayed/60", "$delayed/-1/a/b/c"} {
+		err := s.processPublish(cl, delayedPublish(topic, false))
+		require.NoError(t, err)
+	}
+
+	require.Len(t, recv, 0)
+	require.Equal(t, 0, s.Delayed.Len())
+	require.Empty(t, hook.added)
+}
+
+func TestServerProcessPublishDelayedInvalidQos(t *testing.T) {
+	s, _, recv := newDelayedServer(t)
+
+	cl, r, _ := newTestClient()
+	defer r.Close()
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+	s.Clients.Add(cl)
+	pk := delayedPublish("$delayed/x/a/b/c", false)
+	pk.FixedHeader.Qos = 1
+	pk.PacketID = 7
+	err := s.processPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrTopicNameInvalid)
+	require.True(t, cl.Closed())
+
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+	go func() {
+		err := s.processPublish(cl, pk)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{packets.Puback << 4}, buf[:1])
+	require.Equal(t, []byte{0, 7, packets.ErrTopicNameInvalid.Code}, buf[2:5]) // packet id and reason code
+	require.Len(t, recv, 0)
+	require.Equal(t, 0, s.Delayed.Len())
+}
+
+func TestServerProcessPublishDelayedTopicAlias(t *testing.T) {
+	s, hook, _ := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	pk := delayedPublish("$delayed/60/a/b/c", false)
+	pk.Properties.TopicAliasFlag = true
+	pk.Properties.TopicAlias = 1
+	require.NoError(t, s.processPublish(cl, pk))
+
+	pk.TopicName = "" // the alias is resolved before the delay is parsed
+	require.NoError(t, s.processPublish(cl, pk))
+	require.Len(t, hook.added, 2)
+	require.Equal(t, "a/b/c", hook.added[1].Packet.TopicName)
+}
+
+func TestServerDeleteDelayed(t *testing.T) {
+	s, hook, recv := newDelayedServer(t)
+	cl, _, _ := newTestClient()
+
+	err := s.processPublish(cl, delayedPublish("$delayed/60/a/b/c", false))
+	require.NoError(t, err)
+	id := hook.added[0].ID
+
+	require.False(t, s.DeleteDelayed("unknown"))
+	require.True(t, s.DeleteDelayed(id))
+	require.Equal(t, 0, s.Delayed.Len())
+	require.Len(t, hook.deleted, 1)
+	require.False(t, s.DeleteDelayed(id))
+
+	s.sendDelayedMessages(time.Now().Unix() + 60)
+	require.Len(t, recv, 0)
+}
+
+func TestServerLoadDelayed(t *testing.T) {
+	s := newServer()
+	s.loadDelayed([]storage.Message{
+		{ID: "d2", TopicName: "d/e/f", Payload: []byte("2"), Due: 200},
+		{ID: "d1", TopicName: "a/b/c", Payload: []byte("1"), Due: 100},
+	})
+
+	v := s.Delayed.GetAll()
+	require.Len(t, v, 2)
+	require.Equal(t, "d1", v[0].ID)
+	require.Equal(t, "a/b/c", v[0].Packet.TopicName)
+	require.Equal(t, int64(100), v[0].Due)
+	require.Equal(t, "d2", v[1].ID)
+}
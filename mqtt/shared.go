@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// The strategies which select the member of a shared subscription group to receive a message.
+// In a cluster, the strategy first selects the node, and then the member on that node.
+const (
+	SharedLocalFirst    = "local-first"    // a random member, on this node if it has one
+	SharedRandom        = "random"         // a random member on any node
+	SharedRoundRobin    = "round-robin"    // each member in turn
+	SharedLeastInflight = "least-inflight" // the member with the fewest inflight messages, on this node if it has one
+	SharedStickyClient  = "sticky-client"  // the same member for each publishing client id
+	SharedStickyTopic   = "sticky-topic"   // the same member for each topic
+)
+
+// ErrInvalidSharedStrategy indicates a shared subscription strategy is not known.
+var ErrInvalidSharedStrategy = errors.New("invalid shared subscription strategy")
+
+// SharedOptions selects the strategies of shared subscription groups.
+type SharedOptions struct {
+	// Strategy is the strategy of the groups without their own, defaulting to local-first.
+	Strategy string `yaml:"strategy"`
+
+	// Groups sets the strategy of share groups, keyed on group name.
+	Groups map[string]string `yaml:"groups"`
+}
+
+// validate returns an error if a strategy is not known.
+func (o SharedOptions) validate() error {
+	if o.Strategy != "" && !IsValidSharedStrategy(o.Strategy) {
+		return fmt.Errorf("%w: %s", ErrInvalidSharedStrategy, o.Strategy)
+	}
+
+	for group, strategy := range o.Groups {
+		if !IsValidSharedStrategy(strategy) {
+			return fmt.Errorf("%w: %s for group %s", ErrInvalidSharedStrategy, strategy, group)
+		}
+	}
+
+	return nil
+}
+
+// GroupStrategy returns the strategy of the group of a shared subscription filter.
+func (o SharedOptions) GroupStrategy(filter string) string {
+	if strategy, ok := o.Groups[SharedGroup(filter)]; ok {
+		return strategy
+	}
+
+	if o.Strategy == "" {
+		return SharedLocalFirst
+	}
+
+	return o.Strategy
+}
+
+// IsValidSharedStrategy returns true if a shared subscription strategy is known.
+func IsValidSharedStrategy(strategy string) bool {
+	switch strategy {
+	case SharedLocalFirst, SharedRandom, SharedRoundRobin, SharedLeastInflight, SharedStickyClient, SharedStickyTopic:
+		return true
+	default:
+		return false
+	}
+}
+
+// SharedGroup returns the group name of a shared subscription filter, such as g1 in $share/g1/a/b.
+func SharedGroup(filter string) string {
+	if !IsSharedFilter(filter) {
+		return ""
+	}
+
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// SharedSelector selects the members of shared subscription groups, keeping the round-robin
+// turn of each group.
+type SharedSelector struct {
+	sync.Mutex
+	turns map[string]int // the next turn, keyed on filter
+}
+
+// NewSharedSelector returns a new instance of SharedSelector.
+func NewSharedSelector() *SharedSelector {
+	return &SharedSelector{
+		turns: map[string]int{},
+	}
+}
+
+// Select returns the member of the group of a filter which receives a message. The members
+// must be sorted so that turns are taken in a stable order. inflight returns the number of
+// inflight messages of a member, and is only used by least-inflight; without it, members
+// take turns.
+func (s *SharedSelector) Select(strategy, filter string, pk packets.Packet, members []string, inflight func(member string) int) string {
+	if len(members) == 0 {
+		return ""
+	}
+
+	if len(members) == 1 {
+		return members[0]
+	}
+
+	switch strategy {
+	case SharedRoundRobin:
+		return members[s.turn(filter)%len(members)]
+	case SharedLeastInflight:
+		start := s.turn(filter) % len(members) // members with the same number take turns
+		best := members[start]
+		if inflight == nil {
+			return best
+		}
+
+		least := inflight(best)
+		for i := 1; i < len(members); i++ {
+			m := members[(start+i)%len(members)]
+			if n := inflight(m); n < least {
+				best, least = m, n
+			}
+		}
+		return best
+	case SharedStickyClient:
+		return sticky(pk.Origin, members)
+	case SharedStickyTopic:
+		return sticky(pk.TopicName, members)
+	default:
+		return members[rand.Intn(len(members))]
+	}
+}
+
+// turn returns the turn of a filter and advances it.
+func (s *SharedSelector) turn(filter string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := s.turns[filter]
+	s.turns[filter] = n + 1
+	return n
+}
+
+// Forget removes the turn of a filter, such as when the members of its group change.
+func (s *SharedSelector) Forget(filter string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.turns, filter)
+}
+
+// sticky returns the member with the highest hash of the key and member, so a key keeps its
+// member unless that member leaves, or a new member takes it.
+func sticky(key string, members []string) string {
+	var best string
+	var highest uint64
+	for i, m := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(m))
+		if v := h.Sum64(); i == 0 || v > highest {
+			best, highest = m, v
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestIsValidSharedStrategy(t *testing.T) {
+	require.True(t, IsValidSharedStrategy(SharedLocalFirst))
+	require.True(t, IsValidSharedStrategy(SharedRandom))
+	require.True(t, IsValidSharedStrategy(SharedRoundRobin))
+	require.True(t, IsValidSharedStrategy(SharedLeastInflight))
+	require.True(t, IsValidSharedStrategy(SharedStickyClient))
+	require.True(t, IsValidSharedStrategy(SharedStickyTopic))
+	require.False(t, IsValidSharedStrategy(""))
+	require.False(t, IsValidSharedStrategy("fastest"))
+}
+
+func TestSharedGroup(t *testing.T) {
+	require.Equal(t, "g1", SharedGroup("$share/g1/a/b"))
+	require.Equal(t, "g1", SharedGroup("$SHARE/g1/a"))
+	require.Equal(t, "", SharedGroup("$share/g1"))
+	require.Equal(t, "", SharedGroup("a/b"))
+}
+
+func TestSharedOptionsGroupStrategy(t *testing.T) {
+	o := SharedOptions{}
+	require.Equal(t, SharedLocalFirst, o.GroupStrategy("$share/g1/a"))
+
+	o = SharedOptions{
+		Strategy: SharedRoundRobin,
+		Groups:   map[string]string{"g2": SharedStickyTopic},
+	}
+	require.Equal(t, SharedRoundRobin, o.GroupStrategy("$share/g1/a"))
+	require.Equal(t, SharedStickyTopic, o.GroupStrategy("$share/g2/a"))
+}
+
+func TestSharedOptionsValidate(t *testing.T) {
+	require.NoError(t, SharedOptions{}.validate())
+	require.NoError(t, SharedOptions{Strategy: SharedRandom, Groups: map[string]string{"g1": SharedLeastInflight}}.validate())
+
+	err := SharedOptions{Strategy: "fastest"}.validate()
+	require.True(t, errors.Is(err, ErrInvalidSharedStrategy))
+
+	err = SharedOptions{Groups: map[string]string{"g1": ""}}.validate()
+	require.True(t, errors.Is(err, ErrInvalidSharedStrategy))
+}
+
+func TestSharedSelectorSelectEmpty(t *testing.T) {
+	s := NewSharedSelector()
+	require.Equal(t, "", s.Select(SharedRoundRobin, "$share/g/a", packets.Packet{}, nil, nil))
+	require.Equal(t, "cl1", s.Select(SharedRoundRobin, "$share/g/a", packets.Packet{}, []string{"cl1"}, nil))
+}
+
+func TestSharedSelectorSelectRandom(t *testing.T) {
+	s := NewSharedSelector()
+	members := []string{"cl1", "cl2", "cl3"}
+	for i := 0; i < 10; i++ {
+		require.Contains(t, members, s.Select(SharedRandom, "$share/g/a", packets.Packet{}, members, nil))
+		require.Contains(t, members, s.Select(SharedLocalFirst, "$share/g/a", packets.Packet{}, members, nil))
+	}
+}
+
+func TestSharedSelectorSelectRoundRobin(t *testing.T) {
+	s := NewSharedSelector()
+	members := []string{"cl1", "cl2", "cl3"}
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, s.Select(SharedRoundRobin, "$share/g/a", packets.Packet{}, members, nil))
+	}
+	require.Equal(t, []string{"cl1", "cl2", "cl3", "cl1", "cl2", "cl3"}, got)
+
+	// groups take their own turns
+	require.Equal(t, "cl1", s.Select(SharedRoundRobin, "$share/g2/a", packets.Packet{}, members, nil))
+
+	s.Forget("$share/g/a")
+	require.Equal(t, "cl1", s.Select(SharedRoundRobin, "$share/g/a", packets.Packet{}, members, nil))
+}
+
+func TestSharedSelectorSelectLeastInflight(t *testing.T) {
+	s := NewSharedSelector()
+	members := []string{"cl1", "cl2", "cl3"}
+	inflight := map[string]int{"cl1": 4, "cl2": 1, "cl3": 2}
+	fn := func(id string) int {
+		return inflight[id]
+	}
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, "cl2", s.Select(SharedLeastInflight, "$share/g/a", packets.Packet{}, members, fn))
+	}
+
+	// members with the same number of inflight messages take turns
+	inflight["cl3"] = 1
+	got := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		got[s.Select(SharedLeastInflight, "$share/g/a", packets.Packet{}, members, fn)] = true
+	}
+	require.Equal(t, map[string]bool{"cl2": true, "cl3": true}, got)
+
+	// without inflight, members take turns
+	require.Contains(t, members, s.Select(SharedLeastInflight, "$share/g/a", packets.Packet{}, members, nil))
+}
+
+func TestSharedSelectorSelectSticky(t *testing.T) {
+	s := NewSharedSelector()
+	members := []string{"cl1", "cl2", "cl3", "cl4"}
+
+	pk := packets.Packet{Origin: "publisher", TopicName: "a/b"}
+	client := s.Select(SharedStickyClient, "$share/g/a/#", pk, members, nil)
+	topic := s.Select(SharedStickyTopic, "$share/g/a/#", pk, members, nil)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, client, s.Select(SharedStickyClient, "$share/g/a/#", packets.Packet{Origin: "publisher", TopicName: "a/c"}, members, nil))
+		require.Equal(t, topic, s.Select(SharedStickyTopic, "$share/g/a/#", packets.Packet{Origin: "other", TopicName: "a/b"}, members, nil))
+	}
+
+	// the key keeps its member when another member leaves
+	var rest []string
+	for _, m := range members {
+		if m != client {
+			rest = append(rest, m)
+		}
+	}
+	other := s.Select(SharedStickyClient, "$share/g/a/#", pk, rest, nil)
+	require.NotEqual(t, client, other)
+	rest = append(rest, "cl5")
+	if next := s.Select(SharedStickyClient, "$share/g/a/#", pk, rest, nil); next != "cl5" {
+		require.Equal(t, other, next)
+	}
+
+	// keys are spread across the members
+	got := map[string]bool{}
+	for _, topic := range []string{"a/1", "a/2", "a/3", "a/4", "a/5", "a/6", "a/7", "a/8", "a/9", "a/10", "a/11", "a/12"} {
+		got[s.Select(SharedStickyTopic, "$share/g/a/#", packets.Packet{TopicName: topic}, members, nil)] = true
+	}
+	require.Greater(t, len(got), 1)
+}
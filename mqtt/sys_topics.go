@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	SysTreeBroker    = "broker"    // $SYS/broker/..., the broker-wide counters
+	SysTreeListeners = "listeners" // $SYS/listeners/{id}/..., per-listener client counts
+	SysTreeClients   = "clients"   // $SYS/clients/{id}/..., per-client counters, opt-in
+	SysTreeHooks     = "hooks"     // $SYS/hooks/{id}/..., per-hook error counts
+	SysTreeCluster   = "cluster"   // $SYS/cluster/..., registered by the cluster agent
+)
+
+// SysTopicsFn returns the current values of a $SYS subtree, keyed on topic name
+// relative to the $SYS prefix, such as broker/uptime.
+type SysTopicsFn func() map[string]string
+
+// SysTopicsOptions configures which $SYS subtrees are published and how often.
+type SysTopicsOptions struct {
+	// Disabled lists the subtrees which should not be published, such as listeners or hooks.
+	Disabled []string `yaml:"disabled"`
+
+	// Clients enables the per-client subtree. This can be expensive with many clients.
+	Clients bool `yaml:"clients"`
+
+	// Intervals sets the number of seconds between updates for each subtree, keyed on
+	// subtree name. Subtrees without an interval use SysTopicResendInterval.
+	Intervals map[string]int64 `yaml:"intervals"`
+}
+
+// sysTree is a registered $SYS subtree.
+type sysTree struct {
+	name   string      // the name of the subtree
+	fn     SysTopicsFn // returns the topic values
+	retain bool        // if true, the values are retained
+	next   int64       // the unix time of the next publish
+}
+
+// sysTrees is the set of $SYS subtrees published by the server.
+type sysTrees struct {
+	sync.Mutex
+	trees []*sysTree
+}
+
+// sysTickInterval returns the interval of the $SYS ticker, which is the shortest of the
+// configured subtree intervals.
+func (o *Options) sysTickInterval() time.Duration {
+	d := o.SysTopicResendInterval
+	for _, v := range o.SysTopics.Intervals {
+		if v > 0 && v < d {
+			d = v
+		}
+	}
+	return time.Second * time.Duration(d)
+}
+
+// AddSysTopics registers a subtree of retained $SYS topics which is published on the
+// $SYS interval. Registering a subtree with an existing name replaces it.
+func (s *Server) AddSysTopics(name string, fn SysTopicsFn) {
+	s.addSysTopics(name, fn, true)
+}
+
+// addSysTopics registers a $SYS subtree.
+func (s *Server) addSysTopics(name string, fn SysTopicsFn, retain bool) {
+	s.sysTrees.Lock()
+	defer s.sysTrees.Unlock()
+
+	t := &sysTree{name: name, fn: fn, retain: retain}
+	for i, v := range s.sysTrees.trees {
+		if v.name == name {
+			s.sysTrees.trees[i] = t
+			return
+		}
+	}
+	s.sysTrees.trees = append(s.sysTrees.trees, t)
+}
+
+// registerSysTopics registers the built-in $SYS subtrees.
+func (s *Server) registerSysTopics() {
+	s.addSysTopics(SysTreeBroker, s.brokerSysTopics, true)
+	s.addSysTopics(SysTreeListeners, s.listenerSysTopics, true)
+	s.addSysTopics(SysTreeHooks, s.hookSysTopics, true)
+	if s.Options.SysTopics.Clients {
+		s.addSysTopics(SysTreeClients, s.clientSysTopics, false) // not retained, as clients come and go
+	}
+}
+
+// publishSysTopicTrees publishes each enabled subtree which is due at time now.
+func (s *Server) publishSysTopicTrees(now int64) {
+	s.sysTrees.Lock()
+	due := make([]*sysTree, 0, len(s.sysTrees.trees))
+	for _, t := range s.sysTrees.trees {
+		if now < t.next || slices.Contains(s.Options.SysTopics.Disabled, t.name) {
+			continue
+		}
+
+		interval := s.Options.SysTopicResendInterval
+		if v, ok := s.Options.SysTopics.Intervals[t.name]; ok && v > 0 {
+			interval = v
+		}
+		t.next = now + interval
+		due = append(due, t)
+	}
+	s.sysTrees.Unlock()
+
+	for _, t := range due {
+		pk := packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: t.retain,
+			},
+			Created: now,
+		}
+
+		for topic, payload := range t.fn() {
+			pk.TopicName = SysPrefix + "/" + topic
+			pk.Payload = []byte(payload)
+			if t.retain {
+				s.Topics.RetainMessage(pk.Copy(false))
+			}
+			s.publishToSubscribers(pk)
+		}
+	}
+}
+
+// brokerSysTopics returns the broker-wide $SYS counters.
+func (s *Server) brokerSysTopics() map[string]string {
+	return map[string]string{
+		"broker/version":              s.Info.Version,
+		"broker/time":                 AtomicItoa(&s.Info.Time),
+		"broker/uptime":               AtomicItoa(&s.Info.Uptime),
+		"broker/started":              AtomicItoa(&s.Info.Started),
+		"broker/load/bytes/received":  AtomicItoa(&s.Info.BytesReceived),
+		"broker/load/bytes/sent":      AtomicItoa(&s.Info.BytesSent),
+		"broker/clients/connected":    AtomicItoa(&s.Info.ClientsConnected),
+		"broker/clients/disconnected": AtomicItoa(&s.Info.ClientsDisconnected),
+		"broker/clients/maximum":      AtomicItoa(&s.Info.ClientsMaximum),
+		"broker/clients/total":        AtomicItoa(&s.Info.ClientsTotal),
+		"broker/packets/received":     AtomicItoa(&s.Info.PacketsReceived),
+		"broker/packets/sent":         AtomicItoa(&s.Info.PacketsSent),
+		"broker/messages/received":    AtomicItoa(&s.Info.MessagesReceived),
+		"broker/messages/sent":        AtomicItoa(&s.Info.MessagesSent),
+		"broker/messages/dropped":     AtomicItoa(&s.Info.MessagesDropped),
+		"broker/messages/inflight":    AtomicItoa(&s.Info.Inflight),
+		"broker/retained":             AtomicItoa(&s.Info.Retained),
+		"broker/subscriptions":        AtomicItoa(&s.Info.Subscriptions),
+		"broker/system/memory":        AtomicItoa(&s.Info.MemoryAlloc),
+		"broker/system/threads":       AtomicItoa(&s.Info.Threads),
+	}
+}
+
+// listenerSysTopics returns the number of connected clients on each listener.
+func (s *Server) listenerSysTopics() map[string]string {
+	conns := make(map[string]int)
+	for id := range s.Listeners.GetAll() {
+		conns[id] = 0
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		if !cl.Net.Inline && !cl.Closed() {
+			conns[cl.Net.Listener]++
+		}
+	}
+
+	topics := make(map[string]string, len(conns)*2)
+	for id, n := range conns {
+		if !validSysLevel(id) {
+			continue
+		}
+		topics["listeners/"+id+"/clients/connected"] = strconv.Itoa(n)
+		if l, ok := s.Listeners.Get(id); ok {
+			topics["listeners/"+id+"/protocol"] = l.Protocol()
+		}
+	}
+
+	return topics
+}
+
+// hookSysTopics returns the number of errors returned by each hook.
+func (s *Server) hookSysTopics() map[string]string {
+	errs := s.hooks.Errors()
+	topics := make(map[string]string, len(errs))
+	for id, n := range errs {
+		if validSysLevel(id) {
+			topics["hooks/"+id+"/errors"] = strconv.FormatInt(n, 10)
+		}
+	}
+
+	return topics
+}
+
+// clientSysTopics returns the traffic counters of each connected client.
+func (s *Server) clientSysTopics() map[string]string {
+	clients := s.Clients.GetAll()
+	topics := make(map[string]string, len(clients)*6)
+	for _, cl := range clients {
+		if cl.Net.Inline || cl.Closed() || !validSysLevel(cl.ID) {
+			continue
+		}
+
+		prefix := "clients/" + cl.ID + "/"
+		topics[prefix+"bytes/received"] = AtomicItoa(&cl.State.Stats.BytesReceived)
+		topics[prefix+"bytes/sent"] = AtomicItoa(&cl.State.Stats.BytesSent)
+		topics[prefix+"messages/received"] = AtomicItoa(&cl.State.Stats.MessagesReceived)
+		topics[prefix+"messages/sent"] = AtomicItoa(&cl.State.Stats.MessagesSent)
+		topics[prefix+"messages/inflight"] = strconv.Itoa(cl.State.Inflight.Len())
+		topics[prefix+"subscriptions"] = strconv.Itoa(cl.State.Subscriptions.Len())
+		topics[prefix+"outbound"] = strconv.Itoa(int(atomic.LoadInt32(&cl.State.outboundQty)))
+	}
+
+	return topics
+}
+
+// validSysLevel returns true if an id can be used as a $SYS topic level.
+func validSysLevel(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "+#/")
+}
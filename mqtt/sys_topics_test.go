@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerSysTopicsDefault(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	s.Clients.Add(cl)
+
+	s.publishSysTopics()
+
+	pk, ok := s.Topics.Retained.Get(SysPrefix + "/broker/version")
+	require.True(t, ok)
+	require.Equal(t, []byte(Version), pk.Payload)
+
+	pk, ok = s.Topics.Retained.Get(SysPrefix + "/listeners/t1/clients/connected")
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), pk.Payload)
+
+	pk, ok = s.Topics.Retained.Get(SysPrefix + "/hooks/allow-all-auth/errors")
+	require.True(t, ok)
+	require.Equal(t, []byte("0"), pk.Payload)
+
+	_, ok = s.Topics.Retained.Get(SysPrefix + "/clients/mochi/bytes/received")
+	require.False(t, ok)
+}
+
+func TestServerSysTopicsDisabled(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+		SysTopics: SysTopicsOptions{
+			Disabled: []string{SysTreeListeners, SysTreeHooks},
+		},
+	})
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	s.publishSysTopics()
+
+	_, ok := s.Topics.Retained.Get(SysPrefix + "/broker/uptime")
+	require.True(t, ok)
+	_, ok = s.Topics.Retained.Get(SysPrefix + "/listeners/t1/clients/connected")
+	require.False(t, ok)
+}
+
+func TestServerSysTopicsIntervals(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		SysTopicResendInterval: 10,
+		SysTopics: SysTopicsOptions{
+			Intervals: map[string]int64{SysTreeHooks: 2},
+		},
+	})
+	require.Equal(t, time.Second*2, s.Options.sysTickInterval())
+
+	var calls []string
+	s.AddSysTopics("a", func() map[string]string {
+		calls = append(calls, "a")
+		return nil
+	})
+	s.Options.SysTopics.Intervals["a"] = 3
+
+	s.publishSysTopicTrees(100)
+	s.publishSysTopicTrees(102)
+	s.publishSysTopicTrees(103)
+	require.Equal(t, []string{"a", "a"}, calls)
+}
+
+func TestServerAddSysTopics(t *testing.T) {
+	s := newServer()
+	s.AddSysTopics("custom", func() map[string]string {
+		return map[string]string{"custom/value": "1"}
+	})
+	s.AddSysTopics("custom", func() map[string]string {
+		return map[string]string{"custom/value": "2"}
+	})
+
+	s.publishSysTopics()
+
+	pk, ok := s.Topics.Retained.Get(SysPrefix + "/custom/value")
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), pk.Payload)
+	require.True(t, pk.FixedHeader.Retain)
+}
+
+func TestServerClientSysTopics(t *testing.T) {
+	s := New(&Options{
+		Logger:    logger,
+		SysTopics: SysTopicsOptions{Clients: true},
+	})
+
+	cl, _, _ := newTestClient()
+	cl.State.Stats.BytesReceived = 10
+	cl.State.Stats.MessagesSent = 2
+	s.Clients.Add(cl)
+
+	bad, _, _ := newTestClient()
+	bad.ID = "a/#"
+	s.Clients.Add(bad)
+
+	topics := s.clientSysTopics()
+	require.Equal(t, "10", topics["clients/mochi/bytes/received"])
+	require.Equal(t, "2", topics["clients/mochi/messages/sent"])
+	require.Equal(t, "0", topics["clients/mochi/subscriptions"])
+	require.Len(t, topics, 7)
+
+	s.publishSysTopics()
+	_, ok := s.Topics.Retained.Get(SysPrefix + "/clients/mochi/bytes/received")
+	require.False(t, ok) // per-client values are not retained
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package system
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency histogram buckets.
+var DefaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Histogram is a lock-free cumulative histogram of durations.
+type Histogram struct {
+	bounds []float64 // the upper bounds of the buckets in seconds
+	counts []uint64  // the number of observations per bucket, the last being +Inf
+	count  uint64    // the total number of observations
+	sum    int64     // the sum of all observations in nanoseconds
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram.
+type HistogramSnapshot struct {
+	Bounds []float64 // the upper bounds of the buckets in seconds
+	Counts []uint64  // the cumulative number of observations for each bound
+	Count  uint64    // the total number of observations
+	Sum    float64   // the sum of all observations in seconds
+}
+
+// NewHistogram returns a histogram with the given bucket bounds, or
+// DefaultLatencyBuckets if none are provided.
+func NewHistogram(bounds ...float64) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBuckets
+	}
+
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe records a single duration.
+func (h *Histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for ; i < len(h.bounds); i++ {
+		if s <= h.bounds[i] {
+			break
+		}
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Snapshot returns a cumulative copy of the histogram values.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+
+	var c uint64
+	for i := range h.bounds {
+		c += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = c
+	}
+
+	return s
+}
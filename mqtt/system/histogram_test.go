@@ -0,0 +1,27 @@
+package system
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHistogramDefaultBuckets(t *testing.T) {
+	h := NewHistogram()
+	require.Equal(t, DefaultLatencyBuckets, h.bounds)
+	require.Len(t, h.counts, len(DefaultLatencyBuckets)+1)
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram(0.001, 0.01)
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	s := h.Snapshot()
+	require.Equal(t, []float64{0.001, 0.01}, s.Bounds)
+	require.Equal(t, []uint64{1, 2}, s.Counts)
+	require.Equal(t, uint64(3), s.Count)
+	require.InDelta(t, 1.0055, s.Sum, 0.000001)
+}
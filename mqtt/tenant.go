@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"strings"
+)
+
+// TenantPrefix is the topic prefix of the namespaces of tenants, such as $tenant/acme/a/b/c
+// which is the topic a/b/c of the tenant acme. Clients of a tenant see their topics without
+// the namespace, and the wildcard filters of other clients do not match it.
+const TenantPrefix = "$tenant"
+
+// IsValidTenant returns true if a tenant name can be used as a level of the namespace.
+func IsValidTenant(tenant string) bool {
+	return tenant != "" && !strings.ContainsAny(tenant, "/+#")
+}
+
+// TenantNamespace returns the topic prefix of a tenant, such as $tenant/acme/.
+func TenantNamespace(tenant string) string {
+	return TenantPrefix + "/" + tenant + "/"
+}
+
+// TenantTopic returns a topic or filter within the namespace of a tenant. Shared subscription
+// filters keep their share prefix and group.
+func TenantTopic(tenant, topic string) string {
+	if IsSharedFilter(topic) {
+		parts := strings.SplitN(topic, "/", 3)
+		if len(parts) == 3 {
+			return parts[0] + "/" + parts[1] + "/" + TenantNamespace(tenant) + parts[2]
+		}
+	}
+
+	return TenantNamespace(tenant) + topic
+}
+
+// StripTenant returns a topic without the namespace of a tenant, or false if the topic is
+// not within the namespace.
+func StripTenant(tenant, topic string) (string, bool) {
+	return strings.CutPrefix(topic, TenantNamespace(tenant))
+}
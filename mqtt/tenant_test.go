@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestIsValidTenant(t *testing.T) {
+	require.True(t, IsValidTenant("acme"))
+	require.True(t, IsValidTenant("acme-1.eu"))
+	require.False(t, IsValidTenant(""))
+	require.False(t, IsValidTenant("a/b"))
+	require.False(t, IsValidTenant("a+"))
+	require.False(t, IsValidTenant("#"))
+}
+
+func TestTenantTopic(t *testing.T) {
+	require.Equal(t, "$tenant/acme/", TenantNamespace("acme"))
+	require.Equal(t, "$tenant/acme/a/b", TenantTopic("acme", "a/b"))
+	require.Equal(t, "$tenant/acme/#", TenantTopic("acme", "#"))
+	require.Equal(t, "$tenant/acme/$SYS/#", TenantTopic("acme", "$SYS/#"))
+	require.Equal(t, "$share/g1/$tenant/acme/a/+", TenantTopic("acme", "$share/g1/a/+"))
+}
+
+func TestStripTenant(t *testing.T) {
+	topic, ok := StripTenant("acme", "$tenant/acme/a/b")
+	require.True(t, ok)
+	require.Equal(t, "a/b", topic)
+
+	topic, ok = StripTenant("acme", "$tenant/other/a/b")
+	require.False(t, ok)
+	require.Equal(t, "$tenant/other/a/b", topic)
+
+	_, ok = StripTenant("acme", "$tenant/acmex/a")
+	require.False(t, ok)
+}
+
+func TestTenantTopicsIsolated(t *testing.T) {
+	index := NewTopicsIndex()
+	index.Subscribe("cl1", packets.Subscription{Filter: TenantTopic("acme", "#")})
+	index.Subscribe("cl2", packets.Subscription{Filter: TenantTopic("other", "#")})
+	index.Subscribe("cl3", packets.Subscription{Filter: "#"})
+
+	subs := index.Subscribers(TenantTopic("acme", "a/b"))
+	require.Len(t, subs.Subscriptions, 1)
+	require.Contains(t, subs.Subscriptions, "cl1")
+}
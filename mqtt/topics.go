@@ -492,6 +492,11 @@ func (x *TopicsIndex) RetainMessage(pk packets.Packet) int64 {
 	return out
 }
 
+// Count returns the number of retained messages.
+func (x *TopicsIndex) Count() int64 {
+	return int64(x.Retained.Len())
+}
+
 // set creates a topic address in the index and returns the final particle.
 func (x *TopicsIndex) set(topic string, d int) *particle {
 	var key string
@@ -720,6 +725,47 @@ func IsSharedFilter(filter string) bool {
 	return strings.EqualFold(prefix, SharePrefix)
 }
 
+// MatchFilter returns true if a topic name matches a topic filter. Wildcards in the
+// first level of the filter do not match topics beginning with $.
+func MatchFilter(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false // [MQTT-4.7.2-1]
+	}
+
+	for {
+		fp, fNext := isolateParticle(filter, 0)
+		if fp == "#" {
+			return true // [MQTT-4.7.1-2] also matches the parent level
+		}
+
+		tp, tNext := isolateParticle(topic, 0)
+		if fp != "+" && fp != tp {
+			return false
+		}
+
+		if !fNext || !tNext {
+			return !tNext && (!fNext || filter[len(fp)+1:] == "#")
+		}
+
+		filter, topic = filter[len(fp)+1:], topic[len(tp)+1:]
+	}
+}
+
+// FilterPrefix returns the part of a topic filter before its first wildcard, which
+// every matching topic begins with.
+func FilterPrefix(filter string) string {
+	i := strings.IndexAny(filter, "+#")
+	if i < 0 {
+		return filter
+	}
+
+	if filter[i] == '#' && i > 0 {
+		return filter[:i-1] // a/# also matches a
+	}
+
+	return filter[:i]
+}
+
 // IsValidFilter returns true if the filter is valid.
 func IsValidFilter(filter string, forPublish bool) bool {
 	if !forPublish && len(filter) == 0 { // publishing can accept zero-length topic filter if topic alias exists, so we don't enforce for publish.
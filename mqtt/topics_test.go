@@ -786,6 +786,44 @@ func TestIsSharedFilter(t *testing.T) {
 	require.False(t, IsSharedFilter("a/b/c"))
 }
 
+func TestMatchFilter(t *testing.T) {
+	tt := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{filter: "a/b/c", topic: "a/b/c", match: true},
+		{filter: "a/b/c", topic: "a/b", match: false},
+		{filter: "a/b", topic: "a/b/c", match: false},
+		{filter: "a/+/c", topic: "a/b/c", match: true},
+		{filter: "a/+/c", topic: "a/b/d", match: false},
+		{filter: "a/+", topic: "a/", match: true},
+		{filter: "+/+", topic: "a/b", match: true},
+		{filter: "+", topic: "a/b", match: false},
+		{filter: "a/#", topic: "a/b/c", match: true},
+		{filter: "a/#", topic: "a", match: true},
+		{filter: "a/#", topic: "ab", match: false},
+		{filter: "#", topic: "a/b/c", match: true},
+		{filter: "#", topic: "$SYS/info", match: false},
+		{filter: "+/info", topic: "$SYS/info", match: false},
+		{filter: "$SYS/#", topic: "$SYS/info", match: true},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.filter+" "+tx.topic, func(t *testing.T) {
+			require.Equal(t, tx.match, MatchFilter(tx.filter, tx.topic))
+		})
+	}
+}
+
+func TestFilterPrefix(t *testing.T) {
+	require.Equal(t, "a/b/c", FilterPrefix("a/b/c"))
+	require.Equal(t, "a/", FilterPrefix("a/+/c"))
+	require.Equal(t, "a/b", FilterPrefix("a/b/#"))
+	require.Equal(t, "a/", FilterPrefix("a/+/#"))
+	require.Equal(t, "", FilterPrefix("#"))
+}
+
 func TestNewInboundAliases(t *testing.T) {
 	a := NewInboundTopicAliases(5)
 	require.NotNil(t, a)
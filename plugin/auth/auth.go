@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"errors"
+
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
@@ -18,8 +20,18 @@ const (
 	HashHmacSha1
 	HashHmacSha256
 	HashHmacSha512
+	HashScramSha256
 )
 
+// ErrCredentialNotFound indicates a user has no stored credential, or is not allowed to connect.
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// CredentialStore is implemented by auth backends which can return the stored password
+// of a user, allowing it to be verified without the password being sent by the client.
+type CredentialStore interface {
+	StoredPassword(username string) (string, error)
+}
+
 func CheckAcl(tam map[string]auth.Access, write bool) bool {
 	// access 0 = deny, 1 = read only, 2 = write only, 3 = read and write
 	rm := make(map[string]bool)
@@ -68,6 +80,8 @@ func (b *Blacklist) CheckBLAuth(cl *mqtt.Client, pk packets.Packet) (n int, ok b
 	if b.rules == nil {
 		return -1, false
 	}
+	b.rules.RLock()
+	defer b.rules.RUnlock()
 	for n, rule := range b.rules.Auth {
 		if rule.Client.Matches(cl.ID) &&
 			rule.Username.Matches(string(cl.Properties.Username)) &&
@@ -83,6 +97,8 @@ func (b *Blacklist) CheckBLAcl(cl *mqtt.Client, topic string, write bool) (n int
 	if b.rules == nil {
 		return -1, false
 	}
+	b.rules.RLock()
+	defer b.rules.RUnlock()
 	for _, rule := range b.rules.ACL {
 		if rule.Client.Matches(cl.ID) &&
 			rule.Username.Matches(string(cl.Properties.Username)) &&
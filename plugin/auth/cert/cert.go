@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+// The parts of a client certificate which can be used as an identity.
+const (
+	IdentityCN          = "cn"          // the subject common name
+	IdentitySAN         = "san"         // the dns, email, uri and ip subject alternative names, in that order
+	IdentityFingerprint = "fingerprint" // the lowercase hex sha256 fingerprint of the certificate
+)
+
+// ErrInvalidIdentity indicates an identity option is not cn, san or fingerprint.
+var ErrInvalidIdentity = errors.New("certificate identity must be cn, san or fingerprint")
+
+// Options contains configuration settings for the hook.
+type Options struct {
+	pa.Blacklist
+	Username string       `json:"username" yaml:"username"`   // the identity used as the username, unchanged if empty
+	ClientID string       `json:"client-id" yaml:"client-id"` // the identity the client id must match, unchecked if empty
+	Filters  auth.Filters `json:"filters" yaml:"filters"`     // access granted to certified clients, %c and %u are replaced with the client id and username
+}
+
+// Auth is a hook which authenticates clients by the verified certificate of a mutual tls
+// connection, mapping the certificate identity to the username and client id.
+type Auth struct {
+	mqtt.HookBase
+	config *Options
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-cert"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init initializes the hook.
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	for _, v := range []string{a.config.Username, a.config.ClientID} {
+		if v != "" && v != IdentityCN && v != IdentitySAN && v != IdentityFingerprint {
+			return ErrInvalidIdentity
+		}
+	}
+
+	a.Log.Info("", "username", a.config.Username, "client-id", a.config.ClientID, "filters", len(a.config.Filters))
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the client presented a verified certificate whose
+// identity matches the client id. If the client did not send a client id, it is assigned
+// from the certificate.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if len(cl.Net.PeerCertificates) == 0 {
+		return false
+	}
+
+	leaf := cl.Net.PeerCertificates[0]
+	if a.config.ClientID != "" {
+		ids := Identities(leaf, a.config.ClientID)
+		if len(ids) == 0 {
+			return false
+		}
+
+		if pk.Connect.ClientIdentifier == "" {
+			cl.ID = ids[0]
+			if cl.Properties.Props.AssignedClientID != "" {
+				cl.Properties.Props.AssignedClientID = cl.ID
+			}
+		} else if !slices.Contains(ids, cl.ID) {
+			a.Log.Debug("client id does not match certificate", "client", cl.ID, "remote", cl.Net.Remote)
+			return false
+		}
+	}
+
+	if a.config.Username != "" {
+		ids := Identities(leaf, a.config.Username)
+		if len(ids) == 0 {
+			return false
+		}
+		cl.Properties.Username = []byte(ids[0])
+	}
+
+	// check blacklist against the certificate identity
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return ok
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if a certified client has access to the topic through the
+// configured filters.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if len(cl.Net.PeerCertificates) == 0 {
+		return false
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAcl(cl, topic, write); n >= 0 { // It's on the blacklist
+		return ok
+	}
+
+	fam := make(map[string]auth.Access)
+	for filter, access := range a.config.Filters {
+		f, ok := expandFilter(string(filter), cl)
+		if ok && plugin.MatchTopic(f, topic) {
+			fam[f] = access
+		}
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// Identities returns the values of an identity of a certificate.
+func Identities(cert *x509.Certificate, identity string) []string {
+	switch identity {
+	case IdentityCN:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	case IdentitySAN:
+		ids := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs)+len(cert.IPAddresses))
+		ids = append(ids, cert.DNSNames...)
+		ids = append(ids, cert.EmailAddresses...)
+		for _, u := range cert.URIs {
+			ids = append(ids, u.String())
+		}
+		for _, ip := range cert.IPAddresses {
+			ids = append(ids, ip.String())
+		}
+		return ids
+	case IdentityFingerprint:
+		sum := sha256.Sum256(cert.Raw)
+		return []string{hex.EncodeToString(sum[:])}
+	default:
+		return nil
+	}
+}
+
+// expandFilter replaces %c and %u in a filter with the client id and username, returning
+// false if a substituted value could change the levels of the filter.
+func expandFilter(filter string, cl *mqtt.Client) (string, bool) {
+	if strings.Contains(filter, "%c") {
+		if !validLevel(cl.ID) {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, "%c", cl.ID)
+	}
+
+	if strings.Contains(filter, "%u") {
+		if !validLevel(string(cl.Properties.Username)) {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, "%u", string(cl.Properties.Username))
+	}
+
+	return filter, true
+}
+
+// validLevel returns true if a value can be substituted into a single topic level.
+func validLevel(v string) bool {
+	return v != "" && !strings.ContainsAny(v, "+#/")
+}
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newTestCertificate(t *testing.T, cn string, dns ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: cn},
+		DNSNames:       dns,
+		EmailAddresses: []string{"ops@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/device"}},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func newTestClient(id string, cert *x509.Certificate) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	if cert != nil {
+		cl.Net.PeerCertificates = []*x509.Certificate{cert}
+	}
+	return cl
+}
+
+func newTestAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	return a
+}
+
+func connectPacket(id string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect:     packets.ConnectParams{ClientIdentifier: id},
+	}
+}
+
+func TestID(t *testing.T) {
+	a := new(Auth)
+	require.Equal(t, "auth-cert", a.ID())
+}
+
+func TestProvides(t *testing.T) {
+	a := new(Auth)
+	require.True(t, a.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, a.Provides(mqtt.OnACLCheck))
+	require.False(t, a.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{Username: "serial"}), ErrInvalidIdentity)
+	require.ErrorIs(t, a.Init(&Options{ClientID: "subject"}), ErrInvalidIdentity)
+	require.NoError(t, a.Init(&Options{Username: IdentityCN, ClientID: IdentityFingerprint}))
+	require.NoError(t, a.Init(&Options{}))
+}
+
+func TestIdentities(t *testing.T) {
+	cert := newTestCertificate(t, "device-1", "device-1.example.com")
+	require.Equal(t, []string{"device-1"}, Identities(cert, IdentityCN))
+	require.Equal(t, []string{"device-1.example.com", "ops@example.com", "spiffe://example.com/device", "10.0.0.1"}, Identities(cert, IdentitySAN))
+
+	sum := sha256.Sum256(cert.Raw)
+	require.Equal(t, []string{hex.EncodeToString(sum[:])}, Identities(cert, IdentityFingerprint))
+
+	require.Nil(t, Identities(newTestCertificate(t, ""), IdentityCN))
+	require.Nil(t, Identities(cert, "serial"))
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	a := newTestAuth(t, &Options{})
+	cert := newTestCertificate(t, "device-1")
+	require.True(t, a.OnConnectAuthenticate(newTestClient("any", cert), connectPacket("any")))
+	require.False(t, a.OnConnectAuthenticate(newTestClient("any", nil), connectPacket("any")))
+}
+
+func TestOnConnectAuthenticateClientID(t *testing.T) {
+	a := newTestAuth(t, &Options{ClientID: IdentitySAN})
+	cert := newTestCertificate(t, "device-1", "device-1.example.com")
+
+	require.True(t, a.OnConnectAuthenticate(newTestClient("device-1.example.com", cert), connectPacket("device-1.example.com")))
+	require.True(t, a.OnConnectAuthenticate(newTestClient("ops@example.com", cert), connectPacket("ops@example.com")))
+	require.False(t, a.OnConnectAuthenticate(newTestClient("device-2", cert), connectPacket("device-2")))
+
+	// clients without a client id are assigned the first identity
+	cl := newTestClient("generated", cert)
+	cl.Properties.Props.AssignedClientID = "generated"
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket("")))
+	require.Equal(t, "device-1.example.com", cl.ID)
+	require.Equal(t, "device-1.example.com", cl.Properties.Props.AssignedClientID)
+
+	a = newTestAuth(t, &Options{ClientID: IdentityCN})
+	require.False(t, a.OnConnectAuthenticate(newTestClient("", newTestCertificate(t, "")), connectPacket("")))
+}
+
+func TestOnConnectAuthenticateUsername(t *testing.T) {
+	a := newTestAuth(t, &Options{Username: IdentityCN})
+	cl := newTestClient("c1", newTestCertificate(t, "device-1"))
+	cl.Properties.Username = []byte("claimed")
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket("c1")))
+	require.Equal(t, []byte("device-1"), cl.Properties.Username)
+
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c1", newTestCertificate(t, "")), connectPacket("c1")))
+}
+
+func TestOnConnectAuthenticateBlacklist(t *testing.T) {
+	opts := &Options{Username: IdentityCN}
+	opts.SetBlacklist(&auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: "revoked", Allow: false},
+		},
+	})
+	a := newTestAuth(t, opts)
+
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c1", newTestCertificate(t, "revoked")), connectPacket("c1")))
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", newTestCertificate(t, "device-1")), connectPacket("c1")))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	a := newTestAuth(t, &Options{
+		Filters: auth.Filters{
+			"devices/%c/#":      auth.ReadWrite,
+			"devices/%c/config": auth.ReadOnly,
+			"fleet/%u/+":        auth.WriteOnly,
+		},
+	})
+
+	cl := newTestClient("device-1", newTestCertificate(t, "device-1"))
+	cl.Properties.Username = []byte("line-1")
+	require.True(t, a.OnACLCheck(cl, "devices/device-1/telemetry", true))
+	require.True(t, a.OnACLCheck(cl, "devices/device-1/config", false))
+	require.False(t, a.OnACLCheck(cl, "devices/device-1/config", true))
+	require.False(t, a.OnACLCheck(cl, "devices/device-2/telemetry", true))
+	require.True(t, a.OnACLCheck(cl, "fleet/line-1/status", true))
+	require.False(t, a.OnACLCheck(cl, "fleet/line-1/status", false))
+
+	require.False(t, a.OnACLCheck(newTestClient("device-1", nil), "devices/device-1/telemetry", true))
+	require.False(t, a.OnACLCheck(newTestClient("#", newTestCertificate(t, "x")), "devices/x/telemetry", true))
+}
+
+func TestExpandFilter(t *testing.T) {
+	cl := newTestClient("c1", nil)
+	cl.Properties.Username = []byte("u1")
+
+	f, ok := expandFilter("a/%c/%u/#", cl)
+	require.True(t, ok)
+	require.Equal(t, "a/c1/u1/#", f)
+
+	cl.Properties.Username = []byte("u/1")
+	_, ok = expandFilter("a/%u", cl)
+	require.False(t, ok)
+
+	f, ok = expandFilter("a/b", cl)
+	require.True(t, ok)
+	require.Equal(t, "a/b", f)
+}
@@ -3,15 +3,40 @@ package auth
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// ScramSha256Prefix prefixes stored SCRAM-SHA-256 secrets.
+	ScramSha256Prefix = "SCRAM-SHA-256"
+
+	// ScramSha256Iterations is the default number of PBKDF2 iterations for new secrets.
+	ScramSha256Iterations = 4096
+)
+
+// ErrInvalidScramSecret indicates a stored password is not a SCRAM-SHA-256 secret.
+var ErrInvalidScramSecret = errors.New("invalid scram-sha-256 secret")
+
+// ScramSecret is a stored SCRAM-SHA-256 credential, as described in RFC 5802.
+type ScramSecret struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
 func CompareHash(hashed, plain, key string, ht HashType) bool {
 	var tmp string
 	switch ht {
@@ -37,6 +62,12 @@ func CompareHash(hashed, plain, key string, ht HashType) bool {
 		tmp = HmacSha256(plain, key)
 	case HashHmacSha512:
 		tmp = HmacSha512(plain, key)
+	case HashScramSha256:
+		secret, err := ParseScramSecret(hashed)
+		if err != nil {
+			return false
+		}
+		return secret.Verify(plain)
 	}
 
 	if tmp == hashed {
@@ -99,3 +130,83 @@ func HmacSha512(src, key string) string {
 	m.Write([]byte(src))
 	return hex.EncodeToString(m.Sum(nil))
 }
+
+// ScramSha256 returns a SCRAM-SHA-256 secret for a password with a random salt, in the
+// form SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>, as used by PostgreSQL.
+func ScramSha256(src string) string {
+	salt := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	secret, err := NewScramSecret(src, salt, ScramSha256Iterations)
+	if err != nil {
+		return ""
+	}
+	return secret.String()
+}
+
+// NewScramSecret derives the SCRAM-SHA-256 keys of a password.
+func NewScramSecret(password string, salt []byte, iterations int) (*ScramSecret, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey := hmacSha256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramSecret{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSha256(salted, []byte("Server Key")),
+	}, nil
+}
+
+// ParseScramSecret parses a secret in the form returned by ScramSha256.
+func ParseScramSecret(s string) (*ScramSecret, error) {
+	method, rest, _ := strings.Cut(s, "$")
+	params, keys, _ := strings.Cut(rest, "$")
+	iter, salt, _ := strings.Cut(params, ":")
+	stored, server, _ := strings.Cut(keys, ":")
+	if method != ScramSha256Prefix {
+		return nil, ErrInvalidScramSecret
+	}
+
+	secret := new(ScramSecret)
+	var err error
+	if secret.Iterations, err = strconv.Atoi(iter); err != nil || secret.Iterations < 1 {
+		return nil, ErrInvalidScramSecret
+	}
+
+	for _, v := range []struct {
+		dst *[]byte
+		src string
+	}{{&secret.Salt, salt}, {&secret.StoredKey, stored}, {&secret.ServerKey, server}} {
+		if *v.dst, err = base64.StdEncoding.DecodeString(v.src); err != nil || len(*v.dst) == 0 {
+			return nil, ErrInvalidScramSecret
+		}
+	}
+
+	return secret, nil
+}
+
+// String returns the secret in the form SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>.
+func (s *ScramSecret) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", ScramSha256Prefix, s.Iterations,
+		base64.StdEncoding.EncodeToString(s.Salt),
+		base64.StdEncoding.EncodeToString(s.StoredKey),
+		base64.StdEncoding.EncodeToString(s.ServerKey))
+}
+
+// Verify returns true if a plain password matches the secret.
+func (s *ScramSecret) Verify(plain string) bool {
+	derived, err := NewScramSecret(plain, s.Salt, s.Iterations)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(derived.StoredKey, s.StoredKey)
+}
+
+func hmacSha256(key, src []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(src)
+	return m.Sum(nil)
+}
@@ -17,3 +17,20 @@ func TestBcrypt(t *testing.T) {
 	err = bcrypt.CompareHashAndPassword([]byte(hashed2), []byte(pwd))
 	require.NoError(t, err)
 }
+
+func TestScramSha256(t *testing.T) {
+	hashed := ScramSha256("pencil")
+	require.True(t, CompareHash(hashed, "pencil", "", HashScramSha256))
+	require.False(t, CompareHash(hashed, "pen", "", HashScramSha256))
+	require.False(t, CompareHash("pencil", "pencil", "", HashScramSha256))
+
+	secret, err := ParseScramSecret(hashed)
+	require.NoError(t, err)
+	require.Equal(t, ScramSha256Iterations, secret.Iterations)
+	require.Equal(t, hashed, secret.String())
+
+	_, err = ParseScramSecret("SCRAM-SHA-256$0:c2FsdA==$a2V5:a2V5")
+	require.ErrorIs(t, err, ErrInvalidScramSecret)
+	_, err = ParseScramSecret("SCRAM-SHA-256$4096:c2FsdA==$a2V5")
+	require.ErrorIs(t, err, ErrInvalidScramSecret)
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	gjwt "github.com/golang-jwt/jwt/v5"
+)
+
+// jwksMinRefresh is the minimum time between fetches of the JWKS document when a token
+// is signed with an unknown key id.
+const jwksMinRefresh = 10 * time.Second
+
+// ErrInvalidJwk indicates a key in a JWKS document could not be parsed.
+var ErrInvalidJwk = errors.New("invalid jwk")
+
+// jwk is a key in a JWKS document (RFC 7517). Only RSA and EC keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks is a cached JWKS document which is refreshed periodically.
+type jwks struct {
+	sync.RWMutex
+	url     string
+	refresh time.Duration
+	log     *slog.Logger
+	client  *http.Client
+	keys    map[string]gjwt.VerificationKey // keyed on kid
+	fetched time.Time                       // the time of the last fetch
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newJwks returns a JWKS cache for a url.
+func newJwks(url string, refresh time.Duration, log *slog.Logger) *jwks {
+	return &jwks{
+		url:     url,
+		refresh: refresh,
+		log:     log,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    map[string]gjwt.VerificationKey{},
+		done:    make(chan struct{}),
+	}
+}
+
+// start fetches the document and starts refreshing it in the background.
+func (j *jwks) start() error {
+	if err := j.fetch(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(j.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.fetch(); err != nil {
+					j.log.Warn("failed to refresh jwks", "url", j.url, "error", err)
+				}
+			case <-j.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stop stops refreshing the document.
+func (j *jwks) stop() {
+	j.once.Do(func() {
+		close(j.done)
+	})
+}
+
+// key returns the key with a key id. If the key id is unknown, the document is fetched
+// again, no more often than jwksMinRefresh.
+func (j *jwks) key(kid string) (gjwt.VerificationKey, bool) {
+	if kid == "" {
+		return nil, false
+	}
+
+	j.RLock()
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetched) > jwksMinRefresh
+	j.RUnlock()
+	if ok || !stale {
+		return key, ok
+	}
+
+	if err := j.fetch(); err != nil {
+		j.log.Warn("failed to refresh jwks", "url", j.url, "error", err)
+		return nil, false
+	}
+
+	j.RLock()
+	defer j.RUnlock()
+	key, ok = j.keys[kid]
+	return key, ok
+}
+
+// all returns every key in the document.
+func (j *jwks) all() []gjwt.VerificationKey {
+	j.RLock()
+	defer j.RUnlock()
+	keys := make([]gjwt.VerificationKey, 0, len(j.keys))
+	for _, k := range j.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// fetch downloads and parses the document, replacing the cached keys.
+func (j *jwks) fetch() error {
+	j.Lock()
+	j.fetched = time.Now()
+	j.Unlock()
+
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks %s: unexpected status %d", j.url, resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]gjwt.VerificationKey, len(doc.Keys))
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			j.log.Warn("skipping jwk", "kid", k.Kid, "error", err)
+			continue
+		}
+
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i) // keys without an id are only used for tokens without one
+		}
+		keys[kid] = key
+	}
+
+	j.Lock()
+	j.keys = keys
+	j.Unlock()
+
+	return nil
+}
+
+// publicKey returns the RSA or ECDSA public key of a jwk.
+func (k jwk) publicKey() (gjwt.VerificationKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, ErrInvalidJwk
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: unsupported curve %q", ErrInvalidJwk, k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("%w: point is not on curve", ErrInvalidJwk)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %q", ErrInvalidJwk, k.Kty)
+	}
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, ErrInvalidJwk
+	}
+	return new(big.Int).SetBytes(b), nil
+}
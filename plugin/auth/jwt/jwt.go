@@ -0,0 +1,416 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package jwt
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gjwt "github.com/golang-jwt/jwt/v5"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const (
+	defaultTopicsClaim = "topics"
+	defaultJwksRefresh = 300 // seconds
+)
+
+var (
+	// ErrNoKey indicates the hook was configured without a secret, public key or jwks url.
+	ErrNoKey = errors.New("jwt auth requires a secret, public-keys or jwks-url")
+
+	// ErrNoPublicKeys indicates a PEM file does not contain any public keys.
+	ErrNoPublicKeys = errors.New("no public keys found")
+
+	// ErrUnknownKey indicates no configured key can verify the signing method of a token.
+	ErrUnknownKey = errors.New("no verification key for token")
+
+	// ErrClaimMismatch indicates a claim of a token does not match the connecting client.
+	ErrClaimMismatch = errors.New("token claim does not match client")
+
+	// ErrTokenExpired is the reason code sent to mqtt v5 clients when their token expires.
+	ErrTokenExpired = packets.Code{Code: packets.ErrMaxConnectTime.Code, Reason: "token expired"}
+)
+
+// Options contains configuration settings for the hook.
+type Options struct {
+	pa.Blacklist
+	Algorithms    []string `json:"algorithms" yaml:"algorithms"`         // accepted signing algorithms, such as HS256 or RS256; any if empty
+	Secret        string   `json:"secret" yaml:"secret"`                 // the HMAC secret
+	PublicKeys    []string `json:"public-keys" yaml:"public-keys"`       // paths of PEM files containing RSA or ECDSA public keys or certificates
+	JwksUrl       string   `json:"jwks-url" yaml:"jwks-url"`             // the url of a JWKS document
+	JwksRefresh   int64    `json:"jwks-refresh" yaml:"jwks-refresh"`     // seconds between JWKS refreshes
+	Issuer        string   `json:"issuer" yaml:"issuer"`                 // the required iss claim, if set
+	Audience      string   `json:"audience" yaml:"audience"`             // the required aud claim, if set
+	Leeway        int64    `json:"leeway" yaml:"leeway"`                 // seconds of clock skew allowed when checking exp and nbf
+	UsernameClaim string   `json:"username-claim" yaml:"username-claim"` // a claim which must match the username, such as sub
+	ClientIDClaim string   `json:"clientid-claim" yaml:"clientid-claim"` // a claim which must match the client id
+	TopicsClaim   string   `json:"topics-claim" yaml:"topics-claim"`     // the claim containing the read and write filters
+}
+
+// topics is the value of the topics claim. Filters may contain %c and %u, which
+// are replaced with the client id and username.
+type topics struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+}
+
+// session is the access granted to a connected client by its token.
+type session struct {
+	read   []string
+	write  []string
+	expiry time.Time   // the time the token expires, including leeway
+	timer  *time.Timer // disconnects the client when the token expires
+}
+
+// Auth is a hook which authenticates clients with a JWT sent as the connect password,
+// granting access to the topic filters listed in the token's claims.
+type Auth struct {
+	mqtt.HookBase
+	config   *Options
+	parser   *gjwt.Parser
+	keys     []gjwt.VerificationKey // public keys loaded from PEM files
+	jwks     *jwks
+	sessions sync.Map // *session, keyed on *mqtt.Client
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-jwt"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init loads the verification keys and fetches the JWKS document, if configured.
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.Secret == "" && len(a.config.PublicKeys) == 0 && a.config.JwksUrl == "" {
+		return ErrNoKey
+	}
+
+	if a.config.TopicsClaim == "" {
+		a.config.TopicsClaim = defaultTopicsClaim
+	}
+
+	for _, path := range a.config.PublicKeys {
+		keys, err := loadPublicKeys(path)
+		if err != nil {
+			return err
+		}
+		a.keys = append(a.keys, keys...)
+	}
+
+	if a.config.JwksUrl != "" {
+		refresh := a.config.JwksRefresh
+		if refresh <= 0 {
+			refresh = defaultJwksRefresh
+		}
+		a.jwks = newJwks(a.config.JwksUrl, time.Duration(refresh)*time.Second, a.Log)
+		if err := a.jwks.start(); err != nil {
+			return err
+		}
+	}
+
+	opts := []gjwt.ParserOption{gjwt.WithLeeway(time.Duration(a.config.Leeway) * time.Second)}
+	if len(a.config.Algorithms) > 0 {
+		opts = append(opts, gjwt.WithValidMethods(a.config.Algorithms))
+	}
+	if a.config.Issuer != "" {
+		opts = append(opts, gjwt.WithIssuer(a.config.Issuer))
+	}
+	if a.config.Audience != "" {
+		opts = append(opts, gjwt.WithAudience(a.config.Audience))
+	}
+	a.parser = gjwt.NewParser(opts...)
+
+	a.Log.Info("", "public-keys", len(a.keys), "jwks-url", a.config.JwksUrl)
+
+	return nil
+}
+
+// Stop stops refreshing the JWKS document and cancels the expiry timers.
+func (a *Auth) Stop() error {
+	if a.jwks != nil {
+		a.jwks.stop()
+	}
+
+	a.sessions.Range(func(k, v any) bool {
+		if v.(*session).timer != nil {
+			v.(*session).timer.Stop()
+		}
+		a.sessions.Delete(k)
+		return true
+	})
+
+	return nil
+}
+
+// Inherit takes over the sessions of a replaced hook, such as when the config is reloaded,
+// so connected clients keep their access until their tokens expire.
+func (a *Auth) Inherit(old mqtt.Hook) {
+	prev, ok := old.(*Auth)
+	if !ok {
+		return
+	}
+
+	prev.sessions.Range(func(k, v any) bool {
+		sess := v.(*session)
+		prev.sessions.Delete(k)
+		if sess.timer != nil {
+			sess.timer.Stop()
+			cl := k.(*mqtt.Client)
+			sess.timer = time.AfterFunc(time.Until(sess.expiry), func() { a.expire(cl) })
+		}
+		a.sessions.Store(k, sess)
+		return true
+	})
+}
+
+// OnConnectAuthenticate returns true if the connect password is a valid token whose claims
+// match the client.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return ok
+	}
+
+	claims := gjwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(string(pk.Connect.Password), claims, a.keyfunc)
+	if err != nil {
+		a.Log.Debug("invalid token", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if err := a.matchClaims(cl, claims); err != nil {
+		a.Log.Debug("invalid token", "client", cl.ID, "error", err)
+		return false
+	}
+
+	sess := a.newSession(cl, claims)
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		sess.expiry = exp.Time.Add(time.Duration(a.config.Leeway) * time.Second)
+		sess.timer = time.AfterFunc(time.Until(sess.expiry), func() { a.expire(cl) })
+	}
+
+	if old, ok := a.sessions.Swap(cl, sess); ok && old.(*session).timer != nil {
+		old.(*session).timer.Stop()
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the topic matches one of the read or write filters granted
+// to the client by its token.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	// check blacklist
+	if n, ok := a.config.CheckBLAcl(cl, topic, write); n >= 0 { // It's on the blacklist
+		return ok
+	}
+
+	v, ok := a.sessions.Load(cl)
+	if !ok {
+		return false
+	}
+
+	filters := v.(*session).read
+	if write {
+		filters = v.(*session).write
+	}
+
+	for _, filter := range filters {
+		if plugin.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OnDisconnect discards the session of the client.
+func (a *Auth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if v, ok := a.sessions.LoadAndDelete(cl); ok && v.(*session).timer != nil {
+		v.(*session).timer.Stop()
+	}
+}
+
+// expire disconnects a client whose token has expired.
+func (a *Auth) expire(cl *mqtt.Client) {
+	if _, ok := a.sessions.LoadAndDelete(cl); !ok {
+		return
+	}
+
+	a.Log.Info("token expired", "client", cl.ID, "remote", cl.Net.Remote)
+	if cl.Properties.ProtocolVersion == 5 {
+		_ = cl.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Disconnect},
+			ReasonCode:  ErrTokenExpired.Code,
+			Properties:  packets.Properties{ReasonString: ErrTokenExpired.Reason},
+		})
+	}
+	cl.Stop(ErrTokenExpired)
+}
+
+// keyfunc returns the key used to verify a token, selected by its signing method.
+func (a *Auth) keyfunc(t *gjwt.Token) (any, error) {
+	if _, ok := t.Method.(*gjwt.SigningMethodHMAC); ok {
+		if a.config.Secret == "" {
+			return nil, ErrUnknownKey
+		}
+		return []byte(a.config.Secret), nil
+	}
+
+	keys := a.keys
+	if a.jwks != nil {
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := a.jwks.key(kid); ok {
+			return key, nil
+		}
+		if kid == "" {
+			keys = append(keys[:len(keys):len(keys)], a.jwks.all()...)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+
+	return gjwt.VerificationKeySet{Keys: keys}, nil
+}
+
+// matchClaims checks the username and client id claims of a token against the client,
+// setting the username of the client from the claim if it connected without one.
+func (a *Auth) matchClaims(cl *mqtt.Client, claims gjwt.MapClaims) error {
+	if a.config.UsernameClaim != "" {
+		v, _ := claims[a.config.UsernameClaim].(string)
+		if v == "" || (len(cl.Properties.Username) > 0 && v != string(cl.Properties.Username)) {
+			return ErrClaimMismatch
+		}
+		cl.Properties.Username = []byte(v)
+	}
+
+	if a.config.ClientIDClaim != "" {
+		if v, _ := claims[a.config.ClientIDClaim].(string); v != cl.ID {
+			return ErrClaimMismatch
+		}
+	}
+
+	return nil
+}
+
+// newSession returns a session holding the filters of the topics claim.
+func (a *Auth) newSession(cl *mqtt.Client, claims gjwt.MapClaims) *session {
+	sess := new(session)
+	v, ok := claims[a.config.TopicsClaim]
+	if !ok {
+		return sess
+	}
+
+	var t topics
+	if b, err := json.Marshal(v); err != nil || json.Unmarshal(b, &t) != nil {
+		a.Log.Debug("invalid topics claim", "client", cl.ID)
+		return sess
+	}
+
+	sess.read = expandFilters(t.Read, cl)
+	sess.write = expandFilters(t.Write, cl)
+
+	return sess
+}
+
+// expandFilters replaces %c and %u in each filter with the client id and username. Filters
+// are dropped if the substituted value could change the levels of the filter.
+func expandFilters(filters []string, cl *mqtt.Client) []string {
+	out := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if strings.Contains(f, "%c") {
+			if !validLevel(cl.ID) {
+				continue
+			}
+			f = strings.ReplaceAll(f, "%c", cl.ID)
+		}
+
+		if strings.Contains(f, "%u") {
+			if !validLevel(string(cl.Properties.Username)) {
+				continue
+			}
+			f = strings.ReplaceAll(f, "%u", string(cl.Properties.Username))
+		}
+
+		out = append(out, f)
+	}
+
+	return out
+}
+
+// validLevel returns true if a value can be substituted into a single topic level.
+func validLevel(v string) bool {
+	return v != "" && !strings.ContainsAny(v, "+#/")
+}
+
+// loadPublicKeys returns the public keys of each PUBLIC KEY, RSA PUBLIC KEY or CERTIFICATE
+// block in a PEM file.
+func loadPublicKeys(path string) ([]gjwt.VerificationKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []gjwt.VerificationKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key any
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoPublicKeys, path)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,362 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gjwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const testSecret = "comqtt"
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newTestAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() { _ = a.Stop() })
+	return a
+}
+
+func newTestClient(id, username string) *mqtt.Client {
+	return &mqtt.Client{
+		ID: id,
+		Properties: mqtt.ClientProperties{
+			Username: []byte(username),
+		},
+	}
+}
+
+func signToken(t *testing.T, method gjwt.SigningMethod, key any, kid string, claims gjwt.MapClaims) []byte {
+	token := gjwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return []byte(s)
+}
+
+func connectPacket(password []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			PasswordFlag: true,
+			Password:     password,
+		},
+	}
+}
+
+func writePem(t *testing.T, typ string, b []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600))
+	return path
+}
+
+func TestID(t *testing.T) {
+	a := new(Auth)
+	require.Equal(t, "auth-jwt", a.ID())
+}
+
+func TestProvides(t *testing.T) {
+	a := new(Auth)
+	require.True(t, a.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, a.Provides(mqtt.OnACLCheck))
+	require.True(t, a.Provides(mqtt.OnDisconnect))
+	require.False(t, a.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoKey)
+	require.Error(t, a.Init(&Options{PublicKeys: []string{filepath.Join(t.TempDir(), "missing.pem")}}))
+	require.ErrorIs(t, a.Init(&Options{PublicKeys: []string{writePem(t, "PRIVATE KEY", []byte{1})}}), ErrNoPublicKeys)
+
+	opts := &Options{Secret: testSecret}
+	require.NoError(t, a.Init(opts))
+	require.Equal(t, defaultTopicsClaim, opts.TopicsClaim)
+}
+
+func TestOnConnectAuthenticateHMAC(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret, Algorithms: []string{"HS256"}, Issuer: "comqtt"})
+	exp := time.Now().Add(time.Hour).Unix()
+
+	cl := newTestClient("c1", "u1")
+	pk := connectPacket(signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"iss": "comqtt", "exp": exp}))
+	require.True(t, a.OnConnectAuthenticate(cl, pk))
+
+	pk = connectPacket(signToken(t, gjwt.SigningMethodHS256, []byte("wrong"), "", gjwt.MapClaims{"iss": "comqtt", "exp": exp}))
+	require.False(t, a.OnConnectAuthenticate(cl, pk))
+
+	pk = connectPacket(signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"iss": "other", "exp": exp}))
+	require.False(t, a.OnConnectAuthenticate(cl, pk))
+
+	pk = connectPacket(signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"iss": "comqtt", "exp": time.Now().Add(-time.Minute).Unix()}))
+	require.False(t, a.OnConnectAuthenticate(cl, pk))
+
+	pk = connectPacket(signToken(t, gjwt.SigningMethodHS384, []byte(testSecret), "", gjwt.MapClaims{"iss": "comqtt", "exp": exp}))
+	require.False(t, a.OnConnectAuthenticate(cl, pk))
+
+	require.False(t, a.OnConnectAuthenticate(cl, connectPacket([]byte("not-a-token"))))
+}
+
+func TestOnConnectAuthenticateClaims(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret, UsernameClaim: "sub", ClientIDClaim: "cid"})
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"sub": "u1", "cid": "c1"})
+
+	cl := newTestClient("c1", "")
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(token)))
+	require.Equal(t, []byte("u1"), cl.Properties.Username)
+
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", "u1"), connectPacket(token)))
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c1", "u2"), connectPacket(token)))
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c2", "u1"), connectPacket(token)))
+}
+
+func TestOnConnectAuthenticateBlacklist(t *testing.T) {
+	opts := &Options{Secret: testSecret}
+	opts.SetBlacklist(&auth.Ledger{
+		Auth: auth.AuthRules{
+			{Client: "banned", Allow: false},
+		},
+	})
+	a := newTestAuth(t, opts)
+
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{})
+	require.False(t, a.OnConnectAuthenticate(newTestClient("banned", ""), connectPacket(token)))
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(token)))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret})
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{
+		"topics": map[string]any{
+			"read":  []string{"devices/%c/#", "public/+"},
+			"write": []string{"users/%u/out"},
+		},
+	})
+
+	cl := newTestClient("c1", "u1")
+	require.False(t, a.OnACLCheck(cl, "devices/c1/in", false))
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(token)))
+
+	require.True(t, a.OnACLCheck(cl, "devices/c1/in", false))
+	require.True(t, a.OnACLCheck(cl, "public/news", false))
+	require.False(t, a.OnACLCheck(cl, "devices/c2/in", false))
+	require.False(t, a.OnACLCheck(cl, "devices/c1/in", true))
+	require.True(t, a.OnACLCheck(cl, "users/u1/out", true))
+	require.False(t, a.OnACLCheck(cl, "users/u2/out", true))
+
+	a.OnDisconnect(cl, nil, false)
+	require.False(t, a.OnACLCheck(cl, "devices/c1/in", false))
+}
+
+func TestOnACLCheckNoTopics(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret})
+	cl := newTestClient("c1", "u1")
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"topics": "invalid"})
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(token)))
+	require.False(t, a.OnACLCheck(cl, "a/b", false))
+	require.False(t, a.OnACLCheck(cl, "a/b", true))
+}
+
+func TestExpandFilters(t *testing.T) {
+	filters := []string{"devices/%c/#", "users/%u/#", "fixed/#"}
+	require.Empty(t, expandFilters(nil, newTestClient("c1", "u1")))
+	require.Equal(t, []string{"devices/c1/#", "users/u1/#", "fixed/#"}, expandFilters(filters, newTestClient("c1", "u1")))
+	require.Equal(t, []string{"users/u1/#", "fixed/#"}, expandFilters(filters, newTestClient("c/#", "u1")))
+	require.Equal(t, []string{"devices/c1/#", "fixed/#"}, expandFilters(filters, newTestClient("c1", "")))
+	require.Equal(t, []string{"devices/c1/#", "fixed/#"}, expandFilters(filters, newTestClient("c1", "+")))
+}
+
+func TestPublicKeysRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	a := newTestAuth(t, &Options{PublicKeys: []string{writePem(t, "PUBLIC KEY", der)}})
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(signToken(t, gjwt.SigningMethodRS256, key, "", gjwt.MapClaims{}))))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(signToken(t, gjwt.SigningMethodRS256, other, "", gjwt.MapClaims{}))))
+
+	// without a secret, HMAC tokens are rejected rather than verified with the public key
+	require.False(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(signToken(t, gjwt.SigningMethodHS256, der, "", gjwt.MapClaims{}))))
+}
+
+func TestPublicKeysPKCS1(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keys, err := loadPublicKeys(writePem(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)))
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, &key.PublicKey, keys[0])
+}
+
+func TestPublicKeysECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	a := newTestAuth(t, &Options{Secret: testSecret, PublicKeys: []string{writePem(t, "PUBLIC KEY", der)}})
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(signToken(t, gjwt.SigningMethodES256, key, "", gjwt.MapClaims{}))))
+	require.True(t, a.OnConnectAuthenticate(newTestClient("c1", ""), connectPacket(signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{}))))
+}
+
+func encodeBigInt(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestJwks(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	var rotated atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []jwk{
+			{Kty: "RSA", Kid: "rsa1", Use: "sig", N: encodeBigInt(rsaKey.N.Bytes()), E: encodeBigInt([]byte{1, 0, 1})},
+			{Kty: "oct", Kid: "ignored"},
+		}
+		if rotated.Load() {
+			keys = append(keys, jwk{Kty: "EC", Kid: "ec1", Crv: "P-256", X: encodeBigInt(ecKey.X.Bytes()), Y: encodeBigInt(ecKey.Y.Bytes())})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, &Options{JwksUrl: srv.URL})
+	require.Equal(t, int32(1), fetches.Load())
+	require.Len(t, a.jwks.all(), 1)
+
+	cl := newTestClient("c1", "")
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(signToken(t, gjwt.SigningMethodRS256, rsaKey, "rsa1", gjwt.MapClaims{}))))
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(signToken(t, gjwt.SigningMethodRS256, rsaKey, "", gjwt.MapClaims{}))))
+
+	// unknown key ids are refetched, but no more often than jwksMinRefresh
+	rotated.Store(true)
+	require.False(t, a.OnConnectAuthenticate(cl, connectPacket(signToken(t, gjwt.SigningMethodES256, ecKey, "ec1", gjwt.MapClaims{}))))
+	require.Equal(t, int32(1), fetches.Load())
+
+	a.jwks.fetched = time.Now().Add(-jwksMinRefresh * 2)
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(signToken(t, gjwt.SigningMethodES256, ecKey, "ec1", gjwt.MapClaims{}))))
+	require.Equal(t, int32(2), fetches.Load())
+}
+
+func TestJwksFetchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.Error(t, a.Init(&Options{JwksUrl: srv.URL}))
+}
+
+func TestJwkPublicKey(t *testing.T) {
+	_, err := jwk{Kty: "EC", Crv: "P-192"}.publicKey()
+	require.ErrorIs(t, err, ErrInvalidJwk)
+	_, err = jwk{Kty: "EC", Crv: "P-256", X: encodeBigInt([]byte{1}), Y: encodeBigInt([]byte{1})}.publicKey()
+	require.ErrorIs(t, err, ErrInvalidJwk)
+	_, err = jwk{Kty: "RSA", N: "", E: "AQAB"}.publicKey()
+	require.ErrorIs(t, err, ErrInvalidJwk)
+	_, err = jwk{Kty: "oct"}.publicKey()
+	require.ErrorIs(t, err, ErrInvalidJwk)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret})
+
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	r, w := net.Pipe()
+	defer r.Close()
+	cl := s.NewClient(w, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+
+	exp := time.Now().Add(time.Second).Unix()
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"exp": exp})
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(token)))
+
+	buf := make([]byte, 64)
+	require.NoError(t, r.SetReadDeadline(time.Now().Add(3*time.Second)))
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Greater(t, n, 2)
+	require.Equal(t, packets.Disconnect<<4, buf[0])
+	require.Equal(t, ErrTokenExpired.Code, buf[2])
+
+	require.Eventually(t, cl.Closed, time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, cl.StopCause(), ErrTokenExpired)
+	_, ok := a.sessions.Load(cl)
+	require.False(t, ok)
+}
+
+func TestTokenExpiryStoppedOnDisconnect(t *testing.T) {
+	a := newTestAuth(t, &Options{Secret: testSecret})
+	cl := newTestClient("c1", "")
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+	require.True(t, a.OnConnectAuthenticate(cl, connectPacket(token)))
+
+	v, ok := a.sessions.Load(cl)
+	require.True(t, ok)
+	a.OnDisconnect(cl, nil, false)
+	require.False(t, v.(*session).timer.Stop()) // already stopped
+}
+
+func TestInherit(t *testing.T) {
+	old := newTestAuth(t, &Options{Secret: testSecret})
+	token := signToken(t, gjwt.SigningMethodHS256, []byte(testSecret), "", gjwt.MapClaims{
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"topics": map[string]any{"read": []string{"a/#"}},
+	})
+	cl := newTestClient("c1", "")
+	require.True(t, old.OnConnectAuthenticate(cl, connectPacket(token)))
+
+	a := newTestAuth(t, &Options{Secret: "rotated"})
+	a.Inherit(new(mqtt.HookBase))
+	require.False(t, a.OnACLCheck(cl, "a/b", false))
+
+	a.Inherit(old)
+	require.True(t, a.OnACLCheck(cl, "a/b", false))
+	require.False(t, old.OnACLCheck(cl, "a/b", false))
+
+	v, ok := a.sessions.Load(cl)
+	require.True(t, ok)
+	require.True(t, v.(*session).timer.Stop()) // rescheduled on the new hook
+}
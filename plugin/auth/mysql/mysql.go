@@ -2,6 +2,8 @@ package mysql
 
 import (
 	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -150,6 +152,18 @@ func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	return pa.CompareHash(password, string(pk.Connect.Password), a.config.Auth.HashKey, a.config.Auth.PasswordHash)
 }
 
+// StoredPassword returns the stored password of a user who is allowed to connect.
+func (a *Auth) StoredPassword(username string) (string, error) {
+	var password string
+	var allow int
+	err := a.authStmt.QueryRowx(username).Scan(&password, &allow)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && allow == 0) {
+		return "", pa.ErrCredentialNotFound
+	}
+
+	return password, err
+}
+
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
 // or publish to a given topic.
 func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
@@ -161,6 +161,27 @@ func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	return pa.CompareHash(string(ar.Password), string(pk.Connect.Password), a.config.HashKey, a.config.PasswordHash)
 }
 
+// StoredPassword returns the stored password of a user who is allowed to connect.
+func (a *Auth) StoredPassword(username string) (string, error) {
+	res, err := a.db.HGet(context.Background(), a.getAuthKey(), username).Result()
+	if err == redis.Nil || (err == nil && res == "") {
+		return "", pa.ErrCredentialNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	var ar auth.AuthRule
+	if err = json.Unmarshal([]byte(res), &ar); err != nil {
+		return "", err
+	}
+
+	if !ar.Allow {
+		return "", pa.ErrCredentialNotFound
+	}
+
+	return string(ar.Password), nil
+}
+
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
 // or publish to a given topic.
 func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
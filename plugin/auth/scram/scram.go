@@ -0,0 +1,258 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+// Method is the mqtt v5 authentication method handled by the hook.
+const Method = "SCRAM-SHA-256"
+
+// ErrNoStore indicates the hook was added without a credential store.
+var ErrNoStore = errors.New("scram auth requires a credential store")
+
+// Options contains configuration settings for the hook.
+type Options struct {
+	Store   pa.CredentialStore // looks up the SCRAM-SHA-256 secret of a user, such as an auth backend hook
+	MockKey []byte             // the server secret from which the salts of unknown users are derived, random if empty
+}
+
+// Auth is a hook which authenticates clients with SCRAM-SHA-256 (RFC 5802, RFC 7677) using
+// mqtt v5 enhanced authentication, so passwords are never sent to the server. It handles
+// both the initial exchange and re-authentication.
+type Auth struct {
+	mqtt.HookBase
+	config   *Options
+	sessions sync.Map      // exchanges in progress, keyed on *mqtt.Client
+	nonce    func() string // returns a new server nonce
+	mockKey  []byte        // derives the salts of unknown users
+}
+
+// session is the state of an exchange between the server-first and client-final messages.
+type session struct {
+	username        string
+	header          string // the gs2 header of the client-first message
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	secret          *pa.ScramSecret
+	mock            bool // the user is unknown, so the exchange fails at the client-final message
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-scram"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnAuthPacket,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with a credential store.
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil || config.(*Options).Store == nil {
+		return ErrNoStore
+	}
+
+	a.config = config.(*Options)
+	if a.nonce == nil {
+		a.nonce = newNonce
+	}
+
+	a.mockKey = a.config.MockKey
+	if len(a.mockKey) == 0 {
+		a.mockKey = make([]byte, sha256.Size)
+		if _, err := rand.Read(a.mockKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnAuthPacket performs a step of a SCRAM-SHA-256 exchange. Packets using other
+// authentication methods are returned unchanged.
+func (a *Auth) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.Properties.AuthenticationMethod != Method {
+		return pk, nil
+	}
+
+	if pk.FixedHeader.Type == packets.Connect || pk.ReasonCode == packets.CodeReAuthenticate.Code {
+		return a.serverFirst(cl, pk)
+	}
+
+	return a.serverFinal(cl, pk)
+}
+
+// OnDisconnect discards any exchange in progress for the client.
+func (a *Auth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	a.sessions.Delete(cl)
+}
+
+// serverFirst looks up the user of a client-first message and returns the salt, iteration
+// count and combined nonce to the client.
+func (a *Auth) serverFirst(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	msg := string(pk.Properties.AuthenticationData)
+	cbflag, rest, _ := strings.Cut(msg, ",")
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok || (cbflag != "n" && cbflag != "y") || authzid != "" { // channel binding and authzid are not supported
+		return pk, packets.ErrNotAuthorized
+	}
+
+	attrs := parseAttributes(bare)
+	username, cnonce := decodeName(attrs["n"]), attrs["r"]
+	if username == "" || cnonce == "" {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	if len(cl.Properties.Username) > 0 && username != string(cl.Properties.Username) {
+		return pk, packets.ErrNotAuthorized // the connect username and re-authentication must be for the same user
+	}
+
+	var secret *pa.ScramSecret
+	stored, err := a.config.Store.StoredPassword(username)
+	if err == nil {
+		secret, err = pa.ParseScramSecret(stored)
+		if err != nil {
+			a.Log.Warn("stored password is not a scram-sha-256 secret", "username", username)
+		}
+	} else if !errors.Is(err, pa.ErrCredentialNotFound) {
+		a.Log.Error("failed to look up credential", "error", err, "username", username)
+		return pk, packets.ErrNotAuthorized
+	}
+
+	s := &session{
+		username:        username,
+		header:          cbflag + ",,",
+		clientFirstBare: bare,
+		nonce:           cnonce + a.nonce(),
+		secret:          secret,
+	}
+
+	if secret == nil { // an unknown user gets the same response as a known user (RFC 5802 section 9)
+		s.mock = true
+		s.secret = &pa.ScramSecret{
+			Iterations: pa.ScramSha256Iterations,
+			Salt:       hmacSha256(a.mockKey, []byte(username))[:16],
+		}
+	}
+
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.secret.Salt) + ",i=" + strconv.Itoa(s.secret.Iterations)
+	a.sessions.Store(cl, s)
+
+	return authPacket(packets.CodeContinueAuthentication, s.serverFirst), nil
+}
+
+// serverFinal verifies the proof of a client-final message and returns the server signature.
+func (a *Auth) serverFinal(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	v, ok := a.sessions.LoadAndDelete(cl)
+	if !ok {
+		return pk, packets.ErrNotAuthorized
+	}
+	s := v.(*session)
+
+	msg := string(pk.Properties.AuthenticationData)
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	withoutProof := msg[:i]
+	attrs := parseAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.header)) || attrs["r"] != s.nonce {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientKey := hmacSha256(s.secret.StoredKey, authMessage) // the client signature
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+
+	if s.mock {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.secret.StoredKey) {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	cl.Properties.Username = []byte(s.username) // for username based acl checks
+	signature := hmacSha256(s.secret.ServerKey, authMessage)
+	return authPacket(packets.CodeSuccess, "v="+base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// authPacket returns an auth response containing a scram message.
+func authPacket(code packets.Code, msg string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Auth,
+		},
+		ReasonCode: code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: Method,
+			AuthenticationData:   []byte(msg),
+		},
+	}
+}
+
+// parseAttributes returns the attributes of a scram message, such as r=nonce.
+func parseAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && len(k) == 1 {
+			if _, exists := attrs[k]; !exists {
+				attrs[k] = v
+			}
+		}
+	}
+	return attrs
+}
+
+// decodeName decodes the escaped commas and equals signs of a saslname.
+func decodeName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// newNonce returns a random printable nonce.
+func newNonce() string {
+	b := make([]byte, 18)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hmacSha256(key, src []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(src)
+	return m.Sum(nil)
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package scram
+
+import (
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+// RFC 7677 section 3 test vector.
+const (
+	testClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	testServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	testServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	testClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	testServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+type testStore map[string]string
+
+func (s testStore) StoredPassword(username string) (string, error) {
+	if v, ok := s[username]; ok {
+		return v, nil
+	}
+	return "", pa.ErrCredentialNotFound
+}
+
+func newTestAuth(t *testing.T) *Auth {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+	secret, err := pa.NewScramSecret("pencil", salt, 4096)
+	require.NoError(t, err)
+
+	a := &Auth{nonce: func() string { return testServerNonce }}
+	a.SetOpts(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	require.NoError(t, a.Init(&Options{Store: testStore{"user": secret.String(), "plain": "pencil"}}))
+	return a
+}
+
+func testPacket(fh byte, code packets.Code, msg string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: fh},
+		ReasonCode:  code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: Method,
+			AuthenticationData:   []byte(msg),
+		},
+	}
+}
+
+func TestID(t *testing.T) {
+	a := new(Auth)
+	require.Equal(t, "auth-scram", a.ID())
+}
+
+func TestProvides(t *testing.T) {
+	a := new(Auth)
+	require.True(t, a.Provides(mqtt.OnAuthPacket))
+	require.True(t, a.Provides(mqtt.OnDisconnect))
+	require.False(t, a.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	a := new(Auth)
+	require.ErrorIs(t, a.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(nil), ErrNoStore)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoStore)
+	require.NoError(t, a.Init(&Options{Store: testStore{}}))
+	require.NotEmpty(t, a.nonce())
+}
+
+func TestExchange(t *testing.T) {
+	a := newTestAuth(t)
+	cl := new(mqtt.Client)
+
+	res, err := a.OnAuthPacket(cl, testPacket(packets.Connect, packets.CodeSuccess, testClientFirst))
+	require.NoError(t, err)
+	require.Equal(t, packets.Auth, res.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, res.ReasonCode)
+	require.Equal(t, testServerFirst, string(res.Properties.AuthenticationData))
+
+	res, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, testClientFinal))
+	require.NoError(t, err)
+	require.Equal(t, packets.CodeSuccess.Code, res.ReasonCode)
+	require.Equal(t, testServerFinal, string(res.Properties.AuthenticationData))
+	require.Equal(t, []byte("user"), cl.Properties.Username)
+
+	// re-authentication
+	res, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeReAuthenticate, testClientFirst))
+	require.NoError(t, err)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, res.ReasonCode)
+	res, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, testClientFinal))
+	require.NoError(t, err)
+	require.Equal(t, packets.CodeSuccess.Code, res.ReasonCode)
+}
+
+func TestExchangeBadProof(t *testing.T) {
+	a := newTestAuth(t)
+	cl := new(mqtt.Client)
+
+	_, err := a.OnAuthPacket(cl, testPacket(packets.Connect, packets.CodeSuccess, testClientFirst))
+	require.NoError(t, err)
+
+	final := testClientFinal[:len(testClientFinal)-5] + "AAAA="
+	_, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, final))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+
+	// the exchange is discarded after a failure
+	_, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, testClientFinal))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
+
+func TestExchangeFailures(t *testing.T) {
+	tt := []struct {
+		desc string
+		msg  string
+	}{
+		{desc: "channel binding", msg: "p=tls-unique,,n=user,r=abc"},
+		{desc: "authzid", msg: "n,a=admin,n=user,r=abc"},
+		{desc: "no nonce", msg: "n,,n=user"},
+		{desc: "malformed", msg: "hello"},
+	}
+
+	a := newTestAuth(t)
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			_, err := a.OnAuthPacket(new(mqtt.Client), testPacket(packets.Connect, packets.CodeSuccess, tx.msg))
+			require.ErrorIs(t, err, packets.ErrNotAuthorized)
+		})
+	}
+}
+
+func TestExchangeUnknownUser(t *testing.T) {
+	a := newTestAuth(t)
+
+	tt := []struct {
+		desc     string
+		username string
+	}{
+		{desc: "unknown user", username: "nobody"},
+		{desc: "not a scram secret", username: "plain"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			cl := new(mqtt.Client)
+			res, err := a.OnAuthPacket(cl, testPacket(packets.Connect, packets.CodeSuccess, "n,,n="+tx.username+",r=abc"))
+			require.NoError(t, err)
+			require.Equal(t, packets.CodeContinueAuthentication.Code, res.ReasonCode)
+
+			// the salt and iterations of a user are the same on each attempt
+			attrs := parseAttributes(string(res.Properties.AuthenticationData))
+			require.Equal(t, "4096", attrs["i"])
+			salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+			require.NoError(t, err)
+			require.Len(t, salt, 16)
+
+			again, err := a.OnAuthPacket(new(mqtt.Client), testPacket(packets.Connect, packets.CodeSuccess, "n,,n="+tx.username+",r=abc"))
+			require.NoError(t, err)
+			require.Equal(t, res.Properties.AuthenticationData, again.Properties.AuthenticationData)
+
+			// the exchange fails at the client-final message
+			final := "c=biws,r=abc" + testServerNonce + ",p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+			_, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, final))
+			require.ErrorIs(t, err, packets.ErrNotAuthorized)
+		})
+	}
+
+	// the salts are derived from the mock key
+	b := &Auth{nonce: func() string { return testServerNonce }}
+	b.SetOpts(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	require.NoError(t, b.Init(&Options{Store: testStore{}, MockKey: []byte("secret")}))
+	c := &Auth{nonce: func() string { return testServerNonce }}
+	c.SetOpts(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	require.NoError(t, c.Init(&Options{Store: testStore{}, MockKey: []byte("secret")}))
+	r1, err := b.OnAuthPacket(new(mqtt.Client), testPacket(packets.Connect, packets.CodeSuccess, "n,,n=nobody,r=abc"))
+	require.NoError(t, err)
+	r2, err := c.OnAuthPacket(new(mqtt.Client), testPacket(packets.Connect, packets.CodeSuccess, "n,,n=nobody,r=abc"))
+	require.NoError(t, err)
+	require.Equal(t, r1.Properties.AuthenticationData, r2.Properties.AuthenticationData)
+}
+
+func TestExchangeUsernameMismatch(t *testing.T) {
+	a := newTestAuth(t)
+	cl := new(mqtt.Client)
+	cl.Properties.Username = []byte("other")
+
+	_, err := a.OnAuthPacket(cl, testPacket(packets.Connect, packets.CodeSuccess, testClientFirst))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
+
+func TestOtherMethod(t *testing.T) {
+	a := newTestAuth(t)
+	pk := testPacket(packets.Connect, packets.CodeSuccess, testClientFirst)
+	pk.Properties.AuthenticationMethod = "SCRAM-SHA-1"
+
+	res, err := a.OnAuthPacket(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, res)
+}
+
+func TestOnDisconnect(t *testing.T) {
+	a := newTestAuth(t)
+	cl := new(mqtt.Client)
+
+	_, err := a.OnAuthPacket(cl, testPacket(packets.Connect, packets.CodeSuccess, testClientFirst))
+	require.NoError(t, err)
+	a.OnDisconnect(cl, nil, true)
+
+	_, err = a.OnAuthPacket(cl, testPacket(packets.Auth, packets.CodeContinueAuthentication, testClientFinal))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
@@ -0,0 +1,278 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+const (
+	frameMethod     = 1
+	frameHeader     = 2
+	frameBody       = 3
+	frameEnd        = 0xce
+	flagContentType = 0x8000
+)
+
+type published struct {
+	exchange    string
+	key         string
+	contentType string
+	body        []byte
+}
+
+// server is an in-process amqp 0-9-1 broker which speaks enough of the protocol to record
+// declared exchanges and published messages.
+type server struct {
+	sync.Mutex
+	ln        net.Listener
+	exchanges []string
+	msgs      []published
+	conns     []net.Conn
+}
+
+func newServer(t *testing.T) *server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *server) url() string {
+	return "amqp://guest:guest@" + s.ln.Addr().String() + "/"
+}
+
+// drop closes the open client connections.
+func (s *server) drop() {
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *server) published() []published {
+	s.Lock()
+	defer s.Unlock()
+	return append([]published(nil), s.msgs...)
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	// connection.start with no server properties, plain auth and en_US
+	start := new(bytes.Buffer)
+	start.Write([]byte{0, 9})
+	putLong(start, 0)
+	putLongStr(start, "PLAIN")
+	putLongStr(start, "en_US")
+	writeMethod(conn, 0, 10, 10, start.Bytes())
+
+	var pub *published
+	for {
+		typ, channel, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case frameMethod:
+			class := binary.BigEndian.Uint16(payload[0:2])
+			method := binary.BigEndian.Uint16(payload[2:4])
+			args := payload[4:]
+			switch {
+			case class == 10 && method == 11: // connection.start-ok
+				tune := new(bytes.Buffer)
+				_ = binary.Write(tune, binary.BigEndian, uint16(0))
+				putLong(tune, 131072)
+				_ = binary.Write(tune, binary.BigEndian, uint16(0))
+				writeMethod(conn, 0, 10, 30, tune.Bytes())
+			case class == 10 && method == 40: // connection.open
+				writeMethod(conn, 0, 10, 41, []byte{0})
+			case class == 10 && method == 50: // connection.close
+				writeMethod(conn, 0, 10, 51, nil)
+				return
+			case class == 20 && method == 10: // channel.open
+				writeMethod(conn, channel, 20, 11, []byte{0, 0, 0, 0})
+			case class == 20 && method == 40: // channel.close
+				writeMethod(conn, channel, 20, 41, nil)
+			case class == 40 && method == 10: // exchange.declare
+				name, _ := shortStr(args[2:])
+				s.Lock()
+				s.exchanges = append(s.exchanges, name)
+				s.Unlock()
+				writeMethod(conn, channel, 40, 11, nil)
+			case class == 60 && method == 40: // basic.publish
+				exchange, rest := shortStr(args[2:])
+				key, _ := shortStr(rest)
+				pub = &published{exchange: exchange, key: key}
+			}
+		case frameHeader:
+			flags := binary.BigEndian.Uint16(payload[12:14])
+			if flags&flagContentType > 0 {
+				pub.contentType, _ = shortStr(payload[14:])
+			}
+			if binary.BigEndian.Uint64(payload[4:12]) == 0 {
+				s.record(pub)
+			}
+		case frameBody:
+			pub.body = append(pub.body, payload...)
+			s.record(pub)
+		}
+	}
+}
+
+func (s *server) record(pub *published) {
+	s.Lock()
+	defer s.Unlock()
+	s.msgs = append(s.msgs, *pub)
+}
+
+func readFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	head := make([]byte, 7)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[3:7])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return head[0], binary.BigEndian.Uint16(head[1:3]), payload[:len(payload)-1], nil
+}
+
+func writeMethod(w io.Writer, channel, class, method uint16, args []byte) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(frameMethod)
+	_ = binary.Write(buf, binary.BigEndian, channel)
+	putLong(buf, uint32(4+len(args)))
+	_ = binary.Write(buf, binary.BigEndian, class)
+	_ = binary.Write(buf, binary.BigEndian, method)
+	buf.Write(args)
+	buf.WriteByte(frameEnd)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func putLong(buf *bytes.Buffer, v uint32) {
+	_ = binary.Write(buf, binary.BigEndian, v)
+}
+
+func putLongStr(buf *bytes.Buffer, s string) {
+	putLong(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func shortStr(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+func newBridge(t *testing.T, s *server, opts *Options) *Bridge {
+	if opts.AmqpOptions == nil {
+		opts.AmqpOptions = new(amqpOptions)
+	}
+	opts.AmqpOptions.URL = s.url()
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(opts))
+	t.Cleanup(func() { _ = b.Stop() })
+	return b
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "bridge-amqp", new(Bridge).ID())
+}
+
+func TestInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.Error(t, b.Init(&Options{AmqpOptions: &amqpOptions{URL: "amqp://127.0.0.1:1/"}}))
+}
+
+func TestEvents(t *testing.T) {
+	s := newServer(t)
+	opts := &Options{}
+	b := newBridge(t, s, opts)
+	require.Equal(t, defaultExchange, opts.AmqpOptions.Exchange)
+	require.Equal(t, defaultExchangeType, opts.AmqpOptions.ExchangeType)
+
+	cl := &mqtt.Client{ID: "c1"}
+	b.OnSessionEstablished(cl, packets.Packet{})
+	b.OnPublished(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hi")})
+
+	require.Eventually(t, func() bool { return len(s.published()) == 2 }, time.Second, 10*time.Millisecond)
+	msgs := s.published()
+	require.Equal(t, "comqtt", msgs[0].exchange)
+	require.Equal(t, bridge.Connect, msgs[0].key)
+	require.Equal(t, "application/json", msgs[0].contentType)
+	require.Equal(t, bridge.Publish, msgs[1].key)
+
+	var m bridge.Message
+	require.NoError(t, m.UnmarshalBinary(msgs[1].body))
+	require.Equal(t, []string{"a/b"}, m.Topics)
+	require.Equal(t, []byte("hi"), m.Payload)
+
+	s.Lock()
+	require.Equal(t, []string{"comqtt"}, s.exchanges)
+	s.Unlock()
+}
+
+func TestSend(t *testing.T) {
+	s := newServer(t)
+	b := newBridge(t, s, &Options{AmqpOptions: &amqpOptions{Exchange: "rules"}})
+	require.NoError(t, b.Send("sensors/1/temp", []byte(`{"t":1}`)))
+
+	require.Eventually(t, func() bool { return len(s.published()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, published{exchange: "rules", key: "sensors.1.temp", body: []byte(`{"t":1}`)}, s.published()[0])
+}
+
+func TestReconnect(t *testing.T) {
+	s := newServer(t)
+	b := newBridge(t, s, &Options{})
+
+	s.drop()
+	require.Eventually(t, func() bool { return b.conn.IsClosed() }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, b.Send("a", []byte("x")))
+	require.Eventually(t, func() bool { return len(s.published()) == 1 }, time.Second, 10*time.Millisecond)
+	s.Lock()
+	require.Len(t, s.exchanges, 2)
+	s.Unlock()
+}
@@ -0,0 +1,352 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const defaultBatchSize = 100
+
+// ErrUnknownEvent indicates an event is not one of the bridged actions.
+var ErrUnknownEvent = errors.New("unknown bridge event")
+
+// defaultEvents are the actions bridged if no events are configured.
+var defaultEvents = []string{Connect, Disconnect, Publish, Subscribe, Unsubscribe}
+
+// hookEvents are the hook methods which produce each action.
+var hookEvents = map[string]byte{
+	Connect:     mqtt.OnSessionEstablished,
+	Disconnect:  mqtt.OnDisconnect,
+	Publish:     mqtt.OnPublished,
+	Delivered:   mqtt.OnPacketSent,
+	Subscribe:   mqtt.OnSubscribed,
+	Unsubscribe: mqtt.OnUnsubscribed,
+}
+
+// Options contains the settings shared by the bridges built on the core.
+type Options struct {
+	Events    []string `json:"events" yaml:"events"`         // connect, disconnect, publish, delivered, subscribe and unsubscribe; all but delivered if empty
+	Rules     Rules    `json:"rules" yaml:"rules"`           // the topics and filters which are bridged
+	QueueSize int      `json:"queue-size" yaml:"queue-size"` // records buffered for a background writer, 0 writes in the hook
+	BatchSize int      `json:"batch-size" yaml:"batch-size"` // most records in one buffered write, defaults to 100
+}
+
+// Rules selects the messages which are bridged.
+type Rules struct {
+	Topics  []string `json:"topics" yaml:"topics"`   // publish topics, wildcard(#、+) is supported, empty indicate unrestricted
+	Filters []string `json:"filters" yaml:"filters"` // subscribe/unsubscribe filters, wildcard(#、+) is supported, empty indicate unrestricted
+}
+
+// Record is an encoded message ready to be written to a sink.
+type Record struct {
+	Key     []byte   // the client or packet id with the timestamp, or the topic of a sent payload
+	Value   []byte   // the json message, or a sent payload
+	Action  string   // the action of the message, empty for sent payloads
+	Topic   string   // the mqtt topic of a sent payload
+	Message *Message // the bridged message, nil for sent payloads
+}
+
+// WriteFunc writes records to a sink.
+type WriteFunc func(records []Record) error
+
+// Core turns client events into messages, selects them with the rules and writes them to a
+// sink, directly or through a buffer. Bridges embed it and call Start from their Init.
+type Core struct {
+	mqtt.HookBase
+	opts    *Options
+	events  map[byte]bool
+	write   WriteFunc
+	queue   chan Record
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+}
+
+// Provides indicates which hook methods the bridge provides, according to its events.
+func (c *Core) Provides(b byte) bool {
+	if c.events == nil {
+		return bytes.Contains([]byte{
+			mqtt.OnSessionEstablished,
+			mqtt.OnDisconnect,
+			mqtt.OnPublished,
+			mqtt.OnSubscribed,
+			mqtt.OnUnsubscribed,
+		}, []byte{b})
+	}
+	return c.events[b]
+}
+
+// Start validates the options, applying their defaults, and starts the background writer if
+// the queue is enabled.
+func (c *Core) Start(opts *Options, write WriteFunc) error {
+	if len(opts.Events) == 0 {
+		opts.Events = defaultEvents
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	events := make(map[byte]bool, len(opts.Events))
+	for _, e := range opts.Events {
+		b, ok := hookEvents[e]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, e)
+		}
+		events[b] = true
+	}
+
+	c.opts = opts
+	c.events = events
+	c.write = write
+	if opts.QueueSize > 0 {
+		c.queue = make(chan Record, opts.QueueSize)
+		c.done = make(chan struct{})
+		c.wg.Add(1)
+		go c.run()
+	}
+
+	return nil
+}
+
+// Close writes the buffered records and stops the background writer. Bridges call it from
+// Stop before closing their sink.
+func (c *Core) Close() {
+	if c.done != nil {
+		close(c.done)
+		c.wg.Wait()
+		c.done = nil
+	}
+}
+
+// Dropped returns the number of records which could not be buffered or written.
+func (c *Core) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Send writes a payload to the sink, keyed by its mqtt topic. It lets the rule engine use the
+// bridge as a sink.
+func (c *Core) Send(topic string, payload []byte) error {
+	return c.write([]Record{{Key: []byte(topic), Value: payload, Topic: topic}})
+}
+
+// OnSessionEstablished is called when a new client establishes a session (after OnConnect).
+func (c *Core) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	timestamp := genTimestamp(pk.Created)
+	c.emit(genKey(cl.ID, timestamp), Message{
+		Action:          Connect,
+		ClientID:        cl.ID,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        string(cl.Properties.Username),
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Timestamp:       timestamp,
+	})
+}
+
+// OnDisconnect is called when a client is disconnected for any reason.
+func (c *Core) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	timestamp := time.Now().Unix()
+	msg := Message{
+		Action:    Disconnect,
+		ClientID:  cl.ID,
+		Username:  string(cl.Properties.Username),
+		Remote:    cl.Net.Remote,
+		Listener:  cl.Net.Listener,
+		Timestamp: timestamp,
+	}
+	if err != nil {
+		msg.Payload = []byte(err.Error())
+	}
+	c.emit(genKey(cl.ID, timestamp), msg)
+}
+
+// OnPublished is called when a client has published a message to subscribers.
+func (c *Core) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	c.message(Publish, cl, pk)
+}
+
+// OnPacketSent is called when a packet has been sent to a client, and bridges delivered messages.
+func (c *Core) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		c.message(Delivered, cl, pk)
+	}
+}
+
+// OnSubscribed is called when a client subscribes to one or more filters.
+func (c *Core) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	c.subscriptions(Subscribe, cl, pk, reasonCodes)
+}
+
+// OnUnsubscribed is called when a client unsubscribes from one or more filters.
+func (c *Core) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	c.subscriptions(Unsubscribe, cl, pk, reasonCodes)
+}
+
+// message emits a publish or delivered message if its topic matches the rules.
+func (c *Core) message(action string, cl *mqtt.Client, pk packets.Packet) {
+	if !match(c.opts.Rules.Topics, pk.TopicName) {
+		return
+	}
+
+	timestamp := genTimestamp(pk.Created)
+	c.emit(genKey(fmt.Sprint(pk.PacketID), timestamp), Message{
+		Action:    action,
+		ClientID:  cl.ID,
+		Username:  string(cl.Properties.Username),
+		Topics:    []string{pk.TopicName},
+		Payload:   pk.Payload,
+		Timestamp: timestamp,
+		PacketID:  pk.PacketID,
+	})
+}
+
+// subscriptions emits a subscribe or unsubscribe message with the filters matching the rules.
+func (c *Core) subscriptions(action string, cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	filters := make([]string, 0, len(pk.Filters))
+	codes := make([]byte, 0, len(pk.Filters))
+	for i, sub := range pk.Filters {
+		if match(c.opts.Rules.Filters, sub.Filter) {
+			filters = append(filters, sub.Filter)
+			if i < len(reasonCodes) {
+				codes = append(codes, reasonCodes[i])
+			}
+		}
+	}
+	if len(filters) == 0 {
+		return
+	}
+
+	timestamp := genTimestamp(pk.Created)
+	c.emit(genKey(fmt.Sprint(pk.PacketID), timestamp), Message{
+		Action:      action,
+		ClientID:    cl.ID,
+		Username:    string(cl.Properties.Username),
+		Topics:      filters,
+		ReasonCodes: codes,
+		Timestamp:   timestamp,
+		PacketID:    pk.PacketID,
+	})
+}
+
+// emit encodes a message and writes it, or buffers it if the queue is enabled.
+func (c *Core) emit(key []byte, msg Message) {
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		c.Log.Error("bridge:encode", "error", err, "action", msg.Action)
+		return
+	}
+
+	r := Record{Key: key, Value: data, Action: msg.Action, Message: &msg}
+	if c.queue == nil {
+		if err := c.write([]Record{r}); err != nil {
+			c.dropped.Add(1)
+			c.Log.Error("bridge:write", "error", err, "action", msg.Action)
+		}
+		return
+	}
+
+	select {
+	case c.queue <- r:
+	default:
+		c.dropped.Add(1)
+		c.Log.Warn("bridge queue is full, dropped message", "action", msg.Action, "client", msg.ClientID)
+	}
+}
+
+// run writes buffered records in batches until the core is closed.
+func (c *Core) run() {
+	defer c.wg.Done()
+	batch := make([]Record, 0, c.opts.BatchSize)
+	for {
+		select {
+		case r := <-c.queue:
+			batch = append(batch[:0], r)
+		fill:
+			for len(batch) < c.opts.BatchSize {
+				select {
+				case r := <-c.queue:
+					batch = append(batch, r)
+				default:
+					break fill
+				}
+			}
+			c.flush(batch)
+		case <-c.done:
+			batch = batch[:0]
+			for {
+				select {
+				case r := <-c.queue:
+					batch = append(batch, r)
+					if len(batch) == c.opts.BatchSize {
+						c.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					c.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes a batch of records.
+func (c *Core) flush(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := c.write(batch); err != nil {
+		c.dropped.Add(uint64(len(batch)))
+		c.Log.Error("bridge:write", "error", err, "records", len(batch))
+	}
+}
+
+// match returns true if a topic or filter matches one of the rules, or there are no rules.
+func match(rules []string, topic string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, r := range rules {
+		if plugin.MatchTopic(r, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// DottedTopic converts an mqtt topic to a dot separated subject or routing key, such as a.b.c
+// for a/b/c.
+func DottedTopic(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
+
+func genKey(id string, timestamp int64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	buf.WriteString("-")
+	buf.WriteString(fmt.Sprint(timestamp))
+	return buf.Bytes()
+}
+
+func genTimestamp(created int64) int64 {
+	if created == 0 {
+		created = time.Now().Unix()
+	}
+	return created
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"gopkg.in/yaml.v3"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// sink records the batches written to it.
+type sink struct {
+	sync.Mutex
+	batches [][]Record
+	err     error
+}
+
+func (s *sink) write(records []Record) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, append([]Record(nil), records...))
+	return nil
+}
+
+func (s *sink) records() []Record {
+	s.Lock()
+	defer s.Unlock()
+	var rs []Record
+	for _, b := range s.batches {
+		rs = append(rs, b...)
+	}
+	return rs
+}
+
+func newCore(t *testing.T, opts *Options) (*Core, *sink) {
+	c := new(Core)
+	c.SetOpts(logger, nil)
+	s := new(sink)
+	require.NoError(t, c.Start(opts, s.write))
+	t.Cleanup(c.Close)
+	return c, s
+}
+
+func decode(t *testing.T, r Record) Message {
+	var m Message
+	require.NoError(t, m.UnmarshalBinary(r.Value))
+	return m
+}
+
+var client = &mqtt.Client{
+	ID: "c1",
+	Net: mqtt.ClientConnection{
+		Remote:   "127.0.0.1:1883",
+		Listener: "tcp",
+	},
+	Properties: mqtt.ClientProperties{
+		Username:        []byte("u1"),
+		ProtocolVersion: 5,
+	},
+}
+
+func TestProvides(t *testing.T) {
+	c := new(Core)
+	require.True(t, c.Provides(mqtt.OnSessionEstablished))
+	require.True(t, c.Provides(mqtt.OnPublished))
+	require.False(t, c.Provides(mqtt.OnPacketSent))
+
+	c, _ = newCore(t, &Options{Events: []string{Delivered}})
+	require.True(t, c.Provides(mqtt.OnPacketSent))
+	require.False(t, c.Provides(mqtt.OnPublished))
+}
+
+func TestStart(t *testing.T) {
+	opts := &Options{}
+	newCore(t, opts)
+	require.Equal(t, defaultEvents, opts.Events)
+	require.Equal(t, defaultBatchSize, opts.BatchSize)
+
+	err := new(Core).Start(&Options{Events: []string{"retained"}}, nil)
+	require.ErrorIs(t, err, ErrUnknownEvent)
+}
+
+func TestOptionsInline(t *testing.T) {
+	var opts struct {
+		Options `yaml:",inline"`
+		Stream  string `yaml:"stream"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte("stream: s\nevents: [publish]\nrules:\n  topics: [a/#]\n"), &opts))
+	require.Equal(t, "s", opts.Stream)
+	require.Equal(t, []string{Publish}, opts.Events)
+	require.Equal(t, []string{"a/#"}, opts.Rules.Topics)
+}
+
+func TestEvents(t *testing.T) {
+	c, s := newCore(t, &Options{
+		Events: []string{Connect, Disconnect, Publish, Delivered, Subscribe, Unsubscribe},
+		Rules:  Rules{Topics: []string{"sensors/#"}, Filters: []string{"sensors/#"}},
+	})
+
+	c.OnSessionEstablished(client, packets.Packet{Created: 1700000000})
+	c.OnPublished(client, packets.Packet{TopicName: "sensors/1", Payload: []byte("hi"), PacketID: 7, Created: 1700000000})
+	c.OnPublished(client, packets.Packet{TopicName: "other/1"})
+	c.OnPacketSent(client, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "sensors/2"}, nil)
+	c.OnPacketSent(client, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}}, nil)
+	c.OnSubscribed(client, packets.Packet{Filters: packets.Subscriptions{{Filter: "sensors/+"}, {Filter: "other/#"}}}, []byte{1, 0}, []int{1, 1})
+	c.OnUnsubscribed(client, packets.Packet{Filters: packets.Subscriptions{{Filter: "other/#"}}}, []byte{0}, []int{0})
+	c.OnDisconnect(client, errors.New("gone"), false)
+
+	rs := s.records()
+	require.Len(t, rs, 5)
+
+	require.Equal(t, []byte("c1-1700000000"), rs[0].Key)
+	require.Equal(t, Connect, rs[0].Action)
+	require.Equal(t, Message{
+		Action:          Connect,
+		ClientID:        "c1",
+		Username:        "u1",
+		Remote:          "127.0.0.1:1883",
+		Listener:        "tcp",
+		ProtocolVersion: 5,
+		Timestamp:       1700000000,
+	}, decode(t, rs[0]))
+
+	require.Equal(t, []byte("7-1700000000"), rs[1].Key)
+	m := decode(t, rs[1])
+	require.Equal(t, Publish, m.Action)
+	require.Equal(t, []string{"sensors/1"}, m.Topics)
+	require.Equal(t, []byte("hi"), m.Payload)
+
+	require.Equal(t, Delivered, rs[2].Action)
+	require.Equal(t, []string{"sensors/2"}, decode(t, rs[2]).Topics)
+
+	m = decode(t, rs[3])
+	require.Equal(t, Subscribe, m.Action)
+	require.Equal(t, []string{"sensors/+"}, m.Topics)
+	require.Equal(t, []byte{1}, m.ReasonCodes)
+
+	m = decode(t, rs[4])
+	require.Equal(t, Disconnect, m.Action)
+	require.Equal(t, "tcp", m.Listener)
+	require.Equal(t, []byte("gone"), m.Payload)
+}
+
+func TestSend(t *testing.T) {
+	c, s := newCore(t, &Options{})
+	require.NoError(t, c.Send("a/b", []byte("x")))
+	require.Equal(t, []Record{{Key: []byte("a/b"), Value: []byte("x"), Topic: "a/b"}}, s.records())
+}
+
+func TestWriteError(t *testing.T) {
+	c, s := newCore(t, &Options{})
+	s.err = errors.New("down")
+	c.OnSessionEstablished(client, packets.Packet{})
+	require.Equal(t, uint64(1), c.Dropped())
+}
+
+func TestQueue(t *testing.T) {
+	c, s := newCore(t, &Options{QueueSize: 10, BatchSize: 2})
+	for i := 0; i < 5; i++ {
+		c.OnSessionEstablished(client, packets.Packet{})
+	}
+	require.Eventually(t, func() bool { return len(s.records()) == 5 }, time.Second, 10*time.Millisecond)
+	s.Lock()
+	for _, b := range s.batches {
+		require.LessOrEqual(t, len(b), 2)
+	}
+	s.Unlock()
+}
+
+func TestQueueFull(t *testing.T) {
+	c := new(Core)
+	c.SetOpts(logger, nil)
+	s := new(sink)
+	c.opts = &Options{BatchSize: 1}
+	c.write = s.write
+	c.queue = make(chan Record, 1) // not running, so the queue is never drained
+
+	c.OnSessionEstablished(client, packets.Packet{})
+	c.OnSessionEstablished(client, packets.Packet{})
+	require.Equal(t, uint64(1), c.Dropped())
+}
+
+func TestCloseFlushes(t *testing.T) {
+	c := new(Core)
+	c.SetOpts(logger, nil)
+	s := new(sink)
+	require.NoError(t, c.Start(&Options{QueueSize: 100, BatchSize: 3}, s.write))
+	for i := 0; i < 7; i++ {
+		c.OnDisconnect(client, nil, false)
+	}
+	c.Close()
+	require.Len(t, s.records(), 7)
+	c.Close()
+}
+
+func TestDottedTopic(t *testing.T) {
+	require.Equal(t, "a.b.c", DottedTopic("a/b/c"))
+}
@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	defaultGroupID       = "comqtt"
+	defaultIngressTopic  = "${key}"
+	inlineListener       = "bridge"
+	ingressRetryInterval = time.Second
+)
+
+// The record headers which set the mqtt topic, qos and retain flag of an ingress message,
+// in place of the ingress options.
+const (
+	HeaderTopic  = "mqtt-topic"
+	HeaderQos    = "mqtt-qos"
+	HeaderRetain = "mqtt-retain"
+)
+
+// The start offsets of a consumer group without committed offsets.
+const (
+	OffsetEarliest = "earliest"
+	OffsetLatest   = "latest"
+)
+
+// ErrServerNotSet indicates SetServer was not called before a bridge with an ingress was added.
+var ErrServerNotSet = errors.New("kafka bridge ingress requires the server to be set before it is added")
+
+// IngressOptions configures the consumer which publishes kafka records to mqtt subscribers.
+type IngressOptions struct {
+	Brokers        []string `json:"brokers" yaml:"brokers"`                 // defaults to the brokers of kafka-options
+	GroupID        string   `json:"group-id" yaml:"group-id"`               // the consumer group, defaults to comqtt
+	Topics         []string `json:"topics" yaml:"topics"`                   // the kafka topics which are consumed
+	StartOffset    string   `json:"start-offset" yaml:"start-offset"`       // earliest or latest (default), used if the group has no committed offset
+	Topic          string   `json:"topic" yaml:"topic"`                     // mqtt topic template of ${key}, ${topic}, ${partition} and ${header.name}, defaults to ${key}
+	Qos            byte     `json:"qos" yaml:"qos"`                         // the qos of published messages
+	Retain         bool     `json:"retain" yaml:"retain"`                   // the retain flag of published messages
+	UserProperties bool     `json:"user-properties" yaml:"user-properties"` // the other record headers are published as mqtt v5 user properties
+}
+
+type abstractReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// validate checks the ingress options, applying their defaults.
+func (o *IngressOptions) validate(brokers []string) error {
+	if len(o.Topics) == 0 {
+		return fmt.Errorf("%w: ingress requires at least one topic", ErrInvalidOptions)
+	}
+	if o.Qos > 2 {
+		return fmt.Errorf("%w: ingress qos %d", ErrInvalidOptions, o.Qos)
+	}
+
+	switch o.StartOffset {
+	case "":
+		o.StartOffset = OffsetLatest
+	case OffsetEarliest, OffsetLatest:
+	default:
+		return fmt.Errorf("%w: unknown ingress start-offset %q", ErrInvalidOptions, o.StartOffset)
+	}
+
+	if len(o.Brokers) == 0 {
+		o.Brokers = brokers
+	}
+	if o.GroupID == "" {
+		o.GroupID = defaultGroupID
+	}
+	if o.Topic == "" {
+		o.Topic = defaultIngressTopic
+	}
+	return nil
+}
+
+// SetServer sets the server which ingress messages are published to. It must be called
+// before a bridge with an ingress is added.
+func (b *Bridge) SetServer(server *mqtt.Server) {
+	b.server = server
+}
+
+// Provides indicates which hook methods the bridge provides.
+func (b *Bridge) Provides(bt byte) bool {
+	return (bt == mqtt.OnStarted && b.reader != nil) || b.Core.Provides(bt)
+}
+
+// OnStarted starts consuming the ingress topics once the server is running.
+func (b *Bridge) OnStarted() {
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	b.consumers.Add(1)
+	go b.consume(ctx)
+}
+
+// OnPublished bridges a published message, unless it was published by the ingress.
+func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if b.inline != nil && cl == b.inline {
+		return
+	}
+	b.Core.OnPublished(cl, pk)
+}
+
+// initIngress prepares the consumer group reader and the client which publishes its records.
+func (b *Bridge) initIngress() error {
+	if b.server == nil {
+		return ErrServerNotSet
+	}
+
+	o := b.config.Ingress
+	if err := o.validate(b.config.KafkaOptions.Brokers); err != nil {
+		return err
+	}
+
+	startOffset := kafka.LastOffset
+	if o.StartOffset == OffsetEarliest {
+		startOffset = kafka.FirstOffset
+	}
+
+	b.inline = b.server.NewClient(nil, inlineListener, b.ID(), true)
+	b.inline.Properties.ProtocolVersion = 5
+	b.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     o.Brokers,
+		GroupID:     o.GroupID,
+		GroupTopics: o.Topics,
+		StartOffset: startOffset,
+		ErrorLogger: newKafkaLogger(b.Log),
+	})
+
+	b.Log.Info("consuming kafka topics", "topics", o.Topics, "group", o.GroupID)
+	return nil
+}
+
+// stopIngress stops the consumer and closes the reader.
+func (b *Bridge) stopIngress() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	err := b.reader.Close()
+	b.consumers.Wait()
+	return err
+}
+
+// consume publishes each record of the ingress topics, committing its offset once it has
+// been delivered to the subscribers.
+func (b *Bridge) consume(ctx context.Context) {
+	defer b.consumers.Done()
+	for {
+		m, err := b.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			b.Log.Warn("cannot fetch kafka message", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ingressRetryInterval):
+			}
+			continue
+		}
+
+		if err := b.deliver(m); err != nil {
+			// a record which cannot be published never will be, so its offset is still committed
+			b.Log.Warn("cannot publish kafka message", "error", err, "topic", m.Topic, "partition", m.Partition, "offset", m.Offset)
+		}
+
+		if err := b.reader.CommitMessages(ctx, m); err != nil && ctx.Err() == nil {
+			b.Log.Warn("cannot commit kafka offset", "error", err, "topic", m.Topic, "partition", m.Partition, "offset", m.Offset)
+		}
+	}
+}
+
+// deliver publishes a kafka record to the mqtt subscribers of its topic.
+func (b *Bridge) deliver(m kafka.Message) error {
+	pk, err := b.packet(m)
+	if err != nil {
+		return err
+	}
+	return b.server.InjectPacket(b.inline, pk)
+}
+
+// packet returns the publish packet of a kafka record, taking the topic, qos and retain
+// flag from its headers or the ingress options.
+func (b *Bridge) packet(m kafka.Message) (packets.Packet, error) {
+	o := b.config.Ingress
+	fields := map[string]string{
+		"key":       string(m.Key),
+		"topic":     m.Topic,
+		"partition": strconv.Itoa(m.Partition),
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    o.Qos,
+			Retain: o.Retain,
+		},
+		Payload: m.Value,
+	}
+
+	for _, h := range m.Headers {
+		fields["header."+h.Key] = string(h.Value)
+		switch h.Key {
+		case HeaderTopic:
+			pk.TopicName = string(h.Value)
+		case HeaderQos:
+			qos, err := strconv.ParseUint(string(h.Value), 10, 8)
+			if err != nil || qos > 2 {
+				return pk, fmt.Errorf("invalid %s header %q", HeaderQos, h.Value)
+			}
+			pk.FixedHeader.Qos = byte(qos)
+		case HeaderRetain:
+			retain, err := strconv.ParseBool(string(h.Value))
+			if err != nil {
+				return pk, fmt.Errorf("invalid %s header %q", HeaderRetain, h.Value)
+			}
+			pk.FixedHeader.Retain = retain
+		default:
+			if o.UserProperties {
+				pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: h.Key, Val: string(h.Value)})
+			}
+		}
+	}
+
+	if pk.TopicName == "" {
+		pk.TopicName = render(o.Topic, fields)
+	}
+	if pk.TopicName == "" || !mqtt.IsValidFilter(pk.TopicName, true) {
+		return pk, fmt.Errorf("invalid mqtt topic %q", pk.TopicName)
+	}
+
+	pk.PacketID = uint16(pk.FixedHeader.Qos) // as with Server.Publish, a packet id is only needed for validity checks.
+	return pk, nil
+}
@@ -0,0 +1,191 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// mockReader returns the messages sent to it, and records the order of deliveries and commits.
+type mockReader struct {
+	msgs   chan kafka.Message
+	mu     sync.Mutex
+	events []string
+}
+
+func newMockReader() *mockReader {
+	return &mockReader{msgs: make(chan kafka.Message, 10)}
+}
+
+func (m *mockReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-m.msgs:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (m *mockReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		m.record(fmt.Sprint("commit ", msg.Offset))
+	}
+	return nil
+}
+
+func (m *mockReader) Close() error {
+	return nil
+}
+
+func (m *mockReader) record(event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *mockReader) recorded() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.events...)
+}
+
+func newIngressServer(t *testing.T) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{
+		Logger:       logger,
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	return s
+}
+
+func newIngressBridge(t *testing.T, s *mqtt.Server, ingress *IngressOptions) (*Bridge, *mockReader) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.SetServer(s)
+	require.NoError(t, b.Init(&Options{
+		KafkaOptions: &kafkaOptions{Brokers: []string{"127.0.0.1:1"}},
+		Ingress:      ingress,
+	}))
+	require.NoError(t, b.reader.Close())
+	reader := newMockReader()
+	b.reader = reader
+	b.writer = newMockWriter()
+	t.Cleanup(func() { _ = b.Stop() })
+	return b, reader
+}
+
+func TestIngressInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	opts := &Options{
+		KafkaOptions: &kafkaOptions{Brokers: []string{"127.0.0.1:1"}},
+		Ingress:      &IngressOptions{Topics: []string{"commands"}},
+	}
+	require.ErrorIs(t, b.Init(opts), ErrServerNotSet)
+
+	b.SetServer(newIngressServer(t))
+	for _, o := range []*IngressOptions{
+		{},
+		{Topics: []string{"commands"}, Qos: 3},
+		{Topics: []string{"commands"}, StartOffset: "newest"},
+	} {
+		opts.Ingress = o
+		require.ErrorIs(t, b.Init(opts), ErrInvalidOptions, o)
+	}
+}
+
+func TestIngressDefaults(t *testing.T) {
+	o := &IngressOptions{Topics: []string{"commands"}}
+	b, _ := newIngressBridge(t, newIngressServer(t), o)
+	require.Equal(t, []string{"127.0.0.1:1"}, o.Brokers)
+	require.Equal(t, defaultGroupID, o.GroupID)
+	require.Equal(t, OffsetLatest, o.StartOffset)
+	require.Equal(t, defaultIngressTopic, o.Topic)
+	require.True(t, b.Provides(mqtt.OnStarted))
+	require.True(t, b.Provides(mqtt.OnPublished))
+	require.False(t, new(Bridge).Provides(mqtt.OnStarted))
+}
+
+func TestIngressPacket(t *testing.T) {
+	b, _ := newIngressBridge(t, newIngressServer(t), &IngressOptions{
+		Topics:         []string{"commands"},
+		Topic:          "devices/${key}/${header.kind}",
+		Qos:            1,
+		UserProperties: true,
+	})
+
+	pk, err := b.packet(kafka.Message{
+		Topic:   "commands",
+		Key:     []byte("d1"),
+		Value:   []byte("reboot"),
+		Headers: []kafka.Header{{Key: "kind", Value: []byte("cmd")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "devices/d1/cmd", pk.TopicName)
+	require.Equal(t, []byte("reboot"), pk.Payload)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.False(t, pk.FixedHeader.Retain)
+	require.Equal(t, []packets.UserProperty{{Key: "kind", Val: "cmd"}}, pk.Properties.User)
+
+	pk, err = b.packet(kafka.Message{
+		Key: []byte("d1"),
+		Headers: []kafka.Header{
+			{Key: HeaderTopic, Value: []byte("a/b")},
+			{Key: HeaderQos, Value: []byte("0")},
+			{Key: HeaderRetain, Value: []byte("true")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, byte(0), pk.FixedHeader.Qos)
+	require.True(t, pk.FixedHeader.Retain)
+	require.Empty(t, pk.Properties.User)
+
+	for _, headers := range [][]kafka.Header{
+		{{Key: HeaderQos, Value: []byte("3")}},
+		{{Key: HeaderRetain, Value: []byte("maybe")}},
+		{{Key: HeaderTopic, Value: []byte("a/#")}},
+		{{Key: HeaderTopic, Value: []byte("$SYS/broker/uptime")}},
+		{{Key: HeaderTopic, Value: []byte("$sys/broker/uptime")}},
+	} {
+		_, err = b.packet(kafka.Message{Key: []byte("d1"), Headers: headers})
+		require.Error(t, err, headers)
+	}
+}
+
+func TestIngress(t *testing.T) {
+	s := newIngressServer(t)
+	b, reader := newIngressBridge(t, s, &IngressOptions{Topics: []string{"commands"}})
+
+	require.NoError(t, s.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		reader.record(fmt.Sprint("deliver ", pk.TopicName, " ", string(pk.Payload)))
+	}))
+
+	b.OnStarted()
+	reader.msgs <- kafka.Message{Key: []byte("devices/d1"), Value: []byte("on"), Offset: 1}
+	reader.msgs <- kafka.Message{Value: []byte("no topic"), Offset: 2}
+	reader.msgs <- kafka.Message{Key: []byte("devices/d2"), Value: []byte("off"), Offset: 3}
+
+	require.Eventually(t, func() bool { return len(reader.recorded()) == 5 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{
+		"deliver devices/d1 on",
+		"commit 1",
+		"commit 2",
+		"deliver devices/d2 off",
+		"commit 3",
+	}, reader.recorded())
+
+	// ingress messages are not bridged back to kafka
+	b.OnPublished(b.inline, packets.Packet{TopicName: "devices/d1"})
+	require.Equal(t, 0, b.writer.(*mockWriter).count())
+	b.OnPublished(client, packets.Packet{TopicName: "devices/d1"})
+	require.Equal(t, 1, b.writer.(*mockWriter).count())
+}
@@ -5,33 +5,34 @@
 package kafka
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/wind-c/comqtt/v2/mqtt"
-	"github.com/wind-c/comqtt/v2/mqtt/packets"
-	"github.com/wind-c/comqtt/v2/plugin"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
 )
 
 const defaultAddr = "localhost:9092"
 const defaultTopic = "comqtt"
+const defaultSpoolInterval = 5 // seconds
 
+// ErrInvalidOptions indicates the kafka bridge options are invalid.
+var ErrInvalidOptions = errors.New("invalid kafka bridge options")
+
+// The actions of bridged messages.
 const (
-	//Connect mqtt connect
-	Connect = "connect"
-	//Publish mqtt publish
-	Publish = "publish"
-	//Subscribe mqtt sub
-	Subscribe = "subscribe"
-	//Unsubscribe mqtt sub
-	Unsubscribe = "unsubscribe"
-	//Disconnect mqtt disconenct
-	Disconnect = "disconnect"
+	Connect     = bridge.Connect
+	Publish     = bridge.Publish
+	Subscribe   = bridge.Subscribe
+	Unsubscribe = bridge.Unsubscribe
+	Disconnect  = bridge.Disconnect
 )
 
 const (
@@ -42,52 +43,33 @@ const (
 )
 
 // Message kafka publish message
-type Message struct {
-	Action          string   `json:"action"`
-	ClientID        string   `json:"clientid"`                  // the client id
-	Username        string   `json:"username"`                  // the username of the client
-	Remote          string   `json:"remote,omitempty"`          // the remote address of the client
-	Listener        string   `json:"listener,omitempty"`        // the listener the client connected on
-	Topics          []string `json:"topics,omitempty"`          // publish topic or subscribe/unsubscribe filters
-	reasonCodes     []byte   `json:"reasonCodes,omitempty"`     // subscribe/unsubscribe filters success(0) or failure(>0x80) code
-	Payload         []byte   `json:"payload,omitempty"`         // publish payload
-	ProtocolVersion byte     `json:"protocolVersion,omitempty"` // mqtt protocol version of the client
-	Clean           bool     `json:"clean,omitempty"`           // if the client requested a clean start/session
-	Timestamp       int64    `json:"ts"`                        // event time
-	PacketID        uint16   `json:"packetid,omitempty"`        // the packet id
-}
-
-// MarshalBinary encodes the values into a json string.
-func (d Message) MarshalBinary() (data []byte, err error) {
-	return json.Marshal(d)
-}
-
-// UnmarshalBinary decodes a json string into a struct.
-func (d *Message) UnmarshalBinary(data []byte) error {
-	if len(data) == 0 {
-		return nil
-	}
-	return json.Unmarshal(data, d)
-}
+type Message = bridge.Message
 
 type Options struct {
-	KafkaOptions *kafkaOptions `json:"kafka-options" yaml:"kafka-options"`
-	Rules        rules         `json:"rules" yaml:"rules"`
+	bridge.Options `yaml:",inline"`
+	KafkaOptions   *kafkaOptions   `json:"kafka-options" yaml:"kafka-options"`
+	Mappings       []Mapping       `json:"mappings" yaml:"mappings"` // the first matching mapping selects the topic, key and encoding of a message
+	Ingress        *IngressOptions `json:"ingress" yaml:"ingress"`   // kafka topics which are published to mqtt subscribers, nil disables
 }
 
 type kafkaOptions struct {
-	Brokers      []string `json:"brokers" yaml:"brokers"`
-	Topic        string   `json:"topic" yaml:"topic"`
-	Balancer     byte     `json:"balancer" yaml:"balancer"` // 0 LeastBytes、1 RoundRobin、2 Hash、3 CRC32Balancer
-	Async        bool     `json:"async" yaml:"async"`
-	RequiredAcks byte     `json:"required-acks" yaml:"required-acks"` // 0 None、1 Leader、-1 All
-	Compression  byte     `json:"compression" yaml:"compression"`     // 0 Node、1 Gzip、2 Snappy、3 Lz4、4 Zstd
-	WriteTimeout int      `json:"write-timeout" yaml:"write-timeout"` // defaults to 10 seconds
+	Brokers       []string `json:"brokers" yaml:"brokers"`
+	Topic         string   `json:"topic" yaml:"topic"`
+	Balancer      byte     `json:"balancer" yaml:"balancer"` // 0 LeastBytes、1 RoundRobin、2 Hash、3 CRC32Balancer
+	Async         bool     `json:"async" yaml:"async"`
+	RequiredAcks  byte     `json:"required-acks" yaml:"required-acks"`   // 0 None、1 Leader、-1 All
+	Compression   byte     `json:"compression" yaml:"compression"`       // 0 Node、1 Gzip、2 Snappy、3 Lz4、4 Zstd
+	WriteTimeout  int      `json:"write-timeout" yaml:"write-timeout"`   // defaults to 10 seconds
+	SpoolDir      string   `json:"spool-dir" yaml:"spool-dir"`           // messages are buffered here while kafka is unreachable and replayed in order, empty disables; requires async false and a queue-size
+	SpoolLimit    int      `json:"spool-limit" yaml:"spool-limit"`       // maximum number of buffered messages, 0 is unlimited
+	SpoolInterval int      `json:"spool-interval" yaml:"spool-interval"` // seconds between replays of the spool, defaults to 5
 }
 
-type rules struct {
-	Topics  []string `json:"topics" yaml:"topics"`
-	Filters []string `json:"filters" yaml:"filters"`
+// spooledMessage is a kafka message waiting to be replayed.
+type spooledMessage struct {
+	Topic string `json:"topic"`
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
 }
 
 type abstractWriter interface {
@@ -95,11 +77,22 @@ type abstractWriter interface {
 	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
 }
 
+// Bridge is a hook which writes client events to kafka topics.
 type Bridge struct {
-	mqtt.HookBase
+	bridge.Core
+	mu     sync.Mutex // serializes writes and replays while spooling
 	config *Options
 	writer abstractWriter
+	spool  *bridge.Spool[spooledMessage]
+	done   chan struct{}
+	wg     sync.WaitGroup
 	ctx    context.Context // a context for the connection
+
+	server    *mqtt.Server
+	inline    *mqtt.Client // the client which publishes ingress messages
+	reader    abstractReader
+	cancel    context.CancelFunc
+	consumers sync.WaitGroup
 }
 
 // ID returns the ID of the hook.
@@ -107,17 +100,6 @@ func (b *Bridge) ID() string {
 	return "bridge-kafka"
 }
 
-// Provides indicates which hook methods this hook provides.
-func (b *Bridge) Provides(bt byte) bool {
-	return bytes.Contains([]byte{
-		mqtt.OnSessionEstablished,
-		mqtt.OnDisconnect,
-		mqtt.OnPublished,
-		mqtt.OnSubscribed,
-		mqtt.OnUnsubscribed,
-	}, []byte{bt})
-}
-
 func (b *Bridge) Init(config any) error {
 	if _, ok := config.(*Options); !ok && config != nil {
 		return mqtt.ErrInvalidConfigType
@@ -135,6 +117,18 @@ func (b *Bridge) Init(config any) error {
 	}
 
 	b.config = config.(*Options)
+	if b.config.KafkaOptions == nil {
+		b.config.KafkaOptions = &kafkaOptions{Brokers: []string{defaultAddr}}
+	}
+	if b.config.KafkaOptions.Topic == "" {
+		b.config.KafkaOptions.Topic = defaultTopic
+	}
+	for i := range b.config.Mappings {
+		if err := b.config.Mappings[i].validate(); err != nil {
+			return err
+		}
+	}
+
 	b.Log.Info("connecting to kafka service",
 		"brokers", strings.Join(b.config.KafkaOptions.Brokers, ","),
 		"topic", b.config.KafkaOptions.Topic,
@@ -157,7 +151,6 @@ func (b *Bridge) Init(config any) error {
 	logger := newKafkaLogger(b.Log)
 	b.writer = &kafka.Writer{
 		Addr:                   kafka.TCP(b.config.KafkaOptions.Brokers...),
-		Topic:                  b.config.KafkaOptions.Topic,
 		Async:                  b.config.KafkaOptions.Async,
 		RequiredAcks:           kafka.RequiredAcks(b.config.KafkaOptions.RequiredAcks),
 		Compression:            kafka.Compression(b.config.KafkaOptions.Compression),
@@ -175,6 +168,46 @@ func (b *Bridge) Init(config any) error {
 		b.Log.Error("connected to kafka service", "error", err)
 	}
 
+	if b.config.KafkaOptions.SpoolDir != "" {
+		if err := b.openSpool(); err != nil {
+			return err
+		}
+	}
+
+	if b.config.Ingress != nil {
+		if err := b.initIngress(); err != nil {
+			return err
+		}
+	}
+
+	return b.Start(&b.config.Options, b.write)
+}
+
+// openSpool opens the spool and starts replaying it.
+func (b *Bridge) openSpool() error {
+	o := b.config.KafkaOptions
+	if o.Async {
+		return fmt.Errorf("%w: the spool requires async false, use queue-size for background writes", ErrInvalidOptions)
+	}
+	if b.config.QueueSize <= 0 {
+		return fmt.Errorf("%w: the spool requires a queue-size, so that hooks are not blocked while kafka is unreachable", ErrInvalidOptions)
+	}
+	if o.SpoolInterval <= 0 {
+		o.SpoolInterval = defaultSpoolInterval
+	}
+
+	sp, err := bridge.NewSpool[spooledMessage](filepath.Join(o.SpoolDir, "kafka.spool"), o.SpoolLimit)
+	if err != nil {
+		return err
+	}
+	b.spool = sp
+	if n := sp.Len(); n > 0 {
+		b.Log.Info("replaying spooled kafka messages", "messages", n)
+	}
+
+	b.done = make(chan struct{})
+	b.wg.Add(1)
+	go b.replay(time.Duration(o.SpoolInterval) * time.Second)
 	return nil
 }
 
@@ -202,6 +235,17 @@ func (b *Bridge) kafkaTopics() (map[string]struct{}, error) {
 // Stop closes the kafka connection.
 func (b *Bridge) Stop() error {
 	b.Log.Info("disconnecting from kafka service")
+	if b.reader != nil {
+		if err := b.stopIngress(); err != nil {
+			b.Log.Warn("cannot close kafka reader", "error", err)
+		}
+	}
+	b.Close()
+	if b.done != nil {
+		close(b.done)
+		b.wg.Wait()
+		b.done = nil
+	}
 	return b.writer.Close()
 }
 
@@ -215,203 +259,90 @@ func (b *Bridge) handler(messages []kafka.Message, err error) {
 	}
 }
 
-func (b *Bridge) checkTopic(topic string) bool {
-	if b.config.Rules.Topics == nil || len(b.config.Rules.Topics) == 0 {
-		return true
+// write writes records to their mapped kafka topics, spooling them if a spool is enabled and
+// they cannot be written.
+func (b *Bridge) write(records []bridge.Record) error {
+	msgs := make([]kafka.Message, len(records))
+	for i, r := range records {
+		msgs[i] = b.message(r)
 	}
 
-	for _, t := range b.config.Rules.Topics {
-		if ok := plugin.MatchTopic(t, topic); ok {
-			return true
-		}
+	if b.spool == nil {
+		return b.writer.WriteMessages(b.ctx, msgs...)
 	}
-	return false
-}
 
-func (b *Bridge) checkFilter(filter string) bool {
-	if b.config.Rules.Filters == nil || len(b.config.Rules.Filters) == 0 {
-		return true
-	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	for _, f := range b.config.Rules.Filters {
-		if ok := plugin.MatchTopic(f, filter); ok {
-			return true
-		}
+	// messages are spooled behind any which are waiting, to keep them in order
+	if b.spool.Len() > 0 {
+		return b.spool.Push(spooled(msgs)...)
 	}
-	return false
-}
 
-// OnSessionEstablished is called when a new client establishes a session (after OnConnect).
-func (b *Bridge) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
-	timestamp := genTimestamp(pk.Created)
-	msg := &Message{
-		Action:          Connect,
-		ClientID:        cl.ID,
-		Remote:          cl.Net.Remote,
-		Listener:        cl.Net.Listener,
-		Username:        string(cl.Properties.Username),
-		Clean:           cl.Properties.Clean,
-		ProtocolVersion: cl.Properties.ProtocolVersion,
-		Timestamp:       timestamp,
-	}
-	data, err := msg.MarshalBinary()
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnSessionEstablished", "error", err)
-		return
+	err := b.writer.WriteMessages(b.ctx, msgs...)
+	if err == nil {
+		return nil
 	}
 
-	err = b.writer.WriteMessages(b.ctx, kafka.Message{
-		Key:   genKey(cl.ID, timestamp),
-		Value: data,
-	})
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnSessionEstablished", "error", err)
+	b.Log.Warn("cannot write to kafka, spooling messages", "error", err, "messages", len(msgs))
+	var werrs kafka.WriteErrors
+	if errors.As(err, &werrs) && len(werrs) == len(msgs) {
+		// the messages from the first failed one are spooled, to keep them in order
+		i := slices.IndexFunc(werrs, func(werr error) bool { return werr != nil })
+		if i > 0 {
+			msgs = msgs[i:]
+		}
 	}
+	return b.spool.Push(spooled(msgs)...)
 }
 
-// OnDisconnect is called when a client is disconnected for any reason.
-func (b *Bridge) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
-	timestamp := time.Now().Unix()
-	msg := &Message{
-		Action:    Disconnect,
-		ClientID:  cl.ID,
-		Username:  string(cl.Properties.Username),
-		Timestamp: timestamp,
-	}
-
-	if err != nil {
-		msg.Payload = []byte(err.Error())
-	}
-
-	data, err := msg.MarshalBinary()
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnDisconnect", "error", err)
-		return
-	}
-
-	err = b.writer.WriteMessages(b.ctx, kafka.Message{
-		Key:   genKey(cl.ID, timestamp),
-		Value: data,
-	})
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnDisconnect", "error", err)
+// replay writes the spooled messages to kafka at each interval until the bridge is stopped.
+func (b *Bridge) replay(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flushSpool()
+		case <-b.done:
+			return
+		}
 	}
 }
 
-// OnPublished is called when a client has published a message to subscribers.
-func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
-	if !b.checkTopic(pk.TopicName) {
-		return
-	}
+// flushSpool writes the spooled messages to kafka in order, keeping those which cannot be
+// written for the next replay. A batch which fails part way is replayed in full, so messages
+// are delivered at least once.
+func (b *Bridge) flushSpool() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	timestamp := genTimestamp(pk.Created)
-	msg := &Message{
-		Action:    Publish,
-		ClientID:  cl.ID,
-		Username:  string(cl.Properties.Username),
-		Topics:    []string{pk.TopicName},
-		Payload:   pk.Payload,
-		Timestamp: timestamp,
-		PacketID:  pk.PacketID,
-	}
-	data, err := msg.MarshalBinary()
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnPublished", "error", err)
+	n := b.spool.Len()
+	if n == 0 {
 		return
 	}
 
-	err = b.writer.WriteMessages(b.ctx, kafka.Message{
-		Key:   genKey(fmt.Sprint(pk.PacketID), timestamp),
-		Value: data,
-	})
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnPublished", "error", err)
-	}
-}
-
-// OnSubscribed is called when a client subscribes to one or more filters.
-func (b *Bridge) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
-	filters := make([]string, 0)
-	codes := make([]byte, 0)
-	for i, sub := range pk.Filters {
-		if b.checkFilter(sub.Filter) {
-			filters = append(filters, sub.Filter)
-			codes = append(codes, reasonCodes[i])
+	err := b.spool.DrainBatch(b.config.BatchSize, func(sms []spooledMessage) error {
+		msgs := make([]kafka.Message, len(sms))
+		for i, m := range sms {
+			msgs[i] = kafka.Message{Topic: m.Topic, Key: m.Key, Value: m.Value}
 		}
-	}
-	if len(filters) == 0 {
-		return
-	}
-
-	timestamp := genTimestamp(pk.Created)
-	msg := &Message{
-		Action:      Subscribe,
-		ClientID:    cl.ID,
-		Username:    string(cl.Properties.Username),
-		Topics:      filters,
-		reasonCodes: codes,
-		Timestamp:   timestamp,
-	}
-	data, err := msg.MarshalBinary()
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnSubscribed", "error", err)
-		return
-	}
-
-	err = b.writer.WriteMessages(b.ctx, kafka.Message{
-		Key:   genKey(fmt.Sprint(pk.PacketID), timestamp),
-		Value: data,
+		return b.writer.WriteMessages(b.ctx, msgs...)
 	})
 	if err != nil {
-		b.Log.Error("bridge-kafka:OnSubscribed", "error", err)
-	}
-}
-
-// OnUnsubscribed is called when a client unsubscribes from one or more filters.
-func (b *Bridge) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
-	filters := make([]string, 0)
-	codes := make([]byte, 0)
-	for i, sub := range pk.Filters {
-		if b.checkFilter(sub.Filter) {
-			filters = append(filters, sub.Filter)
-			codes = append(codes, reasonCodes[i])
-		}
-	}
-	timestamp := genTimestamp(pk.Created)
-	msg := &Message{
-		Action:      Unsubscribe,
-		ClientID:    cl.ID,
-		Username:    string(cl.Properties.Username),
-		Topics:      filters,
-		reasonCodes: codes,
-		Timestamp:   timestamp,
-	}
-	data, err := msg.MarshalBinary()
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnUnsubscribed", "error", err)
+		b.Log.Warn("cannot replay spooled kafka messages", "error", err, "remaining", b.spool.Len())
 		return
 	}
 
-	err = b.writer.WriteMessages(b.ctx, kafka.Message{
-		Key:   genKey(fmt.Sprint(pk.PacketID), timestamp),
-		Value: data,
-	})
-	if err != nil {
-		b.Log.Error("bridge-kafka:OnUnsubscribed", "error", err)
-	}
-}
-
-func genKey(id string, timestamp int64) []byte {
-	var buf bytes.Buffer
-	buf.WriteString(id)
-	buf.WriteString("-")
-	buf.WriteString(fmt.Sprint(timestamp))
-	return buf.Bytes()
+	b.Log.Info("replayed spooled kafka messages", "messages", n)
 }
 
-func genTimestamp(created int64) int64 {
-	if created == 0 {
-		created = time.Now().Unix()
+// spooled converts kafka messages to spooled messages.
+func spooled(msgs []kafka.Message) []spooledMessage {
+	sms := make([]spooledMessage, len(msgs))
+	for i, m := range msgs {
+		sms[i] = spooledMessage{Topic: m.Topic, Key: m.Key, Value: m.Value}
 	}
-	return created
+	return sms
 }
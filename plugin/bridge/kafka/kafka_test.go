@@ -14,6 +14,7 @@ import (
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/plugin"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
 )
 
 var (
@@ -99,11 +100,175 @@ func TestBridge(t *testing.T) {
 	}
 }
 
+func TestSend(t *testing.T) {
+	b := newBridge(t)
+	writer := newMockWriter()
+	b.writer = writer
+	require.NoError(t, b.Send("alerts/1", []byte(`{"t":42}`)))
+	msgs := writer.getMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("alerts/1"), msgs[0].Key)
+	require.Equal(t, []byte(`{"t":42}`), msgs[0].Value)
+}
+
+func TestInitInvalidOptions(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+
+	opts := &Options{
+		KafkaOptions: &kafkaOptions{Brokers: []string{"127.0.0.1:1"}},
+		Mappings:     []Mapping{{Filter: "a/#", Encoding: "xml"}},
+	}
+	require.ErrorIs(t, b.Init(opts), ErrInvalidOptions)
+
+	opts = &Options{
+		Options:      bridge.Options{QueueSize: 10},
+		KafkaOptions: &kafkaOptions{Brokers: []string{"127.0.0.1:1"}, Async: true, SpoolDir: t.TempDir()},
+	}
+	require.ErrorIs(t, b.Init(opts), ErrInvalidOptions)
+
+	opts = &Options{KafkaOptions: &kafkaOptions{Brokers: []string{"127.0.0.1:1"}, SpoolDir: t.TempDir()}}
+	require.ErrorIs(t, b.Init(opts), ErrInvalidOptions)
+}
+
+// newMappedBridge returns a bridge with a mock writer, which cannot reach kafka.
+func newMappedBridge(t *testing.T, opts *Options) (*Bridge, *mockWriter) {
+	if opts.KafkaOptions == nil {
+		opts.KafkaOptions = &kafkaOptions{}
+	}
+	opts.KafkaOptions.Brokers = []string{"127.0.0.1:1"}
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(opts))
+	writer := newMockWriter()
+	b.writer = writer
+	t.Cleanup(func() { _ = b.Stop() })
+	return b, writer
+}
+
+func TestMappings(t *testing.T) {
+	b, writer := newMappedBridge(t, &Options{
+		Mappings: []Mapping{
+			{Filter: "sensors/#", Topic: "${level1}", Key: "${clientid}", Encoding: EncodingRaw},
+			{Filter: "cmd/+", Topic: "commands-${level2}", Encoding: EncodingBase64},
+			{Filter: "alerts/#", Topic: "${topic}"},
+		},
+	})
+	require.Equal(t, defaultTopic, b.config.KafkaOptions.Topic)
+	require.Equal(t, EncodingJSON, b.config.Mappings[2].Encoding)
+
+	b.OnPublished(client, packets.Packet{TopicName: "sensors/1/temp", Payload: []byte("21")})
+	b.OnPublished(client, packets.Packet{TopicName: "cmd/reboot", Payload: []byte("now")})
+	b.OnPublished(client, packets.Packet{TopicName: "other", Payload: []byte("x")})
+	b.OnSubscribed(client, packets.Packet{Filters: packets.Subscriptions{{Filter: "sensors/+"}}}, []byte{0}, []int{1})
+	b.OnSessionEstablished(client, pkc)
+	require.NoError(t, b.Send("alerts/1", []byte(`{"t":42}`)))
+
+	msgs := writer.getMessages()
+	require.Len(t, msgs, 6)
+
+	require.Equal(t, "sensors", msgs[0].Topic)
+	require.Equal(t, []byte("test"), msgs[0].Key)
+	require.Equal(t, []byte("21"), msgs[0].Value)
+
+	require.Equal(t, "commands-reboot", msgs[1].Topic)
+	require.Equal(t, []byte("bm93"), msgs[1].Value)
+
+	// unmapped messages keep the default topic, key and json message
+	require.Equal(t, defaultTopic, msgs[2].Topic)
+	require.Equal(t, []byte("0-"), msgs[2].Key[:2])
+	var m Message
+	require.NoError(t, m.UnmarshalBinary(msgs[2].Value))
+	require.Equal(t, []byte("x"), m.Payload)
+
+	// subscriptions are mapped by their filter, but only publishes have a raw payload
+	require.Equal(t, "sensors", msgs[3].Topic)
+	require.NoError(t, m.UnmarshalBinary(msgs[3].Value))
+	require.Equal(t, Subscribe, m.Action)
+
+	require.Equal(t, defaultTopic, msgs[4].Topic)
+
+	require.Equal(t, "alerts.1", msgs[5].Topic)
+	require.Equal(t, []byte("alerts/1"), msgs[5].Key)
+	require.Equal(t, []byte(`{"t":42}`), msgs[5].Value)
+}
+
+func TestSpool(t *testing.T) {
+	b, writer := newMappedBridge(t, &Options{
+		Options:      bridge.Options{QueueSize: 10},
+		KafkaOptions: &kafkaOptions{SpoolDir: t.TempDir(), SpoolInterval: 3600},
+	})
+
+	writer.err = errors.New("unreachable")
+	require.NoError(t, b.Send("a", []byte("1")))
+	writer.err = nil
+	require.NoError(t, b.Send("a", []byte("2"))) // behind the first
+	require.Equal(t, 2, b.spool.Len())
+	require.Equal(t, 0, writer.count())
+	require.Zero(t, b.Dropped())
+
+	b.flushSpool()
+	require.Equal(t, 0, b.spool.Len())
+	require.NoError(t, b.Send("a", []byte("3")))
+
+	msgs := writer.getMessages()
+	require.Len(t, msgs, 3)
+	for i, msg := range msgs {
+		require.Equal(t, []byte(fmt.Sprint(i+1)), msg.Value)
+		require.Equal(t, defaultTopic, msg.Topic)
+	}
+}
+
+func TestSpoolPartialWrite(t *testing.T) {
+	b, writer := newMappedBridge(t, &Options{
+		Options:      bridge.Options{QueueSize: 10},
+		KafkaOptions: &kafkaOptions{SpoolDir: t.TempDir(), SpoolInterval: 3600},
+	})
+
+	// the messages after the first failed one are spooled too, to keep them in order
+	writer.err = kafka.WriteErrors{nil, errors.New("failed"), nil}
+	require.NoError(t, b.write([]bridge.Record{
+		{Key: []byte("a"), Value: []byte("1"), Topic: "a"},
+		{Key: []byte("b"), Value: []byte("2"), Topic: "b"},
+		{Key: []byte("c"), Value: []byte("3"), Topic: "c"},
+	}))
+	require.Equal(t, 2, b.spool.Len())
+
+	writer.err = nil
+	b.flushSpool()
+	require.Equal(t, []kafka.Message{
+		{Topic: defaultTopic, Key: []byte("b"), Value: []byte("2")},
+		{Topic: defaultTopic, Key: []byte("c"), Value: []byte("3")},
+	}, writer.getMessages())
+}
+
+func TestSpoolReplayedOnStart(t *testing.T) {
+	dir := t.TempDir()
+	b, writer := newMappedBridge(t, &Options{
+		Options:      bridge.Options{QueueSize: 10},
+		KafkaOptions: &kafkaOptions{SpoolDir: dir, SpoolLimit: 1, SpoolInterval: 3600},
+	})
+	writer.err = errors.New("unreachable")
+	require.NoError(t, b.Send("a", []byte("1")))
+	require.ErrorIs(t, b.Send("b", []byte("2")), bridge.ErrSpoolFull)
+	require.NoError(t, b.Stop())
+
+	b, writer = newMappedBridge(t, &Options{
+		Options:      bridge.Options{QueueSize: 10},
+		KafkaOptions: &kafkaOptions{SpoolDir: dir, SpoolInterval: 3600},
+	})
+	require.Equal(t, 1, b.spool.Len())
+	b.flushSpool()
+	require.Len(t, writer.getMessages(), 1)
+}
+
 type mockWriter struct {
 	mu       sync.Mutex
 	messages []kafka.Message
 	closed   bool
 	verbose  bool
+	err      error // returned instead of writing the messages
 }
 
 func newMockWriter() *mockWriter {
@@ -115,6 +280,9 @@ func newMockWriter() *mockWriter {
 func (m *mockWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
 	m.messages = append(m.messages, msgs...)
 	if m.verbose {
 		for _, msg := range msgs {
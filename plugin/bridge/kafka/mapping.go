@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package kafka
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/wind-c/comqtt/v2/plugin"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+// The encodings of mapped messages.
+const (
+	EncodingJSON   = "json"   // the json message, as written without a mapping
+	EncodingRaw    = "raw"    // the mqtt payload as it was published
+	EncodingBase64 = "base64" // the mqtt payload as base64 text
+)
+
+// placeholder matches the ${name} fields of a mapping template.
+var placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Mapping selects the kafka topic, key and encoding of the messages matching an mqtt filter.
+type Mapping struct {
+	Filter   string `json:"filter" yaml:"filter"`     // matched against the topic of publish, delivered and sent messages, or the first filter of subscribe and unsubscribe; wildcard(#、+) is supported, empty matches every message
+	Topic    string `json:"topic" yaml:"topic"`       // kafka topic template, defaults to the topic of kafka-options
+	Key      string `json:"key" yaml:"key"`           // message key template, defaults to the packet or client id with the timestamp
+	Encoding string `json:"encoding" yaml:"encoding"` // json (default), raw or base64; raw and base64 only apply to publish, delivered and sent messages
+}
+
+// validate checks the encoding of the mapping, applying the default.
+func (m *Mapping) validate() error {
+	switch m.Encoding {
+	case "":
+		m.Encoding = EncodingJSON
+	case EncodingJSON, EncodingRaw, EncodingBase64:
+	default:
+		return fmt.Errorf("%w: unknown encoding %q for filter %q", ErrInvalidOptions, m.Encoding, m.Filter)
+	}
+	return nil
+}
+
+// message converts a record to a kafka message using the first mapping which matches it.
+// Records which match no mapping are written to the default topic as they are.
+func (b *Bridge) message(r bridge.Record) kafka.Message {
+	msg := kafka.Message{
+		Topic: b.config.KafkaOptions.Topic,
+		Key:   r.Key,
+		Value: r.Value,
+	}
+
+	topic := r.Topic
+	if r.Message != nil && len(r.Message.Topics) > 0 {
+		topic = r.Message.Topics[0]
+	}
+
+	for _, m := range b.config.Mappings {
+		if m.Filter != "" && (topic == "" || !plugin.MatchTopic(m.Filter, topic)) {
+			continue
+		}
+
+		fields := mappingFields(r, topic)
+		if t := bridge.DottedTopic(render(m.Topic, fields)); t != "" {
+			msg.Topic = t
+		}
+		if k := render(m.Key, fields); k != "" {
+			msg.Key = []byte(k)
+		}
+		msg.Value = encode(m.Encoding, r)
+		break
+	}
+
+	return msg
+}
+
+// mappingFields returns the template fields of a record: clientid, username, action, topic,
+// and level1 to levelN for the levels of the topic.
+func mappingFields(r bridge.Record, topic string) map[string]string {
+	fields := map[string]string{
+		"topic": topic,
+	}
+	if r.Message != nil {
+		fields["clientid"] = r.Message.ClientID
+		fields["username"] = r.Message.Username
+		fields["action"] = r.Message.Action
+	}
+	if topic != "" {
+		for i, level := range strings.Split(topic, "/") {
+			fields["level"+strconv.Itoa(i+1)] = level
+		}
+	}
+	return fields
+}
+
+// render replaces the placeholders of a template with the record fields. Missing fields are
+// replaced with an empty string.
+func render(tmpl string, fields map[string]string) string {
+	if !strings.Contains(tmpl, "${") {
+		return tmpl
+	}
+
+	return placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		return fields[m[2:len(m)-1]]
+	})
+}
+
+// encode returns the value of a record in an encoding. The json message is used for the
+// actions which do not carry a published payload.
+func encode(encoding string, r bridge.Record) []byte {
+	payload := r.Value
+	if r.Message != nil {
+		if r.Message.Action != bridge.Publish && r.Message.Action != bridge.Delivered {
+			return r.Value
+		}
+		payload = r.Message.Payload
+	}
+
+	switch encoding {
+	case EncodingRaw:
+		return payload
+	case EncodingBase64:
+		return []byte(base64.StdEncoding.EncodeToString(payload))
+	default:
+		return r.Value
+	}
+}
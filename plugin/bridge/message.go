@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package bridge
+
+import "encoding/json"
+
+// The actions of bridged messages.
+const (
+	//Connect mqtt connect
+	Connect = "connect"
+	//Publish mqtt publish
+	Publish = "publish"
+	//Delivered mqtt publish delivered to a subscriber
+	Delivered = "delivered"
+	//Subscribe mqtt sub
+	Subscribe = "subscribe"
+	//Unsubscribe mqtt sub
+	Unsubscribe = "unsubscribe"
+	//Disconnect mqtt disconenct
+	Disconnect = "disconnect"
+)
+
+// Message is a lifecycle or message event, as emitted by the bridges.
+type Message struct {
+	Action          string   `json:"action"`
+	ClientID        string   `json:"clientid"`                  // the client id
+	Username        string   `json:"username"`                  // the username of the client
+	Remote          string   `json:"remote,omitempty"`          // the remote address of the client
+	Listener        string   `json:"listener,omitempty"`        // the listener the client connected on
+	Topics          []string `json:"topics,omitempty"`          // publish topic or subscribe/unsubscribe filters
+	ReasonCodes     []byte   `json:"reasonCodes,omitempty"`     // subscribe/unsubscribe filters success(0) or failure(>0x80) code
+	Payload         []byte   `json:"payload,omitempty"`         // publish payload
+	ProtocolVersion byte     `json:"protocolVersion,omitempty"` // mqtt protocol version of the client
+	Clean           bool     `json:"clean,omitempty"`           // if the client requested a clean start/session
+	Timestamp       int64    `json:"ts"`                        // event time
+	PacketID        uint16   `json:"packetid,omitempty"`        // the packet id
+}
+
+// MarshalBinary encodes the values into a json string.
+func (d Message) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(d)
+}
+
+// UnmarshalBinary decodes a json string into a struct.
+func (d *Message) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, d)
+}
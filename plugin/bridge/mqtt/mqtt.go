@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	comqtt "github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+const (
+	defaultKeepAlive      = 30 // seconds
+	defaultConnectTimeout = 10 // seconds
+	inlineListener        = "bridge"
+)
+
+var (
+	// ErrServerNotSet indicates SetServer was not called before the hook was added.
+	ErrServerNotSet = errors.New("mqtt bridge requires the server to be set before it is added")
+
+	// ErrNoRemotes indicates that no remote brokers were configured.
+	ErrNoRemotes = errors.New("mqtt bridge requires at least one remote broker")
+
+	// ErrEmptyTopic indicates a message could not be sent because it has no topic.
+	ErrEmptyTopic = errors.New("mqtt bridge cannot send a message without a topic")
+
+	// ErrSpoolFull indicates the spool has reached its message limit.
+	ErrSpoolFull = bridge.ErrSpoolFull
+)
+
+// Options contains configuration settings for the bridge.
+type Options struct {
+	Remotes []RemoteOptions `json:"remotes" yaml:"remotes"`
+}
+
+// RemoteOptions contains the connection settings and forwarding rules for a remote broker.
+type RemoteOptions struct {
+	Name           string          `json:"name" yaml:"name"`                       // a unique name for the remote broker
+	Address        string          `json:"address" yaml:"address"`                 // such as tcp://127.0.0.1:1883, ssl:// or ws://
+	ClientID       string          `json:"client-id" yaml:"client-id"`             // defaults to comqtt-bridge-{name}
+	Username       string          `json:"username" yaml:"username"`               // the username for the remote broker
+	Password       string          `json:"password" yaml:"password"`               // the password for the remote broker
+	CleanSession   bool            `json:"clean-session" yaml:"clean-session"`     // start a clean session with the remote broker
+	KeepAlive      int64           `json:"keep-alive" yaml:"keep-alive"`           // seconds, defaults to 30
+	ConnectTimeout int64           `json:"connect-timeout" yaml:"connect-timeout"` // seconds, defaults to 10
+	Forwards       []ForwardRule   `json:"forwards" yaml:"forwards"`               // local topics published to the remote broker
+	Subscriptions  []SubscribeRule `json:"subscriptions" yaml:"subscriptions"`     // remote filters published to local subscribers
+	SpoolDir       string          `json:"spool-dir" yaml:"spool-dir"`             // directory for buffering messages while the remote is down, empty disables
+	SpoolLimit     int             `json:"spool-limit" yaml:"spool-limit"`         // maximum number of buffered messages, 0 is unlimited
+}
+
+// ForwardRule forwards local messages matching a filter to the remote broker.
+type ForwardRule struct {
+	Filter       string `json:"filter" yaml:"filter"`               // local topic filter, wildcard(#、+) is supported
+	LocalPrefix  string `json:"local-prefix" yaml:"local-prefix"`   // prefix removed from the local topic
+	RemotePrefix string `json:"remote-prefix" yaml:"remote-prefix"` // prefix added to the remote topic
+	MaxQos       byte   `json:"max-qos" yaml:"max-qos"`             // messages are forwarded with at most this qos
+}
+
+// SubscribeRule subscribes to a remote filter and publishes the messages to local subscribers.
+type SubscribeRule struct {
+	Filter       string `json:"filter" yaml:"filter"`               // remote topic filter, wildcard(#、+) is supported
+	Qos          byte   `json:"qos" yaml:"qos"`                     // the subscription qos
+	RemotePrefix string `json:"remote-prefix" yaml:"remote-prefix"` // prefix removed from the remote topic
+	LocalPrefix  string `json:"local-prefix" yaml:"local-prefix"`   // prefix added to the local topic
+}
+
+// Bridge is a hook which forwards messages between the local server and remote mqtt brokers.
+type Bridge struct {
+	comqtt.HookBase
+	config  *Options
+	server  *comqtt.Server
+	inline  *comqtt.Client // the client used to inject remote messages
+	remotes []*remote
+}
+
+// spooledMessage is a message waiting to be forwarded to a remote broker.
+type spooledMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload,omitempty"`
+	Qos     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// remote is a single outbound connection to a remote broker.
+type remote struct {
+	opts     *RemoteOptions
+	client   paho.Client
+	spool    *bridge.Spool[spooledMessage]
+	flushing atomic.Bool // true while the spool is being flushed
+	bridge   *Bridge
+	log      *slog.Logger
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-mqtt"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (b *Bridge) Provides(bt byte) bool {
+	return bytes.Contains([]byte{
+		comqtt.OnStarted,
+		comqtt.OnPublished,
+	}, []byte{bt})
+}
+
+// SetServer sets the server which remote messages are injected into. It must be called
+// before the hook is added.
+func (b *Bridge) SetServer(server *comqtt.Server) {
+	b.server = server
+}
+
+// Init validates the configuration and prepares the remote connections.
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return comqtt.ErrInvalidConfigType
+	}
+
+	if b.server == nil {
+		return ErrServerNotSet
+	}
+
+	if config == nil || len(config.(*Options).Remotes) == 0 {
+		return ErrNoRemotes
+	}
+
+	b.config = config.(*Options)
+	b.inline = b.server.NewClient(nil, inlineListener, b.ID(), true)
+	b.inline.Properties.ProtocolVersion = 5
+
+	b.remotes = make([]*remote, 0, len(b.config.Remotes))
+	for i := range b.config.Remotes {
+		r, err := b.newRemote(&b.config.Remotes[i])
+		if err != nil {
+			return err
+		}
+		b.remotes = append(b.remotes, r)
+	}
+
+	return nil
+}
+
+// newRemote creates a remote connection from the options, applying defaults.
+func (b *Bridge) newRemote(o *RemoteOptions) (*remote, error) {
+	if o.Address == "" {
+		return nil, fmt.Errorf("remote %q has no address", o.Name)
+	}
+	if o.ClientID == "" {
+		o.ClientID = "comqtt-bridge-" + o.Name
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = defaultKeepAlive
+	}
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = defaultConnectTimeout
+	}
+
+	r := &remote{
+		opts:   o,
+		bridge: b,
+		log:    b.Log.With("remote", o.Name),
+	}
+
+	if o.SpoolDir != "" {
+		sp, err := bridge.NewSpool[spooledMessage](filepath.Join(o.SpoolDir, o.ClientID+".spool"), o.SpoolLimit)
+		if err != nil {
+			return nil, err
+		}
+		r.spool = sp
+	}
+
+	co := paho.NewClientOptions().
+		AddBroker(o.Address).
+		SetClientID(o.ClientID).
+		SetUsername(o.Username).
+		SetPassword(o.Password).
+		SetCleanSession(o.CleanSession).
+		SetKeepAlive(time.Duration(o.KeepAlive) * time.Second).
+		SetConnectTimeout(time.Duration(o.ConnectTimeout) * time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(r.onConnect).
+		SetConnectionLostHandler(r.onConnectionLost)
+	r.client = paho.NewClient(co)
+
+	return r, nil
+}
+
+// OnStarted connects to the remote brokers once the server has started.
+func (b *Bridge) OnStarted() {
+	for _, r := range b.remotes {
+		b.Log.Info("connecting to remote broker", "remote", r.opts.Name, "address", r.opts.Address)
+		r.client.Connect() // retries in the background until connected
+	}
+}
+
+// Stop disconnects from the remote brokers.
+func (b *Bridge) Stop() error {
+	for _, r := range b.remotes {
+		if r.client.IsConnected() {
+			r.client.Disconnect(250)
+		}
+	}
+	return nil
+}
+
+// OnPublished forwards a locally published message to each remote broker with a matching rule.
+func (b *Bridge) OnPublished(cl *comqtt.Client, pk packets.Packet) {
+	if cl == b.inline { // never send messages received from a remote broker back out
+		return
+	}
+
+	for _, r := range b.remotes {
+		for _, rule := range r.opts.Forwards {
+			if !matchFilter(rule.Filter, pk.TopicName) {
+				continue
+			}
+
+			qos := min(pk.FixedHeader.Qos, rule.MaxQos)
+			r.publish(spooledMessage{
+				Topic:   remapTopic(pk.TopicName, rule.LocalPrefix, rule.RemotePrefix),
+				Payload: pk.Payload,
+				Qos:     qos,
+				Retain:  pk.FixedHeader.Retain,
+			})
+			break
+		}
+	}
+}
+
+// Send publishes a payload to every remote broker with qos 1, spooling it as usual while a
+// broker is unavailable. It lets the rule engine use the bridge as a sink.
+func (b *Bridge) Send(topic string, payload []byte) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+
+	for _, r := range b.remotes {
+		r.publish(spooledMessage{
+			Topic:   topic,
+			Payload: payload,
+			Qos:     1,
+		})
+	}
+
+	return nil
+}
+
+// onConnect subscribes to the remote filters and flushes any spooled messages.
+func (r *remote) onConnect(c paho.Client) {
+	r.log.Info("connected to remote broker")
+	for _, rule := range r.opts.Subscriptions {
+		token := c.Subscribe(rule.Filter, rule.Qos, func(_ paho.Client, m paho.Message) {
+			r.onMessage(rule, m)
+		})
+		go func() {
+			if token.WaitTimeout(time.Duration(r.opts.ConnectTimeout)*time.Second) && token.Error() != nil {
+				r.log.Error("failed to subscribe to remote filter", "error", token.Error(), "filter", rule.Filter)
+			}
+		}()
+	}
+
+	if r.spool != nil && r.spool.Len() > 0 {
+		go r.flush()
+	}
+}
+
+// onConnectionLost logs the lost connection, which is re-established automatically.
+func (r *remote) onConnectionLost(_ paho.Client, err error) {
+	r.log.Warn("lost connection to remote broker", "error", err)
+}
+
+// onMessage injects a message received from the remote broker into the local server.
+func (r *remote) onMessage(rule SubscribeRule, m paho.Message) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    m.Qos(),
+			Retain: m.Retained(),
+		},
+		TopicName: remapTopic(m.Topic(), rule.RemotePrefix, rule.LocalPrefix),
+		Payload:   m.Payload(),
+		PacketID:  uint16(m.Qos()), // as with Server.Publish, a packet id is only needed for validity checks.
+	}
+
+	if err := r.bridge.server.InjectPacket(r.bridge.inline, pk); err != nil {
+		r.log.Error("failed to inject remote message", "error", err, "topic", pk.TopicName)
+	}
+}
+
+// publish sends a message to the remote broker, spooling it if the broker is unavailable.
+// Messages are spooled behind any which are waiting, to keep them in order.
+func (r *remote) publish(m spooledMessage) {
+	connected := r.client.IsConnectionOpen()
+	if r.spool != nil && r.spool.Len() > 0 {
+		r.store(m, nil)
+		if connected {
+			go r.flush()
+		}
+		return
+	}
+
+	if !connected {
+		r.store(m, nil)
+		return
+	}
+
+	token := r.client.Publish(m.Topic, m.Qos, m.Retain, m.Payload)
+	go func() {
+		if !token.WaitTimeout(time.Duration(r.opts.ConnectTimeout) * time.Second) {
+			r.store(m, errors.New("publish timed out"))
+		} else if token.Error() != nil {
+			r.store(m, token.Error())
+		}
+	}()
+}
+
+// store spools a message which could not be sent.
+func (r *remote) store(m spooledMessage, cause error) {
+	if r.spool == nil {
+		r.log.Warn("dropped message for unavailable remote broker", "error", cause, "topic", m.Topic)
+		return
+	}
+
+	if err := r.spool.Push(m); err != nil {
+		r.log.Error("failed to spool message", "error", err, "topic", m.Topic)
+	}
+}
+
+// flush sends all spooled messages to the remote broker, unless a flush is already running.
+// Messages spooled while flushing are sent before it returns.
+func (r *remote) flush() {
+	for r.flushing.CompareAndSwap(false, true) {
+		err := r.drain()
+		r.flushing.Store(false)
+		if err != nil {
+			r.log.Error("failed to flush spooled messages", "error", err, "remaining", r.spool.Len())
+			return
+		}
+
+		if r.spool.Len() == 0 || !r.client.IsConnectionOpen() {
+			return
+		}
+	}
+}
+
+// drain publishes the spooled messages in order, stopping at the first which fails.
+func (r *remote) drain() error {
+	timeout := time.Duration(r.opts.ConnectTimeout) * time.Second
+	return r.spool.Drain(func(m spooledMessage) error {
+		token := r.client.Publish(m.Topic, m.Qos, m.Retain, m.Payload)
+		if !token.WaitTimeout(timeout) {
+			return errors.New("publish timed out")
+		}
+		return token.Error()
+	})
+}
+
+// matchFilter returns true if a topic matches a filter. Topics beginning with $ are only
+// matched by filters which also begin with $.
+func matchFilter(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	return plugin.MatchTopic(filter, topic)
+}
+
+// remapTopic replaces the from prefix of a topic with the to prefix.
+func remapTopic(topic, from, to string) string {
+	return to + strings.TrimPrefix(topic, from)
+}
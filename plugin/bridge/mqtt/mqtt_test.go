@@ -0,0 +1,196 @@
+package mqtt
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	comqtt "github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newServer(t *testing.T) *comqtt.Server {
+	s := comqtt.New(&comqtt.Options{
+		Logger:       logger,
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	return s
+}
+
+func TestInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), comqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, b.Init(nil), ErrServerNotSet)
+
+	b.SetServer(newServer(t))
+	require.ErrorIs(t, b.Init(nil), ErrNoRemotes)
+	require.Error(t, b.Init(&Options{Remotes: []RemoteOptions{{Name: "x"}}}))
+}
+
+func TestInitDefaults(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.SetServer(newServer(t))
+	opts := &Options{Remotes: []RemoteOptions{{Name: "cloud", Address: "tcp://127.0.0.1:1"}}}
+	require.NoError(t, b.Init(opts))
+	require.Equal(t, "comqtt-bridge-cloud", opts.Remotes[0].ClientID)
+	require.Equal(t, int64(defaultKeepAlive), opts.Remotes[0].KeepAlive)
+	require.Equal(t, int64(defaultConnectTimeout), opts.Remotes[0].ConnectTimeout)
+	require.Nil(t, b.remotes[0].spool)
+}
+
+func TestRemapTopic(t *testing.T) {
+	require.Equal(t, "edge/1/temp", remapTopic("sensors/temp", "sensors/", "edge/1/"))
+	require.Equal(t, "edge/1/other/temp", remapTopic("other/temp", "sensors/", "edge/1/"))
+	require.Equal(t, "sensors/temp", remapTopic("sensors/temp", "", ""))
+}
+
+func TestMatchFilter(t *testing.T) {
+	require.True(t, matchFilter("a/+/c", "a/b/c"))
+	require.True(t, matchFilter("#", "a/b/c"))
+	require.False(t, matchFilter("#", "$SYS/broker/uptime"))
+	require.True(t, matchFilter("$SYS/#", "$SYS/broker/uptime"))
+	require.False(t, matchFilter("a/b", "a/c"))
+}
+
+func TestOnPublishedSpoolsWhileDisconnected(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.SetServer(newServer(t))
+	err := b.Init(&Options{Remotes: []RemoteOptions{{
+		Name:     "cloud",
+		Address:  "tcp://127.0.0.1:1",
+		SpoolDir: t.TempDir(),
+		Forwards: []ForwardRule{{Filter: "sensors/#", LocalPrefix: "sensors/", RemotePrefix: "edge/", MaxQos: 1}},
+	}}})
+	require.NoError(t, err)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}, TopicName: "sensors/temp", Payload: []byte("21")}
+	b.OnPublished(new(comqtt.Client), pk)
+	b.OnPublished(new(comqtt.Client), packets.Packet{TopicName: "other/temp"})
+	b.OnPublished(b.inline, pk)
+
+	sp := b.remotes[0].spool
+	require.Equal(t, 1, sp.Len())
+	require.NoError(t, sp.Drain(func(m spooledMessage) error {
+		require.Equal(t, spooledMessage{Topic: "edge/temp", Payload: []byte("21"), Qos: 1}, m)
+		return nil
+	}))
+}
+
+func TestSendSpoolsWhileDisconnected(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.SetServer(newServer(t))
+	err := b.Init(&Options{Remotes: []RemoteOptions{{
+		Name:     "cloud",
+		Address:  "tcp://127.0.0.1:1",
+		SpoolDir: t.TempDir(),
+	}}})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, b.Send("", []byte("x")), ErrEmptyTopic)
+	require.NoError(t, b.Send("alerts/1", []byte("42")))
+
+	sp := b.remotes[0].spool
+	require.Equal(t, 1, sp.Len())
+	require.NoError(t, sp.Drain(func(m spooledMessage) error {
+		require.Equal(t, spooledMessage{Topic: "alerts/1", Payload: []byte("42"), Qos: 1}, m)
+		return nil
+	}))
+}
+
+func TestBridgeForwardsBothWays(t *testing.T) {
+	addr := freeAddr(t)
+	remoteServer := newServer(t)
+	require.NoError(t, remoteServer.AddListener(listeners.NewTCP("tcp", addr, nil)))
+	go func() {
+		_ = remoteServer.Serve()
+	}()
+	defer remoteServer.Close()
+
+	localServer := newServer(t)
+	b := new(Bridge)
+	b.SetServer(localServer)
+	err := localServer.AddHook(b, &Options{Remotes: []RemoteOptions{{
+		Name:          "cloud",
+		Address:       "tcp://" + addr,
+		SpoolDir:      filepath.Join(t.TempDir(), "spool"),
+		Forwards:      []ForwardRule{{Filter: "sensors/#", LocalPrefix: "sensors/", RemotePrefix: "edge/1/", MaxQos: 1}},
+		Subscriptions: []SubscribeRule{{Filter: "cmd/#", Qos: 1, RemotePrefix: "cmd/", LocalPrefix: "edge/cmd/"}},
+	}}})
+	require.NoError(t, err)
+
+	// spooled before the bridge connects, flushed once it does
+	b.OnPublished(new(comqtt.Client), packets.Packet{TopicName: "sensors/spooled", Payload: []byte("s")})
+	require.Equal(t, 1, b.remotes[0].spool.Len())
+
+	toRemote := make(chan packets.Packet, 4)
+	require.NoError(t, remoteServer.Subscribe("edge/1/#", 1, func(cl *comqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		toRemote <- pk
+	}))
+
+	toLocal := make(chan packets.Packet, 4)
+	require.NoError(t, localServer.Subscribe("edge/cmd/#", 1, func(cl *comqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		toLocal <- pk
+	}))
+
+	go func() {
+		_ = localServer.Serve()
+	}()
+	defer localServer.Close()
+
+	require.Eventually(t, func() bool {
+		return b.remotes[0].client.IsConnectionOpen()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case pk := <-toRemote:
+		require.Equal(t, "edge/1/spooled", pk.TopicName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("spooled message was not flushed")
+	}
+
+	require.NoError(t, localServer.Publish("sensors/temp", []byte("21"), false, 1))
+	select {
+	case pk := <-toRemote:
+		require.Equal(t, "edge/1/temp", pk.TopicName)
+		require.Equal(t, []byte("21"), pk.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("local message was not forwarded")
+	}
+
+	// wait for the remote subscription to be established
+	require.Eventually(t, func() bool {
+		return len(remoteServer.Topics.Subscribers("cmd/reboot").Subscriptions) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, remoteServer.Publish("cmd/reboot", []byte("now"), false, 1))
+	select {
+	case pk := <-toLocal:
+		require.Equal(t, "edge/cmd/reboot", pk.TopicName)
+		require.Equal(t, []byte("now"), pk.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote message was not injected")
+	}
+
+	require.Zero(t, b.remotes[0].spool.Len())
+	require.Len(t, toRemote, 0)
+}
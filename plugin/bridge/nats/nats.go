@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package nats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+const defaultSubject = "comqtt"
+const defaultConnectTimeout = 5
+
+type Options struct {
+	bridge.Options `yaml:",inline"`
+	NatsOptions    *natsOptions `json:"nats-options" yaml:"nats-options"`
+}
+
+type natsOptions struct {
+	Servers        []string `json:"servers" yaml:"servers"` // defaults to nats://localhost:4222
+	Username       string   `json:"username" yaml:"username"`
+	Password       string   `json:"password" yaml:"password"`
+	Token          string   `json:"token" yaml:"token"`
+	Subject        string   `json:"subject" yaml:"subject"`                 // events are published to {subject}.{action} and sent payloads to {subject}.{topic}, defaults to comqtt
+	ConnectTimeout int      `json:"connect-timeout" yaml:"connect-timeout"` // seconds, defaults to 5
+}
+
+// Bridge is a hook which publishes client events to nats subjects.
+type Bridge struct {
+	bridge.Core
+	config *Options
+	conn   *nats.Conn
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-nats"
+}
+
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = &Options{}
+	}
+
+	b.config = config.(*Options)
+	if b.config.NatsOptions == nil {
+		b.config.NatsOptions = new(natsOptions)
+	}
+	if len(b.config.NatsOptions.Servers) == 0 {
+		b.config.NatsOptions.Servers = []string{nats.DefaultURL}
+	}
+	if b.config.NatsOptions.Subject == "" {
+		b.config.NatsOptions.Subject = defaultSubject
+	}
+	if b.config.NatsOptions.ConnectTimeout <= 0 {
+		b.config.NatsOptions.ConnectTimeout = defaultConnectTimeout
+	}
+
+	servers := strings.Join(b.config.NatsOptions.Servers, ",")
+	b.Log.Info("connecting to nats service", "servers", servers, "subject", b.config.NatsOptions.Subject)
+
+	opts := []nats.Option{
+		nats.Name("comqtt-bridge"),
+		nats.Timeout(time.Duration(b.config.NatsOptions.ConnectTimeout) * time.Second),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				b.Log.Warn("disconnected from nats service", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			b.Log.Info("reconnected to nats service")
+		}),
+	}
+	if b.config.NatsOptions.Username != "" {
+		opts = append(opts, nats.UserInfo(b.config.NatsOptions.Username, b.config.NatsOptions.Password))
+	}
+	if b.config.NatsOptions.Token != "" {
+		opts = append(opts, nats.Token(b.config.NatsOptions.Token))
+	}
+
+	conn, err := nats.Connect(servers, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to connect service: %w", err)
+	}
+	b.conn = conn
+
+	b.Log.Info("connected to nats service")
+	return b.Start(&b.config.Options, b.write)
+}
+
+// Stop flushes the pending messages and closes the nats connection.
+func (b *Bridge) Stop() error {
+	b.Log.Info("disconnecting from nats service")
+	b.Close()
+	err := b.conn.Flush()
+	b.conn.Close()
+	return err
+}
+
+// write publishes records to their subjects.
+func (b *Bridge) write(records []bridge.Record) error {
+	for _, r := range records {
+		if err := b.conn.Publish(b.subject(r), r.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subject returns the subject of a record, such as comqtt.publish for a bridged event, or
+// comqtt.a.b for a payload sent to a/b.
+func (b *Bridge) subject(r bridge.Record) string {
+	if r.Action != "" {
+		return b.config.NatsOptions.Subject + "." + r.Action
+	}
+	return b.config.NatsOptions.Subject + "." + bridge.DottedTopic(r.Topic)
+}
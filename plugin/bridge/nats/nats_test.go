@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type published struct {
+	subject string
+	payload []byte
+}
+
+// server is an in-process nats server which speaks enough of the protocol to record publishes.
+type server struct {
+	sync.Mutex
+	ln      net.Listener
+	connect string
+	msgs    []published
+}
+
+func newServer(t *testing.T) *server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *server) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+			s.Lock()
+			s.connect = args
+			s.Unlock()
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "PUB":
+			f := strings.Fields(args)
+			n, _ := strconv.Atoi(f[len(f)-1])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.Lock()
+			s.msgs = append(s.msgs, published{subject: f[0], payload: payload[:n]})
+			s.Unlock()
+		}
+	}
+}
+
+func (s *server) published() []published {
+	s.Lock()
+	defer s.Unlock()
+	return append([]published(nil), s.msgs...)
+}
+
+func newBridge(t *testing.T, s *server, opts *Options) *Bridge {
+	if opts.NatsOptions == nil {
+		opts.NatsOptions = new(natsOptions)
+	}
+	opts.NatsOptions.Servers = []string{s.url()}
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(opts))
+	t.Cleanup(func() { _ = b.Stop() })
+	return b
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "bridge-nats", new(Bridge).ID())
+}
+
+func TestInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.Error(t, b.Init(&Options{NatsOptions: &natsOptions{Servers: []string{"nats://127.0.0.1:1"}, ConnectTimeout: 1}}))
+}
+
+func TestEvents(t *testing.T) {
+	s := newServer(t)
+	opts := &Options{NatsOptions: &natsOptions{Username: "u", Password: "p"}}
+	b := newBridge(t, s, opts)
+	require.Equal(t, defaultSubject, opts.NatsOptions.Subject)
+
+	cl := &mqtt.Client{ID: "c1"}
+	b.OnSessionEstablished(cl, packets.Packet{})
+	b.OnPublished(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hi")})
+	require.NoError(t, b.conn.Flush())
+
+	msgs := s.published()
+	require.Len(t, msgs, 2)
+	require.Equal(t, "comqtt.connect", msgs[0].subject)
+	require.Equal(t, "comqtt.publish", msgs[1].subject)
+
+	var m bridge.Message
+	require.NoError(t, m.UnmarshalBinary(msgs[1].payload))
+	require.Equal(t, []string{"a/b"}, m.Topics)
+	require.Equal(t, []byte("hi"), m.Payload)
+
+	s.Lock()
+	require.Contains(t, s.connect, `"user":"u"`)
+	s.Unlock()
+}
+
+func TestSend(t *testing.T) {
+	s := newServer(t)
+	b := newBridge(t, s, &Options{NatsOptions: &natsOptions{Subject: "rules"}})
+	require.NoError(t, b.Send("sensors/1/temp", []byte(`{"t":1}`)))
+	require.NoError(t, b.conn.Flush())
+
+	require.Equal(t, []published{{subject: "rules.sensors.1.temp", payload: []byte(`{"t":1}`)}}, s.published())
+}
+
+func TestStopFlushes(t *testing.T) {
+	s := newServer(t)
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(&Options{
+		Options:     bridge.Options{QueueSize: 100},
+		NatsOptions: &natsOptions{Servers: []string{s.url()}},
+	}))
+
+	for i := 0; i < 10; i++ {
+		b.OnDisconnect(&mqtt.Client{ID: "c1"}, nil, false)
+	}
+	require.NoError(t, b.Stop())
+	require.Eventually(t, func() bool { return len(s.published()) == 10 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+const defaultAddr = "localhost:6379"
+const defaultStream = "comqtt"
+
+type Options struct {
+	bridge.Options `yaml:",inline"`
+	RedisOptions   *redisOptions `json:"redis-options" yaml:"redis-options"`
+}
+
+type redisOptions struct {
+	Addr     string `json:"addr" yaml:"addr"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	DB       int    `json:"db" yaml:"db"`
+	Stream   string `json:"stream" yaml:"stream"`   // defaults to comqtt
+	MaxLen   int64  `json:"max-len" yaml:"max-len"` // the stream is trimmed to about this many entries, 0 is unlimited
+}
+
+// Bridge is a hook which appends client events to a redis stream.
+type Bridge struct {
+	bridge.Core
+	config *Options
+	db     *redis.Client
+	ctx    context.Context // a context for the connection
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-redis"
+}
+
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	b.ctx = context.Background()
+
+	if config == nil {
+		config = &Options{}
+	}
+
+	b.config = config.(*Options)
+	if b.config.RedisOptions == nil {
+		b.config.RedisOptions = &redisOptions{Addr: defaultAddr}
+	}
+	if b.config.RedisOptions.Stream == "" {
+		b.config.RedisOptions.Stream = defaultStream
+	}
+
+	b.Log.Info("connecting to redis service",
+		"address", b.config.RedisOptions.Addr,
+		"db", b.config.RedisOptions.DB,
+		"stream", b.config.RedisOptions.Stream)
+
+	b.db = redis.NewClient(&redis.Options{
+		Addr:     b.config.RedisOptions.Addr,
+		Username: b.config.RedisOptions.Username,
+		Password: b.config.RedisOptions.Password,
+		DB:       b.config.RedisOptions.DB,
+	})
+	if _, err := b.db.Ping(b.ctx).Result(); err != nil {
+		return fmt.Errorf("failed to ping service: %w", err)
+	}
+
+	b.Log.Info("connected to redis service")
+	return b.Start(&b.config.Options, b.write)
+}
+
+// Stop closes the redis connection.
+func (b *Bridge) Stop() error {
+	b.Log.Info("disconnecting from redis service")
+	b.Close()
+	return b.db.Close()
+}
+
+// write appends records to the stream, pipelining a batch.
+func (b *Bridge) write(records []bridge.Record) error {
+	_, err := b.db.Pipelined(b.ctx, func(p redis.Pipeliner) error {
+		for _, r := range records {
+			values := []any{"key", r.Key, "value", r.Value}
+			if r.Topic != "" {
+				values = append(values, "topic", r.Topic)
+			}
+			p.XAdd(b.ctx, &redis.XAddArgs{
+				Stream: b.config.RedisOptions.Stream,
+				MaxLen: b.config.RedisOptions.MaxLen,
+				Approx: b.config.RedisOptions.MaxLen > 0,
+				Values: values,
+			})
+		}
+		return nil
+	})
+	return err
+}
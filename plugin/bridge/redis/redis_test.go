@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package redis
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newBridge(t *testing.T, opts *Options) (*Bridge, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+	opts.RedisOptions.Addr = s.Addr()
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(opts))
+	t.Cleanup(func() { _ = b.Stop() })
+	return b, s
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "bridge-redis", new(Bridge).ID())
+}
+
+func TestInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.Error(t, b.Init(&Options{RedisOptions: &redisOptions{Addr: "127.0.0.1:1"}}))
+
+	s := miniredis.RunT(t)
+	err := b.Init(&Options{
+		Options:      bridge.Options{Events: []string{"retained"}},
+		RedisOptions: &redisOptions{Addr: s.Addr()},
+	})
+	require.ErrorIs(t, err, bridge.ErrUnknownEvent)
+}
+
+func TestEvents(t *testing.T) {
+	opts := &Options{RedisOptions: &redisOptions{}}
+	b, s := newBridge(t, opts)
+	require.Equal(t, defaultStream, opts.RedisOptions.Stream)
+
+	cl := &mqtt.Client{ID: "c1"}
+	b.OnSessionEstablished(cl, packets.Packet{Created: 1700000000})
+	b.OnPublished(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hi"), PacketID: 3, Created: 1700000000})
+
+	entries, err := s.Stream(defaultStream)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, []string{"key", "c1-1700000000", "value", entries[0].Values[3]}, entries[0].Values)
+
+	var m bridge.Message
+	require.NoError(t, m.UnmarshalBinary([]byte(entries[1].Values[3])))
+	require.Equal(t, bridge.Publish, m.Action)
+	require.Equal(t, []string{"a/b"}, m.Topics)
+	require.Equal(t, []byte("hi"), m.Payload)
+}
+
+func TestSend(t *testing.T) {
+	b, s := newBridge(t, &Options{RedisOptions: &redisOptions{Stream: "rules"}})
+	require.NoError(t, b.Send("a/b", []byte(`{"t":1}`)))
+
+	entries, err := s.Stream("rules")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, []string{"key", "a/b", "value", `{"t":1}`, "topic", "a/b"}, entries[0].Values)
+}
+
+func TestQueueMaxLen(t *testing.T) {
+	b, s := newBridge(t, &Options{
+		Options:      bridge.Options{QueueSize: 100, BatchSize: 10},
+		RedisOptions: &redisOptions{MaxLen: 5},
+	})
+
+	for i := 0; i < 20; i++ {
+		b.OnDisconnect(&mqtt.Client{ID: "c1"}, nil, false)
+	}
+	require.Eventually(t, func() bool {
+		entries, err := s.Stream(defaultStream)
+		return err == nil && len(entries) == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, b.Dropped())
+}
@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxSpoolLine is the largest encoded message which can be read back from the spool.
+const maxSpoolLine = 512 * 1024 * 1024
+
+// ErrSpoolFull indicates the spool has reached its message limit.
+var ErrSpoolFull = errors.New("spool is full")
+
+// Spool is a file backed fifo queue which holds messages while a sink is unavailable. Each
+// message is stored as a line of json.
+type Spool[T any] struct {
+	sync.Mutex
+	drain sync.Mutex // serializes drains, which send messages without holding the spool lock
+	path  string     // the spool file path
+	limit int        // the maximum number of messages held, 0 is unlimited
+	size  int        // the number of messages currently held
+}
+
+// NewSpool opens or creates the spool file at path.
+func NewSpool[T any](path string, limit int) (*Spool[T], error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool[T]{
+		path:  path,
+		limit: limit,
+	}
+
+	msgs, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.size = len(msgs)
+
+	return s, nil
+}
+
+// Len returns the number of messages held in the spool.
+func (s *Spool[T]) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// Push appends messages to the end of the spool. Either all of them are spooled, or none
+// if they would exceed the limit.
+func (s *Spool[T]) Push(msgs ...T) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.limit > 0 && s.size+len(msgs) > s.limit {
+		return ErrSpoolFull
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, m := range msgs {
+		if err := s.write(f, m); err != nil {
+			return err
+		}
+		s.size++
+	}
+
+	return nil
+}
+
+// Drain passes each message to fn in the order they were pushed. If fn returns an
+// error, draining stops and the unsent messages are kept for the next attempt.
+func (s *Spool[T]) Drain(fn func(m T) error) error {
+	return s.DrainBatch(1, func(msgs []T) error {
+		return fn(msgs[0])
+	})
+}
+
+// DrainBatch passes the messages to fn in batches of up to size, in the order they were
+// pushed. If fn returns an error, draining stops and the messages of the failed batch and
+// those after it are kept for the next attempt. The spool is not locked while fn runs, so
+// messages can be pushed behind those being drained.
+func (s *Spool[T]) DrainBatch(size int, fn func(msgs []T) error) error {
+	s.drain.Lock()
+	defer s.drain.Unlock()
+
+	s.Lock()
+	msgs, err := s.read()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		batch := msgs[sent:min(sent+size, len(msgs))]
+		if err = fn(batch); err != nil {
+			break
+		}
+		sent += len(batch)
+	}
+
+	return errors.Join(err, s.discard(sent))
+}
+
+// discard removes the first n messages of the spool, keeping any pushed since they were read.
+func (s *Spool[T]) discard(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	msgs, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if n < len(msgs) {
+		return s.rewrite(msgs[n:])
+	}
+
+	s.size = 0
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// read returns all messages in the spool file.
+func (s *Spool[T]) read() ([]T, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msgs := make([]T, 0)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxSpoolLine)
+	for sc.Scan() {
+		var m T
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			continue // skip a partially written line
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, sc.Err()
+}
+
+// rewrite replaces the spool file with the given messages.
+func (s *Spool[T]) rewrite(msgs []T) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range msgs {
+		if err := s.write(f, m); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.size = len(msgs)
+	return os.Rename(tmp, s.path)
+}
+
+// write encodes a message as a single line.
+func (s *Spool[T]) write(f *os.File, m T) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
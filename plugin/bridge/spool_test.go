@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type spooledMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload,omitempty"`
+	Qos     byte   `json:"qos,omitempty"`
+}
+
+func TestSpoolPushDrain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "test.spool")
+	s, err := NewSpool[spooledMessage](path, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, s.Len())
+
+	require.NoError(t, s.Push(spooledMessage{Topic: "a/b", Payload: []byte("1"), Qos: 1}))
+	require.NoError(t, s.Push(spooledMessage{Topic: "a/c", Payload: []byte("2\n3")}))
+	require.Equal(t, 2, s.Len())
+
+	// reopening the spool keeps the messages
+	s, err = NewSpool[spooledMessage](path, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, s.Len())
+
+	got := make([]spooledMessage, 0)
+	err = s.Drain(func(m spooledMessage) error {
+		got = append(got, m)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []spooledMessage{
+		{Topic: "a/b", Payload: []byte("1"), Qos: 1},
+		{Topic: "a/c", Payload: []byte("2\n3")},
+	}, got)
+	require.Equal(t, 0, s.Len())
+	require.NoFileExists(t, path)
+}
+
+func TestSpoolDrainError(t *testing.T) {
+	s, err := NewSpool[spooledMessage](filepath.Join(t.TempDir(), "test.spool"), 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Push(spooledMessage{Topic: "a"}))
+	require.NoError(t, s.Push(spooledMessage{Topic: "b"}))
+	require.NoError(t, s.Push(spooledMessage{Topic: "c"}))
+
+	errTest := errors.New("test")
+	err = s.Drain(func(m spooledMessage) error {
+		if m.Topic == "b" {
+			return errTest
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errTest)
+	require.Equal(t, 2, s.Len())
+
+	topics := make([]string, 0)
+	require.NoError(t, s.Drain(func(m spooledMessage) error {
+		topics = append(topics, m.Topic)
+		return nil
+	}))
+	require.Equal(t, []string{"b", "c"}, topics)
+}
+
+func TestSpoolDrainBatch(t *testing.T) {
+	s, err := NewSpool[spooledMessage](filepath.Join(t.TempDir(), "test.spool"), 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Push(spooledMessage{Topic: "a"}, spooledMessage{Topic: "b"}, spooledMessage{Topic: "c"}))
+
+	errTest := errors.New("test")
+	batches := make([]int, 0)
+	err = s.DrainBatch(2, func(msgs []spooledMessage) error {
+		batches = append(batches, len(msgs))
+		if msgs[0].Topic == "c" {
+			return errTest
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errTest)
+	require.Equal(t, []int{2, 1}, batches)
+	require.Equal(t, 1, s.Len())
+}
+
+func TestSpoolLimit(t *testing.T) {
+	s, err := NewSpool[spooledMessage](filepath.Join(t.TempDir(), "test.spool"), 2)
+	require.NoError(t, err)
+	require.NoError(t, s.Push(spooledMessage{Topic: "a"}))
+	require.ErrorIs(t, s.Push(spooledMessage{Topic: "b"}, spooledMessage{Topic: "c"}), ErrSpoolFull)
+	require.NoError(t, s.Push(spooledMessage{Topic: "b"}))
+	require.ErrorIs(t, s.Push(spooledMessage{Topic: "c"}), ErrSpoolFull)
+	require.Equal(t, 2, s.Len())
+}
+
+func TestSpoolPushWhileDraining(t *testing.T) {
+	s, err := NewSpool[spooledMessage](filepath.Join(t.TempDir(), "test.spool"), 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Push(spooledMessage{Topic: "a"}, spooledMessage{Topic: "b"}))
+
+	// messages pushed while draining are kept behind those drained
+	require.NoError(t, s.Drain(func(m spooledMessage) error {
+		return s.Push(spooledMessage{Topic: m.Topic + "2"})
+	}))
+	require.Equal(t, 2, s.Len())
+
+	topics := make([]string, 0)
+	require.NoError(t, s.Drain(func(m spooledMessage) error {
+		topics = append(topics, m.Topic)
+		return nil
+	}))
+	require.Equal(t, []string{"a2", "b2"}, topics)
+	require.Equal(t, 0, s.Len())
+}
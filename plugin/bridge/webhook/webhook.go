@@ -0,0 +1,335 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+// The request body formats.
+const (
+	FormatJSON = "json"
+	FormatForm = "form"
+)
+
+// SignatureHeader is the request header containing the hex hmac-sha256 of the body, as sha256=<hex>.
+const SignatureHeader = "X-Comqtt-Signature"
+
+// TopicHeader is the request header containing the mqtt topic of a payload sent by a rule.
+const TopicHeader = "X-Comqtt-Topic"
+
+const (
+	defaultTimeout      = 5     // seconds
+	defaultQueueSize    = 10000 // messages
+	defaultBatchSize    = 1
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 500 // milliseconds, doubled on each retry
+)
+
+var (
+	// ErrInvalidOptions indicates the webhook options are incomplete or conflicting.
+	ErrInvalidOptions = errors.New("invalid webhook bridge options")
+
+	// errRetryable indicates a request failed in a way which may succeed if it is repeated.
+	errRetryable = errors.New("retryable")
+)
+
+// events are the actions which can have their own url.
+var events = map[string]bool{
+	bridge.Connect:     true,
+	bridge.Disconnect:  true,
+	bridge.Subscribe:   true,
+	bridge.Unsubscribe: true,
+	bridge.Publish:     true,
+	bridge.Delivered:   true,
+}
+
+// Options contains configuration settings for the webhook bridge. The queue size defaults
+// to 10000 and the batch size to 1, so requests are made by a background writer.
+type Options struct {
+	bridge.Options `yaml:",inline"`
+	WebhookOptions *webhookOptions `json:"webhook-options" yaml:"webhook-options"`
+}
+
+type webhookOptions struct {
+	URL          string            `json:"url" yaml:"url"`                     // url of the events without their own, and of payloads sent by rules
+	URLs         map[string]string `json:"urls" yaml:"urls"`                   // urls of events, keyed by action
+	Format       string            `json:"format" yaml:"format"`               // json (default) or form
+	Headers      map[string]string `json:"headers" yaml:"headers"`             // added to every request
+	Secret       string            `json:"secret" yaml:"secret"`               // signs request bodies in the X-Comqtt-Signature header
+	Timeout      int               `json:"timeout" yaml:"timeout"`             // request timeout in seconds, defaults to 5
+	MaxRetries   int               `json:"max-retries" yaml:"max-retries"`     // defaults to 3, -1 disables retries
+	RetryBackoff int               `json:"retry-backoff" yaml:"retry-backoff"` // milliseconds before the first retry, doubled on each retry
+}
+
+// Bridge is a hook which posts lifecycle and message events to webhooks.
+type Bridge struct {
+	bridge.Core
+	config *Options
+	client *http.Client
+	done   chan struct{} // closed when stopping, so failed requests are not retried
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-webhook"
+}
+
+// Init validates the options and starts sending messages.
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil || config.(*Options).WebhookOptions == nil {
+		return fmt.Errorf("%w: a url is required", ErrInvalidOptions)
+	}
+
+	b.config = config.(*Options)
+	if err := b.config.validate(); err != nil {
+		return err
+	}
+
+	b.client = &http.Client{Timeout: time.Duration(b.config.WebhookOptions.Timeout) * time.Second}
+	b.done = make(chan struct{})
+	return b.Start(&b.config.Options, b.write)
+}
+
+// validate checks the options and applies their defaults.
+func (o *Options) validate() error {
+	w := o.WebhookOptions
+	if w.Format == "" {
+		w.Format = FormatJSON
+	}
+	if w.Format != FormatJSON && w.Format != FormatForm {
+		return fmt.Errorf("%w: unknown format %s", ErrInvalidOptions, w.Format)
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = defaultTimeout
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultQueueSize
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	if o.BatchSize > 1 && w.Format == FormatForm {
+		return fmt.Errorf("%w: batches can only be sent as json", ErrInvalidOptions)
+	}
+	if w.MaxRetries == 0 {
+		w.MaxRetries = defaultMaxRetries
+	}
+	if w.RetryBackoff <= 0 {
+		w.RetryBackoff = defaultRetryBackoff
+	}
+
+	for action := range w.URLs {
+		if !events[action] {
+			return fmt.Errorf("%w: unknown event %s", ErrInvalidOptions, action)
+		}
+	}
+
+	if w.URL == "" {
+		if len(o.Events) == 0 {
+			return fmt.Errorf("%w: a url is required", ErrInvalidOptions)
+		}
+		for _, action := range o.Events {
+			if w.URLs[action] == "" {
+				return fmt.Errorf("%w: event %s has no url", ErrInvalidOptions, action)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stop sends the buffered messages without retrying failed requests, and stops the bridge.
+func (b *Bridge) Stop() error {
+	if b.done != nil {
+		close(b.done)
+		b.Close()
+		b.done = nil
+	}
+	return nil
+}
+
+// write posts records to the urls of their events, batching the messages of each url. Payloads
+// sent by rules are posted as they are, to the default url.
+func (b *Bridge) write(records []bridge.Record) error {
+	var errs []error
+	var urls []string
+	batches := make(map[string][]bridge.Message)
+	for _, r := range records {
+		if r.Message == nil {
+			errs = append(errs, b.sendPayload(r))
+			continue
+		}
+
+		u := b.url(r.Action)
+		if _, ok := batches[u]; !ok {
+			urls = append(urls, u)
+		}
+		batches[u] = append(batches[u], *r.Message)
+	}
+
+	for _, u := range urls {
+		body, contentType, err := b.encode(batches[u])
+		if err == nil {
+			err = b.send(u, body, contentType, nil)
+		}
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// url returns the url of an action.
+func (b *Bridge) url(action string) string {
+	if u := b.config.WebhookOptions.URLs[action]; u != "" {
+		return u
+	}
+	return b.config.WebhookOptions.URL
+}
+
+// sendPayload posts a payload sent by a rule to the default url, with its topic in a header.
+func (b *Bridge) sendPayload(r bridge.Record) error {
+	if b.config.WebhookOptions.URL == "" {
+		return fmt.Errorf("%w: a url is required to send payloads", ErrInvalidOptions)
+	}
+
+	return b.send(b.config.WebhookOptions.URL, r.Value, "application/json", map[string]string{TopicHeader: r.Topic})
+}
+
+// send posts a body to a url, retrying with backoff until the retries are exhausted.
+func (b *Bridge) send(u string, body []byte, contentType string, headers map[string]string) error {
+	backoff := time.Duration(b.config.WebhookOptions.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := b.post(u, body, contentType, headers)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errRetryable) || attempt >= b.config.WebhookOptions.MaxRetries || !b.wait(backoff) {
+			return fmt.Errorf("post to %s: %w", u, err)
+		}
+		backoff *= 2
+	}
+}
+
+// wait waits before a retry, returning false if the bridge is stopping.
+func (b *Bridge) wait(d time.Duration) bool {
+	select {
+	case <-b.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// post makes a single request. Network errors, 429 and 5xx responses are retryable.
+func (b *Bridge) post(u string, body []byte, contentType string, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range b.config.WebhookOptions.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if b.config.WebhookOptions.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(b.config.WebhookOptions.Secret, body))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%w: webhook responded with %s", errRetryable, resp.Status)
+	default:
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+}
+
+// encode returns the request body of messages. A single json message is sent as an object
+// unless batching is enabled.
+func (b *Bridge) encode(msgs []bridge.Message) ([]byte, string, error) {
+	if b.config.WebhookOptions.Format == FormatForm {
+		return []byte(formValues(msgs[0]).Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	var v any = msgs
+	if b.config.BatchSize == 1 {
+		v = msgs[0]
+	}
+
+	data, err := json.Marshal(v)
+	return data, "application/json", err
+}
+
+// formValues returns the fields of a message as form values, omitting empty fields as the
+// json encoding does. The payload is sent as text.
+func formValues(m bridge.Message) url.Values {
+	v := url.Values{}
+	v.Set("action", m.Action)
+	v.Set("clientid", m.ClientID)
+	v.Set("username", m.Username)
+	v.Set("ts", strconv.FormatInt(m.Timestamp, 10))
+	if m.Remote != "" {
+		v.Set("remote", m.Remote)
+	}
+	if m.Listener != "" {
+		v.Set("listener", m.Listener)
+	}
+	for _, t := range m.Topics {
+		v.Add("topics", t)
+	}
+	for _, c := range m.ReasonCodes {
+		v.Add("reasonCodes", strconv.Itoa(int(c)))
+	}
+	if len(m.Payload) > 0 {
+		v.Set("payload", string(m.Payload))
+	}
+	if m.ProtocolVersion > 0 {
+		v.Set("protocolVersion", strconv.Itoa(int(m.ProtocolVersion)))
+	}
+	if m.Clean {
+		v.Set("clean", "true")
+	}
+	if m.PacketID > 0 {
+		v.Set("packetid", strconv.Itoa(int(m.PacketID)))
+	}
+	return v
+}
+
+// Sign returns the signature of a request body, as sha256=<hex hmac-sha256>.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
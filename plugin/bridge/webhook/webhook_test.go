@@ -0,0 +1,331 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin/bridge"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type request struct {
+	path        string
+	contentType string
+	signature   string
+	topic       string
+	body        []byte
+}
+
+// recorder is a webhook which records its requests, failing the first failures of them.
+type recorder struct {
+	sync.Mutex
+	requests []request
+	failures atomic.Int32
+	status   int
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if r.failures.Add(-1) >= 0 {
+		w.WriteHeader(r.status)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, request{
+		path:        req.URL.Path,
+		contentType: req.Header.Get("Content-Type"),
+		signature:   req.Header.Get(SignatureHeader),
+		topic:       req.Header.Get(TopicHeader),
+		body:        body,
+	})
+}
+
+func (r *recorder) received() []request {
+	r.Lock()
+	defer r.Unlock()
+	return append([]request(nil), r.requests...)
+}
+
+func newWebhook(t *testing.T) (*recorder, string) {
+	r := new(recorder)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+func newBridge(t *testing.T, opts *Options) *Bridge {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(opts))
+	t.Cleanup(func() { _ = b.Stop() })
+	return b
+}
+
+func newClient() *mqtt.Client {
+	cl := &mqtt.Client{ID: "c1"}
+	cl.Properties.Username = []byte("u1")
+	cl.Properties.ProtocolVersion = 5
+	cl.Net.Remote = "127.0.0.1:1883"
+	cl.Net.Listener = "tcp"
+	return cl
+}
+
+func newPublish(topic string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte("hello"),
+		PacketID:    7,
+		Created:     1700000000,
+	}
+}
+
+func decode(t *testing.T, body []byte) bridge.Message {
+	var m bridge.Message
+	require.NoError(t, json.Unmarshal(body, &m))
+	return m
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "bridge-webhook", new(Bridge).ID())
+}
+
+func TestProvides(t *testing.T) {
+	b := newBridge(t, &Options{
+		Options:        bridge.Options{Events: []string{bridge.Connect, bridge.Delivered}},
+		WebhookOptions: &webhookOptions{URL: "http://x"},
+	})
+	require.True(t, b.Provides(mqtt.OnSessionEstablished))
+	require.True(t, b.Provides(mqtt.OnPacketSent))
+	require.False(t, b.Provides(mqtt.OnUnsubscribed))
+	require.False(t, b.Provides(mqtt.OnPublish))
+}
+
+func TestInitErrors(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, b.Init(nil), ErrInvalidOptions)
+	require.ErrorIs(t, b.Init(&Options{}), ErrInvalidOptions)
+	require.ErrorIs(t, b.Init(&Options{
+		Options:        bridge.Options{Events: []string{"retained"}},
+		WebhookOptions: &webhookOptions{URL: "http://x"},
+	}), bridge.ErrUnknownEvent)
+
+	for _, o := range []*Options{
+		{WebhookOptions: &webhookOptions{}},
+		{WebhookOptions: &webhookOptions{URL: "http://x", Format: "xml"}},
+		{Options: bridge.Options{BatchSize: 2}, WebhookOptions: &webhookOptions{URL: "http://x", Format: FormatForm}},
+		{WebhookOptions: &webhookOptions{URL: "http://x", URLs: map[string]string{"retained": "http://y"}}},
+		{
+			Options:        bridge.Options{Events: []string{bridge.Publish, bridge.Connect}},
+			WebhookOptions: &webhookOptions{URLs: map[string]string{bridge.Publish: "http://x"}},
+		},
+	} {
+		require.ErrorIs(t, b.Init(o), ErrInvalidOptions, o)
+	}
+}
+
+func TestInitDefaults(t *testing.T) {
+	opts := &Options{WebhookOptions: &webhookOptions{URL: "http://x"}}
+	newBridge(t, opts)
+	require.Equal(t, FormatJSON, opts.WebhookOptions.Format)
+	require.Equal(t, defaultTimeout, opts.WebhookOptions.Timeout)
+	require.Equal(t, defaultQueueSize, opts.QueueSize)
+	require.Equal(t, defaultBatchSize, opts.BatchSize)
+	require.Equal(t, defaultMaxRetries, opts.WebhookOptions.MaxRetries)
+	require.Equal(t, defaultRetryBackoff, opts.WebhookOptions.RetryBackoff)
+}
+
+func TestEvents(t *testing.T) {
+	r, u := newWebhook(t)
+	b := newBridge(t, &Options{
+		Options: bridge.Options{
+			Events: []string{bridge.Connect, bridge.Disconnect, bridge.Publish, bridge.Delivered, bridge.Subscribe},
+			Rules:  bridge.Rules{Topics: []string{"sensors/#"}, Filters: []string{"sensors/#"}},
+		},
+		WebhookOptions: &webhookOptions{
+			URL:    u + "/events",
+			URLs:   map[string]string{bridge.Publish: u + "/messages", bridge.Delivered: u + "/messages"},
+			Secret: "s3cret",
+		},
+	})
+
+	cl := newClient()
+	b.OnSessionEstablished(cl, packets.Packet{Created: 1700000000})
+	b.OnPublished(cl, newPublish("sensors/1"))
+	b.OnPublished(cl, newPublish("other/1")) // filtered
+	b.OnPacketSent(cl, newPublish("sensors/2"), nil)
+	b.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}}, nil)
+	b.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "sensors/+"}, {Filter: "other/#"}}}, []byte{1, 0x87}, []int{1, 1})
+	b.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "other/#"}}}, []byte{0}, []int{1})
+	require.False(t, b.Provides(mqtt.OnUnsubscribed))
+	b.OnDisconnect(cl, errors.New("gone"), false)
+
+	require.Eventually(t, func() bool { return len(r.received()) == 5 }, time.Second, 10*time.Millisecond)
+	reqs := r.received()
+
+	for _, req := range reqs {
+		require.Equal(t, "application/json", req.contentType)
+		require.Equal(t, Sign("s3cret", req.body), req.signature)
+	}
+
+	m := decode(t, reqs[0].body)
+	require.Equal(t, "/events", reqs[0].path)
+	require.Equal(t, bridge.Message{
+		Action:          bridge.Connect,
+		ClientID:        "c1",
+		Username:        "u1",
+		Remote:          "127.0.0.1:1883",
+		Listener:        "tcp",
+		ProtocolVersion: 5,
+		Timestamp:       1700000000,
+	}, m)
+
+	m = decode(t, reqs[1].body)
+	require.Equal(t, "/messages", reqs[1].path)
+	require.Equal(t, bridge.Publish, m.Action)
+	require.Equal(t, []string{"sensors/1"}, m.Topics)
+	require.Equal(t, []byte("hello"), m.Payload)
+	require.Equal(t, uint16(7), m.PacketID)
+
+	m = decode(t, reqs[2].body)
+	require.Equal(t, "/messages", reqs[2].path)
+	require.Equal(t, bridge.Delivered, m.Action)
+	require.Equal(t, []string{"sensors/2"}, m.Topics)
+
+	m = decode(t, reqs[3].body)
+	require.Equal(t, bridge.Subscribe, m.Action)
+	require.Equal(t, []string{"sensors/+"}, m.Topics)
+	require.Equal(t, []byte{1}, m.ReasonCodes)
+
+	m = decode(t, reqs[4].body)
+	require.Equal(t, "/events", reqs[4].path)
+	require.Equal(t, bridge.Disconnect, m.Action)
+	require.Equal(t, []byte("gone"), m.Payload)
+}
+
+func TestForm(t *testing.T) {
+	r, u := newWebhook(t)
+	b := newBridge(t, &Options{WebhookOptions: &webhookOptions{URL: u, Format: FormatForm}})
+
+	b.OnSubscribed(newClient(), packets.Packet{PacketID: 3, Created: 1700000000, Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}}, []byte{0, 1}, []int{1, 1})
+	require.Eventually(t, func() bool { return len(r.received()) == 1 }, time.Second, 10*time.Millisecond)
+
+	req := r.received()[0]
+	require.Equal(t, "application/x-www-form-urlencoded", req.contentType)
+	require.Empty(t, req.signature)
+	v, err := url.ParseQuery(string(req.body))
+	require.NoError(t, err)
+	require.Equal(t, url.Values{
+		"action":      {bridge.Subscribe},
+		"clientid":    {"c1"},
+		"username":    {"u1"},
+		"ts":          {"1700000000"},
+		"topics":      {"a", "b"},
+		"reasonCodes": {"0", "1"},
+		"packetid":    {"3"},
+	}, v)
+}
+
+func TestSend(t *testing.T) {
+	r, u := newWebhook(t)
+	b := newBridge(t, &Options{WebhookOptions: &webhookOptions{URL: u + "/rules", Secret: "s3cret"}})
+
+	require.NoError(t, b.Send("alerts/1", []byte(`{"t":1}`)))
+	reqs := r.received()
+	require.Len(t, reqs, 1)
+	require.Equal(t, "/rules", reqs[0].path)
+	require.Equal(t, "alerts/1", reqs[0].topic)
+	require.Equal(t, []byte(`{"t":1}`), reqs[0].body)
+	require.Equal(t, Sign("s3cret", reqs[0].body), reqs[0].signature)
+
+	// payloads are sent to the default url only
+	b = newBridge(t, &Options{
+		Options:        bridge.Options{Events: []string{bridge.Publish}},
+		WebhookOptions: &webhookOptions{URLs: map[string]string{bridge.Publish: u}},
+	})
+	require.ErrorIs(t, b.Send("alerts/1", []byte("1")), ErrInvalidOptions)
+}
+
+func TestBatch(t *testing.T) {
+	r, u := newWebhook(t)
+	b := newBridge(t, &Options{Options: bridge.Options{BatchSize: 3}, WebhookOptions: &webhookOptions{URL: u}})
+
+	// the records of a batch written by the core are sent in one request
+	records := make([]bridge.Record, 0, 3)
+	for i := 0; i < 3; i++ {
+		msg := bridge.Message{Action: bridge.Publish, Topics: []string{"a"}}
+		records = append(records, bridge.Record{Action: msg.Action, Message: &msg})
+	}
+	require.NoError(t, b.write(records))
+	require.NoError(t, b.write(records[:1]))
+
+	require.Len(t, r.received(), 2)
+	var batch []bridge.Message
+	require.NoError(t, json.Unmarshal(r.received()[0].body, &batch))
+	require.Len(t, batch, 3)
+	require.NoError(t, json.Unmarshal(r.received()[1].body, &batch))
+	require.Len(t, batch, 1)
+}
+
+func TestRetry(t *testing.T) {
+	r, u := newWebhook(t)
+	r.status = http.StatusServiceUnavailable
+	r.failures.Store(2)
+	b := newBridge(t, &Options{WebhookOptions: &webhookOptions{URL: u, RetryBackoff: 10}})
+
+	b.OnSessionEstablished(newClient(), packets.Packet{})
+	require.Eventually(t, func() bool { return len(r.received()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Zero(t, b.Dropped())
+
+	// client errors are not retried
+	r.status = http.StatusBadRequest
+	r.failures.Store(1)
+	b.OnSessionEstablished(newClient(), packets.Packet{})
+	require.Eventually(t, func() bool { return b.Dropped() == 1 }, time.Second, 10*time.Millisecond)
+
+	// the retries are exhausted
+	r.status = http.StatusInternalServerError
+	r.failures.Store(10)
+	b.OnSessionEstablished(newClient(), packets.Packet{})
+	require.Eventually(t, func() bool { return b.Dropped() == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(6), r.failures.Load()) // one attempt and three retries
+	require.Len(t, r.received(), 1)
+}
+
+func TestStopFlushes(t *testing.T) {
+	r, u := newWebhook(t)
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(&Options{WebhookOptions: &webhookOptions{URL: u}}))
+
+	b.OnSessionEstablished(newClient(), packets.Packet{})
+	b.OnDisconnect(newClient(), nil, false)
+	require.NoError(t, b.Stop())
+	require.Len(t, r.received(), 2)
+	require.NoError(t, b.Stop())
+}
+
+func TestSign(t *testing.T) {
+	require.Equal(t, "sha256=515aae133b435d4000956731f68ae5cf5eb85d4f0dc6a546d2bfcd3595ec1ae1", Sign("key", []byte("body")))
+}
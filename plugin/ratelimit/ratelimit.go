@@ -0,0 +1,409 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"golang.org/x/time/rate"
+)
+
+// The actions which can be taken when a client exceeds a limit.
+const (
+	ActionDrop       = "drop"       // drop the packet, or refuse the connection or subscription
+	ActionDisconnect = "disconnect" // disconnect the client with ErrQuotaExceeded
+	ActionPuback     = "puback"     // return ErrQuotaExceeded in the v5 puback, otherwise drop
+)
+
+const sweepInterval = time.Minute // how often idle connect buckets are removed
+
+var (
+	// ErrServerNotSet indicates SetServer was not called before the hook was added.
+	ErrServerNotSet = errors.New("rate limit requires the server to be set before it is added")
+
+	// ErrInvalidLimit indicates a limit has no rate or maximum, or an unknown action.
+	ErrInvalidLimit = errors.New("invalid rate limit")
+
+	// ErrConnectRateLimited indicates a connection was dropped because of the connect rate.
+	ErrConnectRateLimited = errors.New("connect rate limited")
+)
+
+// Options contains configuration settings for the rate limits. Each limit is taken from
+// the first user pattern which sets it, then the listener, then global.
+type Options struct {
+	Global    Limits            `json:"global" yaml:"global"`       // the default limits
+	Listeners map[string]Limits `json:"listeners" yaml:"listeners"` // limits keyed on listener id
+	Users     []UserLimits      `json:"users" yaml:"users"`         // limits for usernames, first match wins
+}
+
+// UserLimits are the limits for usernames matching a pattern.
+type UserLimits struct {
+	Pattern string `json:"pattern" yaml:"pattern"` // a path.Match pattern, such as sensor-*
+	Limits  `yaml:",inline"`
+}
+
+// Limits contains the limits for a scope. A nil limit is not set.
+type Limits struct {
+	Messages      *Limit `json:"messages" yaml:"messages"`           // publish packets per second per client
+	Bytes         *Limit `json:"bytes" yaml:"bytes"`                 // publish payload bytes per second per client
+	Connects      *Limit `json:"connects" yaml:"connects"`           // connections per second per ip
+	Subscriptions *Quota `json:"subscriptions" yaml:"subscriptions"` // subscriptions per client
+}
+
+// Limit is a token bucket which refills at rate per second up to burst.
+type Limit struct {
+	Rate   float64 `json:"rate" yaml:"rate"`     // tokens added per second
+	Burst  int     `json:"burst" yaml:"burst"`   // bucket size, defaults to the rate
+	Action string  `json:"action" yaml:"action"` // drop, disconnect or puback, defaults to drop
+}
+
+// Quota is a maximum count.
+type Quota struct {
+	Max    int    `json:"max" yaml:"max"`       // the maximum count
+	Action string `json:"action" yaml:"action"` // drop or disconnect, defaults to drop
+}
+
+// clientLimits are the token buckets of a connected client.
+type clientLimits struct {
+	messages      *rate.Limiter
+	bytes         *rate.Limiter
+	messagesLimit *Limit
+	bytesLimit    *Limit
+	subscriptions *Quota
+}
+
+// connectKey identifies the connect bucket of an ip for a limit.
+type connectKey struct {
+	limit *Limit
+	ip    string
+}
+
+// RateLimit is a hook which limits the message, byte, connect and subscription rates of clients.
+type RateLimit struct {
+	mqtt.HookBase
+	sync.Mutex
+	config    *Options
+	server    *mqtt.Server
+	clients   map[*mqtt.Client]*clientLimits
+	connects  map[connectKey]*rate.Limiter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// ID returns the ID of the hook.
+func (h *RateLimit) ID() string {
+	return "rate-limit"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *RateLimit) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnDisconnect,
+		mqtt.OnPublish,
+		mqtt.OnSubscribe,
+	}, []byte{b})
+}
+
+// SetServer sets the server which over-limit clients are disconnected from. It must be
+// called before the hook is added.
+func (h *RateLimit) SetServer(server *mqtt.Server) {
+	h.server = server
+}
+
+// Init validates the configuration.
+func (h *RateLimit) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if h.server == nil {
+		return ErrServerNotSet
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if err := h.config.Global.validate(); err != nil {
+		return fmt.Errorf("global: %w", err)
+	}
+
+	for id, l := range h.config.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listener %s: %w", id, err)
+		}
+	}
+
+	for _, u := range h.config.Users {
+		if _, err := path.Match(u.Pattern, ""); err != nil {
+			return fmt.Errorf("user %s: %w", u.Pattern, err)
+		}
+		if err := u.validate(); err != nil {
+			return fmt.Errorf("user %s: %w", u.Pattern, err)
+		}
+	}
+
+	h.clients = map[*mqtt.Client]*clientLimits{}
+	h.connects = map[connectKey]*rate.Limiter{}
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// validate returns an error if any of the limits are invalid.
+func (l Limits) validate() error {
+	for _, v := range []*Limit{l.Messages, l.Bytes, l.Connects} {
+		if v != nil && (v.Rate <= 0 || v.Burst < 0 || !validAction(v.Action)) {
+			return ErrInvalidLimit
+		}
+	}
+
+	if l.Subscriptions != nil && (l.Subscriptions.Max <= 0 || !validAction(l.Subscriptions.Action)) {
+		return ErrInvalidLimit
+	}
+
+	return nil
+}
+
+// validAction returns true if the action is known.
+func validAction(action string) bool {
+	switch action {
+	case "", ActionDrop, ActionDisconnect, ActionPuback:
+		return true
+	default:
+		return false
+	}
+}
+
+// newLimiter returns a token bucket for a limit, which starts full.
+func newLimiter(l *Limit) *rate.Limiter {
+	burst := l.Burst
+	if burst == 0 {
+		burst = max(int(l.Rate), 1)
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), burst)
+}
+
+// resolve returns the limits which apply to a client.
+func (h *RateLimit) resolve(cl *mqtt.Client) Limits {
+	var scopes []Limits
+	username := string(cl.Properties.Username)
+	for _, u := range h.config.Users {
+		if ok, _ := path.Match(u.Pattern, username); ok {
+			scopes = append(scopes, u.Limits)
+			break
+		}
+	}
+
+	if l, ok := h.config.Listeners[cl.Net.Listener]; ok {
+		scopes = append(scopes, l)
+	}
+	scopes = append(scopes, h.config.Global)
+
+	var out Limits
+	for i := len(scopes) - 1; i >= 0; i-- {
+		s := scopes[i]
+		if s.Messages != nil {
+			out.Messages = s.Messages
+		}
+		if s.Bytes != nil {
+			out.Bytes = s.Bytes
+		}
+		if s.Connects != nil {
+			out.Connects = s.Connects
+		}
+		if s.Subscriptions != nil {
+			out.Subscriptions = s.Subscriptions
+		}
+	}
+
+	return out
+}
+
+// client returns the buckets of a client, creating them if necessary.
+func (h *RateLimit) client(cl *mqtt.Client) *clientLimits {
+	h.Lock()
+	defer h.Unlock()
+	if c, ok := h.clients[cl]; ok {
+		return c
+	}
+
+	l := h.resolve(cl)
+	c := &clientLimits{
+		messagesLimit: l.Messages,
+		bytesLimit:    l.Bytes,
+		subscriptions: l.Subscriptions,
+	}
+	if l.Messages != nil {
+		c.messages = newLimiter(l.Messages)
+	}
+	if l.Bytes != nil {
+		c.bytes = newLimiter(l.Bytes)
+	}
+
+	h.clients[cl] = c
+	return c
+}
+
+// OnConnect refuses connections from an ip which exceed the connect rate.
+func (h *RateLimit) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if cl.Net.Inline {
+		return nil
+	}
+
+	l := h.resolve(cl).Connects
+	if l == nil {
+		return nil
+	}
+
+	ip := cl.Net.Remote
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	now := h.now()
+	h.Lock()
+	h.sweep(now)
+	key := connectKey{limit: l, ip: ip}
+	lim, ok := h.connects[key]
+	if !ok {
+		lim = newLimiter(l)
+		h.connects[key] = lim
+	}
+	allowed := lim.AllowN(now, 1)
+	h.Unlock()
+
+	if allowed {
+		return nil
+	}
+
+	h.Log.Info("connect rate exceeded", "client", cl.ID, "remote", cl.Net.Remote, "listener", cl.Net.Listener)
+	if l.Action == ActionDisconnect || l.Action == ActionPuback {
+		return packets.ErrQuotaExceeded
+	}
+
+	return ErrConnectRateLimited
+}
+
+// sweep removes the connect buckets which have refilled, and so are no different to a new bucket.
+// The lock must be held.
+func (h *RateLimit) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < sweepInterval {
+		return
+	}
+
+	h.lastSweep = now
+	for key, lim := range h.connects {
+		if lim.TokensAt(now) >= float64(lim.Burst()) {
+			delete(h.connects, key)
+		}
+	}
+}
+
+// OnDisconnect removes the buckets of a client.
+func (h *RateLimit) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, cl)
+}
+
+// OnPublish applies the message and byte rates of a client to an inbound message.
+func (h *RateLimit) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	c := h.client(cl)
+	now := h.now()
+	if c.messages != nil && !c.messages.AllowN(now, 1) {
+		return pk, h.exceeded(cl, pk, c.messagesLimit.Action, "message rate exceeded")
+	}
+
+	if c.bytes != nil && !c.bytes.AllowN(now, len(pk.Payload)) {
+		return pk, h.exceeded(cl, pk, c.bytesLimit.Action, "byte rate exceeded")
+	}
+
+	return pk, nil
+}
+
+// exceeded takes the action of an exceeded publish limit, returning the error for OnPublish.
+func (h *RateLimit) exceeded(cl *mqtt.Client, pk packets.Packet, action, msg string) error {
+	h.Log.Debug(msg, "client", cl.ID, "topic", pk.TopicName, "action", action)
+	switch action {
+	case ActionDisconnect:
+		_ = h.server.DisconnectClient(cl, packets.ErrQuotaExceeded)
+	case ActionPuback:
+		if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+			return packets.ErrQuotaExceeded
+		}
+	}
+
+	return packets.ErrRejectPacket
+}
+
+// OnSubscribe rejects the new filters of a client which exceed its subscription quota.
+func (h *RateLimit) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if cl.Net.Inline {
+		return pk
+	}
+
+	q := h.client(cl).subscriptions
+	if q == nil {
+		return pk
+	}
+
+	count := cl.State.Subscriptions.Len()
+	added := map[string]struct{}{}
+	codes := make([]byte, len(pk.Filters))
+	copy(codes, pk.ReasonCodes)
+	exceeded := false
+	for i, sub := range pk.Filters {
+		if codes[i] >= packets.ErrUnspecifiedError.Code {
+			continue // rejected by another hook
+		}
+		if _, ok := cl.State.Subscriptions.Get(sub.Filter); ok {
+			continue
+		}
+		if _, ok := added[sub.Filter]; ok {
+			continue
+		}
+
+		if count+len(added) >= q.Max {
+			codes[i] = packets.ErrQuotaExceeded.Code
+			exceeded = true
+			continue
+		}
+		added[sub.Filter] = struct{}{}
+	}
+
+	if !exceeded {
+		return pk
+	}
+
+	h.Log.Debug("subscription quota exceeded", "client", cl.ID, "action", q.Action)
+	if q.Action == ActionDisconnect {
+		for i := range codes {
+			if codes[i] < packets.ErrUnspecifiedError.Code {
+				codes[i] = packets.ErrQuotaExceeded.Code
+			}
+		}
+		_ = h.server.DisconnectClient(cl, packets.ErrQuotaExceeded)
+	}
+
+	pk.ReasonCodes = codes
+	return pk
+}
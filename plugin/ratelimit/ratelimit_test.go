@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package ratelimit
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// clock is a manually advanced time source.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newHook(t *testing.T, opts *Options) (*RateLimit, *mqtt.Server, *clock) {
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	c := &clock{t: time.Unix(1700000000, 0)}
+	h := &RateLimit{now: c.now}
+	h.SetOpts(logger, nil)
+	h.SetServer(s)
+	require.NoError(t, h.Init(opts))
+	return h, s, c
+}
+
+func newClient(t *testing.T, s *mqtt.Server, listener, username string) *mqtt.Client {
+	r, w := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, w)
+	}()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+
+	cl := s.NewClient(r, listener, "c1", false)
+	cl.Net.Remote = "10.0.0.1:51000"
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+	return cl
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "rate-limit", new(RateLimit).ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(RateLimit)
+	require.True(t, h.Provides(mqtt.OnConnect))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnPublish))
+	require.True(t, h.Provides(mqtt.OnSubscribe))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+}
+
+func TestInitErrors(t *testing.T) {
+	h := new(RateLimit)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrServerNotSet)
+
+	h.SetServer(mqtt.New(&mqtt.Options{Logger: logger}))
+	require.NoError(t, h.Init(nil))
+	require.ErrorIs(t, h.Init(&Options{Global: Limits{Messages: &Limit{}}}), ErrInvalidLimit)
+	require.ErrorIs(t, h.Init(&Options{Global: Limits{Bytes: &Limit{Rate: 1, Action: "kick"}}}), ErrInvalidLimit)
+	require.ErrorIs(t, h.Init(&Options{Listeners: map[string]Limits{"t1": {Subscriptions: &Quota{}}}}), ErrInvalidLimit)
+	require.ErrorIs(t, h.Init(&Options{Users: []UserLimits{{Pattern: "a", Limits: Limits{Connects: &Limit{Rate: -1}}}}}), ErrInvalidLimit)
+	require.Error(t, h.Init(&Options{Users: []UserLimits{{Pattern: "["}}}))
+}
+
+func TestResolve(t *testing.T) {
+	global := &Limit{Rate: 1}
+	listener := &Limit{Rate: 2}
+	user := &Limit{Rate: 3}
+	quota := &Quota{Max: 1}
+	h, s, _ := newHook(t, &Options{
+		Global:    Limits{Messages: global, Bytes: global, Subscriptions: quota},
+		Listeners: map[string]Limits{"ws": {Messages: listener, Bytes: listener}},
+		Users: []UserLimits{
+			{Pattern: "sensor-*", Limits: Limits{Messages: user}},
+			{Pattern: "*", Limits: Limits{Bytes: user}},
+		},
+	})
+
+	l := h.resolve(newClient(t, s, "tcp", ""))
+	require.Same(t, global, l.Messages)
+	require.Same(t, user, l.Bytes)
+	require.Same(t, quota, l.Subscriptions)
+	require.Nil(t, l.Connects)
+
+	l = h.resolve(newClient(t, s, "ws", "sensor-1"))
+	require.Same(t, user, l.Messages)
+	require.Same(t, listener, l.Bytes) // only the first matching pattern applies
+}
+
+func TestOnConnect(t *testing.T) {
+	h, s, c := newHook(t, &Options{
+		Global:    Limits{Connects: &Limit{Rate: 1, Burst: 2}},
+		Listeners: map[string]Limits{"ws": {Connects: &Limit{Rate: 1, Action: ActionDisconnect}}},
+	})
+
+	cl := newClient(t, s, "tcp", "")
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	require.ErrorIs(t, h.OnConnect(cl, packets.Packet{}), ErrConnectRateLimited)
+
+	// the ip is limited separately on another listener with different limits
+	ws := newClient(t, s, "ws", "")
+	require.NoError(t, h.OnConnect(ws, packets.Packet{}))
+	require.ErrorIs(t, h.OnConnect(ws, packets.Packet{}), packets.ErrQuotaExceeded)
+
+	c.t = c.t.Add(time.Second)
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+
+	cl.Net.Inline = true
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+}
+
+func TestOnConnectSweep(t *testing.T) {
+	h, s, c := newHook(t, &Options{Global: Limits{Connects: &Limit{Rate: 1}}})
+	require.NoError(t, h.OnConnect(newClient(t, s, "tcp", ""), packets.Packet{}))
+	require.Len(t, h.connects, 1)
+
+	c.t = c.t.Add(sweepInterval)
+	cl := newClient(t, s, "tcp", "")
+	cl.Net.Remote = "10.0.0.2:51000"
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	require.Len(t, h.connects, 1)
+}
+
+func TestOnPublishDrop(t *testing.T) {
+	h, s, c := newHook(t, &Options{Global: Limits{Messages: &Limit{Rate: 1}}})
+	cl := newClient(t, s, "tcp", "")
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+
+	_, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	c.t = c.t.Add(time.Second)
+	_, err = h.OnPublish(cl, pk)
+	require.NoError(t, err)
+}
+
+func TestOnPublishPuback(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Bytes: &Limit{Rate: 8, Action: ActionPuback}}})
+	cl := newClient(t, s, "tcp", "")
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	pk.FixedHeader.Qos = 1
+
+	_, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+
+	pk.FixedHeader.Qos = 0
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
+
+func TestOnPublishPubackQos2(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	h := &RateLimit{now: time.Now}
+	h.SetServer(s)
+	require.NoError(t, s.AddHook(h, &Options{Global: Limits{Messages: &Limit{Rate: 1, Action: ActionPuback}}}))
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+	cl := s.NewClient(r, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.ResetReceiveQuota(10)
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}, TopicName: "a/b", PacketID: 7}
+	_, err := h.OnPublish(cl, pk) // takes the only token
+	require.NoError(t, err)
+
+	go func() { _ = s.InjectPacket(cl, pk) }()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(w, buf)
+	require.NoError(t, err)
+	require.Equal(t, packets.Pubrec<<4, buf[0]) // a qos 2 publish is refused in its pubrec
+	require.Equal(t, []byte{0, 7, packets.ErrQuotaExceeded.Code}, buf[2:])
+}
+
+func TestOnPublishDisconnect(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Messages: &Limit{Rate: 1, Action: ActionDisconnect}}})
+	cl := newClient(t, s, "tcp", "")
+	pk := packets.Packet{TopicName: "a/b"}
+
+	_, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	require.False(t, cl.Closed())
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	require.True(t, cl.Closed())
+	require.ErrorIs(t, cl.StopCause(), packets.ErrQuotaExceeded)
+}
+
+func TestOnPublishInline(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Messages: &Limit{Rate: 1}}})
+	cl := newClient(t, s, "tcp", "")
+	cl.Net.Inline = true
+	for i := 0; i < 3; i++ {
+		_, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b"})
+		require.NoError(t, err)
+	}
+	require.Empty(t, h.clients)
+}
+
+func TestOnDisconnect(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Messages: &Limit{Rate: 1}}})
+	cl := newClient(t, s, "tcp", "")
+	_, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b"})
+	require.NoError(t, err)
+	require.Len(t, h.clients, 1)
+
+	h.OnDisconnect(cl, nil, false)
+	require.Empty(t, h.clients)
+}
+
+func TestOnSubscribe(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Subscriptions: &Quota{Max: 2}}})
+	cl := newClient(t, s, "tcp", "")
+	cl.State.Subscriptions.Add("a", packets.Subscription{Filter: "a"})
+
+	pk := h.OnSubscribe(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}})
+	require.Empty(t, pk.ReasonCodes)
+
+	pk = h.OnSubscribe(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "b"}, {Filter: "a"}, {Filter: "b"}, {Filter: "c"}}})
+	require.Equal(t, []byte{0, 0, 0, packets.ErrQuotaExceeded.Code}, pk.ReasonCodes)
+	require.False(t, cl.Closed())
+}
+
+func TestOnSubscribeRejectedByOtherHook(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Subscriptions: &Quota{Max: 1}}})
+	cl := newClient(t, s, "tcp", "")
+
+	// the rejected filter does not count toward the quota and keeps its code
+	pk := h.OnSubscribe(cl, packets.Packet{
+		Filters:     packets.Subscriptions{{Filter: "a"}, {Filter: "b"}, {Filter: "c"}},
+		ReasonCodes: []byte{packets.ErrNotAuthorized.Code},
+	})
+	require.Equal(t, []byte{packets.ErrNotAuthorized.Code, 0, packets.ErrQuotaExceeded.Code}, pk.ReasonCodes)
+}
+
+func TestOnSubscribeDisconnect(t *testing.T) {
+	h, s, _ := newHook(t, &Options{Global: Limits{Subscriptions: &Quota{Max: 1, Action: ActionDisconnect}}})
+	cl := newClient(t, s, "tcp", "")
+
+	pk := h.OnSubscribe(cl, packets.Packet{
+		Filters:     packets.Subscriptions{{Filter: "a"}, {Filter: "b"}, {Filter: "c"}},
+		ReasonCodes: []byte{packets.ErrNotAuthorized.Code},
+	})
+	require.Equal(t, []byte{packets.ErrNotAuthorized.Code, packets.ErrQuotaExceeded.Code, packets.ErrQuotaExceeded.Code}, pk.ReasonCodes)
+	require.True(t, cl.Closed())
+}
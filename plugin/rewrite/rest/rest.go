@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rest
+
+import (
+	"net/http"
+
+	rt "github.com/wind-c/comqtt/v2/mqtt/rest"
+	"github.com/wind-c/comqtt/v2/plugin/rewrite"
+)
+
+type rest struct {
+	hook *rewrite.Rewrite
+}
+
+func New(hook *rewrite.Rewrite) *rest {
+	return &rest{
+		hook: hook,
+	}
+}
+
+func (s *rest) GenHandlers() map[string]rt.Handler {
+	return map[string]rt.Handler{
+		"GET /api/v1/rewrite/rules": s.getRules,
+	}
+}
+
+// getRules return all topic rewrite rules with the number of topics they have rewritten
+// GET api/v1/rewrite/rules
+func (s *rest) getRules(w http.ResponseWriter, r *http.Request) {
+	rt.Ok(w, s.hook.Rules())
+}
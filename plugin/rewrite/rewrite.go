@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// The packets a rule applies to.
+const (
+	ActionAll       = "all"       // publish, subscribe and unsubscribe packets
+	ActionPublish   = "publish"   // the topics of publish packets
+	ActionSubscribe = "subscribe" // the filters of subscribe and unsubscribe packets
+)
+
+// ErrInvalidRule indicates a rule is incomplete or has an invalid filter or regex.
+var ErrInvalidRule = errors.New("invalid topic rewrite rule")
+
+// placeholder matches the $1, $2... placeholders of a destination topic.
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// Options contains configuration settings for the topic rewrite hook.
+type Options struct {
+	Rules []Rule `json:"rules" yaml:"rules"` // the first rule matching a topic or filter is applied
+}
+
+// Rule rewrites the topics and filters matching a source filter to a destination. The
+// $1, $2... placeholders of the destination are replaced with the submatches of the regex,
+// or without a regex, with the levels matched by the + and # wildcards of the source.
+type Rule struct {
+	Action string `json:"action" yaml:"action"` // all (default), publish or subscribe
+	Source string `json:"source" yaml:"source"` // topic filter, wildcard(#、+) is supported
+	Regex  string `json:"regex" yaml:"regex"`   // optional regex the topic must also match
+	Dest   string `json:"dest" yaml:"dest"`     // the rewritten topic or filter
+}
+
+// RuleStats is a rule with the number of topics and filters it has rewritten.
+type RuleStats struct {
+	Rule
+	Rewritten int64 `json:"rewritten"`
+}
+
+// rule is a rule with its regex compiled.
+type rule struct {
+	Rule
+	re        *regexp.Regexp
+	rewritten atomic.Int64
+}
+
+// Rewrite is a hook which rewrites the topics of published messages and the filters of
+// subscriptions as they are read, so the validity, acl checks and retained messages of
+// the server all apply to the rewritten topics.
+type Rewrite struct {
+	mqtt.HookBase
+	config *Options
+	rules  []*rule
+}
+
+// ID returns the ID of the hook.
+func (h *Rewrite) ID() string {
+	return "topic-rewrite"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Rewrite) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPacketRead,
+	}, []byte{b})
+}
+
+// Init validates the rules and compiles their regexes.
+func (h *Rewrite) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	h.rules = make([]*rule, 0, len(h.config.Rules))
+	for _, r := range h.config.Rules {
+		lr, err := loadRule(r)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Source, err)
+		}
+
+		h.rules = append(h.rules, lr)
+	}
+
+	return nil
+}
+
+// loadRule validates a rule, applies its defaults and compiles its regex.
+func loadRule(r Rule) (*rule, error) {
+	if r.Source == "" || r.Dest == "" {
+		return nil, fmt.Errorf("%w: source and dest are required", ErrInvalidRule)
+	}
+
+	if !mqtt.IsValidFilter(r.Source, false) || mqtt.IsSharedFilter(r.Source) {
+		return nil, fmt.Errorf("%w: invalid source filter", ErrInvalidRule)
+	}
+
+	if r.Action == "" {
+		r.Action = ActionAll
+	}
+
+	switch r.Action {
+	case ActionAll, ActionPublish, ActionSubscribe:
+	default:
+		return nil, fmt.Errorf("%w: unknown action %s", ErrInvalidRule, r.Action)
+	}
+
+	lr := &rule{Rule: r}
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRule, err)
+		}
+		lr.re = re
+	}
+
+	return lr, nil
+}
+
+// Rules returns the rules with the number of topics and filters they have rewritten.
+func (h *Rewrite) Rules() []RuleStats {
+	v := make([]RuleStats, 0, len(h.rules))
+	for _, r := range h.rules {
+		v = append(v, RuleStats{Rule: r.Rule, Rewritten: r.rewritten.Load()})
+	}
+
+	return v
+}
+
+// OnPacketRead rewrites the topic of a publish packet, or the filters of a subscribe or
+// unsubscribe packet, before the packet is validated.
+func (h *Rewrite) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	switch pk.FixedHeader.Type {
+	case packets.Publish:
+		if pk.TopicName == "" { // an established topic alias is already rewritten
+			return pk, nil
+		}
+
+		if delay, topic, ok := mqtt.ParseDelayedTopic(pk.TopicName); ok {
+			if topic, ok = h.Rewrite(ActionPublish, topic); ok {
+				pk.TopicName = mqtt.DelayedPrefix + "/" + strconv.FormatInt(delay, 10) + "/" + topic
+			}
+		} else if topic, ok := h.Rewrite(ActionPublish, pk.TopicName); ok {
+			pk.TopicName = topic
+		}
+	case packets.Subscribe, packets.Unsubscribe:
+		filters := make(packets.Subscriptions, len(pk.Filters))
+		copy(filters, pk.Filters)
+		for i := range filters {
+			if filter, ok := h.rewriteFilter(filters[i].Filter); ok {
+				filters[i].Filter = filter
+			}
+		}
+		pk.Filters = filters
+	}
+
+	return pk, nil
+}
+
+// rewriteFilter rewrites a subscription filter, keeping the share prefix and group of a
+// shared subscription.
+func (h *Rewrite) rewriteFilter(filter string) (string, bool) {
+	if !mqtt.IsSharedFilter(filter) {
+		return h.Rewrite(ActionSubscribe, filter)
+	}
+
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return filter, false
+	}
+
+	rewritten, ok := h.Rewrite(ActionSubscribe, parts[2])
+	if !ok {
+		return filter, false
+	}
+
+	return parts[0] + "/" + parts[1] + "/" + rewritten, true
+}
+
+// Rewrite applies the first rule for the action matching a topic or filter, returning false
+// if no rule matches or the rewritten topic or filter would not be valid.
+func (h *Rewrite) Rewrite(action, topic string) (string, bool) {
+	for _, r := range h.rules {
+		if r.Action != ActionAll && r.Action != action {
+			continue
+		}
+
+		if !mqtt.MatchFilter(r.Source, topic) {
+			continue
+		}
+
+		var captures []string
+		if r.re != nil {
+			m := r.re.FindStringSubmatch(topic)
+			if m == nil {
+				continue
+			}
+			captures = m[1:]
+		} else {
+			captures = wildcards(r.Source, topic)
+		}
+
+		dest := expand(r.Dest, captures)
+		if !mqtt.IsValidFilter(dest, action == ActionPublish) {
+			h.Log.Warn("rewritten topic is not valid", "rule", r.Source, "topic", topic, "dest", dest)
+			return topic, false
+		}
+
+		r.rewritten.Add(1)
+		h.Log.Debug("rewrote topic", "rule", r.Source, "topic", topic, "dest", dest)
+		return dest, true
+	}
+
+	return topic, false
+}
+
+// wildcards returns the levels of a topic matched by the + and # wildcards of a filter.
+func wildcards(filter, topic string) []string {
+	levels := strings.Split(topic, "/")
+	var v []string
+	for i, f := range strings.Split(filter, "/") {
+		switch f {
+		case "+":
+			v = append(v, levels[i])
+		case "#":
+			v = append(v, strings.Join(levels[min(i, len(levels)):], "/"))
+		}
+	}
+
+	return v
+}
+
+// expand replaces the $1, $2... placeholders of a destination with the captures. Placeholders
+// without a capture are removed.
+func expand(dest string, captures []string) string {
+	return placeholder.ReplaceAllStringFunc(dest, func(s string) string {
+		n, _ := strconv.Atoi(s[1:])
+		if n < 1 || n > len(captures) {
+			return ""
+		}
+		return captures[n-1]
+	})
+}
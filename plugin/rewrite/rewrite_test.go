@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rewrite
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var testRules = []Rule{
+	{Source: "v1/devices/+/up", Dest: "tenants/a/devices/$1/telemetry"},
+	{Action: ActionPublish, Source: "legacy/#", Dest: "new/$1"},
+	{Action: ActionSubscribe, Source: "old/+/+", Dest: "new/$2/$1"},
+	{Source: "sensors/#", Regex: `^sensors/(\w+)-(\d+)$`, Dest: "sensors/$1/$2"},
+	{Source: "bad/+", Dest: "bad/$1/#"},
+}
+
+func newHook(t *testing.T, rules []Rule) *Rewrite {
+	h := new(Rewrite)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Rules: rules}))
+	return h
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "topic-rewrite", new(Rewrite).ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Rewrite)
+	require.True(t, h.Provides(mqtt.OnPacketRead))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	h := new(Rewrite)
+	require.NoError(t, h.Init(nil))
+	require.Empty(t, h.rules)
+
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+
+	h = newHook(t, testRules)
+	require.Len(t, h.rules, len(testRules))
+	require.Equal(t, ActionAll, h.rules[0].Action)
+	require.NotNil(t, h.rules[3].re)
+}
+
+func TestInitInvalidRule(t *testing.T) {
+	tt := []Rule{
+		{Source: "a/+"},
+		{Dest: "b"},
+		{Source: "a/#/b", Dest: "b"},
+		{Source: "$share/g/a", Dest: "b"},
+		{Source: "a", Dest: "b", Action: "connect"},
+		{Source: "a", Dest: "b", Regex: "("},
+	}
+
+	for _, r := range tt {
+		h := new(Rewrite)
+		err := h.Init(&Options{Rules: []Rule{r}})
+		require.ErrorIs(t, err, ErrInvalidRule, r)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	h := newHook(t, testRules)
+
+	tt := []struct {
+		action string
+		topic  string
+		dest   string
+		ok     bool
+	}{
+		{action: ActionPublish, topic: "v1/devices/d1/up", dest: "tenants/a/devices/d1/telemetry", ok: true},
+		{action: ActionSubscribe, topic: "v1/devices/+/up", dest: "tenants/a/devices/+/telemetry", ok: true},
+		{action: ActionPublish, topic: "v1/devices/d1/down", dest: "v1/devices/d1/down"},
+		{action: ActionPublish, topic: "legacy/a/b", dest: "new/a/b", ok: true},
+		{action: ActionPublish, topic: "legacy", dest: "new/", ok: true},
+		{action: ActionSubscribe, topic: "legacy/a/b", dest: "legacy/a/b"},
+		{action: ActionSubscribe, topic: "old/a/b", dest: "new/b/a", ok: true},
+		{action: ActionPublish, topic: "old/a/b", dest: "old/a/b"},
+		{action: ActionPublish, topic: "sensors/temp-12", dest: "sensors/temp/12", ok: true},
+		{action: ActionPublish, topic: "sensors/temp", dest: "sensors/temp"},
+		{action: ActionPublish, topic: "bad/a", dest: "bad/a"},
+		{action: ActionSubscribe, topic: "bad/a", dest: "bad/a/#", ok: true},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.action+" "+tx.topic, func(t *testing.T) {
+			dest, ok := h.Rewrite(tx.action, tx.topic)
+			require.Equal(t, tx.ok, ok)
+			require.Equal(t, tx.dest, dest)
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	h := newHook(t, testRules)
+	h.Rewrite(ActionPublish, "v1/devices/d1/up")
+	h.Rewrite(ActionPublish, "v1/devices/d2/up")
+	h.Rewrite(ActionPublish, "bad/a")
+
+	rules := h.Rules()
+	require.Len(t, rules, len(testRules))
+	require.Equal(t, "v1/devices/+/up", rules[0].Source)
+	require.Equal(t, int64(2), rules[0].Rewritten)
+	require.Equal(t, int64(0), rules[4].Rewritten)
+}
+
+func TestOnPacketReadPublish(t *testing.T) {
+	h := newHook(t, testRules)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "v1/devices/d1/up",
+	}
+
+	out, err := h.OnPacketRead(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, "tenants/a/devices/d1/telemetry", out.TopicName)
+
+	pk.TopicName = "$delayed/60/v1/devices/d1/up"
+	out, err = h.OnPacketRead(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, "$delayed/60/tenants/a/devices/d1/telemetry", out.TopicName)
+
+	pk.TopicName = "$delayed/60/x/y"
+	out, err = h.OnPacketRead(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, "$delayed/60/x/y", out.TopicName)
+
+	pk.TopicName = ""
+	pk.Properties.TopicAlias = 1
+	out, err = h.OnPacketRead(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, "", out.TopicName)
+}
+
+func TestOnPacketReadSubscribe(t *testing.T) {
+	h := newHook(t, testRules)
+	for _, typ := range []byte{packets.Subscribe, packets.Unsubscribe} {
+		pk := packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: typ},
+			Filters: packets.Subscriptions{
+				{Filter: "v1/devices/+/up", Qos: 1},
+				{Filter: "$share/g1/v1/devices/d1/up"},
+				{Filter: "$share/g1"},
+				{Filter: "x/y"},
+			},
+		}
+
+		out, err := h.OnPacketRead(new(mqtt.Client), pk)
+		require.NoError(t, err)
+		require.Equal(t, "tenants/a/devices/+/telemetry", out.Filters[0].Filter)
+		require.Equal(t, byte(1), out.Filters[0].Qos)
+		require.Equal(t, "$share/g1/tenants/a/devices/d1/telemetry", out.Filters[1].Filter)
+		require.Equal(t, "$share/g1", out.Filters[2].Filter)
+		require.Equal(t, "x/y", out.Filters[3].Filter)
+		require.Equal(t, "v1/devices/+/up", pk.Filters[0].Filter) // the read packet is not modified
+	}
+}
+
+func TestOnPacketReadOther(t *testing.T) {
+	h := newHook(t, testRules)
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}
+	out, err := h.OnPacketRead(new(mqtt.Client), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestWildcards(t *testing.T) {
+	require.Equal(t, []string{"b", "d"}, wildcards("a/+/c/+", "a/b/c/d"))
+	require.Equal(t, []string{"b", "c/d"}, wildcards("a/+/#", "a/b/c/d"))
+	require.Equal(t, []string{""}, wildcards("a/#", "a"))
+	require.Empty(t, wildcards("a/b", "a/b"))
+}
+
+func TestExpand(t *testing.T) {
+	require.Equal(t, "x/b/a", expand("x/$2/$1", []string{"a", "b"}))
+	require.Equal(t, "x//y", expand("x/$3/y", []string{"a"}))
+	require.Equal(t, "x/$/y", expand("x/$/y", nil))
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholder matches the ${field} placeholders of topic and payload templates.
+var placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// act takes an action with the result of a rule.
+func (h *Engine) act(a Action, result, env map[string]any) error {
+	payload, err := renderPayload(a.Payload, result, env)
+	if err != nil {
+		return err
+	}
+
+	switch a.Type {
+	case ActionRepublish:
+		topic := render(a.Topic, result, env)
+		return h.server.Publish(topic, payload, a.Retain, a.Qos)
+	case ActionWebhook:
+		return h.callWebhook(a, payload)
+	default: // bridge
+		h.RLock()
+		sink := h.sinks[a.Bridge]
+		h.RUnlock()
+		return sink.Send(render(a.Topic, result, env), payload)
+	}
+}
+
+// callWebhook sends the payload to a webhook, failing if it does not respond with a 2xx status.
+func (h *Engine) callWebhook(a Action, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, a.Method, a.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range a.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// renderPayload renders a payload template, or encodes the result as json if there is no template.
+func renderPayload(tmpl string, result, env map[string]any) ([]byte, error) {
+	if tmpl == "" {
+		return json.Marshal(result)
+	}
+	return []byte(render(tmpl, result, env)), nil
+}
+
+// render replaces the placeholders of a template with the selected fields, falling back to
+// the event fields. Missing fields are replaced with an empty string.
+func render(tmpl string, result, env map[string]any) string {
+	if !strings.Contains(tmpl, "${") {
+		return tmpl
+	}
+
+	return placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[2 : len(m)-1]
+		if v, ok := result[name]; ok {
+			return format(v)
+		}
+		v, _ := ident{path: strings.Split(name, ".")}.Eval(env)
+		return format(v)
+	})
+}
+
+// format returns the text of a value for a template. Strings are used as they are, and
+// objects and arrays are encoded as json.
+func format(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	default:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
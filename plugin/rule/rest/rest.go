@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	rt "github.com/wind-c/comqtt/v2/mqtt/rest"
+	"github.com/wind-c/comqtt/v2/plugin/rule"
+)
+
+type rest struct {
+	engine *rule.Engine
+}
+
+func New(engine *rule.Engine) *rest {
+	return &rest{
+		engine: engine,
+	}
+}
+
+func (s *rest) GenHandlers() map[string]rt.Handler {
+	return map[string]rt.Handler{
+		"GET /api/v1/rules":         s.getRules,
+		"GET /api/v1/rules/{id}":    s.getRule,
+		"POST /api/v1/rules":        s.setRule,
+		"DELETE /api/v1/rules/{id}": s.deleteRule,
+	}
+}
+
+// getRules return all rules with their counters
+// GET api/v1/rules
+func (s *rest) getRules(w http.ResponseWriter, r *http.Request) {
+	rt.Ok(w, s.engine.Rules())
+}
+
+// getRule return a rule with its counters
+// GET api/v1/rules/{id}
+func (s *rest) getRule(w http.ResponseWriter, r *http.Request) {
+	if rs, ok := s.engine.Get(r.PathValue("id")); ok {
+		rt.Ok(w, rs)
+	} else {
+		rt.Error(w, http.StatusNotFound, rule.ErrRuleNotFound.Error())
+	}
+}
+
+// setRule add a rule, or replace the rule with the same id
+// POST api/v1/rules
+func (s *rest) setRule(w http.ResponseWriter, r *http.Request) {
+	var c rule.Config
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		rt.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.engine.Set(c); err != nil {
+		rt.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rs, _ := s.engine.Get(c.ID)
+	rt.Ok(w, rs)
+}
+
+// deleteRule remove a rule
+// DELETE api/v1/rules/{id}
+func (s *rest) deleteRule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.engine.Delete(id); err != nil {
+		rt.Error(w, http.StatusNotFound, err.Error())
+	} else {
+		rt.Ok(w, id)
+	}
+}
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+// The sources of client events, which can be used in the FROM clause instead of topic filters.
+const (
+	SourceClientConnected    = "$events/client_connected"
+	SourceClientDisconnected = "$events/client_disconnected"
+)
+
+// The names of the events, available to rules as the event field.
+const (
+	EventMessagePublish     = "message.publish"
+	EventClientConnected    = "client.connected"
+	EventClientDisconnected = "client.disconnected"
+)
+
+const (
+	defaultWorkers        = 4
+	defaultQueueSize      = 1024
+	defaultWebhookTimeout = 5 // seconds
+	defaultBridgeTopic    = "${topic}"
+)
+
+var (
+	// ErrServerNotSet indicates SetServer was not called before the hook was added.
+	ErrServerNotSet = errors.New("rule engine requires the server to be set before it is added")
+
+	// ErrInvalidRule indicates a rule is incomplete or has an invalid action.
+	ErrInvalidRule = errors.New("invalid rule")
+
+	// ErrRuleNotFound indicates there is no rule with the given id.
+	ErrRuleNotFound = errors.New("rule not found")
+)
+
+// Sink is a destination which rule results can be sent to, such as a configured bridge.
+type Sink interface {
+	Send(topic string, payload []byte) error
+}
+
+// Options contains configuration settings for the rule engine.
+type Options struct {
+	Rules     []Config `json:"rules" yaml:"rules"`
+	Workers   int      `json:"workers" yaml:"workers"`       // number of goroutines running actions, defaults to 4
+	QueueSize int      `json:"queue-size" yaml:"queue-size"` // pending actions before results are dropped, defaults to 1024
+}
+
+// Config is a rule, selecting fields from the events matching its statement and passing
+// the result to its actions.
+type Config struct {
+	ID          string   `json:"id" yaml:"id"`
+	SQL         string   `json:"sql" yaml:"sql"` // such as SELECT payload.temp AS t FROM "sensors/+/data" WHERE t > 40
+	Description string   `json:"description,omitempty" yaml:"description"`
+	Disabled    bool     `json:"disabled,omitempty" yaml:"disabled"`
+	Actions     []Action `json:"actions" yaml:"actions"`
+}
+
+// Action is taken with the result of a rule. Topics and payloads are templates, in which
+// ${field} is replaced with a selected field or an event field such as ${payload.id}.
+type Action struct {
+	Type    string            `json:"type" yaml:"type"`                 // republish, webhook or bridge
+	Topic   string            `json:"topic,omitempty" yaml:"topic"`     // republish topic, or bridge topic which defaults to ${topic}
+	Qos     byte              `json:"qos,omitempty" yaml:"qos"`         // republish qos
+	Retain  bool              `json:"retain,omitempty" yaml:"retain"`   // republish retain flag
+	Payload string            `json:"payload,omitempty" yaml:"payload"` // defaults to the selected fields as json
+	URL     string            `json:"url,omitempty" yaml:"url"`         // webhook url
+	Method  string            `json:"method,omitempty" yaml:"method"`   // webhook method, defaults to POST
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers"` // webhook headers
+	Timeout int               `json:"timeout,omitempty" yaml:"timeout"` // webhook timeout in seconds, defaults to 5
+	Bridge  string            `json:"bridge,omitempty" yaml:"bridge"`   // name of the bridge sink, such as kafka or mqtt
+}
+
+// The types of actions.
+const (
+	ActionRepublish = "republish"
+	ActionWebhook   = "webhook"
+	ActionBridge    = "bridge"
+)
+
+// Status is a rule with its counters.
+type Status struct {
+	Config
+	Matched uint64 `json:"matched"` // events which matched the statement
+	Failed  uint64 `json:"failed"`  // events which failed evaluation, or whose actions failed
+}
+
+// rule is a rule with its statement parsed.
+type rule struct {
+	Config
+	stmt    *Statement
+	matched atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// job is a rule result waiting for its actions to be taken.
+type job struct {
+	rule   *rule
+	result map[string]any
+	env    map[string]any
+}
+
+// Engine is a hook which evaluates rules against published messages and client events.
+type Engine struct {
+	mqtt.HookBase
+	sync.RWMutex
+	config *Options
+	server *mqtt.Server
+	rules  []*rule
+	sinks  map[string]Sink
+	client *http.Client
+	jobs   chan job
+	done   chan struct{}
+	wg     sync.WaitGroup
+	now    func() time.Time
+}
+
+// ID returns the ID of the hook.
+func (h *Engine) ID() string {
+	return "rule-engine"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Engine) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// SetServer sets the server which messages are republished to. It must be called before
+// the hook is added.
+func (h *Engine) SetServer(server *mqtt.Server) {
+	h.server = server
+}
+
+// AddSink registers a sink which bridge actions can send to. Sinks must be added before
+// the hook is added.
+func (h *Engine) AddSink(name string, sink Sink) {
+	h.Lock()
+	defer h.Unlock()
+	if h.sinks == nil {
+		h.sinks = make(map[string]Sink)
+	}
+	h.sinks[name] = sink
+}
+
+// Init parses the rules and starts the action workers.
+func (h *Engine) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if h.server == nil {
+		return ErrServerNotSet
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	h.rules = nil
+	for _, c := range h.config.Rules {
+		if err := h.Set(c); err != nil {
+			return err
+		}
+	}
+
+	if h.config.Workers <= 0 {
+		h.config.Workers = defaultWorkers
+	}
+	if h.config.QueueSize <= 0 {
+		h.config.QueueSize = defaultQueueSize
+	}
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	h.client = new(http.Client)
+	h.jobs = make(chan job, h.config.QueueSize)
+	h.done = make(chan struct{})
+	for i := 0; i < h.config.Workers; i++ {
+		h.wg.Add(1)
+		go h.work()
+	}
+
+	return nil
+}
+
+// Stop stops the action workers. Pending results are discarded.
+func (h *Engine) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		h.wg.Wait()
+	}
+	return nil
+}
+
+// Rules returns all of the rules, in evaluation order.
+func (h *Engine) Rules() []Status {
+	h.RLock()
+	defer h.RUnlock()
+	rs := make([]Status, 0, len(h.rules))
+	for _, r := range h.rules {
+		rs = append(rs, r.status())
+	}
+	return rs
+}
+
+// Get returns a rule by id.
+func (h *Engine) Get(id string) (Status, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	for _, r := range h.rules {
+		if r.ID == id {
+			return r.status(), true
+		}
+	}
+	return Status{}, false
+}
+
+// Set adds a rule, or replaces the rule with the same id. The counters of a replaced rule are reset.
+func (h *Engine) Set(c Config) error {
+	r, err := h.compile(c)
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", c.ID, err)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	rules := slices.Clone(h.rules) // evaluations may still be using the old slice
+	for i, o := range rules {
+		if o.ID == c.ID {
+			rules[i] = r
+			h.rules = rules
+			return nil
+		}
+	}
+	h.rules = append(rules, r)
+	return nil
+}
+
+// Delete removes a rule by id.
+func (h *Engine) Delete(id string) error {
+	h.Lock()
+	defer h.Unlock()
+	for i, r := range h.rules {
+		if r.ID == id {
+			h.rules = append(h.rules[:i:i], h.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// compile validates a rule and parses its statement.
+func (h *Engine) compile(c Config) (*rule, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("%w: id is required", ErrInvalidRule)
+	}
+
+	stmt, err := Parse(c.SQL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Actions) == 0 {
+		return nil, fmt.Errorf("%w: at least one action is required", ErrInvalidRule)
+	}
+
+	actions := make([]Action, len(c.Actions))
+	for i, a := range c.Actions {
+		if actions[i], err = h.validateAction(a); err != nil {
+			return nil, err
+		}
+	}
+	c.Actions = actions
+
+	return &rule{Config: c, stmt: stmt}, nil
+}
+
+// validateAction checks an action and applies its defaults.
+func (h *Engine) validateAction(a Action) (Action, error) {
+	switch a.Type {
+	case ActionRepublish:
+		if a.Topic == "" {
+			return a, fmt.Errorf("%w: republish requires a topic", ErrInvalidRule)
+		}
+		if a.Qos > 2 {
+			return a, fmt.Errorf("%w: invalid republish qos %d", ErrInvalidRule, a.Qos)
+		}
+		if !h.server.Options.InlineClient {
+			return a, mqtt.ErrInlineClientNotEnabled
+		}
+	case ActionWebhook:
+		if !strings.HasPrefix(a.URL, "http://") && !strings.HasPrefix(a.URL, "https://") {
+			return a, fmt.Errorf("%w: webhook requires an http url", ErrInvalidRule)
+		}
+		if a.Method == "" {
+			a.Method = http.MethodPost
+		}
+		if a.Timeout <= 0 {
+			a.Timeout = defaultWebhookTimeout
+		}
+	case ActionBridge:
+		h.RLock()
+		_, ok := h.sinks[a.Bridge]
+		h.RUnlock()
+		if !ok {
+			return a, fmt.Errorf("%w: bridge %q is not configured", ErrInvalidRule, a.Bridge)
+		}
+		if a.Topic == "" {
+			a.Topic = defaultBridgeTopic
+		}
+	default:
+		return a, fmt.Errorf("%w: unknown action type %q", ErrInvalidRule, a.Type)
+	}
+
+	return a, nil
+}
+
+// status returns the rule with its counters.
+func (r *rule) status() Status {
+	return Status{
+		Config:  r.Config,
+		Matched: r.matched.Load(),
+		Failed:  r.failed.Load(),
+	}
+}
+
+// OnPublished evaluates the rules against a published message. Messages published by the
+// server inline client, including republished results, are ignored so rules cannot loop.
+func (h *Engine) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.ID == mqtt.InlineClientId {
+		return
+	}
+
+	var payload any
+	if err := json.Unmarshal(pk.Payload, &payload); err != nil {
+		payload = string(pk.Payload)
+	}
+
+	h.evaluate(pk.TopicName, false, map[string]any{
+		"event":     EventMessagePublish,
+		"topic":     pk.TopicName,
+		"payload":   payload,
+		"qos":       float64(pk.FixedHeader.Qos),
+		"retain":    pk.FixedHeader.Retain,
+		"clientid":  cl.ID,
+		"username":  string(cl.Properties.Username),
+		"timestamp": float64(h.now().UnixMilli()),
+	})
+}
+
+// OnSessionEstablished evaluates the rules selecting from $events/client_connected.
+func (h *Engine) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.evaluate(SourceClientConnected, true, map[string]any{
+		"event":     EventClientConnected,
+		"clientid":  cl.ID,
+		"username":  string(cl.Properties.Username),
+		"remote":    cl.Net.Remote,
+		"listener":  cl.Net.Listener,
+		"protocol":  float64(cl.Properties.ProtocolVersion),
+		"clean":     cl.Properties.Clean,
+		"keepalive": float64(cl.State.Keepalive),
+		"timestamp": float64(h.now().UnixMilli()),
+	})
+}
+
+// OnDisconnect evaluates the rules selecting from $events/client_disconnected.
+func (h *Engine) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+
+	h.evaluate(SourceClientDisconnected, true, map[string]any{
+		"event":     EventClientDisconnected,
+		"clientid":  cl.ID,
+		"username":  string(cl.Properties.Username),
+		"remote":    cl.Net.Remote,
+		"listener":  cl.Net.Listener,
+		"reason":    reason,
+		"timestamp": float64(h.now().UnixMilli()),
+	})
+}
+
+// evaluate runs each enabled rule selecting from the topic or event source, queueing the
+// results of matching rules.
+func (h *Engine) evaluate(source string, event bool, env map[string]any) {
+	h.RLock()
+	rules := h.rules
+	h.RUnlock()
+
+	for _, r := range rules {
+		if r.Disabled || !r.selects(source, event) {
+			continue
+		}
+
+		result, ok, err := r.stmt.Eval(env)
+		if err != nil {
+			r.failed.Add(1)
+			h.Log.Debug("rule evaluation failed", "rule", r.ID, "source", source, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		r.matched.Add(1)
+		select {
+		case h.jobs <- job{rule: r, result: result, env: env}:
+		default:
+			r.failed.Add(1)
+			h.Log.Warn("rule action queue is full, dropped result", "rule", r.ID)
+		}
+	}
+}
+
+// selects returns true if the rule selects from the source. Event sources must be named
+// exactly, while topics are matched against the topic filters.
+func (r *rule) selects(source string, event bool) bool {
+	for _, from := range r.stmt.From {
+		if event && from == source {
+			return true
+		}
+		if !event && !strings.HasPrefix(from, "$events/") && plugin.MatchTopic(from, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Eval evaluates the statement against the fields of an event, returning the selected
+// fields and whether the where condition matched.
+func (st *Statement) Eval(env map[string]any) (map[string]any, bool, error) {
+	result := make(map[string]any, len(st.Fields))
+	for _, f := range st.Fields {
+		if f.Expr == nil {
+			maps.Copy(result, env)
+			continue
+		}
+
+		v, err := f.Expr.Eval(env)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", f.Alias, err)
+		}
+		result[f.Alias] = v
+	}
+
+	if st.Where == nil {
+		return result, true, nil
+	}
+
+	// the condition can use the selected aliases as well as the event fields
+	scope := make(map[string]any, len(env)+len(result))
+	maps.Copy(scope, env)
+	maps.Copy(scope, result)
+	v, err := st.Where.Eval(scope)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch b := v.(type) {
+	case nil:
+		return nil, false, nil
+	case bool:
+		return result, b, nil
+	default:
+		return nil, false, fmt.Errorf("where condition is %T, not a boolean", v)
+	}
+}
+
+// work takes the actions of queued results until the engine is stopped.
+func (h *Engine) work() {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-h.done:
+			return
+		case j := <-h.jobs:
+			for _, a := range j.rule.Actions {
+				if err := h.act(a, j.result, j.env); err != nil {
+					j.rule.failed.Add(1)
+					h.Log.Warn("rule action failed", "rule", j.rule.ID, "action", a.Type, "error", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rule
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type sent struct {
+	topic   string
+	payload string
+}
+
+// fakeSink records the messages sent to it.
+type fakeSink struct {
+	sync.Mutex
+	sent []sent
+}
+
+func (s *fakeSink) Send(topic string, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sent = append(s.sent, sent{topic: topic, payload: string(payload)})
+	return nil
+}
+
+func (s *fakeSink) messages() []sent {
+	s.Lock()
+	defer s.Unlock()
+	return append([]sent(nil), s.sent...)
+}
+
+func newServer(t *testing.T) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{
+		Logger:       logger,
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	return s
+}
+
+func newEngine(t *testing.T, sink Sink, rules ...Config) *Engine {
+	h := &Engine{now: func() time.Time { return time.UnixMilli(1700000000123) }}
+	h.SetOpts(logger, nil)
+	h.SetServer(newServer(t))
+	if sink != nil {
+		h.AddSink("fake", sink)
+	}
+	require.NoError(t, h.Init(&Options{Rules: rules}))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func newClient() *mqtt.Client {
+	cl := &mqtt.Client{ID: "c1"}
+	cl.Properties.Username = []byte("u1")
+	cl.Properties.ProtocolVersion = 5
+	cl.Net.Remote = "127.0.0.1:1883"
+	cl.Net.Listener = "tcp"
+	return cl
+}
+
+func newPacket(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func bridgeAction(topic string) []Action {
+	return []Action{{Type: ActionBridge, Bridge: "fake", Topic: topic}}
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "rule-engine", new(Engine).ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Engine)
+	require.True(t, h.Provides(mqtt.OnPublished))
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestInitErrors(t *testing.T) {
+	h := new(Engine)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrServerNotSet)
+
+	h.SetServer(newServer(t))
+	require.NoError(t, h.Init(nil))
+	require.NoError(t, h.Stop())
+
+	sql := `SELECT * FROM "a"`
+	for _, c := range []Config{
+		{SQL: sql, Actions: bridgeAction("")},
+		{ID: "r", SQL: sql},
+		{ID: "r", SQL: sql, Actions: []Action{{Type: "email"}}},
+		{ID: "r", SQL: sql, Actions: []Action{{Type: ActionRepublish}}},
+		{ID: "r", SQL: sql, Actions: []Action{{Type: ActionRepublish, Topic: "b", Qos: 3}}},
+		{ID: "r", SQL: sql, Actions: []Action{{Type: ActionWebhook, URL: "ftp://x"}}},
+		{ID: "r", SQL: sql, Actions: bridgeAction("")}, // no sink named fake
+	} {
+		require.ErrorIs(t, h.Set(c), ErrInvalidRule, c)
+	}
+	err := h.Set(Config{ID: "r", SQL: "SELECT", Actions: bridgeAction("")})
+	require.ErrorIs(t, err, ErrInvalidSQL)
+
+	h.SetServer(mqtt.New(&mqtt.Options{Logger: logger}))
+	err = h.Init(&Options{Rules: []Config{{ID: "r", SQL: sql, Actions: []Action{{Type: ActionRepublish, Topic: "b"}}}}})
+	require.ErrorIs(t, err, mqtt.ErrInlineClientNotEnabled)
+}
+
+func TestInitDefaults(t *testing.T) {
+	h := newEngine(t, new(fakeSink), Config{
+		ID:  "r",
+		SQL: `SELECT * FROM "a"`,
+		Actions: []Action{
+			{Type: ActionWebhook, URL: "http://localhost"},
+			{Type: ActionBridge, Bridge: "fake"},
+		},
+	})
+	require.Equal(t, defaultWorkers, h.config.Workers)
+	require.Equal(t, defaultQueueSize, h.config.QueueSize)
+
+	r, ok := h.Get("r")
+	require.True(t, ok)
+	require.Equal(t, http.MethodPost, r.Actions[0].Method)
+	require.Equal(t, defaultWebhookTimeout, r.Actions[0].Timeout)
+	require.Equal(t, defaultBridgeTopic, r.Actions[1].Topic)
+}
+
+func TestSetGetDelete(t *testing.T) {
+	h := newEngine(t, new(fakeSink))
+	require.Empty(t, h.Rules())
+
+	require.NoError(t, h.Set(Config{ID: "a", SQL: `SELECT * FROM "a"`, Actions: bridgeAction("")}))
+	require.NoError(t, h.Set(Config{ID: "b", SQL: `SELECT * FROM "b"`, Actions: bridgeAction("")}))
+	require.NoError(t, h.Set(Config{ID: "a", SQL: `SELECT * FROM "c"`, Actions: bridgeAction("")}))
+
+	rs := h.Rules()
+	require.Len(t, rs, 2)
+	require.Equal(t, "a", rs[0].ID)
+	require.Equal(t, `SELECT * FROM "c"`, rs[0].SQL)
+	require.Equal(t, "b", rs[1].ID)
+
+	_, ok := h.Get("c")
+	require.False(t, ok)
+
+	require.NoError(t, h.Delete("a"))
+	require.ErrorIs(t, h.Delete("a"), ErrRuleNotFound)
+	require.Len(t, h.Rules(), 1)
+}
+
+func TestOnPublished(t *testing.T) {
+	sink := new(fakeSink)
+	h := newEngine(t, sink,
+		Config{
+			ID:      "hot",
+			SQL:     `SELECT payload.temp AS t, clientid FROM "sensors/+/data" WHERE t > 40`,
+			Actions: bridgeAction("hot/${clientid}"),
+		},
+		Config{
+			ID:       "off",
+			SQL:      `SELECT * FROM "#"`,
+			Disabled: true,
+			Actions:  bridgeAction(""),
+		},
+		Config{
+			ID:      "failing",
+			SQL:     `SELECT payload * 2 AS x FROM "text/#"`,
+			Actions: bridgeAction(""),
+		},
+	)
+
+	h.OnPublished(newClient(), newPacket("sensors/1/data", `{"temp": 42}`))
+	h.OnPublished(newClient(), newPacket("sensors/1/data", `{"temp": 20}`))
+	h.OnPublished(newClient(), newPacket("sensors/1/other", `{"temp": 42}`))
+	h.OnPublished(newClient(), newPacket("text/1", `hello`))
+
+	inline := newClient()
+	inline.ID = mqtt.InlineClientId
+	h.OnPublished(inline, newPacket("sensors/1/data", `{"temp": 42}`))
+
+	require.Eventually(t, func() bool { return len(sink.messages()) == 1 }, time.Second, 10*time.Millisecond)
+	m := sink.messages()[0]
+	require.Equal(t, "hot/c1", m.topic)
+	require.JSONEq(t, `{"t": 42, "clientid": "c1"}`, m.payload)
+
+	r, _ := h.Get("hot")
+	require.Equal(t, uint64(1), r.Matched)
+	require.Equal(t, uint64(0), r.Failed)
+	r, _ = h.Get("off")
+	require.Equal(t, uint64(0), r.Matched)
+	r, _ = h.Get("failing")
+	require.Equal(t, uint64(0), r.Matched)
+	require.Equal(t, uint64(1), r.Failed)
+}
+
+func TestOnClientEvents(t *testing.T) {
+	sink := new(fakeSink)
+	h := newEngine(t, sink, Config{
+		ID:  "events",
+		SQL: `SELECT event, clientid, username, remote, listener, protocol, clean, reason, timestamp FROM "$events/client_connected", "$events/client_disconnected"`,
+		Actions: []Action{{
+			Type:    ActionBridge,
+			Bridge:  "fake",
+			Topic:   "events/${clientid}",
+			Payload: "${event} ${username} ${remote} ${listener} ${protocol} ${clean} ${reason} ${timestamp}",
+		}},
+	})
+
+	h.OnSessionEstablished(newClient(), packets.Packet{})
+	require.Eventually(t, func() bool { return len(sink.messages()) == 1 }, time.Second, 10*time.Millisecond)
+	h.OnDisconnect(newClient(), errors.New("gone"), false)
+	require.Eventually(t, func() bool { return len(sink.messages()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// topics never match the event sources
+	h.OnPublished(newClient(), newPacket("$events/client_connected", "x"))
+
+	ms := sink.messages()
+	require.Equal(t, "events/c1", ms[0].topic)
+	require.Equal(t, "client.connected u1 127.0.0.1:1883 tcp 5 false  1700000000123", ms[0].payload)
+	require.Equal(t, "client.disconnected u1 127.0.0.1:1883 tcp   gone 1700000000123", ms[1].payload)
+
+	r, _ := h.Get("events")
+	require.Equal(t, uint64(2), r.Matched)
+}
+
+func TestRepublish(t *testing.T) {
+	h := newEngine(t, nil, Config{
+		ID:  "alert",
+		SQL: `SELECT payload.temp AS t FROM "sensors/+/data" WHERE t > 40`,
+		Actions: []Action{{
+			Type:    ActionRepublish,
+			Topic:   "alerts/${clientid}",
+			Qos:     1,
+			Payload: `{"temp": ${t}, "topic": "${topic}"}`,
+		}},
+	})
+
+	received := make(chan packets.Packet, 2)
+	require.NoError(t, h.server.Subscribe("alerts/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	h.OnPublished(newClient(), newPacket("sensors/1/data", `{"temp": 41.5}`))
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "alerts/c1", pk.TopicName)
+		require.JSONEq(t, `{"temp": 41.5, "topic": "sensors/1/data"}`, string(pk.Payload))
+	case <-time.After(time.Second):
+		require.Fail(t, "result not republished")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	bodies := make(chan string, 2)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		require.Equal(t, "Bearer x", r.Header.Get("Authorization"))
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	h := newEngine(t, nil, Config{
+		ID:  "hook",
+		SQL: `SELECT payload AS p, qos FROM "a/#"`,
+		Actions: []Action{{
+			Type:    ActionWebhook,
+			URL:     srv.URL,
+			Method:  http.MethodPut,
+			Headers: map[string]string{"Authorization": "Bearer x"},
+		}},
+	})
+
+	h.OnPublished(newClient(), newPacket("a/b", `{"x": [1, "y"]}`))
+	select {
+	case body := <-bodies:
+		require.JSONEq(t, `{"p": {"x": [1, "y"]}, "qos": 1}`, body)
+	case <-time.After(time.Second):
+		require.Fail(t, "webhook not called")
+	}
+
+	status = http.StatusInternalServerError
+	h.OnPublished(newClient(), newPacket("a/b", `plain`))
+	select {
+	case body := <-bodies:
+		require.JSONEq(t, `{"p": "plain", "qos": 1}`, body)
+	case <-time.After(time.Second):
+		require.Fail(t, "webhook not called")
+	}
+
+	require.Eventually(t, func() bool {
+		r, _ := h.Get("hook")
+		return r.Failed == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRender(t *testing.T) {
+	result := map[string]any{"t": float64(40), "obj": map[string]any{"a": true}}
+	env := map[string]any{"clientid": "c1", "t": "shadowed", "payload": map[string]any{"id": float64(12345678)}}
+
+	require.Equal(t, "plain", render("plain", result, env))
+	require.Equal(t, `c1/40/{"a":true}/12345678/`, render("${clientid}/${t}/${obj}/${payload.id}/${missing}", result, env))
+	require.Equal(t, "true", format(true))
+}
@@ -0,0 +1,575 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidSQL indicates a rule statement could not be parsed.
+var ErrInvalidSQL = errors.New("invalid rule sql")
+
+// Statement is a parsed rule statement, such as
+// SELECT payload.temp AS t, clientid FROM "sensors/+/data" WHERE t > 40.
+type Statement struct {
+	Fields []Field  // the selected fields, in order
+	From   []string // topic filters or event sources
+	Where  Expr     // the condition, nil if there is no where clause
+}
+
+// Field is a selected expression. A nil Expr selects all of the event fields.
+type Field struct {
+	Expr  Expr
+	Alias string
+}
+
+// Expr is an expression which can be evaluated against the fields of an event.
+type Expr interface {
+	Eval(env map[string]any) (any, error)
+}
+
+type (
+	literal struct{ v any }
+	ident   struct{ path []string }
+	unary   struct {
+		op string
+		x  Expr
+	}
+	binary struct {
+		op   string
+		l, r Expr
+	}
+)
+
+// Eval returns the literal value.
+func (e literal) Eval(map[string]any) (any, error) {
+	return e.v, nil
+}
+
+// Eval returns the value of a field, following the path into nested objects. Missing fields are nil.
+func (e ident) Eval(env map[string]any) (any, error) {
+	var v any = env
+	for _, p := range e.path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		v = m[p]
+	}
+	return v, nil
+}
+
+// Eval applies a unary operator.
+func (e unary) Eval(env map[string]any) (any, error) {
+	x, err := e.x.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "NOT":
+		if x == nil {
+			return nil, nil
+		}
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("NOT requires a boolean, got %T", x)
+		}
+		return !b, nil
+	default: // -
+		if x == nil {
+			return nil, nil
+		}
+		n, ok := x.(float64)
+		if !ok {
+			return nil, fmt.Errorf("- requires a number, got %T", x)
+		}
+		return -n, nil
+	}
+}
+
+// Eval applies a binary operator.
+func (e binary) Eval(env map[string]any) (any, error) {
+	l, err := e.l.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op { // short circuit
+	case "AND":
+		if l == false {
+			return false, nil
+		}
+	case "OR":
+		if l == true {
+			return true, nil
+		}
+	}
+
+	r, err := e.r.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "AND", "OR":
+		lb, lok := l.(bool)
+		rb, rok := r.(bool)
+		if (!lok && l != nil) || (!rok && r != nil) {
+			return nil, fmt.Errorf("%s requires booleans", e.op)
+		}
+		if e.op == "AND" {
+			return lok && rok && lb && rb, nil
+		}
+		return (lok && lb) || (rok && rb), nil
+	case "=":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compare(l, r)
+		if !ok {
+			return false, nil
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	default:
+		return arithmetic(e.op, l, r)
+	}
+}
+
+// equal returns true if two values are equal.
+func equal(l, r any) bool {
+	return reflect.DeepEqual(l, r)
+}
+
+// compare orders two numbers or two strings.
+func compare(l, r any) (int, bool) {
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case lv < rv:
+			return -1, true
+		case lv > rv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(lv, rv), true
+	}
+	return 0, false
+}
+
+// arithmetic applies an arithmetic operator to two numbers, or + to two strings.
+func arithmetic(op string, l, r any) (any, error) {
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	if ls, ok := l.(string); ok && op == "+" {
+		if rs, ok := r.(string); ok {
+			return ls + rs, nil
+		}
+	}
+
+	ln, lok := l.(float64)
+	rn, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s requires numbers, got %T and %T", op, l, r)
+	}
+
+	switch op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		if rn == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return ln / rn, nil
+	default: // %
+		if rn == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(ln, rn), nil
+	}
+}
+
+// token is a lexical token of a statement.
+type token struct {
+	kind  byte // i identifier or keyword, n number, s string, o operator, e end
+	value string
+}
+
+// lex splits a statement into tokens.
+func lex(sql string) ([]token, error) {
+	var tokens []token
+	rs := []rune(sql)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(rs); j++ {
+				if rs[j] == c {
+					if j+1 < len(rs) && rs[j+1] == c { // doubled quotes escape a quote
+						sb.WriteRune(c)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidSQL)
+			}
+			tokens = append(tokens, token{kind: 's', value: sb.String()})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: 'n', value: string(rs[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_' || c == '$':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '$' || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: 'i', value: string(rs[i:j])})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "<=", ">=", "!=", "<>":
+					op = two
+				}
+			}
+			if !strings.Contains("=<>!+-*/%(),", op[:1]) || op == "!" {
+				return nil, fmt.Errorf("%w: unexpected character %q", ErrInvalidSQL, c)
+			}
+			if op == "<>" {
+				tokens = append(tokens, token{kind: 'o', value: "!="})
+			} else {
+				tokens = append(tokens, token{kind: 'o', value: op})
+			}
+			i += len([]rune(op))
+		}
+	}
+
+	return append(tokens, token{kind: 'e'}), nil
+}
+
+// parser is a recursive descent parser of statements.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a rule statement.
+func Parse(sql string) (*Statement, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	st, err := p.statement()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSQL, err.Error())
+	}
+
+	return st, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != 'e' {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the keyword.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'i' && strings.EqualFold(t.value, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// operator consumes the next token if it is one of the operators, returning it.
+func (p *parser) operator(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != 'o' {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.value == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) statement() (*Statement, error) {
+	if !p.keyword("SELECT") {
+		return nil, errors.New("expected SELECT")
+	}
+
+	st := new(Statement)
+	for {
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		st.Fields = append(st.Fields, f)
+		if _, ok := p.operator(","); !ok {
+			break
+		}
+	}
+
+	if !p.keyword("FROM") {
+		return nil, errors.New("expected FROM")
+	}
+	for {
+		t := p.next()
+		if t.kind != 's' || t.value == "" {
+			return nil, errors.New("expected a quoted topic filter after FROM")
+		}
+		st.From = append(st.From, t.value)
+		if _, ok := p.operator(","); !ok {
+			break
+		}
+	}
+
+	if p.keyword("WHERE") {
+		var err error
+		if st.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t := p.peek(); t.kind != 'e' {
+		return nil, fmt.Errorf("unexpected %q", t.value)
+	}
+
+	return st, nil
+}
+
+func (p *parser) field() (Field, error) {
+	if _, ok := p.operator("*"); ok {
+		return Field{}, nil
+	}
+
+	start := p.pos
+	x, err := p.or()
+	if err != nil {
+		return Field{}, err
+	}
+
+	f := Field{Expr: x}
+	if p.keyword("AS") {
+		t := p.next()
+		if t.kind != 'i' && t.kind != 's' {
+			return Field{}, errors.New("expected an alias after AS")
+		}
+		f.Alias = t.value
+	} else if id, ok := x.(ident); ok && p.pos == start+1 {
+		f.Alias = id.path[len(id.path)-1]
+	} else {
+		return Field{}, errors.New("selected expressions require an alias")
+	}
+
+	return f, nil
+}
+
+func (p *parser) or() (Expr, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: "OR", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: "AND", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.keyword("NOT") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return unary{op: "NOT", x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (Expr, error) {
+	l, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.operator("=", "!=", "<", "<=", ">", ">="); ok {
+		r, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return binary{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) additive() (Expr, error) {
+	l, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.operator("+", "-")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) multiplicative() (Expr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.operator("*", "/", "%")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) unary() (Expr, error) {
+	if _, ok := p.operator("-"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unary{op: "-", x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.value)
+		}
+		return literal{v: n}, nil
+	case 's':
+		return literal{v: t.value}, nil
+	case 'i':
+		switch strings.ToUpper(t.value) {
+		case "TRUE":
+			return literal{v: true}, nil
+		case "FALSE":
+			return literal{v: false}, nil
+		case "NULL":
+			return literal{v: nil}, nil
+		case "SELECT", "FROM", "WHERE", "AS", "AND", "OR", "NOT":
+			return nil, fmt.Errorf("unexpected %s", t.value)
+		}
+		path := strings.Split(t.value, ".")
+		for _, s := range path {
+			if s == "" {
+				return nil, fmt.Errorf("invalid field %q", t.value)
+			}
+		}
+		return ident{path: path}, nil
+	case 'o':
+		if t.value == "(" {
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.operator(")"); !ok {
+				return nil, errors.New("expected )")
+			}
+			return x, nil
+		}
+	}
+
+	if t.kind == 'e' {
+		return nil, errors.New("unexpected end of statement")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.value)
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package rule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	st, err := Parse(`select payload.temp as t, clientid, 'x' + topic AS "label" FROM "sensors/+/data", 'other/#' where t > 40 AND NOT retain`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"sensors/+/data", "other/#"}, st.From)
+	require.Len(t, st.Fields, 3)
+	require.Equal(t, "t", st.Fields[0].Alias)
+	require.Equal(t, "clientid", st.Fields[1].Alias)
+	require.Equal(t, "label", st.Fields[2].Alias)
+	require.NotNil(t, st.Where)
+
+	st, err = Parse(`SELECT * FROM "$events/client_connected"`)
+	require.NoError(t, err)
+	require.Nil(t, st.Fields[0].Expr)
+	require.Nil(t, st.Where)
+
+	st, err = Parse(`SELECT payload.a.b FROM "a"`)
+	require.NoError(t, err)
+	require.Equal(t, "b", st.Fields[0].Alias)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, sql := range []string{
+		``,
+		`SELECT`,
+		`FROM "a"`,
+		`SELECT a`,
+		`SELECT a FROM a`,
+		`SELECT a FROM ""`,
+		`SELECT a FROM "a`,
+		`SELECT a + 1 FROM "a"`,
+		`SELECT a AS FROM "a"`,
+		`SELECT a FROM "a" WHERE`,
+		`SELECT a FROM "a" WHERE (a > 1`,
+		`SELECT a FROM "a" WHERE a > 1 extra`,
+		`SELECT a FROM "a" WHERE a ! 1`,
+		`SELECT a FROM "a" WHERE a ; 1`,
+		`SELECT a FROM "a" WHERE 1.2.3 > a`,
+		`SELECT a. FROM "a"`,
+		`SELECT and FROM "a"`,
+	} {
+		_, err := Parse(sql)
+		require.ErrorIs(t, err, ErrInvalidSQL, sql)
+	}
+}
+
+func TestEval(t *testing.T) {
+	env := map[string]any{
+		"topic":    "sensors/1/data",
+		"clientid": "c1",
+		"retain":   false,
+		"payload":  map[string]any{"temp": float64(42), "unit": "c", "ok": true},
+	}
+
+	tt := map[string]any{
+		`1 + 2 * 3`:                            float64(7),
+		`(1 + 2) * 3`:                          float64(9),
+		`-payload.temp + 2`:                    float64(-40),
+		`7 % 4`:                                float64(3),
+		`10 / 4`:                               2.5,
+		`'a' + clientid`:                       "ac1",
+		`'it''s'`:                              "it's",
+		`payload.temp > 40`:                    true,
+		`payload.temp >= 42 AND payload.ok`:    true,
+		`payload.temp < 40 OR clientid = 'c1'`: true,
+		`payload.unit != 'f'`:                  true,
+		`payload.unit <> 'c'`:                  false,
+		`clientid > 'b'`:                       true,
+		`NOT retain`:                           true,
+		`payload.missing`:                      nil,
+		`payload.missing > 1`:                  false,
+		`payload.missing = null`:               true,
+		`payload.unit > 1`:                     false,
+		`payload.missing + 1`:                  nil,
+		`false AND payload.unit`:               false,
+		`true OR payload.unit`:                 true,
+		`payload.missing AND true`:             false,
+		`topic.x`:                              nil,
+	}
+	for expr, want := range tt {
+		st, err := Parse("SELECT " + expr + ` AS v FROM "#"`)
+		require.NoError(t, err, expr)
+		got, err := st.Fields[0].Expr.Eval(env)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, got, expr)
+	}
+
+	for _, expr := range []string{
+		`clientid * 2`,
+		`1 / 0`,
+		`1 % 0`,
+		`-clientid`,
+		`NOT clientid`,
+		`payload.unit AND true`,
+	} {
+		st, err := Parse("SELECT " + expr + ` AS v FROM "#"`)
+		require.NoError(t, err, expr)
+		_, err = st.Fields[0].Expr.Eval(env)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestStatementEval(t *testing.T) {
+	env := map[string]any{
+		"clientid": "c1",
+		"payload":  map[string]any{"temp": float64(42)},
+	}
+
+	st, err := Parse(`SELECT payload.temp AS t, clientid FROM "#" WHERE t > 40`)
+	require.NoError(t, err)
+	result, ok, err := st.Eval(env)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]any{"t": float64(42), "clientid": "c1"}, result)
+
+	st, err = Parse(`SELECT payload.temp AS t FROM "#" WHERE t > 50`)
+	require.NoError(t, err)
+	_, ok, err = st.Eval(env)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	st, err = Parse(`SELECT *, 1 AS one FROM "#" WHERE payload.missing`)
+	require.NoError(t, err)
+	_, ok, err = st.Eval(env)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	st, err = Parse(`SELECT *, 1 AS one FROM "#"`)
+	require.NoError(t, err)
+	result, ok, err = st.Eval(env)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "c1", result["clientid"])
+	require.Equal(t, float64(1), result["one"])
+
+	st, err = Parse(`SELECT clientid FROM "#" WHERE clientid`)
+	require.NoError(t, err)
+	_, _, err = st.Eval(env)
+	require.Error(t, err)
+
+	st, err = Parse(`SELECT clientid * 2 AS x FROM "#"`)
+	require.NoError(t, err)
+	_, _, err = st.Eval(env)
+	require.Error(t, err)
+}
@@ -0,0 +1,459 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ErrUnsupportedKeyword indicates a json schema uses a keyword which cannot be validated.
+var ErrUnsupportedKeyword = errors.New("unsupported json schema keyword")
+
+// jsonSchema is a compiled json schema. It supports the validation keywords of draft 7 and
+// later, except for references, formats and conditionals.
+type jsonSchema struct {
+	allow            *bool // a boolean schema
+	types            []string
+	enum             []any
+	constant         any
+	hasConst         bool
+	properties       map[string]*jsonSchema
+	required         []string
+	additional       *jsonSchema
+	items            *jsonSchema
+	minItems         *int
+	maxItems         *int
+	minProperties    *int
+	maxProperties    *int
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	allOf            []*jsonSchema
+	anyOf            []*jsonSchema
+	oneOf            []*jsonSchema
+	not              *jsonSchema
+}
+
+// parseJSONSchema compiles a json schema document.
+func parseJSONSchema(data []byte) (*jsonSchema, error) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return compileJSONSchema(v)
+}
+
+// compileJSONSchema compiles a decoded json schema.
+func compileJSONSchema(v any) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{allow: &b}, nil
+	}
+
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("schema must be an object or boolean")
+	}
+
+	s := new(jsonSchema)
+	for k, kv := range m {
+		var err error
+		switch k {
+		case "$ref", "$dynamicRef", "$recursiveRef", "if", "then", "else", "dependentSchemas",
+			"dependentRequired", "dependencies", "patternProperties", "propertyNames",
+			"prefixItems", "contains", "unevaluatedProperties", "unevaluatedItems":
+			err = ErrUnsupportedKeyword
+		case "type":
+			switch t := kv.(type) {
+			case string:
+				s.types = []string{t}
+			case []any:
+				s.types, err = toStrings(t)
+			default:
+				err = fmt.Errorf("must be a string or array")
+			}
+		case "enum":
+			l, ok := kv.([]any)
+			if !ok {
+				err = fmt.Errorf("must be an array")
+			}
+			for _, e := range l {
+				s.enum = append(s.enum, normalizeDeep(e))
+			}
+		case "const":
+			s.constant, s.hasConst = normalizeDeep(kv), true
+		case "properties":
+			p, ok := kv.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("must be an object")
+				break
+			}
+			s.properties = make(map[string]*jsonSchema, len(p))
+			for name, pv := range p {
+				if s.properties[name], err = compileJSONSchema(pv); err != nil {
+					err = fmt.Errorf("%s: %w", name, err)
+					break
+				}
+			}
+		case "required":
+			l, ok := kv.([]any)
+			if !ok {
+				err = fmt.Errorf("must be an array")
+				break
+			}
+			s.required, err = toStrings(l)
+		case "additionalProperties":
+			s.additional, err = compileJSONSchema(kv)
+		case "items":
+			s.items, err = compileJSONSchema(kv)
+		case "minItems":
+			s.minItems, err = toInt(kv)
+		case "maxItems":
+			s.maxItems, err = toInt(kv)
+		case "minProperties":
+			s.minProperties, err = toInt(kv)
+		case "maxProperties":
+			s.maxProperties, err = toInt(kv)
+		case "minLength":
+			s.minLength, err = toInt(kv)
+		case "maxLength":
+			s.maxLength, err = toInt(kv)
+		case "minimum":
+			s.minimum, err = toNumber(kv)
+		case "maximum":
+			s.maximum, err = toNumber(kv)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = toNumber(kv)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = toNumber(kv)
+		case "multipleOf":
+			s.multipleOf, err = toNumber(kv)
+		case "pattern":
+			p, ok := kv.(string)
+			if !ok {
+				err = fmt.Errorf("must be a string")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "allOf":
+			s.allOf, err = compileJSONSchemas(kv)
+		case "anyOf":
+			s.anyOf, err = compileJSONSchemas(kv)
+		case "oneOf":
+			s.oneOf, err = compileJSONSchemas(kv)
+		case "not":
+			s.not, err = compileJSONSchema(kv)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	return s, nil
+}
+
+// compileJSONSchemas compiles an array of json schemas.
+func compileJSONSchemas(v any) ([]*jsonSchema, error) {
+	l, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("must be an array")
+	}
+
+	out := make([]*jsonSchema, len(l))
+	for i, sv := range l {
+		var err error
+		if out[i], err = compileJSONSchema(sv); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// validate returns an error describing the first part of a value which does not conform
+// to the schema. The value may be decoded from json or msgpack.
+func (s *jsonSchema) validate(v any, path string) error {
+	if s.allow != nil {
+		if !*s.allow {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	}
+
+	v = normalize(v)
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if isType(v, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected type %v", path, s.types)
+		}
+	}
+
+	if s.enum != nil {
+		found := false
+		nv := normalizeDeep(v)
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, nv) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not one of the enum values", path)
+		}
+	}
+
+	if s.hasConst && !reflect.DeepEqual(s.constant, normalizeDeep(v)) {
+		return fmt.Errorf("%s: not equal to the const value", path)
+	}
+
+	var err error
+	switch t := v.(type) {
+	case float64:
+		err = s.validateNumber(t, path)
+	case string:
+		err = s.validateString(t, path)
+	case []any:
+		err = s.validateArray(t, path)
+	case map[string]any:
+		err = s.validateObject(t, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any of the anyOf schemas", path)
+		}
+	}
+
+	if len(s.oneOf) > 0 {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s: matches %d of the oneOf schemas", path, n)
+		}
+	}
+
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fmt.Errorf("%s: matches the not schema", path)
+	}
+
+	return nil
+}
+
+// validateNumber applies the numeric keywords.
+func (s *jsonSchema) validateNumber(n float64, path string) error {
+	switch {
+	case s.minimum != nil && n < *s.minimum:
+		return fmt.Errorf("%s: less than minimum %v", path, *s.minimum)
+	case s.maximum != nil && n > *s.maximum:
+		return fmt.Errorf("%s: greater than maximum %v", path, *s.maximum)
+	case s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum:
+		return fmt.Errorf("%s: not greater than exclusiveMinimum %v", path, *s.exclusiveMinimum)
+	case s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum:
+		return fmt.Errorf("%s: not less than exclusiveMaximum %v", path, *s.exclusiveMaximum)
+	case s.multipleOf != nil && *s.multipleOf > 0 && math.Mod(n, *s.multipleOf) != 0:
+		return fmt.Errorf("%s: not a multiple of %v", path, *s.multipleOf)
+	}
+	return nil
+}
+
+// validateString applies the string keywords.
+func (s *jsonSchema) validateString(str string, path string) error {
+	l := utf8.RuneCountInString(str)
+	switch {
+	case s.minLength != nil && l < *s.minLength:
+		return fmt.Errorf("%s: shorter than minLength %d", path, *s.minLength)
+	case s.maxLength != nil && l > *s.maxLength:
+		return fmt.Errorf("%s: longer than maxLength %d", path, *s.maxLength)
+	case s.pattern != nil && !s.pattern.MatchString(str):
+		return fmt.Errorf("%s: does not match pattern %s", path, s.pattern)
+	}
+	return nil
+}
+
+// validateArray applies the array keywords.
+func (s *jsonSchema) validateArray(a []any, path string) error {
+	switch {
+	case s.minItems != nil && len(a) < *s.minItems:
+		return fmt.Errorf("%s: fewer than minItems %d", path, *s.minItems)
+	case s.maxItems != nil && len(a) > *s.maxItems:
+		return fmt.Errorf("%s: more than maxItems %d", path, *s.maxItems)
+	}
+
+	if s.items != nil {
+		for i, e := range a {
+			if err := s.items.validate(e, path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateObject applies the object keywords.
+func (s *jsonSchema) validateObject(m map[string]any, path string) error {
+	switch {
+	case s.minProperties != nil && len(m) < *s.minProperties:
+		return fmt.Errorf("%s: fewer than minProperties %d", path, *s.minProperties)
+	case s.maxProperties != nil && len(m) > *s.maxProperties:
+		return fmt.Errorf("%s: more than maxProperties %d", path, *s.maxProperties)
+	}
+
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			return fmt.Errorf("%s: missing required property %s", path, name)
+		}
+	}
+
+	for name, pv := range m {
+		if ps, ok := s.properties[name]; ok {
+			if err := ps.validate(pv, path+"/"+name); err != nil {
+				return err
+			}
+		} else if s.additional != nil {
+			if err := s.additional.validate(pv, path+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isType returns true if a normalized value is of a json schema type.
+func isType(v any, t string) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n) && !math.IsInf(n, 0)
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	default:
+		return false
+	}
+}
+
+// normalize converts a number decoded from json or msgpack to float64.
+func normalize(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		f, _ := t.Float64()
+		return f
+	case float32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case int:
+		return float64(t)
+	}
+	return v
+}
+
+// normalizeDeep normalizes a value and the elements of its arrays and objects, for comparison
+// with enum and const values.
+func normalizeDeep(v any) any {
+	switch t := v.(type) {
+	case []any:
+		out := make([]any, len(t))
+		for i, e := range t {
+			out[i] = normalizeDeep(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, e := range t {
+			out[k] = normalizeDeep(e)
+		}
+		return out
+	}
+	return normalize(v)
+}
+
+// toStrings converts a decoded array to strings.
+func toStrings(l []any) ([]string, error) {
+	out := make([]string, len(l))
+	for i, v := range l {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an array of strings")
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// toNumber converts a decoded number.
+func toNumber(v any) (*float64, error) {
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("must be a number")
+	}
+	return &n, nil
+}
+
+// toInt converts a decoded non-negative integer.
+func toInt(v any) (*int, error) {
+	n, ok := v.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	i := int(n)
+	return &i, nil
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const readingSchema = `{
+	"type": "object",
+	"required": ["id", "temp"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"temp": {"type": "number", "exclusiveMinimum": -100, "maximum": 100},
+		"unit": {"enum": ["c", "f"]},
+		"name": {"type": "string", "minLength": 2, "maxLength": 8, "pattern": "^[a-z]+$"},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"mode": {"oneOf": [{"const": 1}, {"const": "auto"}]},
+		"level": {"anyOf": [{"type": "null"}, {"type": "integer", "multipleOf": 10}]},
+		"flag": {"not": {"type": "string"}}
+	},
+	"additionalProperties": false
+}`
+
+func validateJSON(t *testing.T, s *jsonSchema, doc string) error {
+	v, err := decode(FormatJSON, []byte(doc))
+	require.NoError(t, err)
+	return s.validate(v, "#")
+}
+
+func TestParseJSONSchemaErrors(t *testing.T) {
+	_, err := parseJSONSchema([]byte(`{`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`[]`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"$ref": "#/definitions/a"}`))
+	require.ErrorIs(t, err, ErrUnsupportedKeyword)
+	_, err = parseJSONSchema([]byte(`{"properties": {"a": {"if": {}}}}`))
+	require.ErrorIs(t, err, ErrUnsupportedKeyword)
+	_, err = parseJSONSchema([]byte(`{"type": 1}`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"minLength": -1}`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"pattern": "("}`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"required": [1]}`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"anyOf": {}}`))
+	require.Error(t, err)
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	s, err := parseJSONSchema([]byte(readingSchema))
+	require.NoError(t, err)
+
+	valid := []string{
+		`{"id": 1, "temp": 21.5}`,
+		`{"id": 12345678901234567890, "temp": -99, "unit": "c", "name": "abc", "tags": ["a"], "mode": "auto", "level": null, "flag": true}`,
+		`{"id": 2, "temp": 100, "mode": 1, "level": 20}`,
+	}
+	for _, doc := range valid {
+		require.NoError(t, validateJSON(t, s, doc), doc)
+	}
+
+	invalid := map[string]string{
+		`[]`:                                            "expected type",
+		`{"id": 1}`:                                     "missing required property temp",
+		`{"id": 1.5, "temp": 1}`:                        "#/id: expected type",
+		`{"id": 0, "temp": 1}`:                          "less than minimum",
+		`{"id": 1, "temp": -100}`:                       "not greater than exclusiveMinimum",
+		`{"id": 1, "temp": 101}`:                        "greater than maximum",
+		`{"id": 1, "temp": 1, "unit": "k"}`:             "not one of the enum values",
+		`{"id": 1, "temp": 1, "name": "a"}`:             "shorter than minLength",
+		`{"id": 1, "temp": 1, "name": "abcdefghi"}`:     "longer than maxLength",
+		`{"id": 1, "temp": 1, "name": "AB"}`:            "does not match pattern",
+		`{"id": 1, "temp": 1, "tags": [1]}`:             "#/tags/0: expected type",
+		`{"id": 1, "temp": 1, "tags": ["a", "b", "c"]}`: "more than maxItems",
+		`{"id": 1, "temp": 1, "mode": 2}`:               "matches 0 of the oneOf schemas",
+		`{"id": 1, "temp": 1, "level": 5}`:              "does not match any of the anyOf schemas",
+		`{"id": 1, "temp": 1, "flag": "x"}`:             "matches the not schema",
+		`{"id": 1, "temp": 1, "other": 1}`:              "#/other: not allowed",
+	}
+	for doc, msg := range invalid {
+		err := validateJSON(t, s, doc)
+		require.Error(t, err, doc)
+		require.Contains(t, err.Error(), msg, doc)
+	}
+}
+
+func TestJSONSchemaValidateMsgpack(t *testing.T) {
+	s, err := parseJSONSchema([]byte(readingSchema))
+	require.NoError(t, err)
+
+	// msgpack values are decoded with integer and float32 types
+	require.NoError(t, s.validate(map[string]any{"id": int64(3), "temp": float32(1.5), "mode": uint64(1)}, "#"))
+	require.Error(t, s.validate(map[string]any{"id": int64(0), "temp": float32(1.5)}, "#"))
+}
+
+func TestJSONSchemaConstObject(t *testing.T) {
+	s, err := parseJSONSchema([]byte(`{"const": {"a": [1, 2]}, "minProperties": 1, "maxProperties": 1}`))
+	require.NoError(t, err)
+	require.NoError(t, validateJSON(t, s, `{"a": [1, 2.0]}`))
+	require.Error(t, validateJSON(t, s, `{"a": [1, 3]}`))
+}
+
+func TestNormalize(t *testing.T) {
+	require.Equal(t, float64(1), normalize(json.Number("1")))
+	require.Equal(t, float64(1), normalize(int64(1)))
+	require.Equal(t, float64(1), normalize(uint64(1)))
+	require.Equal(t, float64(1.5), normalize(float32(1.5)))
+	require.Equal(t, "a", normalize("a"))
+	require.Equal(t, []any{float64(1), map[string]any{"b": float64(2)}}, normalizeDeep([]any{int64(1), map[string]any{"b": json.Number("2")}}))
+}
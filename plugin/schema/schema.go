@@ -0,0 +1,398 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// The payload formats.
+const (
+	FormatJSON     = "json"
+	FormatMsgpack  = "msgpack"
+	FormatProtobuf = "protobuf"
+)
+
+// The actions which can be taken with invalid messages.
+const (
+	InvalidReject     = "reject"      // drop the message, acknowledging v5 qos 1 and 2 messages with the reason code
+	InvalidDeadLetter = "dead-letter" // publish the message to the dead letter topic instead
+)
+
+var (
+	// ErrServerNotSet indicates SetServer was not called before the hook was added.
+	ErrServerNotSet = errors.New("schema requires the server to be set before it is added")
+
+	// ErrInvalidRule indicates a rule is incomplete or has conflicting settings.
+	ErrInvalidRule = errors.New("invalid schema rule")
+)
+
+// contentTypes are the v5 content types of the payload formats.
+var contentTypes = map[string]string{
+	FormatJSON:    "application/json",
+	FormatMsgpack: "application/msgpack",
+}
+
+// rejectCodes are the puback reason codes which can be returned for invalid messages.
+var rejectCodes = map[byte]packets.Code{
+	packets.ErrUnspecifiedError.Code:            packets.ErrUnspecifiedError,
+	packets.ErrImplementationSpecificError.Code: packets.ErrImplementationSpecificError,
+	packets.ErrNotAuthorized.Code:               packets.ErrNotAuthorized,
+	packets.ErrTopicNameInvalid.Code:            packets.ErrTopicNameInvalid,
+	packets.ErrQuotaExceeded.Code:               packets.ErrQuotaExceeded,
+	packets.ErrPayloadFormatInvalid.Code:        packets.ErrPayloadFormatInvalid,
+}
+
+// Options contains configuration settings for the schema hook.
+type Options struct {
+	Rules []Rule `json:"rules" yaml:"rules"` // the first rule matching the topic of a message is applied
+}
+
+// Rule validates and transforms the messages published to topics matching a filter.
+type Rule struct {
+	Filter          string    `json:"filter" yaml:"filter"`                       // topic filter, wildcard(#、+) is supported
+	Format          string    `json:"format" yaml:"format"`                       // json (default), msgpack or protobuf
+	JSONSchema      string    `json:"json-schema" yaml:"json-schema"`             // json schema file path, for json and msgpack payloads
+	ProtoDescriptor string    `json:"proto-descriptor" yaml:"proto-descriptor"`   // FileDescriptorSet file path (protoc --descriptor_set_out)
+	ProtoMessage    string    `json:"proto-message" yaml:"proto-message"`         // full name of the message, such as sensors.Reading
+	Invalid         string    `json:"invalid" yaml:"invalid"`                     // reject (default) or dead-letter
+	ReasonCode      byte      `json:"reason-code" yaml:"reason-code"`             // v5 puback reason code of rejected messages, defaults to 0x99
+	DeadLetterTopic string    `json:"dead-letter-topic" yaml:"dead-letter-topic"` // %t and %c are replaced with the topic and client id
+	Transform       Transform `json:"transform" yaml:"transform"`                 // transformations of valid json and msgpack messages
+}
+
+// Transform contains the transformations applied to valid messages.
+type Transform struct {
+	TimestampField string `json:"timestamp-field" yaml:"timestamp-field"` // adds the unix time in milliseconds to object payloads
+	ClientIDField  string `json:"client-id-field" yaml:"client-id-field"` // adds the publishing client id to object payloads
+	Output         string `json:"output" yaml:"output"`                   // json or msgpack, defaults to the format
+}
+
+// rule is a rule with its schema loaded.
+type rule struct {
+	Rule
+	schema  *jsonSchema
+	message protoreflect.MessageDescriptor
+	reason  packets.Code
+}
+
+// Schema is a hook which validates and transforms published messages.
+type Schema struct {
+	mqtt.HookBase
+	config *Options
+	server *mqtt.Server
+	rules  []*rule
+	now    func() time.Time
+}
+
+// ID returns the ID of the hook.
+func (h *Schema) ID() string {
+	return "schema"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Schema) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// SetServer sets the server which dead letters are published to. It must be called before
+// the hook is added.
+func (h *Schema) SetServer(server *mqtt.Server) {
+	h.server = server
+}
+
+// Init loads the schemas of the rules.
+func (h *Schema) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if h.server == nil {
+		return ErrServerNotSet
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	h.rules = make([]*rule, 0, len(h.config.Rules))
+	for _, r := range h.config.Rules {
+		lr, err := loadRule(r)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Filter, err)
+		}
+
+		if lr.Invalid == InvalidDeadLetter && !h.server.Options.InlineClient {
+			return fmt.Errorf("rule %s: %w", r.Filter, mqtt.ErrInlineClientNotEnabled)
+		}
+
+		h.rules = append(h.rules, lr)
+	}
+
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// loadRule validates a rule, applies its defaults and loads its schema.
+func loadRule(r Rule) (*rule, error) {
+	if r.Filter == "" {
+		return nil, ErrInvalidRule
+	}
+
+	if r.Format == "" {
+		r.Format = FormatJSON
+	}
+	if r.Invalid == "" {
+		r.Invalid = InvalidReject
+	}
+	if r.ReasonCode == 0 {
+		r.ReasonCode = packets.ErrPayloadFormatInvalid.Code
+	}
+
+	lr := &rule{Rule: r}
+	var ok bool
+	if lr.reason, ok = rejectCodes[r.ReasonCode]; !ok {
+		return nil, fmt.Errorf("%w: reason-code %#x is not a puback reason code", ErrInvalidRule, r.ReasonCode)
+	}
+
+	switch r.Invalid {
+	case InvalidReject:
+	case InvalidDeadLetter:
+		if r.DeadLetterTopic == "" {
+			return nil, fmt.Errorf("%w: dead-letter requires a dead-letter-topic", ErrInvalidRule)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown invalid action %s", ErrInvalidRule, r.Invalid)
+	}
+
+	switch r.Format {
+	case FormatJSON, FormatMsgpack:
+		if r.ProtoDescriptor != "" {
+			return nil, fmt.Errorf("%w: proto-descriptor requires the protobuf format", ErrInvalidRule)
+		}
+		if _, ok := contentTypes[r.Transform.Output]; !ok && r.Transform.Output != "" {
+			return nil, fmt.Errorf("%w: unknown output format %s", ErrInvalidRule, r.Transform.Output)
+		}
+		if r.JSONSchema != "" {
+			data, err := os.ReadFile(r.JSONSchema)
+			if err != nil {
+				return nil, err
+			}
+			if lr.schema, err = parseJSONSchema(data); err != nil {
+				return nil, fmt.Errorf("%s: %w", r.JSONSchema, err)
+			}
+		}
+	case FormatProtobuf:
+		if r.JSONSchema != "" || r.Transform != (Transform{}) {
+			return nil, fmt.Errorf("%w: protobuf messages can only be validated", ErrInvalidRule)
+		}
+		md, err := loadMessageDescriptor(r.ProtoDescriptor, r.ProtoMessage)
+		if err != nil {
+			return nil, err
+		}
+		lr.message = md
+	default:
+		return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidRule, r.Format)
+	}
+
+	return lr, nil
+}
+
+// loadMessageDescriptor returns a message descriptor from a FileDescriptorSet file.
+func loadMessageDescriptor(path, name string) (protoreflect.MessageDescriptor, error) {
+	if path == "" || name == "" {
+		return nil, fmt.Errorf("%w: protobuf requires a proto-descriptor and proto-message", ErrInvalidRule)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a message", ErrInvalidRule, name)
+	}
+
+	return md, nil
+}
+
+// OnPublish validates and transforms a message using the first rule matching its topic.
+func (h *Schema) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	r := h.match(pk.TopicName)
+	if r == nil {
+		return pk, nil
+	}
+
+	payload, err := h.process(r, cl, pk.Payload)
+	if err != nil {
+		return pk, h.invalid(r, cl, pk, err)
+	}
+
+	if output := r.output(); output != r.Format {
+		pk.Properties.ContentType = contentTypes[output]
+		pk.Properties.PayloadFormat = 0
+		pk.Properties.PayloadFormatFlag = false
+		if output == FormatJSON {
+			pk.Properties.PayloadFormat = 1
+			pk.Properties.PayloadFormatFlag = true
+		}
+	}
+
+	pk.Payload = payload
+	return pk, nil
+}
+
+// match returns the first rule matching a topic.
+func (h *Schema) match(topic string) *rule {
+	for _, r := range h.rules {
+		if plugin.MatchTopic(r.Filter, topic) {
+			return r
+		}
+	}
+	return nil
+}
+
+// process validates a payload and returns it transformed.
+func (h *Schema) process(r *rule, cl *mqtt.Client, payload []byte) ([]byte, error) {
+	if r.Format == FormatProtobuf {
+		msg := dynamicpb.NewMessage(r.message)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	v, err := decode(r.Format, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.schema != nil {
+		if err := r.schema.validate(v, "#"); err != nil {
+			return nil, err
+		}
+	}
+
+	changed := false
+	if m, ok := v.(map[string]any); ok {
+		if f := r.Transform.TimestampField; f != "" {
+			m[f] = h.now().UnixMilli()
+			changed = true
+		}
+		if f := r.Transform.ClientIDField; f != "" {
+			m[f] = cl.ID
+			changed = true
+		}
+	}
+
+	output := r.output()
+	if !changed && output == r.Format {
+		return payload, nil
+	}
+
+	return encode(output, v)
+}
+
+// output returns the format of transformed payloads.
+func (r *rule) output() string {
+	if r.Transform.Output != "" {
+		return r.Transform.Output
+	}
+	return r.Format
+}
+
+// invalid handles a message which failed validation, returning the error for OnPublish.
+func (h *Schema) invalid(r *rule, cl *mqtt.Client, pk packets.Packet, err error) error {
+	h.Log.Debug("invalid message", "client", cl.ID, "topic", pk.TopicName, "error", err, "action", r.Invalid)
+	if r.Invalid == InvalidDeadLetter {
+		topic := strings.NewReplacer("%t", pk.TopicName, "%c", cl.ID).Replace(r.DeadLetterTopic)
+		if err := h.server.Publish(topic, pk.Payload, false, pk.FixedHeader.Qos); err != nil {
+			h.Log.Error("publish dead letter", "error", err, "topic", topic)
+		}
+		return packets.CodeSuccessIgnore // acknowledge the message without delivering it
+	}
+
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return r.reason
+	}
+
+	return packets.ErrRejectPacket
+}
+
+// decode decodes a json or msgpack payload.
+func decode(format string, payload []byte) (any, error) {
+	if format == FormatMsgpack {
+		v, rest, err := msgp.ReadIntfBytes(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("%d bytes after msgpack value", len(rest))
+		}
+		return v, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber() // keep large integers intact
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("data after json value")
+	}
+
+	return v, nil
+}
+
+// encode encodes a value as json or msgpack.
+func encode(format string, v any) ([]byte, error) {
+	if format == FormatMsgpack {
+		return msgp.AppendIntf(nil, v)
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package schema
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinylib/msgp/msgp"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newServer(t *testing.T) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{
+		Logger:       logger,
+		InlineClient: true,
+	})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	return s
+}
+
+func newHook(t *testing.T, opts *Options) *Schema {
+	h := &Schema{now: func() time.Time { return time.UnixMilli(1700000000123) }}
+	h.SetOpts(logger, nil)
+	h.SetServer(newServer(t))
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func newClient(version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: "c1"}
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+func newPacket(topic string, qos byte, payload []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos},
+		TopicName:   topic,
+		Payload:     payload,
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// writeDescriptor writes a FileDescriptorSet with a sensors.Reading message, which has a
+// required id and an optional temp.
+func writeDescriptor(t *testing.T) string {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("sensors.proto"),
+			Package: proto.String("sensors"),
+			Syntax:  proto.String("proto2"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Reading"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:   proto.String("id"),
+						Number: proto.Int32(1),
+						Label:  descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum(),
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(),
+					},
+					{
+						Name:   proto.String("temp"),
+						Number: proto.Int32(2),
+						Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum(),
+					},
+				},
+			}},
+		}},
+	}
+
+	data, err := proto.Marshal(set)
+	require.NoError(t, err)
+	return writeFile(t, "sensors.pb", data)
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "schema", new(Schema).ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Schema)
+	require.True(t, h.Provides(mqtt.OnPublish))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestInitErrors(t *testing.T) {
+	h := new(Schema)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrServerNotSet)
+
+	h.SetServer(newServer(t))
+	require.NoError(t, h.Init(nil))
+
+	descriptor := writeDescriptor(t)
+	for _, r := range []Rule{
+		{},
+		{Filter: "a", Format: "xml"},
+		{Filter: "a", Invalid: "ignore"},
+		{Filter: "a", Invalid: InvalidDeadLetter},
+		{Filter: "a", ReasonCode: 0x01},
+		{Filter: "a", Transform: Transform{Output: "xml"}},
+		{Filter: "a", ProtoDescriptor: descriptor},
+		{Filter: "a", JSONSchema: filepath.Join(t.TempDir(), "missing.json")},
+		{Filter: "a", JSONSchema: writeFile(t, "bad.json", []byte(`{"$ref": "x"}`))},
+		{Filter: "a", Format: FormatProtobuf},
+		{Filter: "a", Format: FormatProtobuf, ProtoDescriptor: descriptor, ProtoMessage: "sensors.Missing"},
+		{Filter: "a", Format: FormatProtobuf, ProtoDescriptor: descriptor, ProtoMessage: "sensors.Reading", Transform: Transform{ClientIDField: "c"}},
+	} {
+		require.Error(t, h.Init(&Options{Rules: []Rule{r}}), r)
+	}
+
+	h.SetServer(mqtt.New(&mqtt.Options{Logger: logger}))
+	err := h.Init(&Options{Rules: []Rule{{Filter: "a", Invalid: InvalidDeadLetter, DeadLetterTopic: "dlq"}}})
+	require.ErrorIs(t, err, mqtt.ErrInlineClientNotEnabled)
+}
+
+func TestInitDefaults(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{{Filter: "a/#"}}})
+	require.Len(t, h.rules, 1)
+	require.Equal(t, FormatJSON, h.rules[0].Format)
+	require.Equal(t, InvalidReject, h.rules[0].Invalid)
+	require.Equal(t, packets.ErrPayloadFormatInvalid, h.rules[0].reason)
+}
+
+func TestOnPublishNoRule(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{{Filter: "a/#"}}})
+	pk, err := h.OnPublish(newClient(5), newPacket("b/c", 1, []byte("not json")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("not json"), pk.Payload)
+}
+
+func TestOnPublishReject(t *testing.T) {
+	schema := writeFile(t, "reading.json", []byte(readingSchema))
+	h := newHook(t, &Options{Rules: []Rule{
+		{Filter: "sensors/#", JSONSchema: schema},
+		{Filter: "alerts/#", ReasonCode: packets.ErrNotAuthorized.Code},
+	}})
+
+	pk, err := h.OnPublish(newClient(5), newPacket("sensors/1", 1, []byte(`{"id": 1, "temp": 20}`)))
+	require.NoError(t, err)
+	require.Equal(t, `{"id": 1, "temp": 20}`, string(pk.Payload))
+
+	_, err = h.OnPublish(newClient(5), newPacket("sensors/1", 1, []byte(`{"id": 1}`)))
+	require.ErrorIs(t, err, packets.ErrPayloadFormatInvalid)
+	_, err = h.OnPublish(newClient(5), newPacket("sensors/1", 0, []byte(`{"id": 1}`)))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	_, err = h.OnPublish(newClient(4), newPacket("sensors/1", 1, []byte(`{"id": 1}`)))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	_, err = h.OnPublish(newClient(5), newPacket("alerts/1", 2, []byte(`{"a": 1} {}`)))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+
+	cl := newClient(5)
+	cl.Net.Inline = true
+	_, err = h.OnPublish(cl, newPacket("sensors/1", 1, []byte(`{"id": 1}`)))
+	require.NoError(t, err)
+}
+
+func TestOnPublishRejectQos2(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{{Filter: "sensors/#"}}})
+	require.NoError(t, h.server.AddHook(h, h.config))
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+	cl := h.server.NewClient(r, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.ResetReceiveQuota(10)
+
+	pk := newPacket("sensors/1", 2, []byte("not json"))
+	pk.PacketID = 7
+	go func() { _ = h.server.InjectPacket(cl, pk) }()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(w, buf)
+	require.NoError(t, err)
+	require.Equal(t, packets.Pubrec<<4, buf[0]) // a qos 2 publish is refused in its pubrec
+	require.Equal(t, []byte{0, 7, packets.ErrPayloadFormatInvalid.Code}, buf[2:])
+}
+
+func TestOnPublishDeadLetter(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{{Filter: "sensors/#", Invalid: InvalidDeadLetter, DeadLetterTopic: "dlq/%c/%t"}}})
+
+	received := make(chan packets.Packet, 1)
+	require.NoError(t, h.server.Subscribe("dlq/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	_, err := h.OnPublish(newClient(5), newPacket("sensors/1", 1, []byte("bad")))
+	require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "dlq/c1/sensors/1", pk.TopicName)
+		require.Equal(t, []byte("bad"), pk.Payload)
+	case <-time.After(time.Second):
+		require.Fail(t, "dead letter not published")
+	}
+}
+
+func TestOnPublishTransform(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{
+		{Filter: "json/#", Transform: Transform{TimestampField: "ts", ClientIDField: "client"}},
+		{Filter: "pack/#", Transform: Transform{ClientIDField: "client", Output: FormatMsgpack}},
+		{Filter: "unpack/#", Format: FormatMsgpack, Transform: Transform{Output: FormatJSON}},
+	}})
+
+	pk, err := h.OnPublish(newClient(5), newPacket("json/1", 0, []byte(`{"id": 12345678901234567890}`)))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id": 12345678901234567890, "ts": 1700000000123, "client": "c1"}`, string(pk.Payload))
+	require.Contains(t, string(pk.Payload), `"id":12345678901234567890`) // large integers are kept intact
+	require.Equal(t, "", pk.Properties.ContentType)
+
+	// values which are not objects are not changed
+	pk, err = h.OnPublish(newClient(5), newPacket("json/1", 0, []byte(`[1, 2]`)))
+	require.NoError(t, err)
+	require.Equal(t, `[1, 2]`, string(pk.Payload))
+
+	pk, err = h.OnPublish(newClient(5), newPacket("pack/1", 0, []byte(`{"id": 7}`)))
+	require.NoError(t, err)
+	require.Equal(t, "application/msgpack", pk.Properties.ContentType)
+	v, _, err := msgp.ReadIntfBytes(pk.Payload)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"id": int64(7), "client": "c1"}, v)
+
+	payload, err := msgp.AppendIntf(nil, map[string]any{"id": 7, "on": true})
+	require.NoError(t, err)
+	pk, err = h.OnPublish(newClient(5), newPacket("unpack/1", 0, payload))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id": 7, "on": true}`, string(pk.Payload))
+	require.Equal(t, "application/json", pk.Properties.ContentType)
+	require.True(t, pk.Properties.PayloadFormatFlag)
+
+	_, err = h.OnPublish(newClient(5), newPacket("unpack/1", 0, append(payload, 0xc0)))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
+
+func TestOnPublishProtobuf(t *testing.T) {
+	h := newHook(t, &Options{Rules: []Rule{{
+		Filter:          "sensors/#",
+		Format:          FormatProtobuf,
+		ProtoDescriptor: writeDescriptor(t),
+		ProtoMessage:    "sensors.Reading",
+	}}})
+
+	msg := dynamicpb.NewMessage(h.rules[0].message)
+	msg.Set(h.rules[0].message.Fields().ByName("temp"), protoreflect.ValueOfFloat64(21.5))
+	partial, err := proto.MarshalOptions{AllowPartial: true}.Marshal(msg)
+	require.NoError(t, err)
+
+	_, err = h.OnPublish(newClient(5), newPacket("sensors/1", 1, partial))
+	require.ErrorIs(t, err, packets.ErrPayloadFormatInvalid) // missing the required id
+
+	msg.Set(h.rules[0].message.Fields().ByName("id"), protoreflect.ValueOfInt64(1))
+	payload, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	pk, err := h.OnPublish(newClient(5), newPacket("sensors/1", 1, payload))
+	require.NoError(t, err)
+	require.Equal(t, payload, pk.Payload)
+
+	_, err = h.OnPublish(newClient(5), newPacket("sensors/1", 1, []byte{0xff}))
+	require.ErrorIs(t, err, packets.ErrPayloadFormatInvalid)
+}
@@ -0,0 +1,535 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package tenant
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrServerNotSet indicates SetServer was not called before the hook was added.
+	ErrServerNotSet = errors.New("tenant requires the server to be set before it is added")
+
+	// ErrInvalidTenant indicates a tenant name is empty or contains a / or wildcard.
+	ErrInvalidTenant = errors.New("invalid tenant name")
+
+	// ErrInvalidLimits indicates a limit is negative.
+	ErrInvalidLimits = errors.New("invalid tenant limits")
+)
+
+// Options contains configuration settings for the tenants. The tenant of a client is taken
+// from its listener, then the prefix of its username, then a user property of its CONNECT.
+type Options struct {
+	Listeners map[string]string `json:"listeners" yaml:"listeners"` // tenants keyed on listener id
+	Separator string            `json:"separator" yaml:"separator"` // the tenant is the username before it, such as acme in acme:sensor-1
+	Property  string            `json:"property" yaml:"property"`   // the CONNECT user property naming the tenant
+	Required  bool              `json:"required" yaml:"required"`   // refuse clients without a tenant
+	Default   Limits            `json:"default" yaml:"default"`     // the limits of every tenant
+	Tenants   map[string]Limits `json:"tenants" yaml:"tenants"`     // limits keyed on tenant, a zero limit takes the default
+}
+
+// Limits contains the limits of a tenant. A zero limit is not set.
+type Limits struct {
+	Connections   int     `json:"connections" yaml:"connections"`     // connected clients
+	Subscriptions int     `json:"subscriptions" yaml:"subscriptions"` // subscriptions of the connected clients
+	Messages      float64 `json:"messages" yaml:"messages"`           // inbound publish packets per second
+	Burst         int     `json:"burst" yaml:"burst"`                 // the message bucket size, defaults to the rate
+	Retained      int     `json:"retained" yaml:"retained"`           // retained messages
+}
+
+// state contains the connected clients and message bucket of a tenant.
+type state struct {
+	limits   Limits
+	clients  map[*mqtt.Client]struct{}
+	messages *rate.Limiter
+}
+
+// Tenant is a hook which places the clients of each tenant in their own topic namespace, so
+// that tenants cannot see the topics, retained messages or $SYS topics of each other, and
+// applies the limits of the tenant.
+type Tenant struct {
+	mqtt.HookBase
+	sync.Mutex
+	config   *Options
+	server   *mqtt.Server
+	tenants  map[string]*state
+	retained map[string]map[string]struct{} // the topics of the retained messages of each tenant
+	now      func() time.Time
+}
+
+// ID returns the ID of the hook.
+func (h *Tenant) ID() string {
+	return "tenant"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Tenant) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPacketRead,
+		mqtt.OnPacketEncode,
+		mqtt.OnACLCheck,
+		mqtt.OnSubscribe,
+		mqtt.OnPublish,
+		mqtt.OnWill,
+		mqtt.OnRetainMessage,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// SetServer sets the server whose clients and retained messages are counted. It must be
+// called before the hook is added.
+func (h *Tenant) SetServer(server *mqtt.Server) {
+	h.server = server
+}
+
+// Init validates the configuration.
+func (h *Tenant) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if h.server == nil {
+		return ErrServerNotSet
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	for id, name := range h.config.Listeners {
+		if !mqtt.IsValidTenant(name) {
+			return fmt.Errorf("listener %s: %w", id, ErrInvalidTenant)
+		}
+	}
+
+	if err := h.config.Default.validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+
+	for name, l := range h.config.Tenants {
+		if !mqtt.IsValidTenant(name) {
+			return fmt.Errorf("tenant %s: %w", name, ErrInvalidTenant)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+
+	h.tenants = map[string]*state{}
+	h.retained = map[string]map[string]struct{}{}
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// validate returns an error if any of the limits are negative.
+func (l Limits) validate() error {
+	if l.Connections < 0 || l.Subscriptions < 0 || l.Messages < 0 || l.Burst < 0 || l.Retained < 0 {
+		return ErrInvalidLimits
+	}
+
+	return nil
+}
+
+// limits returns the limits of a tenant.
+func (h *Tenant) limits(name string) Limits {
+	l := h.config.Default
+	t, ok := h.config.Tenants[name]
+	if !ok {
+		return l
+	}
+
+	if t.Connections > 0 {
+		l.Connections = t.Connections
+	}
+	if t.Subscriptions > 0 {
+		l.Subscriptions = t.Subscriptions
+	}
+	if t.Messages > 0 {
+		l.Messages = t.Messages
+		l.Burst = t.Burst
+	}
+	if t.Retained > 0 {
+		l.Retained = t.Retained
+	}
+
+	return l
+}
+
+// OnStarted counts the retained messages of each tenant once they have been loaded from the
+// store. Afterwards they are counted as messages are retained, cleared and expired.
+func (h *Tenant) OnStarted() {
+	for _, pk := range h.server.Retained.Messages(mqtt.TenantPrefix + "/#") {
+		h.addRetained(pk.TopicName)
+	}
+}
+
+// OnRetainMessage counts a retained message of a tenant, or removes a cleared one.
+func (h *Tenant) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if len(pk.Payload) > 0 {
+		h.addRetained(pk.TopicName)
+	} else {
+		h.deleteRetained(pk.TopicName)
+	}
+}
+
+// OnRetainedExpired removes an expired retained message of a tenant.
+func (h *Tenant) OnRetainedExpired(topic string) {
+	h.deleteRetained(topic)
+}
+
+// topicTenant returns the tenant whose namespace contains a topic, if any.
+func topicTenant(topic string) (string, bool) {
+	rest, ok := strings.CutPrefix(topic, mqtt.TenantPrefix+"/")
+	if !ok {
+		return "", false
+	}
+
+	name, _, ok := strings.Cut(rest, "/")
+	return name, ok && name != ""
+}
+
+// addRetained adds a topic to the retained messages of its tenant.
+func (h *Tenant) addRetained(topic string) {
+	name, ok := topicTenant(topic)
+	if !ok {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	topics, ok := h.retained[name]
+	if !ok {
+		topics = map[string]struct{}{}
+		h.retained[name] = topics
+	}
+	topics[topic] = struct{}{}
+}
+
+// deleteRetained removes a topic from the retained messages of its tenant.
+func (h *Tenant) deleteRetained(topic string) {
+	name, ok := topicTenant(topic)
+	if !ok {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	delete(h.retained[name], topic)
+	if len(h.retained[name]) == 0 {
+		delete(h.retained, name)
+	}
+}
+
+// resolve returns the tenant of a connecting client, or an empty string if it has none.
+func (h *Tenant) resolve(cl *mqtt.Client, pk packets.Packet) string {
+	if name, ok := h.config.Listeners[cl.Net.Listener]; ok {
+		return name
+	}
+
+	if h.config.Separator != "" {
+		if name, _, ok := strings.Cut(string(cl.Properties.Username), h.config.Separator); ok {
+			return name
+		}
+	}
+
+	if h.config.Property != "" {
+		for _, p := range pk.Properties.User {
+			if p.Key == h.config.Property {
+				return p.Val
+			}
+		}
+	}
+
+	return ""
+}
+
+// OnConnect sets the tenant of a client, refusing the connection if the tenant is invalid or
+// required, has as many connections as it is allowed, or the session belongs to another tenant.
+func (h *Tenant) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if cl.Net.Inline {
+		return nil
+	}
+
+	name := h.resolve(cl, pk)
+	if name == "" && h.config.Required {
+		h.Log.Info("client has no tenant", "client", cl.ID, "listener", cl.Net.Listener)
+		return packets.ErrNotAuthorized
+	}
+
+	if name != "" && !mqtt.IsValidTenant(name) {
+		h.Log.Info("client has an invalid tenant", "client", cl.ID, "tenant", name)
+		return packets.ErrNotAuthorized
+	}
+
+	existing, ok := h.server.Clients.Get(cl.ID)
+	if ok && existing.Properties.Tenant != name {
+		h.Log.Info("client session belongs to another tenant", "client", cl.ID, "tenant", name)
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	if max := h.limits(name).Connections; max > 0 {
+		h.Lock()
+		count := 0
+		if st, ok := h.tenants[name]; ok {
+			count = len(st.clients)
+			if existing != nil {
+				if _, ok := st.clients[existing]; ok {
+					count-- // the existing connection is taken over
+				}
+			}
+		}
+		h.Unlock()
+
+		if count >= max {
+			h.Log.Info("tenant connection quota exceeded", "client", cl.ID, "tenant", name)
+			return packets.ErrQuotaExceeded
+		}
+	}
+
+	cl.Properties.Tenant = name
+	return nil
+}
+
+// OnSessionEstablished adds a client to the connected clients of its tenant.
+func (h *Tenant) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	name := cl.Properties.Tenant
+	if name == "" {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	st, ok := h.tenants[name]
+	if !ok {
+		st = &state{
+			limits:  h.limits(name),
+			clients: map[*mqtt.Client]struct{}{},
+		}
+		if st.limits.Messages > 0 {
+			burst := st.limits.Burst
+			if burst == 0 {
+				burst = max(int(st.limits.Messages), 1)
+			}
+			st.messages = rate.NewLimiter(rate.Limit(st.limits.Messages), burst)
+		}
+		h.tenants[name] = st
+	}
+	st.clients[cl] = struct{}{}
+}
+
+// OnDisconnect removes a client from the connected clients of its tenant.
+func (h *Tenant) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.Lock()
+	defer h.Unlock()
+	st, ok := h.tenants[cl.Properties.Tenant]
+	if !ok {
+		return
+	}
+
+	delete(st.clients, cl)
+	if len(st.clients) == 0 {
+		delete(h.tenants, cl.Properties.Tenant)
+	}
+}
+
+// OnPacketRead moves the topic of a publish packet, or the filters of a subscribe or
+// unsubscribe packet, into the namespace of the tenant before the packet is validated.
+func (h *Tenant) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	name := cl.Properties.Tenant
+	if name == "" {
+		return pk, nil
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Publish:
+		pk.TopicName = publishTopic(name, pk.TopicName)
+		pk.Properties.ResponseTopic = publishTopic(name, pk.Properties.ResponseTopic)
+	case packets.Subscribe, packets.Unsubscribe:
+		filters := make(packets.Subscriptions, len(pk.Filters))
+		copy(filters, pk.Filters)
+		for i := range filters {
+			if mqtt.IsValidFilter(filters[i].Filter, false) {
+				filters[i].Filter = mqtt.TenantTopic(name, filters[i].Filter)
+			}
+		}
+		pk.Filters = filters
+	}
+
+	return pk, nil
+}
+
+// publishTopic returns a published topic within the namespace of a tenant. Empty topics of
+// topic aliases, and invalid topics such as $SYS topics, are left for the server to handle.
+func publishTopic(name, topic string) string {
+	if mqtt.IsDelayedTopic(topic) {
+		delay, delayed, ok := mqtt.ParseDelayedTopic(topic)
+		if !ok {
+			return topic
+		}
+		return mqtt.DelayedPrefix + "/" + strconv.FormatInt(delay, 10) + "/" + mqtt.TenantTopic(name, delayed)
+	}
+
+	if topic == "" || !mqtt.IsValidFilter(topic, true) {
+		return topic
+	}
+
+	return mqtt.TenantTopic(name, topic)
+}
+
+// OnPacketEncode removes the namespace of the tenant from the topics of a publish packet
+// before it is sent to the client.
+func (h *Tenant) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	name := cl.Properties.Tenant
+	if name == "" || pk.FixedHeader.Type != packets.Publish {
+		return pk
+	}
+
+	pk.TopicName, _ = mqtt.StripTenant(name, pk.TopicName)
+	pk.Properties.ResponseTopic, _ = mqtt.StripTenant(name, pk.Properties.ResponseTopic)
+	return pk
+}
+
+// OnWill moves the topic of the will message of a client into the namespace of its tenant.
+func (h *Tenant) OnWill(cl *mqtt.Client, will mqtt.Will) (mqtt.Will, error) {
+	if cl.Properties.Tenant != "" {
+		will.TopicName = publishTopic(cl.Properties.Tenant, will.TopicName)
+	}
+
+	return will, nil
+}
+
+// RestrictsACL indicates that the topics refused by OnACLCheck are refused even if an auth
+// hook allows them.
+func (h *Tenant) RestrictsACL() bool {
+	return true
+}
+
+// OnACLCheck refuses the topics and filters in the namespaces of tenants to the clients
+// without a tenant, so that they cannot publish or subscribe to them, directly or through
+// a delayed topic. The topics of clients with a tenant are always in its own namespace.
+func (h *Tenant) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if cl.Net.Inline || cl.Properties.Tenant != "" {
+		return true
+	}
+
+	if mqtt.IsSharedFilter(topic) {
+		if parts := strings.SplitN(topic, "/", 3); len(parts) == 3 {
+			topic = parts[2]
+		}
+	}
+
+	return topic != mqtt.TenantPrefix && !strings.HasPrefix(topic, mqtt.TenantPrefix+"/")
+}
+
+// OnSubscribe rejects the new filters of a client which exceed the subscription quota of its tenant.
+func (h *Tenant) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	h.Lock()
+	st, ok := h.tenants[cl.Properties.Tenant]
+	if !ok || st.limits.Subscriptions == 0 {
+		h.Unlock()
+		return pk
+	}
+
+	count := 0
+	for c := range st.clients {
+		count += c.State.Subscriptions.Len()
+	}
+	h.Unlock()
+
+	codes := make([]byte, len(pk.Filters))
+	copy(codes, pk.ReasonCodes)
+	added := map[string]struct{}{}
+	exceeded := false
+	for i, sub := range pk.Filters {
+		if codes[i] >= packets.ErrUnspecifiedError.Code {
+			continue // rejected by another hook
+		}
+		if _, ok := cl.State.Subscriptions.Get(sub.Filter); ok {
+			continue
+		}
+		if _, ok := added[sub.Filter]; ok {
+			continue
+		}
+
+		if count+len(added) >= st.limits.Subscriptions {
+			codes[i] = packets.ErrQuotaExceeded.Code
+			exceeded = true
+			continue
+		}
+		added[sub.Filter] = struct{}{}
+	}
+
+	if !exceeded {
+		return pk
+	}
+
+	h.Log.Debug("tenant subscription quota exceeded", "client", cl.ID, "tenant", cl.Properties.Tenant)
+	pk.ReasonCodes = codes
+	return pk
+}
+
+// OnPublish applies the message rate and retained message quota of the tenant of a client.
+func (h *Tenant) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	name := cl.Properties.Tenant
+	h.Lock()
+	st, ok := h.tenants[name]
+	h.Unlock()
+	if !ok {
+		return pk, nil
+	}
+
+	if st.messages != nil && !st.messages.AllowN(h.now(), 1) {
+		return pk, h.exceeded(cl, pk, "tenant message rate exceeded")
+	}
+
+	if st.limits.Retained > 0 && pk.FixedHeader.Retain && len(pk.Payload) > 0 {
+		topic := pk.TopicName
+		if _, delayed, ok := mqtt.ParseDelayedTopic(topic); ok {
+			topic = delayed
+		}
+
+		h.Lock()
+		_, exists := h.retained[name][topic]
+		full := len(h.retained[name]) >= st.limits.Retained
+		h.Unlock()
+		if !exists && full {
+			return pk, h.exceeded(cl, pk, "tenant retained quota exceeded")
+		}
+	}
+
+	return pk, nil
+}
+
+// exceeded returns the error for OnPublish when a tenant limit is exceeded.
+func (h *Tenant) exceeded(cl *mqtt.Client, pk packets.Packet, msg string) error {
+	h.Log.Debug(msg, "client", cl.ID, "tenant", cl.Properties.Tenant, "topic", pk.TopicName)
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return packets.ErrQuotaExceeded
+	}
+
+	return packets.ErrRejectPacket
+}
@@ -0,0 +1,447 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package tenant
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// epoch is the time of the message buckets of the tenants, unless a test moves it.
+var epoch = time.Unix(1700000000, 0)
+
+// newTenant adds a tenant hook to a server which allows every client, with the inline client
+// which reaches the namespaces of the tenants.
+func newTenant(t *testing.T, opts *Options) (*Tenant, *mqtt.Server) {
+	s := mqtt.New(&mqtt.Options{Logger: logger, InlineClient: true})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+
+	h := &Tenant{now: func() time.Time { return epoch }}
+	h.SetServer(s)
+	require.NoError(t, s.AddHook(h, opts))
+	return h, s
+}
+
+// newClient returns a v5 client of a listener without a connection, so the packets
+// written to it are discarded.
+func newClient(s *mqtt.Server, id, listener, username string) *mqtt.Client {
+	cl := s.NewClient(nil, listener, id, false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+	cl.State.Inflight.ResetReceiveQuota(10)
+	return cl
+}
+
+// connect connects a client to the hook as the server would.
+func connect(t *testing.T, h *Tenant, s *mqtt.Server, cl *mqtt.Client) {
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	s.Clients.Add(cl)
+	h.OnSessionEstablished(cl, packets.Packet{})
+}
+
+func TestID(t *testing.T) {
+	require.Equal(t, "tenant", new(Tenant).ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Tenant)
+	require.True(t, h.Provides(mqtt.OnConnect))
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnPacketRead))
+	require.True(t, h.Provides(mqtt.OnPacketEncode))
+	require.True(t, h.Provides(mqtt.OnSubscribe))
+	require.True(t, h.Provides(mqtt.OnPublish))
+	require.True(t, h.Provides(mqtt.OnWill))
+	require.True(t, h.Provides(mqtt.OnStarted))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnRetainedExpired))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitErrors(t *testing.T) {
+	h := new(Tenant)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrServerNotSet)
+
+	h.SetServer(mqtt.New(&mqtt.Options{Logger: logger}))
+	require.NoError(t, h.Init(nil))
+	require.ErrorIs(t, h.Init(&Options{Listeners: map[string]string{"t1": "a/b"}}), ErrInvalidTenant)
+	require.ErrorIs(t, h.Init(&Options{Tenants: map[string]Limits{"#": {}}}), ErrInvalidTenant)
+	require.ErrorIs(t, h.Init(&Options{Default: Limits{Connections: -1}}), ErrInvalidLimits)
+	require.ErrorIs(t, h.Init(&Options{Tenants: map[string]Limits{"acme": {Messages: -1}}}), ErrInvalidLimits)
+}
+
+func TestLimits(t *testing.T) {
+	h, _ := newTenant(t, &Options{
+		Default: Limits{Connections: 10, Subscriptions: 100, Messages: 5},
+		Tenants: map[string]Limits{"acme": {Connections: 2, Messages: 1, Burst: 3}},
+	})
+
+	require.Equal(t, Limits{Connections: 10, Subscriptions: 100, Messages: 5}, h.limits("other"))
+	require.Equal(t, Limits{Connections: 2, Subscriptions: 100, Messages: 1, Burst: 3}, h.limits("acme"))
+}
+
+func TestResolve(t *testing.T) {
+	h, s := newTenant(t, &Options{
+		Listeners: map[string]string{"t1": "acme"},
+		Separator: ":",
+		Property:  "tenant",
+	})
+
+	props := packets.Packet{Properties: packets.Properties{User: []packets.UserProperty{{Key: "tenant", Val: "prop"}}}}
+	require.Equal(t, "acme", h.resolve(newClient(s, "c1", "t1", "user:a"), props))
+	require.Equal(t, "user", h.resolve(newClient(s, "c1", "t2", "user:a"), props))
+	require.Equal(t, "prop", h.resolve(newClient(s, "c1", "t2", "user"), props))
+	require.Equal(t, "", h.resolve(newClient(s, "c1", "t2", "user"), packets.Packet{}))
+}
+
+func TestOnConnect(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+
+	cl := newClient(s, "c1", "t1", "acme:a")
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	require.Equal(t, "acme", cl.Properties.Tenant)
+
+	cl = newClient(s, "c2", "t1", "a")
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+	require.Equal(t, "", cl.Properties.Tenant)
+
+	cl = newClient(s, "c3", "t1", "a/b:c")
+	require.ErrorIs(t, h.OnConnect(cl, packets.Packet{}), packets.ErrNotAuthorized)
+
+	cl = newClient(s, "c4", "t1", "a")
+	cl.Net.Inline = true
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+}
+
+func TestOnConnectRequired(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Required: true})
+	require.ErrorIs(t, h.OnConnect(newClient(s, "c1", "t1", "a"), packets.Packet{}), packets.ErrNotAuthorized)
+	require.NoError(t, h.OnConnect(newClient(s, "c1", "t1", "acme:a"), packets.Packet{}))
+}
+
+func TestOnConnectOtherTenantSession(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	connect(t, h, s, newClient(s, "c1", "t1", "acme:a"))
+
+	require.ErrorIs(t, h.OnConnect(newClient(s, "c1", "t1", "other:a"), packets.Packet{}), packets.ErrClientIdentifierNotValid)
+	require.ErrorIs(t, h.OnConnect(newClient(s, "c1", "t1", "a"), packets.Packet{}), packets.ErrClientIdentifierNotValid)
+	require.NoError(t, h.OnConnect(newClient(s, "c1", "t1", "acme:b"), packets.Packet{}))
+}
+
+func TestOnConnectQuota(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Default: Limits{Connections: 1}})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	require.ErrorIs(t, h.OnConnect(newClient(s, "c2", "t1", "acme:b"), packets.Packet{}), packets.ErrQuotaExceeded)
+	require.NoError(t, h.OnConnect(newClient(s, "c1", "t1", "acme:a"), packets.Packet{}))  // takes over c1
+	require.NoError(t, h.OnConnect(newClient(s, "c3", "t1", "other:a"), packets.Packet{})) // counted separately
+
+	h.OnDisconnect(cl, nil, false)
+	require.Empty(t, h.tenants)
+	require.NoError(t, h.OnConnect(newClient(s, "c2", "t1", "acme:b"), packets.Packet{}))
+}
+
+func TestOnPacketReadPublish(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	tt := []struct {
+		topic string
+		want  string
+	}{
+		{topic: "a/b", want: "$tenant/acme/a/b"},
+		{topic: "$delayed/60/a/b", want: "$delayed/60/$tenant/acme/a/b"},
+		{topic: "$delayed/60/a/+", want: "$delayed/60/a/+"},
+		{topic: "$SYS/a", want: "$SYS/a"},
+		{topic: "$tenant/other/a", want: "$tenant/acme/$tenant/other/a"},
+		{topic: "a/+", want: "a/+"},
+		{topic: "", want: ""},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.topic, func(t *testing.T) {
+			pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: tx.topic}
+			out, err := h.OnPacketRead(cl, pk)
+			require.NoError(t, err)
+			require.Equal(t, tx.want, out.TopicName)
+		})
+	}
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a"}
+	pk.Properties.ResponseTopic = "resp/a"
+	out, err := h.OnPacketRead(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, "$tenant/acme/resp/a", out.Properties.ResponseTopic)
+}
+
+func TestOnPacketReadSubscribe(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	for _, typ := range []byte{packets.Subscribe, packets.Unsubscribe} {
+		pk := packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: typ},
+			Filters: packets.Subscriptions{
+				{Filter: "#", Qos: 1},
+				{Filter: "$SYS/#"},
+				{Filter: "$share/g1/a/+"},
+				{Filter: "$share/g1"},
+				{Filter: "a/#/b"},
+			},
+		}
+
+		out, err := h.OnPacketRead(cl, pk)
+		require.NoError(t, err)
+		require.Equal(t, "$tenant/acme/#", out.Filters[0].Filter)
+		require.Equal(t, byte(1), out.Filters[0].Qos)
+		require.Equal(t, "$tenant/acme/$SYS/#", out.Filters[1].Filter)
+		require.Equal(t, "$share/g1/$tenant/acme/a/+", out.Filters[2].Filter)
+		require.Equal(t, "$share/g1", out.Filters[3].Filter)
+		require.Equal(t, "a/#/b", out.Filters[4].Filter)
+		require.Equal(t, "#", pk.Filters[0].Filter) // the read packet is not modified
+	}
+}
+
+func TestOnPacketReadNoTenant(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	cl := newClient(s, "c1", "t1", "a")
+	connect(t, h, s, cl)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b"}
+	out, err := h.OnPacketRead(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestOnPacketEncode(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "$tenant/acme/a/b"}
+	pk.Properties.ResponseTopic = "$tenant/acme/resp"
+	out := h.OnPacketEncode(cl, pk)
+	require.Equal(t, "a/b", out.TopicName)
+	require.Equal(t, "resp", out.Properties.ResponseTopic)
+
+	pk.TopicName = "" // topic alias
+	require.Equal(t, "", h.OnPacketEncode(cl, pk).TopicName)
+
+	pk = packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Suback}}
+	require.Equal(t, pk, h.OnPacketEncode(cl, pk))
+}
+
+func TestOnWill(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	will, err := h.OnWill(cl, mqtt.Will{TopicName: "status/c1"})
+	require.NoError(t, err)
+	require.Equal(t, "$tenant/acme/status/c1", will.TopicName)
+
+	will, err = h.OnWill(newClient(s, "c2", "t1", "a"), mqtt.Will{TopicName: "status/c2"})
+	require.NoError(t, err)
+	require.Equal(t, "status/c2", will.TopicName)
+}
+
+func TestOnSubscribe(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Default: Limits{Subscriptions: 3}})
+	cl1 := newClient(s, "c1", "t1", "acme:a")
+	cl2 := newClient(s, "c2", "t1", "acme:b")
+	connect(t, h, s, cl1)
+	connect(t, h, s, cl2)
+	cl1.State.Subscriptions.Add("a", packets.Subscription{Filter: "a"})
+	cl2.State.Subscriptions.Add("b", packets.Subscription{Filter: "b"})
+
+	pk := h.OnSubscribe(cl1, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "c"}}})
+	require.Empty(t, pk.ReasonCodes)
+
+	pk = h.OnSubscribe(cl1, packets.Packet{Filters: packets.Subscriptions{{Filter: "c"}, {Filter: "a"}, {Filter: "c"}, {Filter: "d"}}})
+	require.Equal(t, []byte{0, 0, 0, packets.ErrQuotaExceeded.Code}, pk.ReasonCodes)
+
+	// filters rejected by another hook are not counted and keep their code
+	pk = h.OnSubscribe(cl1, packets.Packet{
+		Filters:     packets.Subscriptions{{Filter: "c"}, {Filter: "d"}},
+		ReasonCodes: []byte{packets.ErrNotAuthorized.Code},
+	})
+	require.Equal(t, []byte{packets.ErrNotAuthorized.Code}, pk.ReasonCodes)
+
+	// clients without a tenant are not limited
+	pk = h.OnSubscribe(newClient(s, "c3", "t1", "a"), packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}, {Filter: "c"}, {Filter: "d"}}})
+	require.Empty(t, pk.ReasonCodes)
+}
+
+func TestOnPublishRate(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Default: Limits{Messages: 1, Burst: 2}})
+	cl1 := newClient(s, "c1", "t1", "acme:a")
+	cl2 := newClient(s, "c2", "t1", "acme:b")
+	connect(t, h, s, cl1)
+	connect(t, h, s, cl2)
+	pk := packets.Packet{TopicName: "$tenant/acme/a"}
+
+	_, err := h.OnPublish(cl1, pk)
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl2, pk)
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl1, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket) // the rate is shared by the clients of the tenant
+
+	pk.FixedHeader.Qos = 1
+	_, err = h.OnPublish(cl2, pk)
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+
+	h.now = func() time.Time { return epoch.Add(time.Second) }
+	_, err = h.OnPublish(cl1, pk)
+	require.NoError(t, err)
+}
+
+func TestOnPublishRateQos2(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Default: Limits{Messages: 1}})
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+	cl := s.NewClient(r, "t1", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte("acme:a")
+	cl.State.Inflight.ResetReceiveQuota(10)
+	connect(t, h, s, cl)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}, TopicName: "$tenant/acme/a", PacketID: 7}
+	_, err := h.OnPublish(cl, pk) // takes the only token
+	require.NoError(t, err)
+
+	go func() { _ = s.InjectPacket(cl, pk) }()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(w, buf)
+	require.NoError(t, err)
+	require.Equal(t, packets.Pubrec<<4, buf[0]) // a qos 2 publish is refused in its pubrec
+	require.Equal(t, []byte{0, 7, packets.ErrQuotaExceeded.Code}, buf[2:])
+}
+
+func TestOnPublishRetained(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":", Default: Limits{Retained: 1}})
+	cl := newClient(s, "c1", "t1", "acme:a")
+	connect(t, h, s, cl)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: "$tenant/acme/a", Payload: []byte("a")}
+	_, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	h.OnRetainMessage(cl, pk, 1)
+	h.OnRetainMessage(cl, packets.Packet{FixedHeader: pk.FixedHeader, TopicName: "$tenant/other/a", Payload: []byte("a")}, 1)
+
+	_, err = h.OnPublish(cl, pk) // replaces the retained message
+	require.NoError(t, err)
+
+	pk.TopicName = "$tenant/acme/b"
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	pk.TopicName = "$delayed/60/$tenant/acme/b"
+	_, err = h.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	pk.Payload = nil // clears a retained message
+	_, err = h.OnPublish(cl, pk)
+	require.NoError(t, err)
+
+	pk.FixedHeader.Retain = false
+	pk.Payload = []byte("a")
+	_, err = h.OnPublish(cl, pk)
+	require.NoError(t, err)
+
+	// clearing the retained message makes room for another
+	pk.FixedHeader.Retain = true
+	h.OnRetainMessage(cl, packets.Packet{TopicName: "$tenant/acme/a"}, -1)
+	_, err = h.OnPublish(cl, pk)
+	require.NoError(t, err)
+}
+
+func TestRetainedCount(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+	retain := func(topic string) {
+		s.Retained.RetainMessage(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: topic, Payload: []byte("a")})
+	}
+	retain("$tenant/acme/a")
+	retain("$tenant/acme/b")
+	retain("$tenant/other/a")
+	retain("shared/a")
+
+	h.OnStarted()
+	require.Len(t, h.retained, 2)
+	require.Len(t, h.retained["acme"], 2)
+	require.Len(t, h.retained["other"], 1)
+
+	h.OnRetainMessage(nil, packets.Packet{TopicName: "$tenant/acme/a", Payload: []byte("b")}, 1) // replaced
+	require.Len(t, h.retained["acme"], 2)
+
+	h.OnRetainedExpired("$tenant/acme/a")
+	h.OnRetainMessage(nil, packets.Packet{TopicName: "$tenant/acme/b"}, -1)
+	require.NotContains(t, h.retained, "acme")
+
+	h.OnRetainedExpired("$tenant/acme/b") // already removed
+	h.OnRetainedExpired("shared/a")
+	require.Len(t, h.retained, 1)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	h, s := newTenant(t, &Options{Separator: ":"})
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, s.Subscribe("$tenant/acme/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	cl := newClient(s, "c1", "t1", "shared")
+	publish := func(cl *mqtt.Client, topic string) {
+		pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: topic, Payload: []byte("a")}
+		require.NoError(t, s.InjectPacket(cl, pk))
+	}
+
+	// a client without a tenant can neither publish nor subscribe to the namespace of a tenant
+	publish(cl, "$tenant/acme/a")
+	publish(cl, "$delayed/1/$tenant/acme/a")
+	require.Len(t, received, 0)
+	require.Equal(t, 0, s.Delayed.Len())
+
+	err := s.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		PacketID:    1,
+		Filters:     packets.Subscriptions{{Filter: "$tenant/acme/#"}, {Filter: "$share/g/$tenant/acme/#"}, {Filter: "a/#"}},
+	})
+	require.NoError(t, err)
+	_, ok := cl.State.Subscriptions.Get("$tenant/acme/#")
+	require.False(t, ok)
+	_, ok = cl.State.Subscriptions.Get("$share/g/$tenant/acme/#")
+	require.False(t, ok)
+	_, ok = cl.State.Subscriptions.Get("a/#")
+	require.True(t, ok)
+
+	// the clients of the tenant use its namespace
+	tc := newClient(s, "c2", "t1", "acme:a")
+	connect(t, h, s, tc)
+	publish(tc, "$tenant/acme/a")
+	require.Len(t, received, 1)
+}
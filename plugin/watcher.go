@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// WatchFn applies the contents of a watched file. If it returns an error, such as when the
+// file is malformed, the previous contents remain in effect.
+type WatchFn func(data []byte) error
+
+// watchedFile is a file and the function which applies its contents.
+type watchedFile struct {
+	path string
+	fn   WatchFn
+	sum  [sha256.Size]byte // the checksum of the last contents passed to fn
+}
+
+// Watcher polls files for changes, calling the WatchFn of a file when its contents change.
+type Watcher struct {
+	sync.Mutex
+	interval time.Duration
+	log      *slog.Logger
+	files    []*watchedFile
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewWatcher returns a watcher which polls files at an interval. If the interval is zero,
+// files are only reloaded when Reload is called.
+func NewWatcher(interval time.Duration, log *slog.Logger) *Watcher {
+	return &Watcher{
+		interval: interval,
+		log:      log,
+		done:     make(chan struct{}),
+	}
+}
+
+// Add watches a file which has already been applied, such as a config loaded at startup.
+func (w *Watcher) Add(path string, fn WatchFn) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.files = append(w.files, &watchedFile{path: path, fn: fn, sum: sha256.Sum256(data)})
+
+	return nil
+}
+
+// Start polls the files in the background until Stop is called.
+func (w *Watcher) Start() {
+	if w.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.check(false); err != nil {
+					w.log.Warn("failed to reload file, keeping previous contents", "error", err)
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling the files.
+func (w *Watcher) Stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// Reload applies the contents of every file, whether or not they have changed, such as
+// when the process receives SIGHUP.
+func (w *Watcher) Reload() error {
+	return w.check(true)
+}
+
+// check applies the contents of each file which has changed since it was last applied, or
+// of every file if force is true.
+func (w *Watcher) check(force bool) error {
+	w.Lock()
+	defer w.Unlock()
+
+	var errs []error
+	for _, f := range w.files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		if sum == f.sum && !force {
+			continue
+		}
+		f.sum = sum // rejected contents are not retried until the file changes again
+
+		if err := f.fn(data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.path, err))
+			continue
+		}
+
+		w.log.Info("reloaded file", "path", f.path)
+	}
+
+	return errors.Join(errs...)
+}
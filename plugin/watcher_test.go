@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package plugin
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var errMalformed = errors.New("malformed")
+
+// testRules records the contents applied by a watcher, rejecting "bad".
+type testRules struct {
+	sync.Mutex
+	applied []string
+}
+
+func (r *testRules) apply(data []byte) error {
+	if string(data) == "bad" {
+		return errMalformed
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.applied = append(r.applied, string(data))
+	return nil
+}
+
+func (r *testRules) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string{}, r.applied...)
+}
+
+func TestWatcherAdd(t *testing.T) {
+	w := NewWatcher(0, logger)
+	require.Error(t, w.Add(filepath.Join(t.TempDir(), "missing.yml"), nil))
+
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+	require.NoError(t, w.Add(path, new(testRules).apply))
+	require.Len(t, w.files, 1)
+}
+
+func TestWatcherCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+
+	rules := new(testRules)
+	w := NewWatcher(0, logger)
+	require.NoError(t, w.Add(path, rules.apply))
+
+	require.NoError(t, w.check(false))
+	require.Empty(t, rules.get())
+
+	require.NoError(t, os.WriteFile(path, []byte("b"), 0600))
+	require.NoError(t, w.check(false))
+	require.Equal(t, []string{"b"}, rules.get())
+
+	require.NoError(t, os.WriteFile(path, []byte("bad"), 0600))
+	require.ErrorIs(t, w.check(false), errMalformed)
+	require.NoError(t, w.check(false)) // not retried until changed
+	require.Equal(t, []string{"b"}, rules.get())
+
+	require.NoError(t, os.WriteFile(path, []byte("c"), 0600))
+	require.NoError(t, w.check(false))
+	require.Equal(t, []string{"b", "c"}, rules.get())
+
+	require.NoError(t, os.Remove(path))
+	require.Error(t, w.check(false))
+}
+
+func TestWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+
+	rules := new(testRules)
+	w := NewWatcher(0, logger)
+	require.NoError(t, w.Add(path, rules.apply))
+
+	require.NoError(t, w.Reload())
+	require.NoError(t, w.Reload())
+	require.Equal(t, []string{"a", "a"}, rules.get())
+}
+
+func TestWatcherStartStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(path, []byte("a"), 0600))
+
+	rules := new(testRules)
+	w := NewWatcher(time.Millisecond, logger)
+	require.NoError(t, w.Add(path, rules.apply))
+	w.Start()
+	defer w.Stop()
+
+	require.NoError(t, os.WriteFile(path, []byte("b"), 0600))
+	require.Eventually(t, func() bool { return len(rules.get()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"b"}, rules.get())
+
+	w.Stop()
+	w.Stop()
+}